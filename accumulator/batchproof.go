@@ -110,10 +110,10 @@ func FromBytesBatchProof(b []byte) (BatchProof, error) {
 // also takes the number of leaves and forest rows (those are redundant
 // if we don't do weird stuff with overly-high forests, which we might)
 // it returns a bool of whether the proof worked, and a map of the sparse
-// forest in the blockproof
+// forest in the blockproof.  In swapless mode, proof hashes can be empty.
 func verifyBatchProof(
-	bp BatchProof, roots []Hash,
-	numLeaves uint64, forestRows uint8) (bool, map[uint64]Hash) {
+	bp BatchProof, roots []Hash, numLeaves uint64, forestRows uint8,
+	mode DeleteMode) (bool, map[uint64]Hash) {
 
 	// if nothing to prove, it worked
 	if len(bp.Targets) == 0 {
@@ -125,6 +125,15 @@ func verifyBatchProof(
 		fmt.Printf("VerifyBlockProof Reconstruct ERROR %s\n", err.Error())
 		return false, proofmap
 	}
+	// a deleted leaf can't be proven; in swap mode parentHash catches that
+	if mode == SwaplessDelete {
+		for _, t := range bp.Targets {
+			if proofmap[t] == empty {
+				fmt.Printf("VerifyBlockProof target %d is empty\n", t)
+				return false, nil
+			}
+		}
+	}
 
 	//	fmt.Printf("Reconstruct complete\n")
 	rootPositions, rootRows := getRootsReverse(numLeaves, forestRows)
@@ -147,6 +156,7 @@ func verifyBatchProof(
 	}
 
 	var left, right uint64
+	var lefts, rights []Hash
 	// iterate through rows
 
 	for r := uint8(0); r <= forestRows; r++ {
@@ -194,12 +204,24 @@ func verifyBatchProof(
 				fmt.Printf("%d %04x %d %04x -> %d\n",
 					left, proofmap[left], right, proofmap[right], parpos)
 			}
-			// this will crash if either is 0000
-			parhash := parentHash(proofmap[left], proofmap[right])
+			// hashed all at once at the end of the row
+			lefts = append(lefts, proofmap[left])
+			rights = append(rights, proofmap[right])
 			nextRow = append(nextRow, parpos)
-			proofmap[parpos] = parhash
 		}
 
+		// this will crash if any are 0000, unless swapless
+		parhashes := make([]Hash, len(nextRow))
+		if mode == SwaplessDelete {
+			swaplessParentHashes(parhashes, lefts, rights)
+		} else {
+			parentHashes(parhashes, lefts, rights)
+		}
+		for i, parpos := range nextRow {
+			proofmap[parpos] = parhashes[i]
+		}
+		lefts, rights = lefts[:0], rights[:0]
+
 		tagRow = nextRow
 		nextRow = []uint64{}
 		// if done with row and there's a root left on this row, remove it
@@ -2,6 +2,7 @@ package accumulator
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"time"
 )
@@ -42,10 +43,11 @@ type Forest struct {
 	// be 1 more than the tallest tree in the forest.
 	// While you could just run treeRows(numLeaves), and pollard does just this,
 	// here it incurs the cost of a reMap when you cross a power of 2 boundary.
-	// So right now it reMaps on the way up, but NOT on the way down, so the
+	// So Modify reMaps on the way up, but NOT on the way down, so the
 	// rows can sometimes be higher than it would be as treeRows(numLeaves)
-	// A little weird; could remove this, but likely would have a performance
-	// penalty if the set dances right above / below a power of 2 leaves.
+	// Doing it automatically would have a performance penalty if the set
+	// dances right above / below a power of 2 leaves, so call Compact() to
+	// bring it back down to treeRows(numLeaves).
 	rows uint8
 
 	// "data" (not the best name but) is an interface to storing the forest
@@ -57,9 +59,15 @@ type Forest struct {
 	// at that point to do runs of i/o).  Not sure about "deleting" as it
 	// might not be needed at all with a slice.
 
-	positionMap map[MiniHash]uint64 // map from hashes to positions.
+	positionMap *positionIndex // map from hashes to positions.
 	// Inverse of forestMap for leaves.
 
+	// observer gets told what each Modify did to the leaves, if it's set
+	observer ModifyObserver
+
+	// deleteMode is whether deletes swap leaves in or leave holes
+	deleteMode DeleteMode
+
 	/*
 	 * below are just for testing / benchmarking
 	 */
@@ -112,7 +120,17 @@ func NewForest(forestFile *os.File) *Forest {
 	}
 
 	f.data.resize(1)
-	f.positionMap = make(map[MiniHash]uint64)
+	f.positionMap = newPositionIndex()
+	return f
+}
+
+// NewHybridForest makes a forest in forestFile, keeping the top rows in ram
+// as long as they fit in ramBudget bytes.  The leaves are always on disk.
+func NewHybridForest(forestFile *os.File, ramBudget uint64) *Forest {
+	f := new(Forest)
+	f.data = newHybridForestData(forestFile, ramBudget)
+	f.data.resize(1)
+	f.positionMap = newPositionIndex()
 	return f
 }
 
@@ -147,59 +165,19 @@ func (f *Forest) removev4(dels []uint64) error {
 				"Trying to delete leaf at %d, beyond max %d", dpos, f.numLeaves)
 		}
 	}
-	var hashDirt, nextHashDirt []uint64
-	var prevHash uint64
-	var err error
 	swapRows := remTrans2(dels, f.numLeaves, f.rows)
-	// loop taken from pollard rem2.  maybe pollard and forest can both
-	// satisfy the same interface..?  maybe?  that could work...
-	// TODO try that ^^^^^^
+	dirt := transformDirt(swapRows, f.numLeaves, f.rows)
+	// swap a row, then hash the parents that changed on the row above.
+	// The next row's swaps move those parents along with everything else.
 	for r := uint8(0); r < f.rows; r++ {
-		var hDestSlice []uint64
-		var hashDest uint64
-		hashDirt = dedupeSwapDirt(hashDirt, swapRows[r])
-		for len(swapRows[r]) != 0 || len(hashDirt) != 0 {
-			// check if doing dirt. if not dirt, swap.
-			// (maybe a little clever here...)
-			if len(swapRows[r]) == 0 ||
-				len(hashDirt) != 0 && hashDirt[0] > swapRows[r][0].to {
-				// re-descending here which isn't great
-				// fmt.Printf("hashing from dirt %d\n", hashDirt[0])
-				hashDest = parent(hashDirt[0], f.rows)
-				hashDirt = hashDirt[1:]
-			} else { // swapping
-
-				err = f.swapNodes(swapRows[r][0], r)
-				if err != nil {
-					return err
-				}
-				// fmt.Printf("swap %v %x %x\n", swaprows[h][0],
-				// f.data.read(swaprows[h][0].from).Prefix(),
-				// f.data.read(swaprows[h][0].to).Prefix())
-				hashDest = parent(swapRows[r][0].to, f.rows)
-				swapRows[r] = swapRows[r][1:]
-			}
-			if !inForest(hashDest, f.numLeaves, f.rows) || hashDest == 0 {
-				continue
-				// TODO would be great to use nextNumLeaves... but tricky
-			}
-			if hashDest == prevHash { // we just did this
-				// fmt.Printf("just did %d\n", prevHash)
-				continue // TODO this doesn't cover eveything
-			}
-			hDestSlice = append(hDestSlice, hashDest)
-			// fmt.Printf("added hp %d\n", hashdest)
-			prevHash = hashDest
-			if len(nextHashDirt) == 0 ||
-				(nextHashDirt[len(nextHashDirt)-1] != hashDest) {
-				// skip if already on end of slice. redundant?
-				nextHashDirt = append(nextHashDirt, hashDest)
+		for _, s := range swapRows[r] {
+			err := f.swapNodes(s, r)
+			if err != nil {
+				return err
 			}
 		}
-		hashDirt = nextHashDirt
-		nextHashDirt = []uint64{}
 		// do all the hashes at once at the end
-		err := f.hashRow(hDestSlice)
+		err := f.hashRow(dirt[r])
 		if err != nil {
 			return err
 		}
@@ -218,8 +196,8 @@ func (f *Forest) swapNodes(s arrow, row uint8) error {
 	}
 	if row == 0 {
 		f.data.swapHash(s.from, s.to)
-		f.positionMap[f.data.read(s.to).Mini()] = s.to
-		f.positionMap[f.data.read(s.from).Mini()] = s.from
+		f.positionMap.set(f.data.read(s.to), s.to, f.data)
+		f.positionMap.set(f.data.read(s.from), s.from, f.data)
 		return nil
 	}
 	// fmt.Printf("swapnodes %v\n", s)
@@ -229,8 +207,8 @@ func (f *Forest) swapNodes(s arrow, row uint8) error {
 
 	// happens before the actual swap, so swapping a and b
 	for i := uint64(0); i < run; i++ {
-		f.positionMap[f.data.read(a+i).Mini()] = b + i
-		f.positionMap[f.data.read(b+i).Mini()] = a + i
+		f.positionMap.set(f.data.read(a+i), b+i, f.data)
+		f.positionMap.set(f.data.read(b+i), a+i, f.data)
 	}
 
 	// start at the bottom and go to the top
@@ -319,20 +297,13 @@ func (f *Forest) reHash(dirt []uint64) error {
 				continue
 			}
 
-			right := pos | 1
-			left := right ^ 1
-			parpos := parent(left, f.rows)
-
-			//				fmt.Printf("bridge hash %d %04x, %d %04x -> %d\n",
-			//					left, leftHash[:4], right, rightHash[:4], parpos)
-			if f.data.read(left) == empty || f.data.read(right) == empty {
-				f.data.write(parpos, empty)
-			} else {
-				par := parentHash(f.data.read(left), f.data.read(right))
-				f.HistoricHashes++
-				f.data.write(parpos, par)
-			}
-			nextRow = append(nextRow, parpos)
+			nextRow = append(nextRow, parent(pos, f.rows))
+		}
+		// hash the whole next row at once; hashRow writes empty parents
+		// for empty children
+		err := f.hashRow(nextRow)
+		if err != nil {
+			return err
 		}
 		if rootRows[0] == r {
 			rootPositions = rootPositions[1:]
@@ -349,7 +320,7 @@ func (f *Forest) reHash(dirt []uint64) error {
 // Probably don't need this at all, if everything else is working.
 func (f *Forest) cleanup(overshoot uint64) {
 	for p := f.numLeaves; p < f.numLeaves+overshoot; p++ {
-		delete(f.positionMap, f.data.read(p).Mini()) // clear position map
+		f.positionMap.del(f.data.read(p)) // clear position map
 		// TODO ^^^^ that probably does nothing. or at least should...
 		// f.data.write(p, empty) // clear forest
 	}
@@ -360,29 +331,39 @@ func (f *Forest) Add(adds []Leaf) {
 	f.addv2(adds)
 }
 
-// Add adds leaves to the forest.  This is the easy part.
+// addv2 puts all the new leaves on the bottom row first, then goes up a row
+// at a time hashing all the new parents that row makes.  The parents are
+// the same ones adding the leaves 1 at a time would make, just hashed in
+// batches with hashRow.
 func (f *Forest) addv2(adds []Leaf) {
-
-	for _, add := range adds {
-		// fmt.Printf("adding %x pos %d\n", add.Hash[:4], f.numLeaves)
-		f.positionMap[add.Mini()] = f.numLeaves
-
-		rootPositions, _ := getRootsReverse(f.numLeaves, f.rows)
-		pos := f.numLeaves
-		n := add.Hash
-		f.data.write(pos, n)
-		for h := uint8(0); (f.numLeaves>>h)&1 == 1; h++ {
-			// grab, pop, swap, hash, new
-			root := f.data.read(rootPositions[h]) // grab
-			//			fmt.Printf("grabbed %x from %d\n", root[:12], roots[h])
-			n = parentHash(root, n)   // hash
-			pos = parent(pos, f.rows) // rise
-			f.data.write(pos, n)      // write
-			//			fmt.Printf("wrote %x to %d\n", n[:4], pos)
+	if len(adds) == 0 {
+		return
+	}
+	startLeaves := f.numLeaves
+	for i, add := range adds {
+		pos := startLeaves + uint64(i)
+		// fmt.Printf("adding %x pos %d\n", add.Hash[:4], pos)
+		f.data.write(pos, add.Hash)
+		f.positionMap.set(add.Hash, pos, f.data)
+	}
+	f.numLeaves += uint64(len(adds))
+
+	// on each row, the new nodes are the ones past where the row
+	// ended before.  Row h holds numLeaves>>h nodes.
+	var rowDirt []uint64
+	for h := uint8(1); h <= f.rows; h++ {
+		start, end := startLeaves>>h, f.numLeaves>>h
+		if start == end {
+			break
+		}
+		rowStart := parentMany(0, h, f.rows)
+		rowDirt = rowDirt[:0]
+		for i := start; i < end; i++ {
+			rowDirt = append(rowDirt, rowStart+i)
 		}
-		f.numLeaves++
+		// can't error; hashRow only returns nil
+		f.hashRow(rowDirt)
 	}
-	return
 }
 
 // Modify changes the forest, adding and deleting leaves and updating internal nodes.
@@ -404,6 +385,9 @@ func (f *Forest) Modify(adds []Leaf, dels []uint64) (*undoBlock, error) {
 			return nil, fmt.Errorf("Can't add empty (all 0s) leaf to accumulator")
 		}
 	}
+	if f.deleteMode == SwaplessDelete {
+		return f.modifySwapless(adds, dels)
+	}
 	// remap to expand the forest if needed
 	for int64(f.numLeaves)+delta > int64(1<<f.rows) {
 		// fmt.Printf("current cap %d need %d\n",
@@ -414,6 +398,16 @@ func (f *Forest) Modify(adds []Leaf, dels []uint64) (*undoBlock, error) {
 		}
 	}
 
+	// work out what moves before it moves, if anyone wants to know
+	var changes LeafChanges
+	if f.observer != nil {
+		var err error
+		changes, err = deleteChanges(dels, f.numLeaves, f.rows, f.data.read)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// v3 should do the exact same thing as v2 now
 	err := f.removev4(dels)
 	if err != nil {
@@ -430,6 +424,11 @@ func (f *Forest) Modify(adds []Leaf, dels []uint64) (*undoBlock, error) {
 
 	f.addv2(adds)
 
+	if f.observer != nil {
+		changes.addChanges(adds, f.numLeaves-uint64(numadds))
+		f.observer.LeavesChanged(changes)
+	}
+
 	// fmt.Printf("done modifying block, added %d\n", len(adds))
 	// fmt.Printf("post add %s\n", f.ToString())
 	// for m, p := range f.positionMap {
@@ -456,10 +455,8 @@ func (f *Forest) reMap(destRows uint8) error {
 
 	// for row reduction
 	if destRows < f.rows {
-		return fmt.Errorf("row reduction not implemented")
+		return f.reMapDown(destRows)
 	}
-	// I don't think you ever need to remap down.  It really doesn't
-	// matter.  Something to program someday if you feel like it for fun.
 	// fmt.Printf("size is %d\n", f.data.size())
 	// rows increase
 	f.data.resize(2 << destRows)
@@ -494,6 +491,48 @@ func (f *Forest) reMap(destRows uint8) error {
 	return nil
 }
 
+// reMapDown takes away the top row of the forest.  The leaves have to fit in
+// the smaller forest.  Row 0 stays where it is; every row above it keeps its
+// left half, which moves down to where that row starts in the smaller forest.
+// Rows are moved bottom to top so nothing gets overwritten before it's moved:
+// everything above row 0 moves to positions below 1<<f.rows.
+func (f *Forest) reMapDown(destRows uint8) error {
+	if f.numLeaves > 1<<destRows {
+		return fmt.Errorf("can't remap %d leaves down to %d rows",
+			f.numLeaves, destRows)
+	}
+
+	src := uint64(1 << f.rows)    // leftmost position of row 1 now
+	dest := uint64(1 << destRows) // leftmost position of row 1 after
+	for h := uint8(1); h <= destRows; h++ {
+		runLength := uint64(1<<destRows) >> h
+		for x := uint64(0); x < runLength; x++ {
+			// copy empties too, so there's no stale hashes left over
+			f.data.write(dest+x, f.data.read(src+x))
+		}
+		src += runLength << 1
+		dest += runLength
+	}
+
+	f.data.resize(2 << destRows)
+	f.rows = destRows
+	return nil
+}
+
+// Compact removes rows from the top of the forest until it's as small as it
+// can be for the number of leaves, the same rows a pollard would have.
+// Modify never does this on its own.  The forest data (and forest file if
+// it's on disk) shrinks to match.
+func (f *Forest) Compact() error {
+	for f.rows > treeRows(f.numLeaves) {
+		err := f.reMap(f.rows - 1)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // sanity checks forest sanity: does numleaves make sense, and are the roots
 // populated?
 func (f *Forest) sanity() error {
@@ -504,14 +543,15 @@ func (f *Forest) sanity() error {
 	}
 	rootPositions, _ := getRootsReverse(f.numLeaves, f.rows)
 	for _, t := range rootPositions {
-		if f.data.read(t) == empty {
+		// swapless zombie roots are empty
+		if f.data.read(t) == empty && f.deleteMode != SwaplessDelete {
 			return fmt.Errorf("Forest has %d leaves %d roots, but root @%d is empty",
 				f.numLeaves, len(rootPositions), t)
 		}
 	}
-	if uint64(len(f.positionMap)) > f.numLeaves {
+	if uint64(f.positionMap.size()) > f.numLeaves {
 		return fmt.Errorf("sanity: positionMap %d leaves but forest %d leaves",
-			len(f.positionMap), f.numLeaves)
+			f.positionMap.size(), f.numLeaves)
 	}
 
 	return nil
@@ -520,9 +560,13 @@ func (f *Forest) sanity() error {
 // PosMapSanity is costly / slow: check that everything in posMap is correct
 func (f *Forest) PosMapSanity() error {
 	for i := uint64(0); i < f.numLeaves; i++ {
-		if f.positionMap[f.data.read(i).Mini()] != i {
-			return fmt.Errorf("positionMap error: map says %x @%d but @%d",
-				f.data.read(i).Prefix(), f.positionMap[f.data.read(i).Mini()], i)
+		if f.deleteMode == SwaplessDelete && f.data.read(i) == empty {
+			continue // deleted
+		}
+		pos, ok := f.positionMap.get(f.data.read(i), f.data)
+		if !ok || pos != i {
+			return fmt.Errorf("positionMap error: map says %x @%d (%v) but @%d",
+				f.data.read(i).Prefix(), pos, ok, i)
 		}
 	}
 	return nil
@@ -543,7 +587,24 @@ func RestoreForest(miscForestFile *os.File, forestFile *os.File) (*Forest, error
 		d.f = forestFile
 		f.data = d
 	}
-	f.positionMap = make(map[MiniHash]uint64)
+	return f.restore(miscForestFile)
+}
+
+// RestoreHybridForest is RestoreForest for a forest made with
+// NewHybridForest, or any forest file.  The ramBudget doesn't have to be
+// the same as before.
+func RestoreHybridForest(miscForestFile *os.File, forestFile *os.File,
+	ramBudget uint64) (*Forest, error) {
+
+	f := new(Forest)
+	f.data = newHybridForestData(forestFile, ramBudget)
+	return f.restore(miscForestFile)
+}
+
+// restore reads the rest of the forest from miscForestFile, once the data
+// is set
+func (f *Forest) restore(miscForestFile *os.File) (*Forest, error) {
+	f.positionMap = newPositionIndex()
 
 	// This restores the numLeaves
 	var byteLeaves [8]byte
@@ -558,7 +619,11 @@ func RestoreForest(miscForestFile *os.File, forestFile *os.File) (*Forest, error
 	var i uint64
 	fmt.Printf("%d iterations to do\n", f.numLeaves)
 	for i = uint64(0); i < f.numLeaves; i++ {
-		f.positionMap[f.data.read(i).Mini()] = i
+		h := f.data.read(i)
+		if h == empty {
+			continue // deleted, in swapless mode
+		}
+		f.positionMap.set(h, i, f.data)
 
 		if i%uint64(100000) == 0 && i != uint64(0) {
 			fmt.Printf("Done %d iterations\n", i)
@@ -576,34 +641,88 @@ func RestoreForest(miscForestFile *os.File, forestFile *os.File) (*Forest, error
 	}
 	f.rows = BtU8(byteRows[:])
 	fmt.Println("Forest rows:", f.rows)
+
+	// swapless forests have the delete mode after; older files don't
+	var byteMode [1]byte
+	_, err = miscForestFile.Read(byteMode[:])
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if err == nil {
+		f.deleteMode = DeleteMode(byteMode[0])
+		err = f.deleteMode.Check()
+		if err != nil {
+			return nil, err
+		}
+	}
 	fmt.Println("Done restoring forest")
 
 	return f, nil
 }
 
+// ReadDeleteMode reads just the delete mode from a misc forest file or a
+// snapshot, which both start numLeaves (8) rows (1) deleteMode (1).  Misc
+// files without it are from before swapless, so they're SwapDelete.
+func ReadDeleteMode(r io.Reader) (DeleteMode, error) {
+	var head [10]byte
+	n, err := io.ReadFull(r, head[:])
+	if err == io.ErrUnexpectedEOF && n == 9 {
+		return SwapDelete, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	mode := DeleteMode(head[9])
+	return mode, mode.Check()
+}
+
 func (f *Forest) PrintPositionMap() string {
 	var s string
 	for pos := uint64(0); pos < f.numLeaves; pos++ {
-		l := f.data.read(pos).Mini()
-		s += fmt.Sprintf("pos %d, leaf %x map to %d\n", pos, l, f.positionMap[l])
+		l := f.data.read(pos)
+		mapPos, _ := f.positionMap.get(l, f.data)
+		s += fmt.Sprintf("pos %d, leaf %x map to %d\n", pos, l.Mini(), mapPos)
 	}
 
 	return s
 }
 
-// WriteForest writes the numLeaves and rows to miscForestFile
+// Flush makes sure everything written to the forest is on disk.  Doesn't do
+// anything for a forest in ram.
+func (f *Forest) Flush() error {
+	return f.data.flush()
+}
+
+// Close closes the forest file.  The forest can't be used after.
+func (f *Forest) Close() error {
+	return f.data.close()
+}
+
+// WriteForest writes the numLeaves and rows to miscForestFile, and the
+// delete mode if it's swapless.  Anything only in ram in a hybrid forest
+// gets written to the forest file too.
 func (f *Forest) WriteForest(miscForestFile *os.File) error {
 	fmt.Println("numLeaves=", f.numLeaves)
 	fmt.Println("f.rows=", f.rows)
-	_, err := miscForestFile.WriteAt(append(U64tB(f.numLeaves), U8tB(f.rows)...), 0)
+	if h, ok := f.data.(*hybridForestData); ok {
+		err := h.writeHot()
+		if err != nil {
+			return err
+		}
+	}
+	b := append(U64tB(f.numLeaves), U8tB(f.rows)...)
+	if f.deleteMode != SwapDelete {
+		b = append(b, byte(f.deleteMode))
+	}
+	_, err := miscForestFile.WriteAt(b, 0)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// getRoots returns all the roots of the trees
-func (f *Forest) getRoots() []Hash {
+// GetRoots returns all the roots of the trees
+func (f *Forest) GetRoots() []Hash {
 
 	rootPositions, _ := getRootsReverse(f.numLeaves, f.rows)
 	roots := make([]Hash, len(rootPositions))
@@ -619,11 +738,15 @@ func (f *Forest) getRoots() []Hash {
 func (f *Forest) Stats() string {
 
 	s := fmt.Sprintf("numleaves: %d hashesever: %d posmap: %d forest: %d\n",
-		f.numLeaves, f.HistoricHashes, len(f.positionMap), f.data.size())
+		f.numLeaves, f.HistoricHashes, f.positionMap.size(), f.data.size())
 
 	s += fmt.Sprintf("\thashT: %.2f remT: %.2f (of which MST %.2f) proveT: %.2f",
 		f.TimeInHash.Seconds(), f.TimeRem.Seconds(), f.TimeMST.Seconds(),
 		f.TimeInProve.Seconds())
+	if h, ok := f.data.(*hybridForestData); ok {
+		s += fmt.Sprintf("\n\trows %d and up in ram: %d of %d hashes",
+			h.hotRow, len(h.ram), h.size())
+	}
 	return s
 }
 
@@ -686,6 +809,6 @@ func (f *Forest) ToString() string {
 
 // FindLeaf finds a leave from the positionMap and returns a bool
 func (f *Forest) FindLeaf(leaf Hash) bool {
-	_, found := f.positionMap[leaf.Mini()]
+	_, found := f.positionMap.get(leaf, f.data)
 	return found
 }
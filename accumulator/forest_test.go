@@ -2,13 +2,44 @@ package accumulator
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
 	"reflect"
 	"sort"
 	"testing"
 	"testing/quick"
 )
 
+// simBlocks runs n blocks from a SimChain through f, with rand seeded so
+// they're the same every time.  sn is nil for a chain with leaves lasting up
+// to 32 blocks.  fn, if not nil, gets each block after f has it, along with
+// the proof f made for the deletions.
+func simBlocks(t *testing.T, f *Forest, sn *SimChain, seed int64, n int,
+	fn func(b int, adds []Leaf, delHashes []Hash, bp BatchProof)) {
+
+	rand.Seed(seed)
+	if sn == nil {
+		sn = NewSimChain(0x1f)
+		sn.lookahead = 40
+	}
+	for b := 0; b < n; b++ {
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x3f)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bp.SortTargets()
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fn != nil {
+			fn(b, adds, delHashes, bp)
+		}
+	}
+}
+
 func TestDeleteReverseOrder(t *testing.T) {
 	f := NewForest(nil)
 	leaf1 := Leaf{Hash: Hash{1}}
@@ -188,7 +219,8 @@ func addDelFullBatchProof(nAdds, nDels int) error {
 	}
 	bp.SortTargets()
 	// check block proof.  Note this doesn't delete anything, just proves inclusion
-	worked, _ := verifyBatchProof(bp, f.getRoots(), f.numLeaves, f.rows)
+	worked, _ := verifyBatchProof(
+		bp, f.GetRoots(), f.numLeaves, f.rows, f.deleteMode)
 	//	worked := f.VerifyBatchProof(bp)
 
 	if !worked {
@@ -268,7 +300,8 @@ func TestSmallRandomForests(t *testing.T) {
 		deletions = make([]int, len(leavesToDeleteSet))
 		i = 0
 		for leafTxo := range leavesToDeleteSet {
-			deletions[i] = int(f.positionMap[leafTxo.Mini()])
+			pos, _ := f.positionMap.get(leafTxo.Hash, f.data)
+			deletions[i] = int(pos)
 			i++
 		}
 		sort.Ints(deletions)
@@ -304,3 +337,273 @@ func TestSmallRandomForests(t *testing.T) {
 		}
 	}
 }
+
+// TestForestCompact deletes most of the leaves, compacts the forest, and
+// checks that it's the same as a pollard with those leaves, and the same as a
+// new forest built from those leaves
+func TestForestCompact(t *testing.T) {
+	ffile, err := ioutil.TempFile("", "forestcompact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ffile.Name())
+	defer ffile.Close()
+
+	for _, f := range []*Forest{NewForest(nil), NewForest(ffile)} {
+		var p Pollard
+		adds := make([]Leaf, 100)
+		for i := range adds {
+			adds[i].Hash[0] = uint8(i)
+			adds[i].Hash[1] = 0xcc
+			adds[i].Remember = true
+		}
+		err := compactModify(f, &p, adds, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 100 leaves -> 19, then 2; rows should come down 7 -> 5 -> 1
+		for _, dels := range [][]uint64{
+			{0, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19,
+				20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35,
+				36, 37, 38, 39, 40, 41, 42, 43, 44, 45, 46, 47, 48, 49, 50, 51,
+				52, 53, 54, 55, 56, 57, 58, 59, 60, 61, 62, 63, 64, 65, 66, 67,
+				68, 69, 70, 71, 72, 73, 74, 75, 76, 77, 78, 79, 80, 81, 99},
+			{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 15, 16, 17, 18},
+		} {
+			err = compactModify(f, &p, nil, dels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkCompact(f, &p)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// grow it again after compacting
+		for i := range adds {
+			adds[i].Hash[1] = 0xdd
+		}
+		err = compactModify(f, &p, adds, []uint64{1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkCompact(f, &p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// compactModify applies the same adds and dels to a forest and a pollard
+func compactModify(f *Forest, p *Pollard, adds []Leaf, dels []uint64) error {
+	delHashes := make([]Hash, len(dels))
+	for i, d := range dels {
+		delHashes[i] = f.data.read(d)
+	}
+	bp, err := f.ProveBatch(delHashes)
+	if err != nil {
+		return err
+	}
+	bp.SortTargets()
+	err = p.IngestBatchProof(bp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Modify(adds, bp.Targets)
+	if err != nil {
+		return err
+	}
+	return p.Modify(adds, bp.Targets)
+}
+
+// checkCompact compacts the forest and compares it to the pollard and a
+// forest built from scratch
+func checkCompact(f *Forest, p *Pollard) error {
+	err := f.Compact()
+	if err != nil {
+		return err
+	}
+	pLeaves, pRows := p.ReconstructStats()
+	fLeaves, fRows := f.ReconstructStats()
+	if fLeaves != pLeaves || fRows != pRows {
+		return fmt.Errorf("forest %d leaves %d rows, pollard %d leaves %d rows",
+			fLeaves, fRows, pLeaves, pRows)
+	}
+	if f.data.size() != 2<<f.rows {
+		return fmt.Errorf("forest data size %d, expect %d",
+			f.data.size(), 2<<f.rows)
+	}
+	if !p.equalToForest(f) {
+		return fmt.Errorf("pollard and forest leaves differ")
+	}
+	err = f.sanity()
+	if err != nil {
+		return err
+	}
+	err = f.PosMapSanity()
+	if err != nil {
+		return err
+	}
+
+	fresh := NewForest(nil)
+	leaves := make([]Leaf, f.numLeaves)
+	for i := range leaves {
+		leaves[i].Hash = f.data.read(uint64(i))
+	}
+	_, err = fresh.Modify(leaves, nil)
+	if err != nil {
+		return err
+	}
+	if fresh.rows != f.rows {
+		return fmt.Errorf("fresh forest %d rows, compacted %d", fresh.rows, f.rows)
+	}
+	// every node that exists should match, not just the roots
+	for h := uint8(0); h <= f.rows; h++ {
+		for i := uint64(0); i < f.numLeaves>>h; i++ {
+			pos := parentMany(i<<h, h, f.rows)
+			if f.data.read(pos) != fresh.data.read(pos) {
+				return fmt.Errorf("pos %d compacted %x fresh %x", pos,
+					f.data.read(pos).Prefix(), fresh.data.read(pos).Prefix())
+			}
+		}
+	}
+
+	fRoots, pRoots := f.GetRoots(), p.rootHashesReverse()
+	if fmt.Sprintf("%x", fRoots) != fmt.Sprintf("%x", pRoots) {
+		return fmt.Errorf("forest roots %x pollard roots %x", fRoots, pRoots)
+	}
+	return nil
+}
+
+// TestBatchAdd checks adding a bunch of leaves at once ends up the same as
+// adding them 1 at a time, for forests and pollards of all sorts of sizes.
+func TestBatchAdd(t *testing.T) {
+	rand.Seed(9)
+	for start := 0; start < 34; start++ {
+		for numAdds := 0; numAdds < 70; numAdds++ {
+			err := batchAddVsOne(start, numAdds)
+			if err != nil {
+				t.Fatalf("start %d adds %d: %s", start, numAdds, err.Error())
+			}
+		}
+	}
+}
+
+func batchAddVsOne(start, numAdds int) error {
+	leaves := make([]Leaf, start+numAdds)
+	for i := range leaves {
+		leaves[i].Hash = Hash{byte(i), byte(i >> 8), 0xba}
+		leaves[i].Remember = rand.Intn(3) == 0
+	}
+
+	oneF, batchF := NewForest(nil), NewForest(nil)
+	var oneP, batchP Pollard
+	oneFP, batchFP := NewFullPollard(), NewFullPollard()
+	for i := 0; i < start; i++ {
+		for _, p := range []*Pollard{&oneP, &batchP, &oneFP, &batchFP} {
+			err := p.add(leaves[i : i+1])
+			if err != nil {
+				return err
+			}
+		}
+		for _, f := range []*Forest{oneF, batchF} {
+			_, err := f.Modify(leaves[i:i+1], nil)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i := start; i < len(leaves); i++ {
+		for _, p := range []*Pollard{&oneP, &oneFP} {
+			err := p.add(leaves[i : i+1])
+			if err != nil {
+				return err
+			}
+		}
+		_, err := oneF.Modify(leaves[i:i+1], nil)
+		if err != nil {
+			return err
+		}
+	}
+	for _, p := range []*Pollard{&batchP, &batchFP} {
+		err := p.add(leaves[start:])
+		if err != nil {
+			return err
+		}
+	}
+	_, err := batchF.Modify(leaves[start:], nil)
+	if err != nil {
+		return err
+	}
+
+	if !reflect.DeepEqual(oneF.GetRoots(), batchF.GetRoots()) {
+		return fmt.Errorf("forest roots differ")
+	}
+	for pos := uint64(0); pos < 2<<oneF.rows; pos++ {
+		if !inForest(pos, oneF.numLeaves, oneF.rows) {
+			continue
+		}
+		if oneF.data.read(pos) != batchF.data.read(pos) {
+			return fmt.Errorf("forests differ at %d", pos)
+		}
+	}
+	err = batchF.PosMapSanity()
+	if err != nil {
+		return err
+	}
+	err = batchFP.PosMapSanity()
+	if err != nil {
+		return err
+	}
+	for _, pair := range [][2]*Pollard{{&oneP, &batchP}, {&oneFP, &batchFP}} {
+		one, batch := pair[0], pair[1]
+		if one.numLeaves != batch.numLeaves || one.hashesEver != batch.hashesEver ||
+			len(one.roots) != len(batch.roots) {
+			return fmt.Errorf("pollards differ: %s vs %s",
+				one.Stats(), batch.Stats())
+		}
+		_, rows := getRootsReverse(one.numLeaves, one.rows())
+		for i := range one.roots {
+			// roots are big to small, rows small to big
+			h := rows[len(rows)-1-i]
+			if !samePolNodes(&one.roots[i], &batch.roots[i], h) {
+				return fmt.Errorf("pollard root %d differs", i)
+			}
+		}
+		if !batch.equalToForestIfThere(oneF) {
+			return fmt.Errorf("pollard doesn't match forest")
+		}
+	}
+	return nil
+}
+
+// samePolNodes checks that 2 nodes at row h, and everything under them, have
+// the same data and the same nodes there.  Leaves' nieces just say if
+// they're remembered, and can point back up, so those are only checked for
+// being there or not.
+func samePolNodes(a, b *polNode, h uint8) bool {
+	if (a == nil) != (b == nil) {
+		return false
+	}
+	if a == nil {
+		return true
+	}
+	if a.data != b.data {
+		return false
+	}
+	for i := range a.niece {
+		if h == 0 {
+			if (a.niece[i] == nil) != (b.niece[i] == nil) {
+				return false
+			}
+			continue
+		}
+		if !samePolNodes(a.niece[i], b.niece[i], h-1) {
+			return false
+		}
+	}
+	return true
+}
@@ -17,7 +17,9 @@ type ForestData interface {
 	swapHash(a, b uint64)
 	swapHashRange(a, b, w uint64)
 	size() uint64
-	resize(newSize uint64) // make it have a new size (bigger)
+	resize(newSize uint64) // make it have a new size (bigger or smaller)
+	flush() error          // make sure writes are persisted
+	close() error          // done with it
 }
 
 // ********************************************* forest in ram
@@ -69,14 +71,45 @@ func (r *ramForestData) size() uint64 {
 	return uint64(len(r.m))
 }
 
-// resize makes the forest bigger (never gets smaller so don't try)
+// resize makes the forest bigger or smaller
 func (r *ramForestData) resize(newSize uint64) {
+	if newSize < r.size() {
+		// copy so the old, bigger array can be garbage collected
+		r.m = append([]Hash(nil), r.m[:newSize]...)
+		return
+	}
 	r.m = append(r.m, make([]Hash, newSize-r.size())...)
 }
 
+// flush doesn't need to do anything in ram
+func (r *ramForestData) flush() error {
+	return nil
+}
+
+// close drops the hashes
+func (r *ramForestData) close() error {
+	r.m = nil
+	return nil
+}
+
 // ********************************************* forest on disk
 type diskForestData struct {
 	f *os.File
+	// undo is nil unless there's an undo log; see SetUndoLog
+	undo *undoLog
+}
+
+// saveUndo logs the w hashes at pos before they get written over, if
+// there's an undo log
+func (d *diskForestData) saveUndo(pos, w uint64) {
+	if d.undo == nil {
+		return
+	}
+	err := d.undo.save(d.f, pos, w)
+	if err != nil {
+		fmt.Printf("\tWARNING!! undo log pos %d len %d %s\n",
+			pos, w, err.Error())
+	}
 }
 
 // read ignores errors. Probably get an empty hash if it doesn't work
@@ -91,6 +124,7 @@ func (d *diskForestData) read(pos uint64) Hash {
 
 // writeHash writes a hash.  Don't go out of bounds.
 func (d *diskForestData) write(pos uint64, h Hash) {
+	d.saveUndo(pos, 1)
 	_, err := d.f.WriteAt(h[:], int64(pos*leafSize))
 	if err != nil {
 		fmt.Printf("\tWARNING!! write pos %d %s\n", pos, err.Error())
@@ -123,6 +157,8 @@ func (d *diskForestData) swapHashRange(a, b, w uint64) {
 		fmt.Printf("\tshr WARNING!! read pos %d len %d %s\n",
 			b*leafSize, w, err.Error())
 	}
+	d.saveUndo(a, w)
+	d.saveUndo(b, w)
 	_, err = d.f.WriteAt(arange, int64(b*leafSize)) // write arange to b
 	if err != nil {
 		fmt.Printf("\tshr WARNING!! write pos %d len %d %s\n",
@@ -145,10 +181,180 @@ func (d *diskForestData) size() uint64 {
 	return uint64(s.Size() / leafSize)
 }
 
-// resize makes the forest bigger (never gets smaller so don't try)
+// resize makes the forest bigger or smaller by truncating the file
 func (d *diskForestData) resize(newSize uint64) {
+	// anything cut off has to be saved to put back
+	if size := d.size(); newSize < size {
+		d.saveUndo(newSize, size-newSize)
+	}
 	err := d.f.Truncate(int64(newSize * leafSize))
 	if err != nil {
 		panic(err)
 	}
 }
+
+// flush fsyncs the forest file
+func (d *diskForestData) flush() error {
+	return d.f.Sync()
+}
+
+// close closes the forest file, and the undo log if there is one
+func (d *diskForestData) close() error {
+	if d.undo != nil {
+		d.undo.f.Close()
+	}
+	return d.f.Close()
+}
+
+// ********************************************* forest hybrid
+
+// hybridForestData keeps the top rows of the forest in ram and the rest in
+// the forest file.  In the forest layout, rows k and up are the last
+// size>>k positions, so that's just everything past split.  Rows above the
+// bottom get written every block but are small, so keeping them in ram
+// saves most of the disk i/o for a fraction of the memory.  k is the
+// lowest row where everything above fits in ramBudget bytes, and gets
+// worked out again each resize, so it goes up as the forest grows.
+//
+// The file always has room for the whole forest, but what's there past
+// split is only up to date after a flush or resize.
+type hybridForestData struct {
+	disk      diskForestData
+	ramBudget uint64
+	// hotRow is k, the lowest row in ram
+	hotRow uint8
+	// split is the first position in ram; ram[0] is at split
+	split uint64
+	ram   []Hash
+}
+
+// newHybridForestData makes hybrid forest data from what's already in
+// forestFile
+func newHybridForestData(
+	forestFile *os.File, ramBudget uint64) *hybridForestData {
+	h := &hybridForestData{disk: diskForestData{f: forestFile},
+		ramBudget: ramBudget}
+	h.loadHot(h.disk.size())
+	return h
+}
+
+// hotSplit is where ram starts for a forest of size positions, and the
+// lowest row in ram: rows k and up fit in ramBudget, with k at least 1 so
+// the leaves are on disk
+func hotSplit(size, ramBudget uint64) (uint64, uint8) {
+	k := uint8(1)
+	for (size>>k)*leafSize > ramBudget {
+		k++
+	}
+	return size - size>>k, k
+}
+
+// loadHot reads the top rows of a forest of size positions from the file
+// into ram.  Anything in ram before gets dropped, so writeHot first.
+func (h *hybridForestData) loadHot(size uint64) {
+	h.split, h.hotRow = hotSplit(size, h.ramBudget)
+	h.ram = make([]Hash, size-h.split)
+	if len(h.ram) == 0 {
+		return
+	}
+	buf := make([]byte, len(h.ram)*leafSize)
+	_, err := h.disk.f.ReadAt(buf, int64(h.split*leafSize))
+	if err != nil {
+		fmt.Printf("\tWARNING!! read hot rows at %d %s\n",
+			h.split, err.Error())
+	}
+	for i := range h.ram {
+		copy(h.ram[i][:], buf[i*leafSize:])
+	}
+}
+
+// writeHot writes what's in ram to the file
+func (h *hybridForestData) writeHot() error {
+	if len(h.ram) == 0 {
+		return nil
+	}
+	buf := make([]byte, 0, len(h.ram)*leafSize)
+	for _, hash := range h.ram {
+		buf = append(buf, hash[:]...)
+	}
+	h.disk.saveUndo(h.split, uint64(len(h.ram)))
+	_, err := h.disk.f.WriteAt(buf, int64(h.split*leafSize))
+	return err
+}
+
+// read reads from ram or disk, wherever pos is
+func (h *hybridForestData) read(pos uint64) Hash {
+	if pos >= h.split {
+		return h.ram[pos-h.split]
+	}
+	return h.disk.read(pos)
+}
+
+// write writes to ram or disk, wherever pos is.  Don't go out of bounds.
+func (h *hybridForestData) write(pos uint64, hash Hash) {
+	if pos >= h.split {
+		h.ram[pos-h.split] = hash
+		return
+	}
+	h.disk.write(pos, hash)
+}
+
+// swapHash swaps 2 hashes.  Don't go out of bounds.
+func (h *hybridForestData) swapHash(a, b uint64) {
+	if a >= h.split && b >= h.split {
+		h.ram[a-h.split], h.ram[b-h.split] = h.ram[b-h.split], h.ram[a-h.split]
+		return
+	}
+	ha, hb := h.read(a), h.read(b)
+	h.write(a, hb)
+	h.write(b, ha)
+}
+
+// swapHashRange swaps 2 continuous ranges of hashes.  Ranges are on 1 row,
+// so they're both on disk or both in ram, but if they aren't it still works.
+func (h *hybridForestData) swapHashRange(a, b, w uint64) {
+	if a+w <= h.split && b+w <= h.split {
+		h.disk.swapHashRange(a, b, w)
+		return
+	}
+	for i := uint64(0); i < w; i++ {
+		h.swapHash(a+i, b+i)
+	}
+}
+
+// size gives you the size of the forest
+func (h *hybridForestData) size() uint64 {
+	return h.split + uint64(len(h.ram))
+}
+
+// resize makes the forest bigger or smaller.  The rows in ram go out to
+// the file, and then the top rows of the new size come back in, with k
+// worked out again for the new size.
+func (h *hybridForestData) resize(newSize uint64) {
+	err := h.writeHot()
+	if err != nil {
+		panic(err)
+	}
+	h.disk.resize(newSize)
+	h.loadHot(newSize)
+}
+
+// flush writes the rows in ram to the file and fsyncs it
+func (h *hybridForestData) flush() error {
+	err := h.writeHot()
+	if err != nil {
+		return err
+	}
+	return h.disk.flush()
+}
+
+// close writes the rows in ram to the file and closes it
+func (h *hybridForestData) close() error {
+	err := h.writeHot()
+	if err != nil {
+		h.disk.close()
+		return err
+	}
+	h.ram = nil
+	return h.disk.close()
+}
@@ -0,0 +1,131 @@
+package accumulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestHybridForest runs a ram forest and a hybrid forest with only a few
+// rows in ram through the same blocks, and checks they match all along,
+// through remaps up and down and a restore.
+func TestHybridForest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hybrid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	forestPath := filepath.Join(dir, "forest")
+	forestFile, err := os.OpenFile(forestPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ramf := NewForest(nil)
+	// 8 hashes of ram
+	hf := NewHybridForest(forestFile, 8*leafSize)
+	simBlocks(t, ramf, nil, 9, 150, func(b int, adds []Leaf, _ []Hash,
+		bp BatchProof) {
+
+		_, err := hf.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// sometimes shrink them back down
+		if b%20 == 19 {
+			ramf.Compact()
+			hf.Compact()
+		}
+		err = sameForests(ramf, hf)
+		if err != nil {
+			t.Fatalf("block %d %s", b, err.Error())
+		}
+		h := hf.data.(*hybridForestData)
+		if uint64(len(h.ram)) > 8 || hf.data.size() != 2<<hf.rows {
+			t.Fatalf("block %d %d rows forest has %d of %d hashes in ram",
+				b, hf.rows, len(h.ram), hf.data.size())
+		}
+	})
+
+	miscFile, err := os.OpenFile(filepath.Join(dir, "misc"),
+		os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer miscFile.Close()
+	err = hf.WriteForest(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = hf.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restore with more ram, and as a plain disk forest
+	for _, budget := range []uint64{1 << 20, 0} {
+		forestFile, err = os.OpenFile(forestPath, os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		miscFile.Seek(0, 0)
+		var f2 *Forest
+		if budget == 0 {
+			f2, err = RestoreForest(miscFile, forestFile)
+		} else {
+			f2, err = RestoreHybridForest(miscFile, forestFile, budget)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = sameForests(ramf, f2)
+		if err != nil {
+			t.Fatalf("restored with budget %d %s", budget, err.Error())
+		}
+		err = f2.PosMapSanity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		f2.Close()
+	}
+}
+
+// sameForests checks 2 forests have the same size and hashes everywhere
+func sameForests(a, b *Forest) error {
+	if a.numLeaves != b.numLeaves || a.rows != b.rows {
+		return fmt.Errorf("%d leaves %d rows vs %d leaves %d rows",
+			a.numLeaves, a.rows, b.numLeaves, b.rows)
+	}
+	for pos := uint64(0); pos < 2<<a.rows-1; pos++ {
+		if a.data.read(pos) != b.data.read(pos) {
+			return fmt.Errorf("at %d %x vs %x", pos,
+				a.data.read(pos).Prefix(), b.data.read(pos).Prefix())
+		}
+	}
+	return nil
+}
+
+func TestHotSplit(t *testing.T) {
+	tests := []struct {
+		size, budget uint64
+		split        uint64
+		hotRow       uint8
+	}{
+		{size: 1, budget: 0, split: 1, hotRow: 1},
+		// 8 leaves; rows 1 and up are 8 hashes
+		{size: 16, budget: 8 * leafSize, split: 8, hotRow: 1},
+		{size: 16, budget: 7 * leafSize, split: 12, hotRow: 2},
+		{size: 16, budget: 1 << 30, split: 8, hotRow: 1},
+		{size: 16, budget: 0, split: 16, hotRow: 5},
+		{size: 1 << 30, budget: 1 << 20, split: 1<<30 - 1<<15, hotRow: 15},
+	}
+	for _, test := range tests {
+		split, hotRow := hotSplit(test.size, test.budget)
+		if split != test.split || hotRow != test.hotRow {
+			t.Errorf("size %d budget %d split %d row %d, expect %d row %d",
+				test.size, test.budget, split, hotRow, test.split, test.hotRow)
+		}
+	}
+}
@@ -19,7 +19,7 @@ func (f *Forest) Prove(wanted Hash) (Proof, error) {
 	var pr Proof
 	var empty [32]byte
 	// first look up where the hash is
-	pos, ok := f.positionMap[wanted.Mini()]
+	pos, ok := f.positionMap.get(wanted, f.data)
 	if !ok {
 		return pr, fmt.Errorf("hash %x not found", wanted)
 	}
@@ -141,9 +141,6 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 	if len(hs) == 0 {
 		return bp, nil
 	}
-	if f.data.size() < 2 {
-		return bp, nil
-	}
 
 	// first get all the leaf positions
 	// there shouldn't be any duplicates in hs, but if there are I guess
@@ -152,7 +149,7 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 
 	for i, wanted := range hs {
 
-		pos, ok := f.positionMap[wanted.Mini()]
+		pos, ok := f.positionMap.get(wanted, f.data)
 		if !ok {
 			fmt.Printf(f.ToString())
 			return bp, fmt.Errorf("hash %x not found", wanted)
@@ -160,9 +157,7 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 
 		// should never happen
 		if pos > f.numLeaves {
-			for m, p := range f.positionMap {
-				fmt.Printf("%x @%d\t", m[:4], p)
-			}
+			fmt.Printf("%s\n", f.positionMap.String())
 			return bp, fmt.Errorf(
 				"ProveBatch: got leaf position %d but only %d leaves exist",
 				pos, f.numLeaves)
@@ -266,6 +261,7 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 
 // VerifyBatchProof :
 func (f *Forest) VerifyBatchProof(bp BatchProof) bool {
-	ok, _ := verifyBatchProof(bp, f.getRoots(), f.numLeaves, f.rows)
+	ok, _ := verifyBatchProof(
+		bp, f.GetRoots(), f.numLeaves, f.rows, f.deleteMode)
 	return ok
 }
@@ -0,0 +1,157 @@
+package accumulator
+
+import (
+	"fmt"
+)
+
+// FsckReport is what Fsck found wrong with a forest
+type FsckReport struct {
+	// BadNodes are the nodes above the leaves that aren't what their
+	// children hash to, worked out from the leaves up.  A wrong node doesn't
+	// make its parent show up too, since the parent is checked against what
+	// the node should be.
+	BadNodes []BadNode
+	// EmptyLeaves are positions below numLeaves with nothing there.  Only
+	// for swap mode; in swapless mode those are deleted leaves.
+	EmptyLeaves []uint64
+	// PosMapWrong are leaf positions where the positionMap doesn't say the
+	// leaf is there.  A forest from RestoreForest or RestoreSnapshot has
+	// its positionMap made from its leaves, so for those this only finds
+	// leaves with the same hash as another leaf.
+	PosMapWrong []uint64
+	// PosMapExtra is how many more hashes the positionMap has than there
+	// are leaves.  Can't happen right after a restore.
+	PosMapExtra int
+	// Roots are the roots worked out from the leaves, in the same order as
+	// GetRoots
+	Roots []Hash
+}
+
+// BadNode is a node with the wrong hash
+type BadNode struct {
+	Pos              uint64
+	Row              uint8
+	Stored, Computed Hash
+}
+
+// OK says nothing was wrong
+func (r *FsckReport) OK() bool {
+	return len(r.BadNodes) == 0 && len(r.EmptyLeaves) == 0 &&
+		len(r.PosMapWrong) == 0 && r.PosMapExtra == 0
+}
+
+// fsckChunk is how many nodes Fsck hashes at once
+const fsckChunk = 1 << 12
+
+// Fsck checks the whole forest: every node above the leaves is hashed again
+// from the leaves up and compared to what's stored, and every leaf is looked
+// up in the positionMap.  The positionMap check is only as good as the map;
+// see PosMapWrong.  It reads everything, so it takes a while for a big
+// forest on disk.  It doesn't change anything; RepairFsck does that.
+func (f *Forest) Fsck() FsckReport {
+	var r FsckReport
+	var leaves int
+	for pos := uint64(0); pos < f.numLeaves; pos++ {
+		h := f.data.read(pos)
+		if h == empty {
+			if f.deleteMode != SwaplessDelete {
+				r.EmptyLeaves = append(r.EmptyLeaves, pos)
+			}
+			continue
+		}
+		leaves++
+		mapPos, ok := f.positionMap.get(h, f.data)
+		if !ok || mapPos != pos {
+			r.PosMapWrong = append(r.PosMapWrong, pos)
+		}
+	}
+	if f.positionMap.size() > leaves {
+		r.PosMapExtra = f.positionMap.size() - leaves
+	}
+
+	// fixed is what the bad nodes should be, so their parents get checked
+	// against that
+	fixed := make(map[uint64]Hash)
+	value := func(pos uint64) Hash {
+		if h, ok := fixed[pos]; ok {
+			return h
+		}
+		return f.data.read(pos)
+	}
+	for h := uint8(1); h <= f.rows; h++ {
+		start := parentMany(0, h, f.rows)
+		childStart := parentMany(0, h-1, f.rows)
+		rowLen := f.numLeaves >> h
+		for i := uint64(0); i < rowLen; i += fsckChunk {
+			end := i + fsckChunk
+			if end > rowLen {
+				end = rowLen
+			}
+			lefts := make([]Hash, end-i)
+			rights := make([]Hash, end-i)
+			for j := i; j < end; j++ {
+				lefts[j-i] = value(childStart + j<<1)
+				rights[j-i] = value(childStart + j<<1 + 1)
+			}
+			computed := make([]Hash, end-i)
+			f.fsckHashes(computed, lefts, rights)
+			for j := i; j < end; j++ {
+				stored := f.data.read(start + j)
+				if stored != computed[j-i] {
+					r.BadNodes = append(r.BadNodes, BadNode{Pos: start + j,
+						Row: h, Stored: stored, Computed: computed[j-i]})
+					fixed[start+j] = computed[j-i]
+				}
+			}
+		}
+	}
+
+	rootPositions, _ := getRootsReverse(f.numLeaves, f.rows)
+	for _, pos := range rootPositions {
+		r.Roots = append(r.Roots, value(pos))
+	}
+	return r
+}
+
+// fsckHashes hashes parents the way hashRow does: in swap mode, a parent
+// with an empty child is empty
+func (f *Forest) fsckHashes(dst, lefts, rights []Hash) {
+	if f.deleteMode == SwaplessDelete {
+		hashChildren(dst, lefts, rights, f.deleteMode)
+		return
+	}
+	var both []int
+	var bothLefts, bothRights []Hash
+	for i := range dst {
+		if lefts[i] == empty || rights[i] == empty {
+			dst[i] = empty
+			continue
+		}
+		both = append(both, i)
+		bothLefts = append(bothLefts, lefts[i])
+		bothRights = append(bothRights, rights[i])
+	}
+	results := make([]Hash, len(both))
+	hashChildren(results, bothLefts, bothRights, f.deleteMode)
+	for j, i := range both {
+		dst[i] = results[j]
+	}
+}
+
+// RepairFsck writes the right hashes over the bad nodes Fsck found, and
+// flushes.  The leaves have to be right for that to help, so it won't
+// with empty leaves, and whatever's keeping track of the roots should check
+// report.Roots first.  The forest can't have changed since Fsck.
+func (f *Forest) RepairFsck(report FsckReport) error {
+	if len(report.EmptyLeaves) != 0 {
+		return fmt.Errorf("can't repair with %d empty leaves",
+			len(report.EmptyLeaves))
+	}
+	for _, b := range report.BadNodes {
+		if b.Pos < 1<<f.rows || b.Pos >= f.data.size() {
+			return fmt.Errorf("can't repair %d, not above the leaves", b.Pos)
+		}
+		f.data.write(b.Pos, b.Computed)
+	}
+	return f.data.flush()
+}
@@ -0,0 +1,67 @@
+package accumulator
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestFsck messes up some nodes in a forest and checks Fsck finds exactly
+// those, and RepairFsck fixes them.
+func TestFsck(t *testing.T) {
+	for _, mode := range []DeleteMode{SwapDelete, SwaplessDelete} {
+		f := NewForest(nil)
+		f.SetDeleteMode(mode)
+		simBlocks(t, f, nil, 12, 50, nil)
+		r := f.Fsck()
+		if !r.OK() || !reflect.DeepEqual(r.Roots, f.GetRoots()) {
+			t.Fatalf("%s: good forest not ok: %+v", mode, r)
+		}
+
+		roots := f.GetRoots()
+		rootPositions, _ := getRootsReverse(f.numLeaves, f.rows)
+		// a node on row 1, one right above it, and the biggest root
+		bad := []uint64{parent(4, f.rows), parent(parent(4, f.rows), f.rows),
+			rootPositions[len(rootPositions)-1]}
+		for _, pos := range bad {
+			f.data.write(pos, Hash{0xba, 0xd0})
+		}
+		r = f.Fsck()
+		var got []uint64
+		for _, b := range r.BadNodes {
+			got = append(got, b.Pos)
+			if b.Stored != (Hash{0xba, 0xd0}) {
+				t.Fatalf("%s: bad node at %d stored %x", mode, b.Pos, b.Stored)
+			}
+		}
+		if !reflect.DeepEqual(got, bad) || !reflect.DeepEqual(r.Roots, roots) {
+			t.Fatalf("%s: found bad %v roots %x, expect %v %x",
+				mode, got, r.Roots, bad, roots)
+		}
+		err := f.RepairFsck(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = f.Fsck()
+		if !r.OK() || !reflect.DeepEqual(f.GetRoots(), roots) {
+			t.Fatalf("%s: repaired forest not ok: %+v", mode, r)
+		}
+
+		// leaves and the position map
+		f.positionMap.del(f.data.read(3))
+		f.positionMap.set(Hash{0xe1}, 3, f.data)
+		r = f.Fsck()
+		if !reflect.DeepEqual(r.PosMapWrong, []uint64{3}) ||
+			r.PosMapExtra != 0 {
+			t.Fatalf("%s: position map wrong %v extra %d",
+				mode, r.PosMapWrong, r.PosMapExtra)
+		}
+		if mode == SwapDelete {
+			f.data.write(5, empty)
+			r = f.Fsck()
+			if !reflect.DeepEqual(r.EmptyLeaves, []uint64{5}) ||
+				f.RepairFsck(r) == nil {
+				t.Fatalf("empty leaves %v", r.EmptyLeaves)
+			}
+		}
+	}
+}
@@ -1,9 +1,20 @@
 package accumulator
 
 import (
+	"runtime"
 	"sync"
 )
 
+// HashWorkers is the most goroutines that will be used to hash a single row
+// of parents.  Defaults to the number of CPUs; set to 1 to do all hashing
+// inline.  Change it before using the forest / pollard, not during.
+var HashWorkers = runtime.NumCPU()
+
+// minHashBatch is the smallest number of hashes worth giving to a worker.
+// A sha256 of 64 bytes takes well under a microsecond, so for small rows
+// starting goroutines and waiting on them costs more than the hashing.
+const minHashBatch = 64
+
 // hashableNode is the data needed to perform a hash
 type hashableNode struct {
 	sib, dest *polNode
@@ -15,41 +26,81 @@ type hashableNode struct {
 // so the data is "there" in a static structure so I can use pointers to it
 // and it won't move around.  hopefully.
 
-func (n *hashableNode) run(wg *sync.WaitGroup) {
-	// fmt.Printf("hasher about to replace %x\n", n.dest.data[:4])
-	n.dest.data = n.sib.auntOp()
-	// fmt.Printf("hasher finished %x %x -> %x\n",
-	// n.sib.niece[0].data[:4], n.sib.niece[1].data[:4], n.dest.data[:4])
-	wg.Done()
-}
-
-type hashNpos struct {
-	result Hash
-	pos    uint64
-}
+// hashParallel calls hashFn on ranges covering 0 to n-1.  The ranges are
+// contiguous batches, one per worker, with at most HashWorkers workers and at
+// least minHashBatch items per worker.  If that leaves only 1 worker the
+// whole range is done inline in the calling goroutine.
+// hashFn must be safe to call concurrently on non-overlapping ranges.
+func hashParallel(n int, hashFn func(start, end int)) {
+	workers := HashWorkers
+	if workers > n/minHashBatch {
+		workers = n / minHashBatch
+	}
+	if workers < 2 {
+		hashFn(0, n)
+		return
+	}
 
-func hashOne(l, r Hash, p uint64, hchan chan hashNpos) {
-	var hnp hashNpos
-	hnp.pos = p
-	hnp.result = parentHash(l, r)
-	hchan <- hnp
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	// give each worker a run of n/workers, spreading the remainder over the
+	// first few workers
+	batch, extra := n/workers, n%workers
+	start := 0
+	for w := 0; w < workers; w++ {
+		end := start + batch
+		if w < extra {
+			end++
+		}
+		go func(start, end int) {
+			hashFn(start, end)
+			wg.Done()
+		}(start, end)
+		start = end
+	}
+	wg.Wait()
 }
 
+// hashRow computes and writes the hashes at all the given parent positions,
+// reading their children from the forest.  If either child is empty, the
+// parent is written as empty; in swapless mode swaplessParent says.  All
+// reads happen before hashing and all writes after, so the positions should
+// all be on the same row.
 func (f *Forest) hashRow(dirtpositions []uint64) error {
+	if len(dirtpositions) == 0 {
+		return nil
+	}
 
-	hchan := make(chan hashNpos, 256) // probably don't need that big a buffer
-
+	// skip parents with an empty child; those parents become empty
+	lefts := make([]Hash, 0, len(dirtpositions))
+	rights := make([]Hash, 0, len(dirtpositions))
+	var hashPositions []uint64
 	for _, hp := range dirtpositions {
 		l := f.data.read(child(hp, f.rows))
 		r := f.data.read(child(hp, f.rows) | 1)
 		// fmt.Printf("hash pos %d l %x r %x\n", hp, l[:4], r[:4])
-		go hashOne(l, r, hp, hchan)
+		if l == empty || r == empty {
+			par := empty
+			if f.deleteMode == SwaplessDelete {
+				par, _ = swaplessParent(l, r)
+			}
+			f.data.write(hp, par)
+			continue
+		}
+		lefts = append(lefts, l)
+		rights = append(rights, r)
+		hashPositions = append(hashPositions, hp)
 	}
 
-	for remaining := len(dirtpositions); remaining > 0; remaining-- {
-		hnp := <-hchan
-		f.data.write(hnp.pos, hnp.result)
+	results := make([]Hash, len(hashPositions))
+	hashParallel(len(results), func(start, end int) {
+		parentHashes(results[start:end], lefts[start:end], rights[start:end])
+	})
+
+	for i, hp := range hashPositions {
+		f.data.write(hp, results[i])
 	}
+	f.HistoricHashes += uint64(len(results))
 
 	return nil
 }
@@ -0,0 +1,123 @@
+package accumulator
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// TestHashParallel checks that hashParallel gives the same results as hashing
+// one at a time, for rows that go inline and rows that get split up.
+func TestHashParallel(t *testing.T) {
+	prevWorkers := HashWorkers
+	defer func() { HashWorkers = prevWorkers }()
+
+	for _, workers := range []int{1, 2, 3, 8} {
+		HashWorkers = workers
+		for _, n := range []int{0, 1, 63, 64, 129, 1000} {
+			lefts, rights := randomHashPairs(n)
+			results := make([]Hash, n)
+			hashParallel(n, func(start, end int) {
+				for i := start; i < end; i++ {
+					results[i] = parentHash(lefts[i], rights[i])
+				}
+			})
+			for i := range results {
+				if results[i] != parentHash(lefts[i], rights[i]) {
+					t.Fatalf("workers %d n %d: hash %d mismatch", workers, n, i)
+				}
+			}
+		}
+	}
+}
+
+// TestForestHashWorkers runs the same blocks through forests with different
+// numbers of hash workers and checks that the roots come out the same.
+func TestForestHashWorkers(t *testing.T) {
+	prevWorkers := HashWorkers
+	defer func() { HashWorkers = prevWorkers }()
+
+	var roots [][]Hash
+	for _, workers := range []int{1, 4} {
+		HashWorkers = workers
+		rand.Seed(5)
+		f := NewForest(nil)
+		sc := NewSimChain(0x07)
+		for b := 0; b < 50; b++ {
+			adds, _, delHashes := sc.NextBlock(500)
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bp.SortTargets()
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		roots = append(roots, f.GetRoots())
+	}
+	if fmt.Sprintf("%x", roots[0]) != fmt.Sprintf("%x", roots[1]) {
+		t.Fatalf("roots differ between 1 and 4 hash workers")
+	}
+}
+
+func randomHashPairs(n int) (lefts, rights []Hash) {
+	lefts = make([]Hash, n)
+	rights = make([]Hash, n)
+	for i := 0; i < n; i++ {
+		rand.Read(lefts[i][:])
+		rand.Read(rights[i][:])
+	}
+	return
+}
+
+// benchHashRow hashes a row of n parents with the given number of workers
+func benchHashRow(b *testing.B, n, workers int) {
+	prevWorkers := HashWorkers
+	defer func() { HashWorkers = prevWorkers }()
+	HashWorkers = workers
+
+	lefts, rights := randomHashPairs(n)
+	results := make([]Hash, n)
+	b.ResetTimer()
+	for j := 0; j < b.N; j++ {
+		hashParallel(n, func(start, end int) {
+			parentHashes(results[start:end], lefts[start:end], rights[start:end])
+		})
+	}
+}
+
+// benchHashRowSpawn is the old way hashRow worked: one goroutine per parent,
+// with results sent back over a channel.  Here to compare against.
+func benchHashRowSpawn(b *testing.B, n int) {
+	type hashNpos struct {
+		result Hash
+		pos    int
+	}
+	lefts, rights := randomHashPairs(n)
+	results := make([]Hash, n)
+	b.ResetTimer()
+	for j := 0; j < b.N; j++ {
+		hchan := make(chan hashNpos, 256)
+		for i := 0; i < n; i++ {
+			go func(i int) {
+				hchan <- hashNpos{parentHash(lefts[i], rights[i]), i}
+			}(i)
+		}
+		for remaining := n; remaining > 0; remaining-- {
+			hnp := <-hchan
+			results[hnp.pos] = hnp.result
+		}
+	}
+}
+
+func BenchmarkHashRow16Spawn(b *testing.B)    { benchHashRowSpawn(b, 16) }
+func BenchmarkHashRow16Inline(b *testing.B)   { benchHashRow(b, 16, 1) }
+func BenchmarkHashRow16Pool(b *testing.B)     { benchHashRow(b, 16, HashWorkers) }
+func BenchmarkHashRow1024Spawn(b *testing.B)  { benchHashRowSpawn(b, 1024) }
+func BenchmarkHashRow1024Inline(b *testing.B) { benchHashRow(b, 1024, 1) }
+func BenchmarkHashRow1024Pool(b *testing.B)   { benchHashRow(b, 1024, HashWorkers) }
+func BenchmarkHashRow16kSpawn(b *testing.B)   { benchHashRowSpawn(b, 16384) }
+func BenchmarkHashRow16kInline(b *testing.B)  { benchHashRow(b, 16384, 1) }
+func BenchmarkHashRow16kPool(b *testing.B)    { benchHashRow(b, 16384, HashWorkers) }
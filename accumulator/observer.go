@@ -0,0 +1,96 @@
+package accumulator
+
+// ModifyObserver gets told what each Modify did to the leaves, so things
+// keeping track of leaf positions outside the accumulator (wallets holding
+// proofs, block explorers, the bridge node's leaf data) don't have to redo
+// the transform to find out.  It's called after Modify is done, in the same
+// goroutine.
+type ModifyObserver interface {
+	LeavesChanged(c LeafChanges)
+}
+
+// LeafChanges is what happened to the leaves in a Modify.  Deletes and
+// moves happen before adds, so Added positions start at the number of leaves
+// left after the deletes.
+type LeafChanges struct {
+	// Deleted are the leaves deleted and where they were
+	Deleted []LeafPosition
+	// Moved are the leaves that are still there but at a different
+	// position, from deleting the others
+	Moved []LeafMove
+	// Added are the new leaves and where they went
+	Added []LeafPosition
+}
+
+// LeafPosition is a leaf and where it is.  In a pollard, leaves it doesn't
+// have have an empty Hash.
+type LeafPosition struct {
+	Hash Hash
+	Pos  uint64
+}
+
+// LeafMove is a leaf moving from one position to another.  In a pollard,
+// leaves it doesn't have have an empty Hash.
+type LeafMove struct {
+	Hash     Hash
+	From, To uint64
+}
+
+// SetModifyObserver makes o get told about the leaves changed by every
+// Modify.  nil stops it; with no observer Modify does no extra work.
+func (f *Forest) SetModifyObserver(o ModifyObserver) {
+	f.observer = o
+}
+
+// SetModifyObserver makes o get told about the leaves changed by every
+// Modify.  nil stops it; with no observer Modify does no extra work.
+func (p *Pollard) SetModifyObserver(o ModifyObserver) {
+	p.observer = o
+}
+
+// deleteChanges works out what deleting dels does to the leaves.  read gives
+// the hashes at positions before anything moves.
+func deleteChanges(dels []uint64, numLeaves uint64, forestRows uint8,
+	read func(pos uint64) Hash) (LeafChanges, error) {
+
+	var c LeafChanges
+	tp, err := NewTransformPlan(dels, numLeaves, forestRows)
+	if err != nil {
+		return c, err
+	}
+	for _, d := range dels {
+		c.Deleted = append(c.Deleted, LeafPosition{Hash: read(d), Pos: d})
+	}
+
+	// follow the leaf moves, keeping only positions that changed: from
+	// says which leaf is at each position now
+	from := make(map[uint64]uint64)
+	fromPos := func(pos uint64) uint64 {
+		if f, ok := from[pos]; ok {
+			return f
+		}
+		return pos
+	}
+	for _, a := range tp.LeafMoves() {
+		from[a.From], from[a.To] = fromPos(a.To), fromPos(a.From)
+	}
+	nextNumLeaves := tp.NextNumLeaves()
+	for pos := range from {
+		if pos >= nextNumLeaves || from[pos] == pos {
+			continue
+		}
+		c.Moved = append(c.Moved, LeafMove{
+			Hash: read(from[pos]), From: from[pos], To: pos})
+	}
+	// maps have no order, so sort by where they end up
+	sortLeafMoves(c.Moved)
+	return c, nil
+}
+
+// addChanges puts the adds in the changes, starting at position start
+func (c *LeafChanges) addChanges(adds []Leaf, start uint64) {
+	for i, a := range adds {
+		c.Added = append(c.Added,
+			LeafPosition{Hash: a.Hash, Pos: start + uint64(i)})
+	}
+}
@@ -0,0 +1,108 @@
+package accumulator
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// positionLog keeps track of where leaves are from nothing but the changes
+// it's told about
+type positionLog struct {
+	positions map[Hash]uint64
+	last      LeafChanges
+}
+
+func (pl *positionLog) LeavesChanged(c LeafChanges) {
+	for _, d := range c.Deleted {
+		delete(pl.positions, d.Hash)
+	}
+	for _, m := range c.Moved {
+		pl.positions[m.Hash] = m.To
+	}
+	for _, a := range c.Added {
+		pl.positions[a.Hash] = a.Pos
+	}
+	pl.last = c
+}
+
+// TestModifyObserver rebuilds the position map of a forest and a full
+// pollard from just the changes they report, and checks a sparse pollard
+// reports the same positions.
+func TestModifyObserver(t *testing.T) {
+	f := NewForest(nil)
+	fp := NewFullPollard()
+	var p Pollard
+	fLog := &positionLog{positions: make(map[Hash]uint64)}
+	fpLog := &positionLog{positions: make(map[Hash]uint64)}
+	pLog := &positionLog{positions: make(map[Hash]uint64)}
+	f.SetModifyObserver(fLog)
+	fp.SetModifyObserver(fpLog)
+	p.SetModifyObserver(pLog)
+
+	simBlocks(t, f, nil, 4, 200, func(b int, adds []Leaf, delHashes []Hash,
+		bp BatchProof) {
+
+		err := p.IngestBatchProof(bp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fp.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(fLog.last.Deleted) != len(delHashes) ||
+			len(fLog.last.Added) != len(adds) {
+			t.Fatalf("block %d: %d dels %d adds but told %d %d", b,
+				len(delHashes), len(adds),
+				len(fLog.last.Deleted), len(fLog.last.Added))
+		}
+		for _, pl := range []*positionLog{fLog, fpLog} {
+			if uint64(len(pl.positions)) != f.numLeaves {
+				t.Fatalf("block %d: %d leaves but %d positions",
+					b, f.numLeaves, len(pl.positions))
+			}
+			for pos := uint64(0); pos < f.numLeaves; pos++ {
+				h := f.data.read(pos)
+				logPos, ok := pl.positions[h]
+				if !ok || logPos != pos {
+					t.Fatalf("block %d: %x at %d but told %d (%v)",
+						b, h.Prefix(), pos, logPos, ok)
+				}
+			}
+		}
+		err = sameChangePositions(fLog.last, pLog.last)
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+	})
+}
+
+// sameChangePositions checks a pollard's changes are at the same positions
+// as the forest's, and that any hashes it has match
+func sameChangePositions(fc, pc LeafChanges) error {
+	if len(fc.Deleted) != len(pc.Deleted) || len(fc.Moved) != len(pc.Moved) ||
+		!reflect.DeepEqual(fc.Added, pc.Added) {
+		return fmt.Errorf("forest changes %+v pollard %+v", fc, pc)
+	}
+	for i, d := range pc.Deleted {
+		if d.Pos != fc.Deleted[i].Pos ||
+			(d.Hash != empty && d.Hash != fc.Deleted[i].Hash) {
+			return fmt.Errorf("delete %d forest %+v pollard %+v",
+				i, fc.Deleted[i], d)
+		}
+	}
+	for i, m := range pc.Moved {
+		if m.From != fc.Moved[i].From || m.To != fc.Moved[i].To ||
+			(m.Hash != empty && m.Hash != fc.Moved[i].Hash) {
+			return fmt.Errorf("move %d forest %+v pollard %+v",
+				i, fc.Moved[i], m)
+		}
+	}
+	return nil
+}
@@ -2,12 +2,32 @@ package accumulator
 
 import (
 	"fmt"
-	"sync"
 )
 
 // Modify is the main function that deletes then adds elements to the accumulator
 func (p *Pollard) Modify(adds []Leaf, dels []uint64) error {
-	err := p.rem2(dels)
+	// work out what moves before it moves, if anyone wants to know
+	var changes LeafChanges
+	if p.observer != nil && p.deleteMode == SwaplessDelete {
+		// nothing moves
+		for _, d := range dels {
+			changes.Deleted = append(changes.Deleted,
+				LeafPosition{Hash: p.peek(d), Pos: d})
+		}
+	} else if p.observer != nil {
+		var err error
+		changes, err = deleteChanges(dels, p.numLeaves, p.rows(), p.peek)
+		if err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if p.deleteMode == SwaplessDelete {
+		err = p.remSwapless(dels)
+	} else {
+		err = p.rem2(dels)
+	}
 	if err != nil {
 		return err
 	}
@@ -18,6 +38,10 @@ func (p *Pollard) Modify(adds []Leaf, dels []uint64) error {
 		return err
 	}
 
+	if p.observer != nil {
+		changes.addChanges(adds, p.numLeaves-uint64(len(adds)))
+		p.observer.LeavesChanged(changes)
+	}
 	return nil
 }
 
@@ -37,21 +61,25 @@ func (p *Pollard) ReconstructStats() (uint64, uint8) {
 	return p.numLeaves, p.rows()
 }
 
-// Add a leaf to a pollard.  Not as simple!
+// Add leaves to a pollard.  Not as simple!
 func (p *Pollard) add(adds []Leaf) error {
 
 	// General algo goes:
-	// 1 make a new node & assign data (no neices; at bottom)
-	// 2 if this node is on a row where there's already a root,
-	// then swap neices with that root, hash the two datas, and build a new
-	// node 1 higher pointing to them.
-	// goto 2.
-
-	// this does everything 1 at a time, with hashing also mixed in, so that's
-	// pretty sub-optimal, but we're not doing multi-thread yet
-
-	for _, a := range adds {
-
+	// 1 make new nodes & assign data (no neices; at bottom) for all the leaves
+	// 2 if there's already a root on this row, it goes on the left of the
+	// new nodes.
+	// 3 pair up the nodes on this row from the left: swap their neices, and
+	// build a new node 1 higher pointing to them.  If one's left over on the
+	// right, it's a root.
+	// 4 hash all the new nodes 1 row up at once, and goto 2 with them.
+	// This makes the same nodes as adding leaves 1 at a time, which would
+	// do grab, pop, swap, hash, new for each leaf.
+
+	if len(adds) == 0 {
+		return nil
+	}
+	rowNodes := make([]*polNode, len(adds))
+	for i, a := range adds {
 		//		if p.numLeaves < p.Minleaves ||
 		//			(add.Duration < p.Lookahead && add.Duration > 0) {
 		//			remember = true
@@ -60,68 +88,61 @@ func (p *Pollard) add(adds []Leaf) error {
 		if a.Remember {
 			p.rememberEver++
 		}
+		n := &polNode{data: a.Hash}
+		if a.Remember || p.positionMap != nil {
+			// flag this leaf as memorable via it's left pointer
+			n.niece[0] = n // points to itself (mind blown)
+		}
+		rowNodes[i] = n
+	}
+
+	startLeaves := p.numLeaves
+	// new roots, smallest first
+	var newRoots []polNode
+	for h := uint8(0); len(rowNodes) != 0; h++ {
+		if (startLeaves>>h)&1 == 1 {
+			// grab & pop the old root on this row; it's on the left
+			leftRoot := p.roots[len(p.roots)-1]
+			p.roots = p.roots[:len(p.roots)-1]
+			rowNodes = append([]*polNode{&leftRoot}, rowNodes...)
+		}
+		if len(rowNodes)&1 == 1 {
+			newRoots = append(newRoots, *rowNodes[len(rowNodes)-1])
+			rowNodes = rowNodes[:len(rowNodes)-1]
+		}
 
-		err := p.addOne(a.Hash, a.Remember)
-		if err != nil {
-			return err
+		parents := make([]*polNode, len(rowNodes)/2)
+		lefts := make([]Hash, len(parents))
+		rights := make([]Hash, len(parents))
+		for i := range parents {
+			l, r := rowNodes[2*i], rowNodes[2*i+1]
+			l.niece, r.niece = r.niece, l.niece // swap
+			lefts[i], rights[i] = l.data, r.data
+			parents[i] = &polNode{niece: [2]*polNode{l, r}} // new
+			parents[i].prune()
 		}
+		results := make([]Hash, len(parents))
+		hashChildren(results, lefts, rights, p.deleteMode)
+		for i, n := range parents {
+			n.data = results[i]
+		}
+		p.hashesEver += uint64(len(results))
+		rowNodes = parents
 	}
-	//	fmt.Printf("added %d, nl %d roots %d\n", len(adds), p.numLeaves, len(p.roots))
-	return nil
-}
-
-/*
-Algo explanation with catchy terms: grab, swap, hash, new, pop
-we're iterating through the roots of the pollard.  Roots correspond with 1-bits
-in numLeaves.  As soon as we hit a 0 (no root), we're done.
 
-grab: Grab the lowest root.
-pop: pop off the lowest root.
-swap: swap the neices of the node we grabbed and our new node
-hash: calculate the hashes of the old root and new node
-new: create a new parent node, with the hash as data, and the old root / prev new node
-as neices (not neices though, children)
-*/
-
-// add a single leaf to a pollard
-func (p *Pollard) addOne(add Hash, remember bool) error {
-	// basic idea: you're going to start at the LSB and move left;
-	// the first 0 you find you're going to turn into a 1.
-
-	// make the new leaf & populate it with the actual data you're trying to add
-	n := new(polNode)
-	n.data = add
-	if remember || p.positionMap != nil {
-		// flag this leaf as memorable via it's left pointer
-		n.niece[0] = n // points to itself (mind blown)
+	// the roots that weren't popped are all bigger than the new ones
+	for i := len(newRoots) - 1; i >= 0; i-- {
+		p.roots = append(p.roots, newRoots[i])
 	}
+	p.numLeaves += uint64(len(adds))
 
+	// now that the leaves are in the pollard, their positions can be read
 	if p.positionMap != nil {
-		p.positionMap[add.Mini()] = p.numLeaves
-	}
-
-	// if add is forgetable, forget all the new nodes made
-	var h uint8
-	// loop until we find a zero; destroy roots until you make one
-	for ; (p.numLeaves>>h)&1 == 1; h++ {
-		// grab, pop, swap, hash, new
-		leftRoot := p.roots[len(p.roots)-1]                         // grab
-		p.roots = p.roots[:len(p.roots)-1]                          // pop
-		leftRoot.niece, n.niece = n.niece, leftRoot.niece           // swap
-		nHash := parentHash(leftRoot.data, n.data)                  // hash
-		n = &polNode{data: nHash, niece: [2]*polNode{&leftRoot, n}} // new
-		p.hashesEver++
-
-		n.prune()
-
+		for i, a := range adds {
+			p.positionMap.set(a.Hash, startLeaves+uint64(i), p)
+		}
 	}
-
-	// the new roots are all the 1 bits above where we got to, and nothing below where
-	// we got to.  We've already deleted all the lower roots, so append the new
-	// one we just made onto the end.
-
-	p.roots = append(p.roots, *n)
-	p.numLeaves++
+	//	fmt.Printf("added %d, nl %d roots %d\n", len(adds), p.numLeaves, len(p.roots))
 	return nil
 }
 
@@ -149,13 +170,12 @@ func (p *Pollard) rem2(dels []uint64) error {
 
 	if p.positionMap != nil { // if fulpol, remove hashes from posMap
 		for _, delpos := range dels {
-			delete(p.positionMap, p.read(delpos).Mini())
+			p.positionMap.del(p.read(delpos))
 		}
 	}
 
 	// get all the swaps, then apply them all
 	swaprows := remTrans2(dels, p.numLeaves, ph)
-	wg := new(sync.WaitGroup)
 	// fmt.Printf(" @@@@@@ rem2 nl %d ph %d rem %v\n", p.numLeaves, ph, dels)
 	var hashDirt, nextHashDirt []uint64
 	var prevHash uint64
@@ -212,7 +232,7 @@ func (p *Pollard) rem2(dels []uint64) error {
 		hashDirt = nextHashDirt
 		nextHashDirt = []uint64{}
 		// do all the hashes at once at the end
-		wg.Add(len(hnslice))
+		hashable := hnslice[:0]
 		for _, hn := range hnslice {
 			// skip hashes we can't compute
 			if hn.sib.niece[0] == nil || hn.sib.niece[1] == nil ||
@@ -221,14 +241,23 @@ func (p *Pollard) rem2(dels []uint64) error {
 				// it'd be better to avoid this and not create hns that aren't
 				// supposed to exist.
 				fmt.Printf("hn %d nil or uncomputable\n", hn.position)
-				wg.Done()
 				continue
 			}
-			// fmt.Printf("giving hasher %d %x %x\n",
-			// hn.position, hn.sib.niece[0].data[:4], hn.sib.niece[1].data[:4])
-			go hn.run(wg)
+			hashable = append(hashable, hn)
+		}
+		// fmt.Printf("giving hasher %d nodes\n", len(hashable))
+		lefts := make([]Hash, len(hashable))
+		rights := make([]Hash, len(hashable))
+		for i, hn := range hashable {
+			lefts[i], rights[i] = hn.sib.niece[0].data, hn.sib.niece[1].data
+		}
+		results := make([]Hash, len(hashable))
+		hashParallel(len(results), func(start, end int) {
+			parentHashes(results[start:end], lefts[start:end], rights[start:end])
+		})
+		for i, hn := range hashable {
+			hn.dest.data = results[i]
 		}
-		wg.Wait() // wait for all hashing to finish at end of each row
 		// fmt.Printf("done with row %d %s\n", h, p.toString())
 	}
 
@@ -286,8 +315,8 @@ func (p *Pollard) swapNodes(s arrow, row uint8) (*hashableNode, error) {
 		run := uint64(1 << row)
 		// happens before the actual swap, so swapping a and b
 		for i := uint64(0); i < run; i++ {
-			p.positionMap[p.read(a+i).Mini()] = b + i
-			p.positionMap[p.read(b+i).Mini()] = a + i
+			p.positionMap.set(p.read(a+i), b+i, p)
+			p.positionMap.set(p.read(b+i), a+i, p)
 		}
 	}
 
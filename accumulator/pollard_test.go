@@ -3,6 +3,7 @@ package accumulator
 import (
 	"fmt"
 	"math/rand"
+	"reflect"
 	"testing"
 )
 
@@ -81,9 +82,7 @@ func pollardRandomRemember(blocks int32) error {
 		err = f.sanity()
 		if err != nil {
 			fmt.Printf("frs broke %s", f.ToString())
-			for h, p := range f.positionMap {
-				fmt.Printf("%x@%d ", h[:4], p)
-			}
+			fmt.Printf("%s", f.positionMap.String())
 			return err
 		}
 		err = f.PosMapSanity()
@@ -107,7 +106,7 @@ func pollardRandomRemember(blocks int32) error {
 			return fmt.Errorf("pollard and forest leaves differ")
 		}
 
-		fullTops := f.getRoots()
+		fullTops := f.GetRoots()
 		polTops := p.rootHashesReverse()
 
 		// check that tops match
@@ -191,3 +190,152 @@ func fixedPollard(leaves int32) error {
 
 	return nil
 }
+
+// TestPollardEmpty runs blocks where every leaf gets deleted, so the forest,
+// the pollard and the full pollard all go down to 0 leaves and fill back up
+// again a bunch of times
+func TestPollardEmpty(t *testing.T) {
+	for z := 0; z < 30; z++ {
+		rand.Seed(int64(z))
+		err := emptyingRandom(60)
+		if err != nil {
+			fmt.Printf("randseed %d\n", z)
+			t.Fatal(err)
+		}
+	}
+}
+
+func emptyingRandom(blocks int32) error {
+	f := NewForest(nil)
+	fp := NewFullPollard()
+	var p Pollard
+
+	sn := NewSimChain(0x03)
+	sn.lookahead = 400
+	sn.NoImmortal = true
+	emptied := 0
+	for b := int32(0); b < blocks; b++ {
+		// lots of blocks with no adds, so everything runs out
+		numAdds := rand.Uint32() & 0x07
+		if numAdds > 3 {
+			numAdds = 0
+		}
+		adds, _, delHashes := sn.NextBlock(numAdds)
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		bp.SortTargets()
+		if !f.VerifyBatchProof(bp) {
+			return fmt.Errorf("block %d batch proof didn't verify",
+				sn.blockHeight)
+		}
+		err = p.IngestBatchProof(bp)
+		if err != nil {
+			return err
+		}
+		fbp, err := fp.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		if fmt.Sprintf("%v %x", fbp.Targets, fbp.Proof) !=
+			fmt.Sprintf("%v %x", bp.Targets, bp.Proof) {
+			return fmt.Errorf("block %d full pollard proof differs from forest",
+				sn.blockHeight)
+		}
+
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		err = fp.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+
+		err = f.sanity()
+		if err != nil {
+			return err
+		}
+		err = f.PosMapSanity()
+		if err != nil {
+			return err
+		}
+		if f.numLeaves != p.numLeaves || f.numLeaves != fp.numLeaves {
+			return fmt.Errorf("block %d forest %d leaves pollard %d full %d",
+				sn.blockHeight, f.numLeaves, p.numLeaves, fp.numLeaves)
+		}
+		if f.numLeaves == 0 {
+			emptied++
+		}
+
+		fRoots := fmt.Sprintf("%x", f.GetRoots())
+		if fRoots != fmt.Sprintf("%x", p.rootHashesReverse()) ||
+			fRoots != fmt.Sprintf("%x", fp.rootHashesReverse()) {
+			return fmt.Errorf("block %d roots differ forest %s pol %x full %x",
+				sn.blockHeight, fRoots, p.rootHashesReverse(),
+				fp.rootHashesReverse())
+		}
+	}
+	if emptied == 0 {
+		return fmt.Errorf("never got down to 0 leaves")
+	}
+
+	return nil
+}
+
+// TestPollardRestoreRoots starts a pollard from a forest's roots partway
+// through, and checks it keeps up with the forest after.
+func TestPollardRestoreRoots(t *testing.T) {
+	for _, mode := range []DeleteMode{SwapDelete, SwaplessDelete} {
+		rand.Seed(5)
+		f := NewForest(nil)
+		f.SetDeleteMode(mode)
+		var p Pollard
+		sn := NewSimChain(0x1f)
+		sn.lookahead = 30
+		for b := 0; b < 60; b++ {
+			adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x3f)
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bp.SortTargets()
+			if b == 30 {
+				err = p.RestoreRoots(f.numLeaves, f.GetRoots(), mode)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if b >= 30 {
+				err = p.IngestBatchProof(bp)
+				if err != nil {
+					t.Fatalf("%s block %d %s", mode, b, err.Error())
+				}
+				err = p.Modify(adds, bp.Targets)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !reflect.DeepEqual(p.GetRoots(), f.GetRoots()) {
+			t.Fatalf("%s pollard roots %x, forest %x",
+				mode, p.GetRoots(), f.GetRoots())
+		}
+	}
+
+	var p Pollard
+	err := p.RestoreRoots(3, []Hash{{1}}, SwapDelete)
+	if err == nil {
+		t.Fatal("1 root for 3 leaves, no error")
+	}
+}
@@ -11,7 +11,7 @@ func (p *Pollard) IngestBatchProof(bp BatchProof) error {
 
 	// TODO so many things to change
 	ok, proofMap := verifyBatchProof(
-		bp, p.rootHashesReverse(), p.numLeaves, p.rows())
+		bp, p.rootHashesReverse(), p.numLeaves, p.rows(), p.deleteMode)
 	if !ok {
 		return fmt.Errorf("block proof mismatch")
 	}
@@ -38,7 +38,8 @@ func (p *Pollard) IngestBatchProof(bp BatchProof) error {
 				node.niece[lr] = new(polNode)
 				node.niece[lr].data = proofMap[pos]
 				// fmt.Printf("------wrote %x at %d\n", proofMap[pos], pos)
-				if node.niece[lr].data == empty {
+				if node.niece[lr].data == empty &&
+					p.deleteMode != SwaplessDelete {
 					return fmt.Errorf(
 						"h %d wrote empty hash at pos %d %04x.niece[%d]",
 						h, pos, node.data[:4], lr)
@@ -70,7 +71,8 @@ func (p *Pollard) IngestBatchProof(bp BatchProof) error {
 			node.niece[lr^1] = new(polNode)
 			node.niece[lr^1].data = proofMap[pos^1]
 			fmt.Printf("------wrote %x at %d\n", proofMap[pos^1], pos^1)
-			if node.niece[lr^1].data == empty {
+			if node.niece[lr^1].data == empty &&
+				p.deleteMode != SwaplessDelete {
 				return fmt.Errorf("Wrote an empty hash h %d under %04x %d.niece[%d]",
 					h, node.data[:4], pos, lr^1)
 			}
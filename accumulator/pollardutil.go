@@ -2,6 +2,8 @@ package accumulator
 
 import (
 	"fmt"
+	"io"
+	"math/bits"
 	"os"
 )
 
@@ -26,7 +28,13 @@ type Pollard struct {
 	//	Lookahead int32  // remember leafs below this TTL
 	//	Minleaves uint64 // remember everything below this leaf count
 
-	positionMap map[MiniHash]uint64
+	positionMap *positionIndex
+
+	// observer gets told what each Modify did to the leaves, if it's set
+	observer ModifyObserver
+
+	// deleteMode is whether deletes swap leaves in or leave holes
+	deleteMode DeleteMode
 }
 
 // PolNode is a node in the pollard forest
@@ -127,24 +135,28 @@ func (p *Pollard) rootHashesReverse() []Hash {
 	return rHashes
 }
 
-func (p *Pollard) WritePollard(pollardFile *os.File) error {
+// GetRoots returns the root hashes, in the same order as Forest.GetRoots
+func (p *Pollard) GetRoots() []Hash {
+	return p.rootHashesReverse()
+}
 
-	// "Overwriting" pollardFile passed in
-	// I feel like this is faster than writing 0s
-	os.Remove("pollardfile.dat")
-	var err error
-	pollardFile, err = os.OpenFile(
-		"pollardfile.dat", os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic(err)
-	}
+// WritePollard writes numLeaves and the roots to pollardFile, replacing
+// whatever was there.  A swapless pollard has the delete mode after.
+func (p *Pollard) WritePollard(pollardFile *os.File) error {
 
 	// The Hash of all the roots appended
 	var allRoots []byte
 	for _, t := range p.roots {
 		allRoots = append(allRoots, t.data[:]...)
 	}
+	if p.deleteMode != SwapDelete {
+		allRoots = append(allRoots, byte(p.deleteMode))
+	}
 
+	err := pollardFile.Truncate(0)
+	if err != nil {
+		return err
+	}
 	_, err = pollardFile.WriteAt(append(U64tB(p.numLeaves), allRoots...), 0)
 	if err != nil {
 		return err
@@ -153,34 +165,77 @@ func (p *Pollard) WritePollard(pollardFile *os.File) error {
 	return nil
 }
 
+// RestorePollard reads back what WritePollard wrote
 func (p *Pollard) RestorePollard(pollardFile *os.File) error {
 	fmt.Println("Restoring Pollard Roots...")
 
 	var byteLeaves [8]byte
-	_, err := pollardFile.Read(byteLeaves[:])
+	_, err := io.ReadFull(pollardFile, byteLeaves[:])
 	if err != nil {
-		panic(err)
+		return err
 	}
 	p.numLeaves = BtU64(byteLeaves[:])
 	fmt.Println("Pollard Leaves:", p.numLeaves)
 
 	pstat, err := pollardFile.Stat()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	// a root for every 1 bit in numLeaves
+	numRoots := bits.OnesCount64(p.numLeaves)
+	rootsEnd := 8 + 32*int64(numRoots)
+	if pstat.Size() != rootsEnd && pstat.Size() != rootsEnd+1 {
+		return fmt.Errorf("pollard file %d bytes, expect %d for %d leaves",
+			pstat.Size(), rootsEnd, p.numLeaves)
 	}
 
-	pos := int64(8)
-	for i := int(0); pos != pstat.Size(); i++ {
-		var h Hash
-		_, err := pollardFile.Read(h[:])
+	p.roots = nil
+	for i := 0; i < numRoots; i++ {
+		var n polNode
+		_, err := io.ReadFull(pollardFile, n.data[:])
 		if err != nil {
-			panic(err)
+			return err
+		}
+		p.roots = append(p.roots, n)
+	}
+	p.deleteMode = SwapDelete
+	if pstat.Size() == rootsEnd+1 {
+		var mode [1]byte
+		_, err = io.ReadFull(pollardFile, mode[:])
+		if err != nil {
+			return err
+		}
+		p.deleteMode = DeleteMode(mode[0])
+		err = p.deleteMode.Check()
+		if err != nil {
+			return err
 		}
-		n := new(polNode)
-		n.data = h
-		p.roots = append(p.roots, *n)
-		pos += 32
 	}
 	fmt.Println("Finished restoring pollard")
 	return nil
 }
+
+// RestoreRoots sets the pollard to numLeaves with just the given roots, in
+// the same order as GetRoots, like RestorePollard does from a file.  For
+// starting from roots that came from somewhere else, so they'd better be
+// right; nothing here can check.
+func (p *Pollard) RestoreRoots(
+	numLeaves uint64, roots []Hash, mode DeleteMode) error {
+
+	err := mode.Check()
+	if err != nil {
+		return err
+	}
+	// a root for every 1 bit in numLeaves
+	if len(roots) != bits.OnesCount64(numLeaves) {
+		return fmt.Errorf("%d roots for %d leaves, expect %d",
+			len(roots), numLeaves, bits.OnesCount64(numLeaves))
+	}
+	p.numLeaves = numLeaves
+	p.deleteMode = mode
+	p.roots = make([]polNode, len(roots))
+	for i, r := range roots {
+		p.roots[len(roots)-1-i].data = r
+	}
+	return nil
+}
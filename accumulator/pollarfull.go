@@ -17,19 +17,43 @@ func (p *Pollard) read(pos uint64) Hash {
 	return n.data
 }
 
+// peek gives the hash at pos if the pollard has it, or empty if it doesn't.
+// Same descent as grabPos, but it doesn't hook in missing siblings on the
+// way down, so it doesn't change the pollard.
+func (p *Pollard) peek(pos uint64) Hash {
+	tree, branchLen, bits := detectOffset(pos, p.numLeaves)
+	if tree >= uint8(len(p.roots)) {
+		return empty
+	}
+	n := &p.roots[tree]
+	for h := branchLen - 1; h != 255; h-- { // go through branch
+		lr := uint8(bits>>h) & 1
+		if h == 0 {
+			n = n.niece[lr^1]
+		} else {
+			n = n.niece[lr]
+		}
+		if n == nil {
+			return empty
+		}
+	}
+	return n.data
+}
+
 // NewFullPollard gives you a Pollard with an activated
 func NewFullPollard() Pollard {
 	var p Pollard
-	p.positionMap = make(map[MiniHash]uint64)
+	p.positionMap = newPositionIndex()
 	return p
 }
 
 // PosMapSanity is costly / slow: check that everything in posMap is correct
 func (p *Pollard) PosMapSanity() error {
 	for i := uint64(0); i < p.numLeaves; i++ {
-		if p.positionMap[p.read(i).Mini()] != i {
-			return fmt.Errorf("positionMap error: map says %x @%d but it's @%d",
-				p.read(i).Prefix(), p.positionMap[p.read(i).Mini()], i)
+		pos, ok := p.positionMap.get(p.read(i), p)
+		if !ok || pos != i {
+			return fmt.Errorf("positionMap error: map says %x @%d (%v) but it's @%d",
+				p.read(i).Prefix(), pos, ok, i)
 		}
 	}
 	return nil
@@ -47,10 +71,6 @@ func (p *Pollard) ProveBatch(hs []Hash) (BatchProof, error) {
 	if len(hs) == 0 {
 		return bp, nil
 	}
-	if p.numLeaves < 2 {
-		return bp, nil
-	}
-
 	// for h, p := range f.positionMap {
 	// 	fmt.Printf("%x@%d ", h[:4], p)
 	// }
@@ -62,7 +82,7 @@ func (p *Pollard) ProveBatch(hs []Hash) (BatchProof, error) {
 
 	for i, wanted := range hs {
 
-		pos, ok := p.positionMap[wanted.Mini()]
+		pos, ok := p.positionMap.get(wanted, p)
 		if !ok {
 			fmt.Printf(p.ToString())
 			return bp, fmt.Errorf("hash %x not found", wanted)
@@ -70,9 +90,7 @@ func (p *Pollard) ProveBatch(hs []Hash) (BatchProof, error) {
 
 		// should never happen
 		if pos > p.numLeaves {
-			for m, p := range p.positionMap {
-				fmt.Printf("%x @%d\t", m[:4], p)
-			}
+			fmt.Printf("%s\n", p.positionMap.String())
 			return bp, fmt.Errorf(
 				"ProveBlock: got leaf position %d but only %d leaves exist",
 				pos, p.numLeaves)
@@ -0,0 +1,114 @@
+package accumulator
+
+import "fmt"
+
+// positionIndex maps leaf hashes to their positions in the forest.  Normally
+// it only keys on the 12 byte MiniHash, which keeps it small.  But 12 bytes
+// isn't that much to grind, so someone making outputs could make 2 leaves
+// with the same MiniHash, and with a plain map one would overwrite the other.
+// So when 2 leaves with the same MiniHash show up, both (and any later ones
+// with that MiniHash) go in a second map keyed by the full 32 byte hash.
+//
+// The index doesn't keep full hashes around for the compact entries, so it
+// needs something it can read the forest from to tell a collision from a
+// leaf moving, and to make sure a lookup actually found what was asked for.
+type positionIndex struct {
+	mini map[MiniHash]uint64
+
+	// full has the leaves whose MiniHash collided; collided has how many
+	// entries in full have each of those MiniHashes.  Usually both empty.
+	full     map[Hash]uint64
+	collided map[MiniHash]int
+}
+
+// hashReader is anything you can read leaves from; ForestData and Pollard
+type hashReader interface {
+	read(pos uint64) Hash
+}
+
+func newPositionIndex() *positionIndex {
+	return &positionIndex{
+		mini:     make(map[MiniHash]uint64),
+		full:     make(map[Hash]uint64),
+		collided: make(map[MiniHash]int),
+	}
+}
+
+// get returns the position of leaf h, and false if it's not there.
+func (pi *positionIndex) get(h Hash, r hashReader) (uint64, bool) {
+	var pos uint64
+	var ok bool
+	if pi.collided[h.Mini()] != 0 {
+		pos, ok = pi.full[h]
+	} else {
+		pos, ok = pi.mini[h.Mini()]
+	}
+	// the MiniHash matching isn't enough, the whole thing has to
+	if !ok || r.read(pos) != h {
+		return 0, false
+	}
+	return pos, true
+}
+
+// set puts leaf h at pos.  r is used to look at what's at the old position
+// if there's already an entry for h's MiniHash.  It should still have the
+// leaf that entry was set for; that's the case for all the callers, which
+// set positions before moving the hashes around or after they're all moved.
+func (pi *positionIndex) set(h Hash, pos uint64, r hashReader) {
+	m := h.Mini()
+	if pi.collided[m] != 0 {
+		if _, there := pi.full[h]; !there {
+			pi.collided[m]++
+		}
+		pi.full[h] = pos
+		return
+	}
+	oldpos, ok := pi.mini[m]
+	if ok && oldpos != pos {
+		old := r.read(oldpos)
+		if old != h && old.Mini() == m {
+			// different leaf, same MiniHash; move both to the full map
+			delete(pi.mini, m)
+			pi.full[old] = oldpos
+			pi.full[h] = pos
+			pi.collided[m] = 2
+			return
+		}
+		// otherwise it's h moving, or an old entry that's not there anymore
+	}
+	pi.mini[m] = pos
+}
+
+// del removes leaf h from the index.
+func (pi *positionIndex) del(h Hash) {
+	m := h.Mini()
+	if pi.collided[m] == 0 {
+		delete(pi.mini, m)
+		return
+	}
+	if _, there := pi.full[h]; !there {
+		return
+	}
+	delete(pi.full, h)
+	pi.collided[m]--
+	if pi.collided[m] == 0 {
+		delete(pi.collided, m)
+	}
+}
+
+// size is the number of leaves in the index
+func (pi *positionIndex) size() int {
+	return len(pi.mini) + len(pi.full)
+}
+
+// String lists everything in the index, for debugging
+func (pi *positionIndex) String() string {
+	var s string
+	for m, p := range pi.mini {
+		s += fmt.Sprintf("%x@%d ", m[:4], p)
+	}
+	for h, p := range pi.full {
+		s += fmt.Sprintf("%x(full)@%d ", h[:4], p)
+	}
+	return s
+}
@@ -0,0 +1,163 @@
+package accumulator
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// memReader is a hashReader for testing positionIndex by itself
+type memReader map[uint64]Hash
+
+func (m memReader) read(pos uint64) Hash {
+	return m[pos]
+}
+
+// collidingHash makes a hash with a MiniHash that only depends on group, so
+// different n with the same group collide
+func collidingHash(group uint8, n uint32) (h Hash) {
+	h[0] = group
+	h[1] = 0xcc
+	h[12] = uint8(n)
+	h[13] = uint8(n >> 8)
+	h[14] = uint8(n >> 16)
+	h[31] = 0x01
+	return
+}
+
+func TestPositionIndexCollision(t *testing.T) {
+	pi := newPositionIndex()
+	r := make(memReader)
+
+	a, b, c := collidingHash(1, 0), collidingHash(1, 1), collidingHash(2, 0)
+	r[0], r[1], r[2] = a, b, c
+	pi.set(a, 0, r)
+	pi.set(b, 1, r)
+	pi.set(c, 2, r)
+
+	if pi.size() != 3 || len(pi.full) != 2 || len(pi.mini) != 1 {
+		t.Fatalf("size %d full %d mini %d, expect 3 2 1",
+			pi.size(), len(pi.full), len(pi.mini))
+	}
+	for i, h := range []Hash{a, b, c} {
+		pos, ok := pi.get(h, r)
+		if !ok || pos != uint64(i) {
+			t.Fatalf("leaf %d got %d %v", i, pos, ok)
+		}
+	}
+
+	// a 3rd leaf with the same MiniHash that isn't in the index
+	_, ok := pi.get(collidingHash(1, 2), r)
+	if ok {
+		t.Fatalf("found leaf that was never added")
+	}
+
+	// swap a and b, setting positions before moving like swapNodes does
+	pi.set(r[0], 1, r)
+	pi.set(r[1], 0, r)
+	r[0], r[1] = r[1], r[0]
+	pos, ok := pi.get(a, r)
+	if !ok || pos != 1 {
+		t.Fatalf("after swap a @%d %v, expect 1", pos, ok)
+	}
+
+	pi.del(a)
+	pi.del(b)
+	if pi.size() != 1 || len(pi.collided) != 0 {
+		t.Fatalf("after deleting size %d collided %d, expect 1 0",
+			pi.size(), len(pi.collided))
+	}
+	// the MiniHash isn't in collision mode anymore
+	pi.set(a, 0, r)
+	if len(pi.mini) != 2 {
+		t.Fatalf("mini %d entries, expect 2", len(pi.mini))
+	}
+}
+
+// TestForestCollisions fills a forest and full pollard with leaves where lots
+// of them share MiniHashes, and makes sure positions and proofs all still work
+func TestForestCollisions(t *testing.T) {
+	rand.Seed(3)
+	f := NewForest(nil)
+	fp := NewFullPollard()
+
+	var live []Hash
+	var dead []Hash
+	var leafCounter uint32
+	for b := 0; b < 40; b++ {
+		// only 4 different MiniHashes
+		adds := make([]Leaf, rand.Intn(20))
+		for i := range adds {
+			adds[i].Hash = collidingHash(uint8(rand.Intn(4)), leafCounter)
+			leafCounter++
+		}
+
+		var delHashes []Hash
+		for i := 0; i < len(live); i++ {
+			if rand.Intn(3) == 0 {
+				delHashes = append(delHashes, live[i])
+				dead = append(dead, live[i])
+				live = append(live[:i], live[i+1:]...)
+				i--
+			}
+		}
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bp.SortTargets()
+		if !f.VerifyBatchProof(bp) {
+			t.Fatalf("block %d batch proof didn't verify", b)
+		}
+		fbp, err := fp.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprintf("%v", fbp.Targets) != fmt.Sprintf("%v", bp.Targets) {
+			t.Fatalf("block %d forest targets %v full pollard %v",
+				b, bp.Targets, fbp.Targets)
+		}
+
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fp.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range adds {
+			live = append(live, a.Hash)
+		}
+
+		err = f.PosMapSanity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = fp.PosMapSanity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, h := range live {
+			if !f.FindLeaf(h) {
+				t.Fatalf("block %d can't find %x", b, h[:4])
+			}
+			pr, err := f.Prove(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !f.Verify(pr) {
+				t.Fatalf("block %d proof for %x didn't verify", b, h[:4])
+			}
+		}
+		for _, h := range dead {
+			if f.FindLeaf(h) {
+				t.Fatalf("block %d found deleted leaf %x", b, h[:4])
+			}
+		}
+	}
+	if len(f.positionMap.full) == 0 {
+		t.Fatalf("no collisions happened")
+	}
+}
@@ -0,0 +1,77 @@
+package accumulator
+
+import (
+	"crypto/sha256"
+)
+
+// Row hashing: almost all the hashing in the accumulator is computing a
+// whole row of parents, each from 64 bytes of children, none depending on
+// any other.  That's a good fit for multi-buffer sha256, where one set of
+// vector instructions runs several independent hashes side by side.
+// parentHashes is the entry point; it uses the multi-lane code on platforms
+// that have it (see rowhash_amd64.go) and falls back to hashing one at a
+// time with crypto/sha256.
+
+// parentHashes puts parentHash(lefts[i], rights[i]) in dst[i] for every i.
+// lefts and rights need to be at least as long as dst.  Like parentHash, it
+// panics if it's given an empty hash.
+func parentHashes(dst, lefts, rights []Hash) {
+	if multiLane {
+		parentHashesMulti(dst, lefts, rights)
+		return
+	}
+	parentHashesGeneric(dst, lefts, rights)
+}
+
+// parentHashesGeneric is the pure go version of parentHashes.  Same as calling
+// parentHash over and over, but without the allocation from append.
+func parentHashesGeneric(dst, lefts, rights []Hash) {
+	var buf [64]byte
+	for i := range dst {
+		checkEmptyChildren(lefts[i], rights[i])
+		copy(buf[:32], lefts[i][:])
+		copy(buf[32:], rights[i][:])
+		dst[i] = sha256.Sum256(buf[:])
+	}
+}
+
+// checkEmptyChildren panics the same way parentHash does
+func checkEmptyChildren(l, r Hash) {
+	if l == empty {
+		panic("got a left empty here. ")
+	}
+	if r == empty {
+		panic("got a right empty here. ")
+	}
+}
+
+// sha256 round constants, used by the multi-lane code
+var sha256K = [64]uint32{
+	0x428a2f98, 0x71374491, 0xb5c0fbcf, 0xe9b5dba5,
+	0x3956c25b, 0x59f111f1, 0x923f82a4, 0xab1c5ed5,
+	0xd807aa98, 0x12835b01, 0x243185be, 0x550c7dc3,
+	0x72be5d74, 0x80deb1fe, 0x9bdc06a7, 0xc19bf174,
+	0xe49b69c1, 0xefbe4786, 0x0fc19dc6, 0x240ca1cc,
+	0x2de92c6f, 0x4a7484aa, 0x5cb0a9dc, 0x76f988da,
+	0x983e5152, 0xa831c66d, 0xb00327c8, 0xbf597fc7,
+	0xc6e00bf3, 0xd5a79147, 0x06ca6351, 0x14292967,
+	0x27b70a85, 0x2e1b2138, 0x4d2c6dfc, 0x53380d13,
+	0x650a7354, 0x766a0abb, 0x81c2c92e, 0x92722c85,
+	0xa2bfe8a1, 0xa81a664b, 0xc24b8b70, 0xc76c51a3,
+	0xd192e819, 0xd6990624, 0xf40e3585, 0x106aa070,
+	0x19a4c116, 0x1e376c08, 0x2748774c, 0x34b0bcb5,
+	0x391c0cb3, 0x4ed8aa4a, 0x5b9cca4f, 0x682e6ff3,
+	0x748f82ee, 0x78a5636f, 0x84c87814, 0x8cc70208,
+	0x90befffa, 0xa4506ceb, 0xbef9a3f7, 0xc67178f2,
+}
+
+// sha256 initial state
+var sha256Init = [8]uint32{
+	0x6a09e667, 0xbb67ae85, 0x3c6ef372, 0xa54ff53a,
+	0x510e527f, 0x9b05688c, 0x1f83d9ab, 0x5be0cd19,
+}
+
+// sha256PadBlock is the second block of every 64 byte message: a 1 bit,
+// zeros, then the message length (512 bits).  It's the same for every
+// parent, so its message schedule only needs to be computed once.
+var sha256PadBlock = [16]uint32{0: 0x80000000, 15: 512}
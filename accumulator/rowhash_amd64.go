@@ -0,0 +1,112 @@
+package accumulator
+
+import (
+	"encoding/binary"
+)
+
+// On amd64 with AVX2, parents are hashed 8 at a time, one per 32 bit lane of
+// the ymm registers.  The assembly only does the sha256 compression; putting
+// the 8 messages into lanes (and taking the 8 digests back out) is done here.
+
+// multiLane is true if parentHashes should use the 8 lane AVX2 code.
+// Even on processors with the sha extensions (which crypto/sha256 uses) 8
+// lanes of AVX2 come out ahead; see BenchmarkParentHashes*
+var multiLane = haveAVX2
+
+var haveAVX2 = hasAVX2()
+
+// padWK is the message schedule (plus round constants) for the padding block,
+// the same in every lane.  initDigests is the sha256 initial state in every
+// lane.  Both are filled in at init if AVX2 is there.
+var padWK [64][8]uint32
+var initDigests [8][8]uint32
+
+func init() {
+	if !haveAVX2 {
+		return
+	}
+	for lane := 0; lane < 8; lane++ {
+		for t, w := range sha256PadBlock {
+			padWK[t][lane] = w
+		}
+		for j, s := range sha256Init {
+			initDigests[j][lane] = s
+		}
+	}
+	schedule8(&padWK, &sha256K)
+}
+
+// schedule8 expands the first 16 words of wk into the full 64 word sha256
+// message schedule for all 8 lanes, then adds the round constants in k.
+//
+//go:noescape
+func schedule8(wk *[64][8]uint32, k *[64]uint32)
+
+// rounds8 runs the 64 sha256 rounds for 8 lanes using the message schedule
+// from schedule8, and adds the result into digests.  digests[j][lane] is
+// state word j of lane.
+//
+//go:noescape
+func rounds8(digests *[8][8]uint32, wk *[64][8]uint32)
+
+func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+func xgetbv() (eax, edx uint32)
+
+// hasAVX2 checks both that the cpu has AVX2 and that the OS saves the ymm
+// registers.
+func hasAVX2() bool {
+	maxID, _, _, _ := cpuid(0, 0)
+	if maxID < 7 {
+		return false
+	}
+	_, _, ecx1, _ := cpuid(1, 0)
+	// need OSXSAVE (bit 27) to call xgetbv, and AVX (bit 28)
+	if ecx1&(1<<27) == 0 || ecx1&(1<<28) == 0 {
+		return false
+	}
+	// xmm (bit 1) and ymm (bit 2) state enabled by the OS
+	xcr0, _ := xgetbv()
+	if xcr0&6 != 6 {
+		return false
+	}
+	_, ebx7, _, _ := cpuid(7, 0)
+	return ebx7&(1<<5) != 0
+}
+
+// parentHashesMulti hashes 8 parents at a time, with the leftovers going
+// through the generic code.
+func parentHashesMulti(dst, lefts, rights []Hash) {
+	if !haveAVX2 {
+		parentHashesGeneric(dst, lefts, rights)
+		return
+	}
+	i := 0
+	for ; i+8 <= len(dst); i += 8 {
+		parentHashes8(dst[i:i+8], lefts[i:i+8], rights[i:i+8])
+	}
+	parentHashesGeneric(dst[i:], lefts[i:], rights[i:])
+}
+
+// parentHashes8 hashes exactly 8 parents using AVX2
+func parentHashes8(dst, lefts, rights []Hash) {
+	var wk [64][8]uint32
+	// put each message in its lane; the left child is the first 8 words and
+	// the right child is the next 8
+	for lane := 0; lane < 8; lane++ {
+		checkEmptyChildren(lefts[lane], rights[lane])
+		for t := 0; t < 8; t++ {
+			wk[t][lane] = binary.BigEndian.Uint32(lefts[lane][t*4:])
+			wk[t+8][lane] = binary.BigEndian.Uint32(rights[lane][t*4:])
+		}
+	}
+	digests := initDigests
+	schedule8(&wk, &sha256K)
+	rounds8(&digests, &wk)
+	rounds8(&digests, &padWK)
+
+	for lane := 0; lane < 8; lane++ {
+		for j := 0; j < 8; j++ {
+			binary.BigEndian.PutUint32(dst[lane][j*4:], digests[j][lane])
+		}
+	}
+}
@@ -0,0 +1,181 @@
+#include "textflag.h"
+
+// 8 lane sha256 compression using AVX2.  Each ymm register holds the same
+// state word (or message word) for 8 different messages.  See rowhash_amd64.go
+
+// ROUND does one sha256 round on all 8 lanes.  The w+k for this round is at
+// off(SI).  Y8, Y9 and Y10 are scratch.  Rather than shuffling registers
+// around, the new e goes into d's register and the new a goes into h's
+// register; the caller rotates the register arguments each round.
+//
+// T1 = h + S1(e) + Ch(e, f, g) + w + k
+// T2 = S0(a) + Maj(a, b, c)
+// d = d + T1
+// h = T1 + T2
+//
+// S1(e) = (e ror 6) ^ (e ror 11) ^ (e ror 25)
+// S0(a) = (a ror 2) ^ (a ror 13) ^ (a ror 22)
+// Ch(e, f, g) = (e & f) ^ (^e & g)
+// Maj(a, b, c) = ((a | b) & c) | (a & b)
+#define ROUND(a, b, c, d, e, f, g, h, off) \
+	VPADDD off(SI), h, Y8; \
+	VPSRLD $6, e, Y9; \
+	VPSLLD $26, e, Y10; \
+	VPXOR  Y10, Y9, Y9; \
+	VPSRLD $11, e, Y10; \
+	VPXOR  Y10, Y9, Y9; \
+	VPSLLD $21, e, Y10; \
+	VPXOR  Y10, Y9, Y9; \
+	VPSRLD $25, e, Y10; \
+	VPXOR  Y10, Y9, Y9; \
+	VPSLLD $7, e, Y10; \
+	VPXOR  Y10, Y9, Y9; \
+	VPADDD Y9, Y8, Y8; \
+	VPAND  f, e, Y9; \
+	VPANDN g, e, Y10; \
+	VPXOR  Y10, Y9, Y9; \
+	VPADDD Y9, Y8, Y8; \
+	VPADDD Y8, d, d; \
+	VPSRLD $2, a, Y9; \
+	VPSLLD $30, a, Y10; \
+	VPXOR  Y10, Y9, Y9; \
+	VPSRLD $13, a, Y10; \
+	VPXOR  Y10, Y9, Y9; \
+	VPSLLD $19, a, Y10; \
+	VPXOR  Y10, Y9, Y9; \
+	VPSRLD $22, a, Y10; \
+	VPXOR  Y10, Y9, Y9; \
+	VPSLLD $10, a, Y10; \
+	VPXOR  Y10, Y9, Y9; \
+	VPADDD Y9, Y8, Y8; \
+	VPOR   b, a, Y9; \
+	VPAND  c, Y9, Y9; \
+	VPAND  b, a, Y10; \
+	VPOR   Y10, Y9, Y9; \
+	VPADDD Y9, Y8, h
+
+// func schedule8(wk *[64][8]uint32, k *[64]uint32)
+TEXT ·schedule8(SB), NOSPLIT, $0-16
+	MOVQ wk+0(FP), DI
+	MOVQ k+8(FP), CX
+	MOVQ DI, BX
+	ADDQ $(16*32), DI // start at w[16]
+	ADDQ $(64*32), BX // stop after w[63]
+
+	// w[t] = s1(w[t-2]) + w[t-7] + s0(w[t-15]) + w[t-16]
+	// s0(x) = (x ror 7) ^ (x ror 18) ^ (x >> 3)
+	// s1(x) = (x ror 17) ^ (x ror 19) ^ (x >> 10)
+expand:
+	VMOVDQU -64(DI), Y0
+	VPSRLD  $17, Y0, Y1
+	VPSLLD  $15, Y0, Y2
+	VPXOR   Y2, Y1, Y1
+	VPSRLD  $19, Y0, Y2
+	VPXOR   Y2, Y1, Y1
+	VPSLLD  $13, Y0, Y2
+	VPXOR   Y2, Y1, Y1
+	VPSRLD  $10, Y0, Y2
+	VPXOR   Y2, Y1, Y1
+	VPADDD  -224(DI), Y1, Y1
+	VMOVDQU -480(DI), Y0
+	VPSRLD  $7, Y0, Y2
+	VPSLLD  $25, Y0, Y3
+	VPXOR   Y3, Y2, Y2
+	VPSRLD  $18, Y0, Y3
+	VPXOR   Y3, Y2, Y2
+	VPSLLD  $14, Y0, Y3
+	VPXOR   Y3, Y2, Y2
+	VPSRLD  $3, Y0, Y3
+	VPXOR   Y3, Y2, Y2
+	VPADDD  Y2, Y1, Y1
+	VPADDD  -512(DI), Y1, Y1
+	VMOVDQU Y1, (DI)
+	ADDQ    $32, DI
+	CMPQ    DI, BX
+	JNE     expand
+
+	// add k[t] to every lane of w[t]
+	SUBQ $(64*32), DI
+	MOVQ $64, DX
+
+addk:
+	VPBROADCASTD (CX), Y0
+	VPADDD       (DI), Y0, Y0
+	VMOVDQU      Y0, (DI)
+	ADDQ         $32, DI
+	ADDQ         $4, CX
+	DECQ         DX
+	JNZ          addk
+
+	VZEROUPPER
+	RET
+
+// func rounds8(digests *[8][8]uint32, wk *[64][8]uint32)
+TEXT ·rounds8(SB), NOSPLIT, $0-16
+	MOVQ digests+0(FP), DI
+	MOVQ wk+8(FP), SI
+
+	VMOVDQU (0*32)(DI), Y0
+	VMOVDQU (1*32)(DI), Y1
+	VMOVDQU (2*32)(DI), Y2
+	VMOVDQU (3*32)(DI), Y3
+	VMOVDQU (4*32)(DI), Y4
+	VMOVDQU (5*32)(DI), Y5
+	VMOVDQU (6*32)(DI), Y6
+	VMOVDQU (7*32)(DI), Y7
+
+	// 8 rounds per loop, so the registers are back where they started
+	MOVQ $8, DX
+
+loop:
+	ROUND(Y0, Y1, Y2, Y3, Y4, Y5, Y6, Y7, 0)
+	ROUND(Y7, Y0, Y1, Y2, Y3, Y4, Y5, Y6, 32)
+	ROUND(Y6, Y7, Y0, Y1, Y2, Y3, Y4, Y5, 64)
+	ROUND(Y5, Y6, Y7, Y0, Y1, Y2, Y3, Y4, 96)
+	ROUND(Y4, Y5, Y6, Y7, Y0, Y1, Y2, Y3, 128)
+	ROUND(Y3, Y4, Y5, Y6, Y7, Y0, Y1, Y2, 160)
+	ROUND(Y2, Y3, Y4, Y5, Y6, Y7, Y0, Y1, 192)
+	ROUND(Y1, Y2, Y3, Y4, Y5, Y6, Y7, Y0, 224)
+	ADDQ $256, SI
+	DECQ DX
+	JNZ  loop
+
+	// add this block's result to the digests
+	VPADDD  (0*32)(DI), Y0, Y0
+	VMOVDQU Y0, (0*32)(DI)
+	VPADDD  (1*32)(DI), Y1, Y1
+	VMOVDQU Y1, (1*32)(DI)
+	VPADDD  (2*32)(DI), Y2, Y2
+	VMOVDQU Y2, (2*32)(DI)
+	VPADDD  (3*32)(DI), Y3, Y3
+	VMOVDQU Y3, (3*32)(DI)
+	VPADDD  (4*32)(DI), Y4, Y4
+	VMOVDQU Y4, (4*32)(DI)
+	VPADDD  (5*32)(DI), Y5, Y5
+	VMOVDQU Y5, (5*32)(DI)
+	VPADDD  (6*32)(DI), Y6, Y6
+	VMOVDQU Y6, (6*32)(DI)
+	VPADDD  (7*32)(DI), Y7, Y7
+	VMOVDQU Y7, (7*32)(DI)
+
+	VZEROUPPER
+	RET
+
+// func cpuid(eaxArg, ecxArg uint32) (eax, ebx, ecx, edx uint32)
+TEXT ·cpuid(SB), NOSPLIT, $0-24
+	MOVL eaxArg+0(FP), AX
+	MOVL ecxArg+4(FP), CX
+	CPUID
+	MOVL AX, eax+8(FP)
+	MOVL BX, ebx+12(FP)
+	MOVL CX, ecx+16(FP)
+	MOVL DX, edx+20(FP)
+	RET
+
+// func xgetbv() (eax, edx uint32)
+TEXT ·xgetbv(SB), NOSPLIT, $0-8
+	MOVL $0, CX
+	XGETBV
+	MOVL AX, eax+0(FP)
+	MOVL DX, edx+4(FP)
+	RET
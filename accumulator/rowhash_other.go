@@ -0,0 +1,12 @@
+//go:build !amd64
+// +build !amd64
+
+package accumulator
+
+// No multi-lane hashing on this platform; parentHashes always uses the
+// generic code.
+var multiLane = false
+
+func parentHashesMulti(dst, lefts, rights []Hash) {
+	parentHashesGeneric(dst, lefts, rights)
+}
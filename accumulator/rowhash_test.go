@@ -0,0 +1,113 @@
+package accumulator
+
+import (
+	"fmt"
+	"testing"
+)
+
+// TestParentHashes checks that both the generic and multi-lane row hashing
+// give exactly the same output as parentHash
+func TestParentHashes(t *testing.T) {
+	for _, n := range []int{0, 1, 7, 8, 9, 16, 31, 100} {
+		lefts, rights := randomHashPairs(n)
+
+		generic := make([]Hash, n)
+		parentHashesGeneric(generic, lefts, rights)
+		multi := make([]Hash, n)
+		parentHashesMulti(multi, lefts, rights)
+		dispatched := make([]Hash, n)
+		parentHashes(dispatched, lefts, rights)
+
+		for i := 0; i < n; i++ {
+			want := parentHash(lefts[i], rights[i])
+			if generic[i] != want {
+				t.Fatalf("n %d generic hash %d got %x want %x",
+					n, i, generic[i], want)
+			}
+			if multi[i] != want {
+				t.Fatalf("n %d multi-lane hash %d got %x want %x",
+					n, i, multi[i], want)
+			}
+			if dispatched[i] != want {
+				t.Fatalf("n %d parentHashes %d got %x want %x",
+					n, i, dispatched[i], want)
+			}
+		}
+	}
+}
+
+// TestParentHashesEmpty makes sure empty children still panic like they do
+// in parentHash
+func TestParentHashesEmpty(t *testing.T) {
+	lefts, rights := randomHashPairs(8)
+	lefts[5] = empty
+	for _, hashFn := range []func(dst, l, r []Hash){
+		parentHashesGeneric, parentHashesMulti} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("no panic on empty left child")
+				}
+			}()
+			hashFn(make([]Hash, 8), lefts, rights)
+		}()
+	}
+}
+
+// TestMultiLaneForest runs the same blocks through a forest and pollard with
+// and without multi-lane hashing and makes sure the roots and proofs match
+func TestMultiLaneForest(t *testing.T) {
+	prevMulti := multiLane
+	defer func() { multiLane = prevMulti }()
+
+	// everything each block gives, as a string to compare
+	var runs [2][]string
+	for i, multi := range []bool{false, true} {
+		multiLane = multi
+		f := NewForest(nil)
+		var p Pollard
+		simBlocks(t, f, nil, 27, 100, func(b int, adds []Leaf, _ []Hash,
+			bp BatchProof) {
+
+			err := p.IngestBatchProof(bp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = p.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			runs[i] = append(runs[i], fmt.Sprintf("proof %v %x roots %x %x",
+				bp.Targets, bp.Proof, f.GetRoots(), p.GetRoots()))
+		})
+	}
+	for b := range runs[0] {
+		if runs[0][b] != runs[1][b] {
+			t.Fatalf("block %d generic:\n%s\nmulti-lane:\n%s",
+				b, runs[0][b], runs[1][b])
+		}
+	}
+}
+
+func benchParentHashes(b *testing.B, hashFn func(dst, l, r []Hash)) {
+	lefts, rights := randomHashPairs(1024)
+	dst := make([]Hash, 1024)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hashFn(dst, lefts, rights)
+	}
+}
+
+func BenchmarkParentHashOneAtATime(b *testing.B) {
+	benchParentHashes(b, func(dst, l, r []Hash) {
+		for i := range dst {
+			dst[i] = parentHash(l[i], r[i])
+		}
+	})
+}
+func BenchmarkParentHashesGeneric(b *testing.B) {
+	benchParentHashes(b, parentHashesGeneric)
+}
+func BenchmarkParentHashesMulti(b *testing.B) {
+	benchParentHashes(b, parentHashesMulti)
+}
@@ -0,0 +1,171 @@
+package accumulator
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A ForestSnapshot is a copy of everything in a forest, so it can be
+// written out while the forest keeps going.  It's mostly for forests in
+// ram, which have no file of their own to resume from.
+//
+// Written out it's all big endian: numLeaves (8) rows (1) deleteMode (1),
+// then for each row from the bottom the hashes that are there, which is
+// numLeaves>>row of them, then a sha256 of everything before (32).  Past
+// those there's nothing in a forest, so that's about half of what the forest
+// takes up.
+type ForestSnapshot struct {
+	numLeaves  uint64
+	rows       uint8
+	deleteMode DeleteMode
+	// hashes are the rows one after another
+	hashes []Hash
+}
+
+// Snapshot copies the forest.  It takes as much ram as the hashes in the
+// forest, up to half of what the forest does.
+func (f *Forest) Snapshot() *ForestSnapshot {
+	s := &ForestSnapshot{numLeaves: f.numLeaves, rows: f.rows,
+		deleteMode: f.deleteMode}
+	s.hashes = make([]Hash, 0, snapshotHashes(f.numLeaves, f.rows))
+	for h := uint8(0); h <= f.rows; h++ {
+		start := parentMany(0, h, f.rows)
+		for i := uint64(0); i < f.numLeaves>>h; i++ {
+			s.hashes = append(s.hashes, f.data.read(start+i))
+		}
+	}
+	return s
+}
+
+// snapshotHashes is how many hashes are in a snapshot
+func snapshotHashes(numLeaves uint64, rows uint8) uint64 {
+	var n uint64
+	for h := uint8(0); h <= rows; h++ {
+		n += numLeaves >> h
+	}
+	return n
+}
+
+// NumLeaves is how many leaves the forest had
+func (s *ForestSnapshot) NumLeaves() uint64 {
+	return s.numLeaves
+}
+
+// WriteTo writes the snapshot to w.  Doesn't sync or close anything.
+func (s *ForestSnapshot) WriteTo(w io.Writer) (int64, error) {
+	sum := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, sum))
+	var head bytes.Buffer
+	binary.Write(&head, binary.BigEndian, s.numLeaves)
+	head.WriteByte(s.rows)
+	head.WriteByte(byte(s.deleteMode))
+	n, err := bw.Write(head.Bytes())
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	for _, h := range s.hashes {
+		n, err = bw.Write(h[:])
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	err = bw.Flush()
+	if err != nil {
+		return written, err
+	}
+	n, err = w.Write(sum.Sum(nil))
+	return written + int64(n), err
+}
+
+// RestoreSnapshot makes a forest in ram from a snapshot written with
+// WriteTo, from where r is to its end.  The checksum has to match, and
+// there can't be anything after.  It reads the snapshot twice: once for the
+// checksum, so that nothing in a corrupt header gets used, then for real.
+func RestoreSnapshot(r io.ReadSeeker) (*Forest, error) {
+	begin, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+	size := end - begin
+	if size < 10+32 {
+		return nil, fmt.Errorf("snapshot only %d bytes", size)
+	}
+	_, err = r.Seek(begin, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.New()
+	_, err = io.CopyN(sum, r, size-32)
+	if err != nil {
+		return nil, err
+	}
+	var fileSum [32]byte
+	_, err = io.ReadFull(r, fileSum[:])
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(fileSum[:], sum.Sum(nil)) {
+		return nil, fmt.Errorf("snapshot checksum mismatch")
+	}
+	_, err = r.Seek(begin, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	var head [10]byte
+	_, err = io.ReadFull(br, head[:])
+	if err != nil {
+		return nil, err
+	}
+	f := new(Forest)
+	f.numLeaves = BtU64(head[:8])
+	f.rows = head[8]
+	f.deleteMode = DeleteMode(head[9])
+	if f.rows > 63 || f.numLeaves > 1<<f.rows {
+		return nil, fmt.Errorf("snapshot has %d leaves in %d rows",
+			f.numLeaves, f.rows)
+	}
+	if uint64(size-10-32)/32 != snapshotHashes(f.numLeaves, f.rows) ||
+		(size-10-32)%32 != 0 {
+		return nil, fmt.Errorf("snapshot is %d bytes, but has %d leaves "+
+			"in %d rows", size, f.numLeaves, f.rows)
+	}
+	err = f.deleteMode.Check()
+	if err != nil {
+		return nil, err
+	}
+
+	data := new(ramForestData)
+	data.resize(2 << f.rows)
+	for h := uint8(0); h <= f.rows; h++ {
+		start := parentMany(0, h, f.rows)
+		for i := uint64(0); i < f.numLeaves>>h; i++ {
+			_, err = io.ReadFull(br, data.m[start+i][:])
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	f.data = data
+
+	f.positionMap = newPositionIndex()
+	for pos := uint64(0); pos < f.numLeaves; pos++ {
+		h := f.data.read(pos)
+		if h == empty {
+			continue // deleted, in swapless mode
+		}
+		f.positionMap.set(h, pos, f.data)
+	}
+	return f, nil
+}
@@ -0,0 +1,108 @@
+package accumulator
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// TestSnapshot snapshots a forest, keeps going, then restores the snapshot
+// and runs it through the same blocks after, which should end up the same.
+func TestSnapshot(t *testing.T) {
+	for _, mode := range []DeleteMode{SwapDelete, SwaplessDelete} {
+		f := NewForest(nil)
+		f.SetDeleteMode(mode)
+		type block struct {
+			adds []Leaf
+			dels []Hash
+		}
+		var after []block
+		var snap *ForestSnapshot
+		var snapRoots []Hash
+		simBlocks(t, f, nil, 11, 100, func(b int, adds []Leaf,
+			delHashes []Hash, _ BatchProof) {
+
+			if snap != nil {
+				after = append(after, block{adds, delHashes})
+			}
+			if b == 60 {
+				snap = f.Snapshot()
+				snapRoots = f.GetRoots()
+			}
+		})
+
+		var buf bytes.Buffer
+		n, err := snap.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(buf.Len()) ||
+			n != 10+32*int64(len(snap.hashes))+32 {
+			t.Fatalf("wrote %d bytes, %d in buffer for %d hashes",
+				n, buf.Len(), len(snap.hashes))
+		}
+		f2, err := RestoreSnapshot(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f2.DeleteMode() != mode || f2.numLeaves != snap.NumLeaves() ||
+			!reflect.DeepEqual(f2.GetRoots(), snapRoots) {
+			t.Fatalf("%s restored %d leaves roots %x, expect %d %x", mode,
+				f2.numLeaves, f2.GetRoots(), snap.NumLeaves(), snapRoots)
+		}
+		err = f2.PosMapSanity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, blk := range after {
+			bp, err := f2.ProveBatch(blk.dels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bp.SortTargets()
+			_, err = f2.Modify(blk.adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !reflect.DeepEqual(f.GetRoots(), f2.GetRoots()) {
+			t.Fatalf("%s caught up roots %x, expect %x",
+				mode, f2.GetRoots(), f.GetRoots())
+		}
+	}
+}
+
+func TestSnapshotBad(t *testing.T) {
+	f := NewForest(nil)
+	adds := make([]Leaf, 11)
+	for i := range adds {
+		adds[i].Hash = Hash{byte(i), 0x46}
+	}
+	f.Modify(adds, nil)
+	var buf bytes.Buffer
+	_, err := f.Snapshot().WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good := buf.Bytes()
+
+	flipped := append([]byte{}, good...)
+	flipped[100] ^= 1
+	// too many rows to allocate, if it didn't check the checksum first
+	bigRows := append([]byte{}, good...)
+	bigRows[8] = 62
+	tests := map[string][]byte{
+		"flipped bit": flipped,
+		"rows":        bigRows,
+		"truncated":   good[:len(good)-1],
+		"extra byte":  append(append([]byte{}, good...), 0),
+		"too many leaves": append([]byte{0, 0, 0, 0, 0, 0, 0, 9, 3, 0},
+			good[10:]...),
+	}
+	for name, b := range tests {
+		_, err = RestoreSnapshot(bytes.NewReader(b))
+		if err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package accumulator
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// DeleteMode says what deleting leaves does to the accumulator
+type DeleteMode uint8
+
+const (
+	// SwapDelete fills in the deleted leaves by moving others over from the
+	// right, so the forest stays packed.  This is the default.
+	SwapDelete DeleteMode = iota
+	// SwaplessDelete leaves an empty hole where a deleted leaf was and
+	// doesn't move anything.  A parent with 1 empty child is hashed with
+	// the empty one as 32 zero bytes, so it still says where the other one
+	// is, and with 2 it's empty.  So once everything in a tree is deleted
+	// it's a zombie: its root is empty but it still takes up its spot, and
+	// numLeaves counts every leaf ever added.  Since leaves never move, a
+	// proof only changes by the hashes in it, and deleting only writes the
+	// path up from each leaf.
+	SwaplessDelete
+)
+
+func (m DeleteMode) String() string {
+	switch m {
+	case SwapDelete:
+		return "swap"
+	case SwaplessDelete:
+		return "swapless"
+	}
+	return fmt.Sprintf("DeleteMode(%d)", uint8(m))
+}
+
+// Check gives an error if m isn't a mode this knows about, like one read
+// from a file written by something newer
+func (m DeleteMode) Check() error {
+	if m > SwaplessDelete {
+		return fmt.Errorf("unknown delete mode %d", uint8(m))
+	}
+	return nil
+}
+
+// SetDeleteMode sets how the forest deletes.  It has to be set before
+// anything's added.
+func (f *Forest) SetDeleteMode(m DeleteMode) error {
+	err := m.Check()
+	if err != nil {
+		return err
+	}
+	if f.numLeaves != 0 {
+		return fmt.Errorf("can't change delete mode with %d leaves in forest",
+			f.numLeaves)
+	}
+	f.deleteMode = m
+	return nil
+}
+
+// DeleteMode is how the forest deletes
+func (f *Forest) DeleteMode() DeleteMode {
+	return f.deleteMode
+}
+
+// SetDeleteMode sets how the pollard deletes.  It has to be set before
+// anything's added, and has to match the forest it gets proofs from.
+func (p *Pollard) SetDeleteMode(m DeleteMode) error {
+	err := m.Check()
+	if err != nil {
+		return err
+	}
+	if p.numLeaves != 0 {
+		return fmt.Errorf("can't change delete mode with %d leaves in pollard",
+			p.numLeaves)
+	}
+	p.deleteMode = m
+	return nil
+}
+
+// DeleteMode is how the pollard deletes
+func (p *Pollard) DeleteMode() DeleteMode {
+	return p.deleteMode
+}
+
+// swaplessParent is the parent of l and r in swapless mode, if either is
+// empty: empty if both are, otherwise the hash of both with the empty one as
+// zeros.  That can't just be the other child, or a proof could put a leaf
+// anywhere under it.  ok is false if neither is empty, for parentHash.
+func swaplessParent(l, r Hash) (par Hash, ok bool) {
+	if l == empty && r == empty {
+		return empty, true
+	}
+	if l == empty || r == empty {
+		return sha256.Sum256(append(l[:], r[:]...)), true
+	}
+	return empty, false
+}
+
+// swaplessParentHashes is parentHashes, but parents with an empty child
+// come from swaplessParent instead of panicking
+func swaplessParentHashes(dst, lefts, rights []Hash) {
+	// hash the ones that have both children all at once
+	var both []int
+	var bothLefts, bothRights []Hash
+	for i := range dst {
+		par, ok := swaplessParent(lefts[i], rights[i])
+		if ok {
+			dst[i] = par
+			continue
+		}
+		both = append(both, i)
+		bothLefts = append(bothLefts, lefts[i])
+		bothRights = append(bothRights, rights[i])
+	}
+	if len(both) == len(dst) {
+		parentHashes(dst, lefts, rights)
+		return
+	}
+	results := make([]Hash, len(both))
+	parentHashes(results, bothLefts, bothRights)
+	for j, i := range both {
+		dst[i] = results[j]
+	}
+}
+
+// hashChildren is parentHashes for the delete mode, spread over
+// hashParallel
+func hashChildren(dst, lefts, rights []Hash, mode DeleteMode) {
+	hashFn := parentHashes
+	if mode == SwaplessDelete {
+		hashFn = swaplessParentHashes
+	}
+	hashParallel(len(dst), func(start, end int) {
+		hashFn(dst[start:end], lefts[start:end], rights[start:end])
+	})
+}
+
+// modifySwapless is Modify in swapless mode: empty out the deleted leaves,
+// hash up from them, then add
+func (f *Forest) modifySwapless(adds []Leaf, dels []uint64) (
+	*undoBlock, error) {
+
+	for _, d := range dels {
+		if d >= f.numLeaves {
+			return nil, fmt.Errorf(
+				"Trying to delete leaf at %d, beyond max %d", d, f.numLeaves)
+		}
+		if f.data.read(d) == empty {
+			return nil, fmt.Errorf("leaf at %d already deleted", d)
+		}
+	}
+	// remap to expand the forest if needed; deletes don't make room
+	for f.numLeaves+uint64(len(adds)) > 1<<f.rows {
+		err := f.reMap(f.rows + 1)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	ub := &undoBlock{numAdds: uint32(len(adds)),
+		positions: dels, hashes: make([]Hash, len(dels))}
+	var changes LeafChanges
+	for i, d := range dels {
+		ub.hashes[i] = f.data.read(d)
+		f.positionMap.del(ub.hashes[i])
+		f.data.write(d, empty)
+		if f.observer != nil {
+			changes.Deleted = append(changes.Deleted,
+				LeafPosition{Hash: ub.hashes[i], Pos: d})
+		}
+	}
+	f.hashUp(dels)
+
+	f.addv2(adds)
+
+	if f.observer != nil {
+		changes.addChanges(adds, f.numLeaves-uint64(len(adds)))
+		f.observer.LeavesChanged(changes)
+	}
+	return ub, nil
+}
+
+// hashUp hashes everything above the sorted leaf positions in dirt, up to
+// the roots
+func (f *Forest) hashUp(dirt []uint64) {
+	rootPositions, _ := getRootsReverse(f.numLeaves, f.rows)
+	roots := make(map[uint64]bool, len(rootPositions))
+	for _, r := range rootPositions {
+		roots[r] = true
+	}
+	for len(dirt) != 0 {
+		var nextRow []uint64
+		for _, pos := range dirt {
+			if roots[pos] {
+				continue
+			}
+			par := parent(pos, f.rows)
+			if len(nextRow) == 0 || nextRow[len(nextRow)-1] != par {
+				nextRow = append(nextRow, par)
+			}
+		}
+		// can't error; hashRow only returns nil
+		f.hashRow(nextRow)
+		dirt = nextRow
+	}
+}
+
+// undoSwapless is Undo in swapless mode: take the adds back out and put
+// the deleted leaves back where they were
+func (f *Forest) undoSwapless(ub undoBlock) error {
+	numAdds := uint64(ub.numAdds)
+	if numAdds > f.numLeaves {
+		return fmt.Errorf("can't undo %d adds, only %d leaves",
+			numAdds, f.numLeaves)
+	}
+	for pos := f.numLeaves - numAdds; pos < f.numLeaves; pos++ {
+		f.positionMap.del(f.data.read(pos))
+		f.data.write(pos, empty)
+	}
+	f.numLeaves -= numAdds
+	for i, pos := range ub.positions {
+		if pos >= f.numLeaves || f.data.read(pos) != empty {
+			return fmt.Errorf("can't put leaf back at %d", pos)
+		}
+		f.data.write(pos, ub.hashes[i])
+		f.positionMap.set(ub.hashes[i], pos, f.data)
+	}
+	f.hashUp(ub.positions)
+	return nil
+}
+
+// remSwapless is rem2 in swapless mode.  The pollard needs the proofs for
+// dels ingested first, so the paths up from them are there.
+func (p *Pollard) remSwapless(dels []uint64) error {
+	if len(dels) == 0 {
+		return nil
+	}
+	for _, d := range dels {
+		if d >= p.numLeaves {
+			return fmt.Errorf(
+				"Trying to delete leaf at %d, beyond max %d", d, p.numLeaves)
+		}
+		n, _, _, err := p.grabPos(d)
+		if err != nil {
+			return err
+		}
+		if n == nil || n.data == empty {
+			return fmt.Errorf("can't delete %d, not in pollard", d)
+		}
+		if p.positionMap != nil {
+			p.positionMap.del(n.data)
+		}
+		n.data = empty
+	}
+
+	rootPositions, _ := getRootsReverse(p.numLeaves, p.rows())
+	roots := make(map[uint64]bool, len(rootPositions))
+	for _, r := range rootPositions {
+		roots[r] = true
+	}
+	dirt := dels
+	for len(dirt) != 0 {
+		var nextRow []uint64
+		var hns []*hashableNode
+		for _, pos := range dirt {
+			if roots[pos] {
+				continue
+			}
+			par := parent(pos, p.rows())
+			if len(nextRow) != 0 && nextRow[len(nextRow)-1] == par {
+				continue
+			}
+			hn, err := p.hnFromPos(pos)
+			if err != nil {
+				return err
+			}
+			if hn == nil || hn.sib.niece[0] == nil || hn.sib.niece[1] == nil {
+				return fmt.Errorf("can't hash %d, missing children", par)
+			}
+			nextRow = append(nextRow, par)
+			hns = append(hns, hn)
+		}
+		lefts := make([]Hash, len(hns))
+		rights := make([]Hash, len(hns))
+		for i, hn := range hns {
+			lefts[i], rights[i] = hn.sib.niece[0].data, hn.sib.niece[1].data
+		}
+		results := make([]Hash, len(hns))
+		hashChildren(results, lefts, rights, SwaplessDelete)
+		for i, hn := range hns {
+			hn.dest.data = results[i]
+			if results[i] == empty {
+				// everything under it's deleted, no need to keep it
+				hn.sib.chop()
+			}
+		}
+		p.hashesEver += uint64(len(results))
+		dirt = nextRow
+	}
+	return nil
+}
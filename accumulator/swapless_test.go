@@ -0,0 +1,333 @@
+package accumulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// TestSwapless runs a swapless forest, pollard and full pollard through
+// a bunch of blocks, checking they agree, that the roots are what they
+// should be for the leaves left, and that no leaf ever moves.
+func TestSwapless(t *testing.T) {
+	f := NewForest(nil)
+	fp := NewFullPollard()
+	var p Pollard
+	for _, err := range []error{f.SetDeleteMode(SwaplessDelete),
+		fp.SetDeleteMode(SwaplessDelete), p.SetDeleteMode(SwaplessDelete)} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// every leaf ever added, with the deleted ones emptied
+	var leaves []Hash
+	where := make(map[Hash]uint64)
+	sn := NewSimChain(0x07)
+	sn.lookahead = 40
+	sn.NoImmortal = true
+	simBlocks(t, f, sn, 5, 300, func(b int, adds []Leaf, _ []Hash,
+		bp BatchProof) {
+
+		// checks the proof against the roots from before the block
+		err := p.IngestBatchProof(bp)
+		if err != nil {
+			t.Fatalf("block %d: %s", b, err.Error())
+		}
+		for _, pos := range bp.Targets {
+			leaves[pos] = empty
+		}
+
+		err = fp.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range adds {
+			where[a.Hash] = uint64(len(leaves))
+			leaves = append(leaves, a.Hash)
+		}
+
+		if f.numLeaves != uint64(len(leaves)) {
+			t.Fatalf("block %d forest has %d leaves, expect %d",
+				b, f.numLeaves, len(leaves))
+		}
+		want := fmt.Sprintf("%x", swaplessRoots(leaves))
+		for name, roots := range map[string][]Hash{"forest": f.GetRoots(),
+			"pollard": p.GetRoots(), "full pollard": fp.GetRoots()} {
+			if fmt.Sprintf("%x", roots) != want {
+				t.Fatalf("block %d %s roots %x, expect %s",
+					b, name, roots, want)
+			}
+		}
+		err = f.sanity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = f.PosMapSanity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for pos, h := range leaves {
+			if h == empty {
+				continue
+			}
+			got, ok := f.positionMap.get(h, f.data)
+			if !ok || got != where[h] {
+				t.Fatalf("block %d leaf %x added at %d now at %d",
+					b, h.Prefix(), where[h], got)
+			}
+			if fp.read(uint64(pos)) != h {
+				t.Fatalf("block %d full pollard doesn't have %x at %d",
+					b, h.Prefix(), pos)
+			}
+		}
+	})
+}
+
+// swaplessRoots works out the roots for leaves the slow way, smallest
+// first like GetRoots
+func swaplessRoots(leaves []Hash) []Hash {
+	var roots []Hash
+	end := len(leaves)
+	for h := uint8(0); 1<<h <= len(leaves); h++ {
+		size := 1 << h
+		if len(leaves)&size == 0 {
+			continue
+		}
+		roots = append(roots, swaplessTree(leaves[end-size:end]))
+		end -= size
+	}
+	return roots
+}
+
+func swaplessTree(leaves []Hash) Hash {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	l := swaplessTree(leaves[:len(leaves)/2])
+	r := swaplessTree(leaves[len(leaves)/2:])
+	if par, ok := swaplessParent(l, r); ok {
+		return par
+	}
+	return parentHash(l, r)
+}
+
+func TestSwaplessUndo(t *testing.T) {
+	f := NewForest(nil)
+	err := f.SetDeleteMode(SwaplessDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adds := make([]Leaf, 13)
+	for i := range adds {
+		adds[i].Hash = Hash{byte(i), 0x51}
+	}
+	_, err = f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.SetDeleteMode(SwapDelete)
+	if err == nil {
+		t.Fatalf("changed delete mode with leaves in")
+	}
+	before := f.GetRoots()
+
+	more := []Leaf{{Hash: Hash{1, 0x52}}, {Hash: Hash{2, 0x52}}}
+	ub, err := f.Modify(more, []uint64{0, 1, 6, 12})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Modify(nil, []uint64{1})
+	if err == nil {
+		t.Fatalf("deleted the same leaf twice")
+	}
+	err = f.Undo(*ub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(before, f.GetRoots()) {
+		t.Fatalf("roots after undo %x, expect %x", f.GetRoots(), before)
+	}
+	err = f.PosMapSanity()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSwaplessForgedProof deletes all but the first of 4 leaves, then checks
+// proofs that put it anywhere else don't verify.
+func TestSwaplessForgedProof(t *testing.T) {
+	f := NewForest(nil)
+	err := f.SetDeleteMode(SwaplessDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adds := make([]Leaf, 4)
+	for i := range adds {
+		adds[i].Hash = Hash{byte(i), 0x53}
+	}
+	_, err = f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Modify(nil, []uint64{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := adds[0].Hash
+	roots := f.GetRoots()
+
+	ok, _ := verifyBatchProof(BatchProof{Targets: []uint64{0},
+		Proof: []Hash{a, empty, empty}}, roots, 4, 2, SwaplessDelete)
+	if !ok {
+		t.Fatalf("real proof for leaf 0 didn't verify")
+	}
+	for _, bp := range []BatchProof{
+		{Targets: []uint64{1}, Proof: []Hash{empty, a, empty}},
+		{Targets: []uint64{2}, Proof: []Hash{a, empty, empty}},
+		{Targets: []uint64{3}, Proof: []Hash{empty, a, empty}},
+	} {
+		ok, _ := verifyBatchProof(
+			bp, roots, 4, 2, SwaplessDelete)
+		if ok {
+			t.Fatalf("leaf 0 proven at %d", bp.Targets[0])
+		}
+	}
+}
+
+// TestSwaplessRestore writes out a swapless forest and pollard and reads
+// them back
+func TestSwaplessRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "swapless")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	open := func(name string) *os.File {
+		file, err := os.OpenFile(dir+"/"+name, os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	forestFile := open("forest")
+	f := NewForest(forestFile)
+	var p Pollard
+	f.SetDeleteMode(SwaplessDelete)
+	p.SetDeleteMode(SwaplessDelete)
+	adds := make([]Leaf, 21)
+	for i := range adds {
+		adds[i].Hash = Hash{byte(i), 0x53}
+	}
+	f.Modify(adds, nil)
+	p.Modify(adds, nil)
+	bp, err := f.ProveBatch([]Hash{adds[4].Hash, adds[20].Hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.IngestBatchProof(bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Modify(nil, bp.Targets)
+	p.Modify(nil, bp.Targets)
+
+	miscFile := open("misc")
+	err = f.WriteForest(miscFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	miscFile.Seek(0, 0)
+	f2, err := RestoreForest(miscFile, forestFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f2.DeleteMode() != SwaplessDelete ||
+		!reflect.DeepEqual(f.GetRoots(), f2.GetRoots()) {
+		t.Fatalf("restored %s forest roots %x, expect %x",
+			f2.DeleteMode(), f2.GetRoots(), f.GetRoots())
+	}
+	err = f2.PosMapSanity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pollardFile := open("pollard")
+	err = p.WritePollard(pollardFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pollardFile.Seek(0, 0)
+	var p2 Pollard
+	err = p2.RestorePollard(pollardFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.DeleteMode() != SwaplessDelete ||
+		!reflect.DeepEqual(p.GetRoots(), p2.GetRoots()) {
+		t.Fatalf("restored %s pollard roots %x, expect %x",
+			p2.DeleteMode(), p2.GetRoots(), p.GetRoots())
+	}
+}
+
+// countingData counts the writes to forest data
+type countingData struct {
+	ForestData
+	writes uint64
+}
+
+func (cd *countingData) write(pos uint64, h Hash) {
+	cd.writes++
+	cd.ForestData.write(pos, h)
+}
+
+func (cd *countingData) swapHash(a, b uint64) {
+	cd.writes += 2
+	cd.ForestData.swapHash(a, b)
+}
+
+func (cd *countingData) swapHashRange(a, b, w uint64) {
+	cd.writes += 2 * w
+	cd.ForestData.swapHashRange(a, b, w)
+}
+
+// moveCounter counts how many leaves moved
+type moveCounter struct {
+	moved int
+}
+
+func (mc *moveCounter) LeavesChanged(c LeafChanges) {
+	mc.moved += len(c.Moved)
+}
+
+// TestSwaplessChurn runs the same blocks through a swapping and a
+// swapless forest and compares how much each writes and how many leaves
+// move, which means proofs to update.  Run with -v to see the numbers.
+func TestSwaplessChurn(t *testing.T) {
+	var moved [2]int
+	for _, mode := range []DeleteMode{SwapDelete, SwaplessDelete} {
+		f := NewForest(nil)
+		f.SetDeleteMode(mode)
+		cd := &countingData{ForestData: f.data}
+		f.data = cd
+		mc := new(moveCounter)
+		f.SetModifyObserver(mc)
+		simBlocks(t, f, nil, 7, 200, nil)
+		moved[mode] = mc.moved
+		t.Logf("%s: %d leaves %d writes %d leaves moved",
+			mode, f.numLeaves, cd.writes, mc.moved)
+	}
+	if moved[SwaplessDelete] != 0 {
+		t.Fatalf("%d leaves moved in swapless mode", moved[SwaplessDelete])
+	}
+	if moved[SwapDelete] == 0 {
+		t.Fatalf("no leaves moved in swap mode")
+	}
+}
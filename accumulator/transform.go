@@ -1,16 +1,35 @@
 package accumulator
 
-// remTrans returns a slice arrow in bottom row to top row.
-// also returns all "dirty" positions which need to be hashed after the swaps
+// remTrans2 returns a slice arrow in bottom row to top row: the swaps on each
+// row, with the row's collapse on the end if it moves anything.
 func remTrans2(dels []uint64, numLeaves uint64, forestRows uint8) [][]arrow {
+	swaps, collapses := removeTransform(dels, numLeaves, forestRows)
+
+	// merge slice of collapses, placing the collapses at the end of the row
+	// ... is that the right place to put them....?
+	for i, c := range collapses {
+		if len(c) == 1 && c[0].from != c[0].to {
+			swaps[i] = append(swaps[i], c[0])
+		}
+	}
+
+	return swaps
+}
+
+// removeTransform works out the swaps and collapses for deleting dels.
+// Swaps and collapses both go from the bottom row to the top.  There's 0 or 1
+// collapse per row; some of those don't move anything.
+func removeTransform(dels []uint64, numLeaves uint64, forestRows uint8) (
+	swaps, collapses [][]arrow) {
+
 	// calculate the number of leaves after deletion
 	nextNumLeaves := numLeaves - uint64(len(dels))
 
 	// Initialize swaps and collapses. Swaps are where a leaf should go
 	// collapses are for the roots
-	swaps := make([][]arrow, forestRows)
+	swaps = make([][]arrow, forestRows)
 	// a bit ugly: collapses also [][], but only have 1 or 0 things per row
-	collapses := make([][]arrow, forestRows)
+	collapses = make([][]arrow, forestRows)
 
 	// per forest row: 4 operations are executed
 	// sort / extract / swap / root / promote
@@ -84,15 +103,47 @@ func remTrans2(dels []uint64, numLeaves uint64, forestRows uint8) [][]arrow {
 	}
 	swapCollapses(swaps, collapses, forestRows)
 
-	// merge slice of collapses, placing the collapses at the end of the row
-	// ... is that the right place to put them....?
-	for i, c := range collapses {
-		if len(c) == 1 && c[0].from != c[0].to {
-			swaps[i] = append(swaps[i], c[0])
+	return swaps, collapses
+}
+
+// transformDirt gives the parents to hash after each row of swapRows is
+// done, so dirt[r] is on row r+1.  Parents above a node that moved are
+// dirty, and so are parents above dirty nodes, unless a swap to that dirty
+// spot already covers it.
+func transformDirt(
+	swapRows [][]arrow, numLeaves uint64, forestRows uint8) [][]uint64 {
+
+	dirt := make([][]uint64, forestRows)
+	var hashDirt []uint64
+	var prevHash uint64
+	for r := uint8(0); r < forestRows; r++ {
+		swaps := swapRows[r]
+		hashDirt = dedupeSwapDirt(hashDirt, swaps)
+		for len(swaps) != 0 || len(hashDirt) != 0 {
+			var hashDest uint64
+			// check if doing dirt. if not dirt, swap.
+			if len(swaps) == 0 ||
+				len(hashDirt) != 0 && hashDirt[0] > swaps[0].to {
+				hashDest = parent(hashDirt[0], forestRows)
+				hashDirt = hashDirt[1:]
+			} else {
+				hashDest = parent(swaps[0].to, forestRows)
+				swaps = swaps[1:]
+			}
+			if !inForest(hashDest, numLeaves, forestRows) || hashDest == 0 {
+				continue
+				// TODO would be great to use nextNumLeaves... but tricky
+			}
+			if hashDest == prevHash { // we just did this
+				continue // TODO this doesn't cover eveything
+			}
+			dirt[r] = append(dirt[r], hashDest)
+			prevHash = hashDest
 		}
+		// what got hashed is the dirt for the next row up
+		hashDirt = dirt[r]
 	}
-
-	return swaps
+	return dirt
 }
 
 // swapCollapses applies all swaps to lower collapses.
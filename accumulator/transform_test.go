@@ -2,6 +2,8 @@ package accumulator
 
 import (
 	"fmt"
+	"math/rand"
+	"reflect"
 	"testing"
 )
 
@@ -24,3 +26,166 @@ func TestGetTop(t *testing.T) {
 
 	fmt.Printf("%d leaves, top at h %d is %d\n", nl, h, root)
 }
+
+// TestTransformPlanReadme goes through the examples in transformreadme.md.
+// moves are what Moves gives for each row, and after is which of the
+// original leaves ends up at each position.
+func TestTransformPlanReadme(t *testing.T) {
+	tests := []struct {
+		name       string
+		numLeaves  uint64
+		forestRows uint8
+		dels       []uint64
+		moves      [][]Arrow
+		after      []uint64
+	}{
+		{
+			// 06 is a root and all under it goes
+			name: "delroot", numLeaves: 4, forestRows: 2,
+			dels:  []uint64{0, 1, 2, 3},
+			moves: [][]Arrow{nil, nil},
+			after: []uint64{},
+		},
+		{
+			// 04 and 05 go, so root 10 does too
+			name: "delroot row 1", numLeaves: 6, forestRows: 3,
+			dels:  []uint64{4, 5},
+			moves: [][]Arrow{nil, nil, nil},
+			after: []uint64{0, 1, 2, 3},
+		},
+		{
+			// 09 goes with 02 and 03.  08 is left alone so 13 moves over
+			// to be the big root, and 08 ends up a root where 10 was.
+			name: "twin", numLeaves: 8, forestRows: 3,
+			dels:  []uint64{2, 3},
+			moves: [][]Arrow{nil, nil, {{From: 13, To: 12}}},
+			after: []uint64{4, 5, 6, 7, 0, 1},
+		},
+		{
+			// 07 moves to 05
+			name: "swap", numLeaves: 8, forestRows: 3,
+			dels:  []uint64{5, 6},
+			moves: [][]Arrow{{{From: 7, To: 5}}, nil, nil},
+			after: []uint64{0, 1, 2, 3, 4, 7},
+		},
+		{
+			// 06 is a root and moves to 05
+			name: "root moves", numLeaves: 7, forestRows: 3,
+			dels:  []uint64{5},
+			moves: [][]Arrow{{{From: 6, To: 5}}, nil, nil},
+			after: []uint64{0, 1, 2, 3, 4, 6},
+		},
+		{
+			// 10 goes and 04 is a root where it is
+			name: "becomes root", numLeaves: 7, forestRows: 3,
+			dels:  []uint64{5, 6},
+			moves: [][]Arrow{nil, nil, nil},
+			after: []uint64{0, 1, 2, 3, 4},
+		},
+	}
+	for _, test := range tests {
+		tp, err := NewTransformPlan(test.dels, test.numLeaves, test.forestRows)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err.Error())
+		}
+		for r, want := range test.moves {
+			got := tp.Moves(uint8(r))
+			if len(got) != 0 || len(want) != 0 {
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("%s: row %d moves %v, expect %v",
+						test.name, r, got, want)
+				}
+			}
+		}
+		after := followLeafMoves(tp)
+		if !reflect.DeepEqual(after, test.after) {
+			t.Fatalf("%s: leaves end up %v, expect %v",
+				test.name, after, test.after)
+		}
+	}
+}
+
+// followLeafMoves applies the plan's leaf moves to a list of where each
+// leaf is, and gives the leaves left
+func followLeafMoves(tp TransformPlan) []uint64 {
+	leaves := make([]uint64, 1<<tp.ForestRows)
+	for i := range leaves {
+		leaves[i] = uint64(i)
+	}
+	for _, a := range tp.LeafMoves() {
+		leaves[a.From], leaves[a.To] = leaves[a.To], leaves[a.From]
+	}
+	return leaves[:tp.NextNumLeaves()]
+}
+
+// TestTransformPlanForest checks that following a plan's leaf moves puts
+// every leaf where the forest puts it, and that plans serialize
+func TestTransformPlanForest(t *testing.T) {
+	rand.Seed(6)
+	for i := 0; i < 300; i++ {
+		numLeaves := uint64(rand.Intn(200)) + 1
+		f := NewForest(nil)
+		adds := make([]Leaf, numLeaves)
+		for j := range adds {
+			adds[j].Hash = Hash{byte(j), byte(j >> 8), 0x77}
+		}
+		_, err := f.Modify(adds, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var dels []uint64
+		for pos := uint64(0); pos < numLeaves; pos++ {
+			if rand.Intn(3) == 0 {
+				dels = append(dels, pos)
+			}
+		}
+
+		tp, err := NewTransformPlan(dels, f.numLeaves, f.rows)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tp2, err := FromBytesTransformPlan(tp.ToBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tp, tp2) {
+			t.Fatalf("plan %+v came back from bytes as %+v", tp, tp2)
+		}
+
+		_, err = f.Modify(nil, dels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for pos, leaf := range followLeafMoves(tp) {
+			if f.data.read(uint64(pos)) != adds[leaf].Hash {
+				t.Fatalf("%d leaves del %v: plan has leaf %d at %d, "+
+					"forest has %x", numLeaves, dels, leaf, pos,
+					f.data.read(uint64(pos)).Prefix())
+			}
+		}
+	}
+}
+
+func TestTransformPlanErrors(t *testing.T) {
+	for _, dels := range [][]uint64{{3, 2}, {2, 2}, {8}} {
+		_, err := NewTransformPlan(dels, 8, 3)
+		if err == nil {
+			t.Fatalf("no error deleting %v", dels)
+		}
+	}
+	_, err := NewTransformPlan(nil, 9, 3)
+	if err == nil {
+		t.Fatalf("no error for 9 leaves in 3 rows")
+	}
+	tp, err := NewTransformPlan([]uint64{1, 4}, 7, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := tp.ToBytes()
+	for _, bad := range [][]byte{b[:len(b)-1], append(b, 0), b[:8]} {
+		_, err = FromBytesTransformPlan(bad)
+		if err == nil {
+			t.Fatalf("no error for %d bytes", len(bad))
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package accumulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// TransformPlan is what happens to the forest when leaves get deleted: which
+// nodes move where on each row, and which parents get hashed after.  It
+// only depends on the positions deleted and the size of the forest, so
+// anything keeping track of leaf positions outside the accumulator (wallets
+// holding proofs, block explorers) can make one and follow along without
+// having the forest.  It's the same transform the forest does in Modify.
+//
+// Moves happen row by row from the bottom.  On each row the swaps go first,
+// then the collapse, then that row's dirt gets hashed.  Moving a node takes
+// everything under it along, so LeafMoves gives the same thing at the
+// bottom row only.
+type TransformPlan struct {
+	// NumLeaves and ForestRows are the size of the forest before the
+	// deletion
+	NumLeaves  uint64
+	ForestRows uint8
+	// Dels are the leaf positions deleted, sorted
+	Dels []uint64
+	// Swaps are the nodes that trade places on each row
+	Swaps [][]Arrow
+	// Collapses are the roots that move to where the new roots go, 1 per
+	// row.  If From and To are the same nothing moves on that row.
+	Collapses []Arrow
+	// Dirt is the parents to hash once each row has moved.  Dirt[r] is on
+	// row r+1.
+	Dirt [][]uint64
+}
+
+// Arrow is a node moving from one position to another.  With a swap, the
+// node at To goes to From at the same time.
+type Arrow struct {
+	From, To uint64
+}
+
+// NewTransformPlan works out what happens to a forest with numLeaves leaves
+// and forestRows rows when the leaves at dels are deleted.  dels need to be
+// sorted.
+func NewTransformPlan(
+	dels []uint64, numLeaves uint64, forestRows uint8) (TransformPlan, error) {
+
+	tp := TransformPlan{NumLeaves: numLeaves, ForestRows: forestRows}
+	if forestRows > 63 || numLeaves > 1<<forestRows {
+		return tp, fmt.Errorf("%d leaves don't fit in %d rows",
+			numLeaves, forestRows)
+	}
+	if !checkSortedNoDupes(dels) {
+		return tp, fmt.Errorf("Deletions in incorrect order or duplicated")
+	}
+	if len(dels) != 0 && dels[len(dels)-1] >= numLeaves {
+		return tp, fmt.Errorf("Trying to delete leaf at %d, only %d leaves",
+			dels[len(dels)-1], numLeaves)
+	}
+	tp.Dels = append([]uint64(nil), dels...)
+
+	swaps, collapses := removeTransform(dels, numLeaves, forestRows)
+	tp.Swaps = make([][]Arrow, forestRows)
+	tp.Collapses = make([]Arrow, forestRows)
+	for r := range swaps {
+		for _, a := range swaps[r] {
+			tp.Swaps[r] = append(tp.Swaps[r], Arrow{From: a.from, To: a.to})
+		}
+		if len(collapses[r]) == 1 {
+			c := collapses[r][0]
+			tp.Collapses[r] = Arrow{From: c.from, To: c.to}
+		}
+	}
+	tp.Dirt = transformDirt(tp.moveRows(), numLeaves, forestRows)
+	return tp, nil
+}
+
+// NextNumLeaves is how many leaves are left after the deletion
+func (tp *TransformPlan) NextNumLeaves() uint64 {
+	return tp.NumLeaves - uint64(len(tp.Dels))
+}
+
+// Moves gives everything that moves on a row, in order: the swaps, then the
+// collapse if it goes anywhere
+func (tp *TransformPlan) Moves(row uint8) []Arrow {
+	if int(row) >= len(tp.Swaps) {
+		return nil
+	}
+	moves := append([]Arrow{}, tp.Swaps[row]...)
+	if int(row) < len(tp.Collapses) {
+		c := tp.Collapses[row]
+		if c.From != c.To {
+			moves = append(moves, c)
+		}
+	}
+	return moves
+}
+
+// LeafMoves gives all the moves expanded down to the leaves, in the order
+// they happen.  Swapping the leaves in a list of leaf positions in this
+// order leaves the remaining leaves at the positions they end up at, with
+// the deleted ones past NextNumLeaves.
+func (tp *TransformPlan) LeafMoves() []Arrow {
+	var leafMoves []Arrow
+	for r, row := range tp.moveRows() {
+		for _, a := range row {
+			for _, l := range a.toLeaves(uint8(r), tp.ForestRows) {
+				leafMoves = append(leafMoves, Arrow{From: l.from, To: l.to})
+			}
+		}
+	}
+	return leafMoves
+}
+
+// moveRows is Moves for every row, as the arrows the forest uses
+func (tp *TransformPlan) moveRows() [][]arrow {
+	rows := make([][]arrow, len(tp.Swaps))
+	for r := range rows {
+		for _, a := range tp.Moves(uint8(r)) {
+			rows[r] = append(rows[r], arrow{from: a.From, to: a.To})
+		}
+	}
+	return rows
+}
+
+// ToBytes gives the bytes for a TransformPlan.  All big endian:
+// numLeaves (8) forestRows (1) number of dels (4) dels (8 each), then for
+// each row: number of swaps (4) swaps (16 each) collapse (16)
+// number of dirt (4) dirt (8 each)
+func (tp *TransformPlan) ToBytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, tp.NumLeaves)
+	buf.WriteByte(tp.ForestRows)
+	binary.Write(&buf, binary.BigEndian, uint32(len(tp.Dels)))
+	binary.Write(&buf, binary.BigEndian, tp.Dels)
+	for r := 0; r < int(tp.ForestRows); r++ {
+		var swaps []Arrow
+		var collapse Arrow
+		var dirt []uint64
+		if r < len(tp.Swaps) {
+			swaps = tp.Swaps[r]
+		}
+		if r < len(tp.Collapses) {
+			collapse = tp.Collapses[r]
+		}
+		if r < len(tp.Dirt) {
+			dirt = tp.Dirt[r]
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(len(swaps)))
+		binary.Write(&buf, binary.BigEndian, swaps)
+		binary.Write(&buf, binary.BigEndian, collapse)
+		binary.Write(&buf, binary.BigEndian, uint32(len(dirt)))
+		binary.Write(&buf, binary.BigEndian, dirt)
+	}
+	return buf.Bytes()
+}
+
+// FromBytesTransformPlan gives a TransformPlan back from the serialized bytes
+func FromBytesTransformPlan(b []byte) (TransformPlan, error) {
+	var tp TransformPlan
+	buf := bytes.NewReader(b)
+	err := binary.Read(buf, binary.BigEndian, &tp.NumLeaves)
+	if err != nil {
+		return tp, err
+	}
+	tp.ForestRows, err = buf.ReadByte()
+	if err != nil {
+		return tp, err
+	}
+	if tp.ForestRows > 63 {
+		return tp, fmt.Errorf("transform plan has %d rows", tp.ForestRows)
+	}
+	tp.Dels, err = readUint64s(buf)
+	if err != nil {
+		return tp, err
+	}
+	tp.Swaps = make([][]Arrow, tp.ForestRows)
+	tp.Collapses = make([]Arrow, tp.ForestRows)
+	tp.Dirt = make([][]uint64, tp.ForestRows)
+	for r := range tp.Swaps {
+		var n uint32
+		err = binary.Read(buf, binary.BigEndian, &n)
+		if err != nil {
+			return tp, err
+		}
+		// each swap is 16 bytes; don't trust n past what's there
+		if int64(n)*16 > int64(buf.Len()) {
+			return tp, fmt.Errorf("row %d has %d swaps but only %d bytes left",
+				r, n, buf.Len())
+		}
+		if n != 0 {
+			tp.Swaps[r] = make([]Arrow, n)
+			err = binary.Read(buf, binary.BigEndian, tp.Swaps[r])
+			if err != nil {
+				return tp, err
+			}
+		}
+		err = binary.Read(buf, binary.BigEndian, &tp.Collapses[r])
+		if err != nil {
+			return tp, err
+		}
+		tp.Dirt[r], err = readUint64s(buf)
+		if err != nil {
+			return tp, err
+		}
+	}
+	if buf.Len() != 0 {
+		return tp, fmt.Errorf("%d extra bytes after transform plan", buf.Len())
+	}
+	return tp, nil
+}
+
+// readUint64s reads a 4 byte count and then that many uint64s
+func readUint64s(buf *bytes.Reader) ([]uint64, error) {
+	var n uint32
+	err := binary.Read(buf, binary.BigEndian, &n)
+	if err != nil {
+		return nil, err
+	}
+	if int64(n)*8 > int64(buf.Len()) {
+		return nil, fmt.Errorf("%d uint64s but only %d bytes left", n, buf.Len())
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	s := make([]uint64, n)
+	err = binary.Read(buf, binary.BigEndian, s)
+	return s, err
+}
@@ -28,6 +28,16 @@ func HashFromString(s string) Hash {
 	return sha256.Sum256([]byte(s))
 }
 
+// RootsCommitment is 1 hash of numLeaves and the roots, in the order
+// GetRoots gives them, so 2 accumulators can be compared by it
+func RootsCommitment(numLeaves uint64, roots []Hash) Hash {
+	b := U64tB(numLeaves)
+	for _, r := range roots {
+		b = append(b, r[:]...)
+	}
+	return sha256.Sum256(b)
+}
+
 // an arror describes the movement of a node from one position to another
 type arrow struct {
 	from, to uint64
@@ -73,9 +83,15 @@ type SimChain struct {
 	leafCounter  uint64
 	durationMask uint32
 	lookahead    int32
+
+	// NoImmortal makes every leaf get deleted eventually, including the
+	// first one, so the accumulator can go all the way down to 0 leaves.
+	NoImmortal bool
 }
 
-// NewSimChain :
+// NewSimChain makes a SimChain where leaves last up to duration blocks;
+// duration is a mask, like 0xff.  The first leaf added never gets deleted,
+// unless NoImmortal is set before the first block.
 func NewSimChain(duration uint32) *SimChain {
 	var s SimChain
 	s.blockHeight = -1
@@ -155,9 +171,14 @@ func (s *SimChain) NextBlock(numAdds uint32) ([]Leaf, []int32, []Hash) {
 		// which makes a leaf last forever, and the forest will expand
 		// over time.
 
-		// the first utxo added lives forever.
-		// (prevents leaves from going to 0 which is buggy)
-		if s.blockHeight == 0 {
+		// the first utxo added lives forever, unless NoImmortal is set.
+		// In that case nothing lives forever, and the number of leaves
+		// can go to 0 once in a while.
+		if s.NoImmortal {
+			if durations[j] == 0 {
+				durations[j] = 1
+			}
+		} else if s.blockHeight == 0 {
 			durations[j] = 0
 		}
 
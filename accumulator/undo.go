@@ -9,8 +9,6 @@ compact nodes can just keep old roots.
 although actually it can make sense for non-bridge nodes to undo as well...
 */
 
-// TODO in general, deal with numLeaves going to 0
-
 // blockUndo is all the data needed to undo a block: number of adds,
 // and all the hashes that got deleted and where they were from
 type undoBlock struct {
@@ -35,11 +33,21 @@ func (u *undoBlock) ToString() string {
 
 // Undo : undoes one block with the undoBlock
 func (f *Forest) Undo(ub undoBlock) error {
+	if f.deleteMode == SwaplessDelete {
+		return f.undoSwapless(ub)
+	}
 
 	prevAdds := uint64(ub.numAdds)
 	prevDels := uint64(len(ub.hashes))
 	// how many leaves were there at the last block?
 	prevNumLeaves := f.numLeaves + prevDels - prevAdds
+	// if the forest was compacted since, it might need to grow back
+	for prevNumLeaves > 1<<f.rows {
+		err := f.reMap(f.rows + 1)
+		if err != nil {
+			return err
+		}
+	}
 	// run the transform to figure out where things came from
 	leafMoves := floorTransform(ub.positions, prevNumLeaves, f.rows)
 	reverseArrowSlice(leafMoves)
@@ -57,9 +65,8 @@ func (f *Forest) Undo(ub undoBlock) error {
 
 	// remove everything between prevNumLeaves and numLeaves from positionMap
 	for p := f.numLeaves; p < f.numLeaves+prevAdds; p++ {
-		fmt.Printf("remove %x@%d from map\n",
-			f.data.read(p).Prefix(), f.positionMap[f.data.read(p).Mini()])
-		delete(f.positionMap, f.data.read(p).Mini())
+		fmt.Printf("remove %x@%d from map\n", f.data.read(p).Prefix(), p)
+		f.positionMap.del(f.data.read(p))
 	}
 
 	// also add everything past numleaves and prevnumleaves to dirt
@@ -90,21 +97,20 @@ func (f *Forest) Undo(ub undoBlock) error {
 	// the stuff we don't want has been moved to the right past the edge
 	for p := f.numLeaves; p < prevNumLeaves; p++ {
 		fmt.Printf("put back edge %x@%d from map\n", f.data.read(p).Prefix(), p)
-		f.positionMap[f.data.read(p).Mini()] = p
+		f.positionMap.set(f.data.read(p), p, f.data)
 	}
 	for _, p := range ub.positions {
 		fmt.Printf("put back internal %x@%d in map\n", f.data.read(p).Prefix(), p)
-		f.positionMap[f.data.read(p).Mini()] = p
+		f.positionMap.set(f.data.read(p), p, f.data)
 	}
 	for _, d := range dirt {
 		// everything that moved needs to have its position updated in the map
 		// TODO does it..?
-		m := f.data.read(d).Mini()
-		oldpos := f.positionMap[m]
-		if oldpos != d {
-			fmt.Printf("update map %x %d to %d\n", m[:4], oldpos, d)
-			delete(f.positionMap, m)
-			f.positionMap[m] = d
+		h := f.data.read(d)
+		oldpos, ok := f.positionMap.get(h, f.data)
+		if !ok || oldpos != d {
+			fmt.Printf("update map %x %d to %d\n", h[:4], oldpos, d)
+			f.positionMap.set(h, d, f.data)
 		}
 	}
 
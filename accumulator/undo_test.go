@@ -60,9 +60,7 @@ func undoOnceRandom(blocks int32) error {
 		}
 		fmt.Printf(f.ToString())
 		fmt.Printf(sc.ttlString())
-		for h, p := range f.positionMap {
-			fmt.Printf("%x@%d ", h[:4], p)
-		}
+		fmt.Printf("%s", f.positionMap.String())
 		err = f.PosMapSanity()
 		if err != nil {
 			return err
@@ -76,9 +74,7 @@ func undoOnceRandom(blocks int32) error {
 				return err
 			}
 			fmt.Printf("\n post undo map: ")
-			for h, p := range f.positionMap {
-				fmt.Printf("%x@%d ", h[:4], p)
-			}
+			fmt.Printf("%s", f.positionMap.String())
 			sc.BackOne(adds, durations, delHashes)
 		}
 
@@ -99,7 +95,7 @@ func undoAddDelOnce(numStart, numAdds, numDels uint32) error {
 		return err
 	}
 	fmt.Printf(f.ToString())
-	beforeTops := f.getRoots()
+	beforeTops := f.GetRoots()
 	for i, h := range beforeTops {
 		fmt.Printf("beforeTops %d %x\n", i, h)
 	}
@@ -127,7 +123,7 @@ func undoAddDelOnce(numStart, numAdds, numDels uint32) error {
 	}
 	fmt.Printf(f.ToString())
 	fmt.Printf(ub.ToString())
-	afterTops := f.getRoots()
+	afterTops := f.GetRoots()
 	for i, h := range afterTops {
 		fmt.Printf("afterTops %d %x\n", i, h)
 	}
@@ -137,13 +133,11 @@ func undoAddDelOnce(numStart, numAdds, numDels uint32) error {
 		return err
 	}
 
-	undoneTops := f.getRoots()
+	undoneTops := f.GetRoots()
 	for i, h := range undoneTops {
 		fmt.Printf("undoneTops %d %x\n", i, h)
 	}
-	for h, p := range f.positionMap {
-		fmt.Printf("%x@%d ", h[:4], p)
-	}
+	fmt.Printf("%s", f.positionMap.String())
 	fmt.Printf("tops: ")
 	for i, _ := range beforeTops {
 		fmt.Printf("pre %04x post %04x ", beforeTops[i][:4], undoneTops[i][:4])
@@ -170,3 +164,76 @@ func undoTestSimChain() error {
 	fmt.Printf(sc.ttlString())
 	return nil
 }
+
+// TestUndoEmpty undoes blocks in a forest that keeps running out of leaves
+func TestUndoEmpty(t *testing.T) {
+	for z := int64(0); z < 100; z++ {
+		rand.Seed(z)
+		err := undoEmptyRandom(60)
+		if err != nil {
+			fmt.Printf("rand seed %d\n", z)
+			t.Fatal(err)
+		}
+	}
+}
+
+func undoEmptyRandom(blocks int32) error {
+	f := NewForest(nil)
+
+	sc := NewSimChain(0x03)
+	sc.NoImmortal = true
+	emptied := 0
+	for b := int32(0); b < blocks; b++ {
+		numAdds := rand.Uint32() & 0x07
+		if numAdds > 3 {
+			numAdds = 0
+		}
+		adds, durations, delHashes := sc.NextBlock(numAdds)
+
+		prevLeaves := f.numLeaves
+		prevRoots := fmt.Sprintf("%x", f.GetRoots())
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		bp.SortTargets()
+		ub, err := f.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		if f.numLeaves == 0 {
+			emptied++
+		}
+		err = f.PosMapSanity()
+		if err != nil {
+			return err
+		}
+
+		// undo every other block, and make sure it's back where it was
+		if b%2 == 1 {
+			err := f.Undo(*ub)
+			if err != nil {
+				return err
+			}
+			if f.numLeaves != prevLeaves {
+				return fmt.Errorf("block %d undo gave %d leaves, expect %d",
+					sc.blockHeight, f.numLeaves, prevLeaves)
+			}
+			postRoots := fmt.Sprintf("%x", f.GetRoots())
+			if postRoots != prevRoots {
+				return fmt.Errorf("block %d undo roots %s, expect %s",
+					sc.blockHeight, postRoots, prevRoots)
+			}
+			err = f.PosMapSanity()
+			if err != nil {
+				return err
+			}
+			sc.BackOne(adds, durations, delHashes)
+		}
+	}
+	if emptied == 0 {
+		return fmt.Errorf("never got down to 0 leaves")
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+package accumulator
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// An undoLog keeps what was in a forest file before it got written over,
+// since the last time the log was cleared, so after a crash the file can be
+// put back how it was then with RollBackForest.  Each spot only needs
+// saving the first time it's written, so it's one entry per hash changed,
+// not per write.  Entries go to the log before the write they're for goes
+// to the forest file, so if the process dies, whatever got to the forest
+// file is in the log.
+//
+// On disk it's all big endian:
+// forest size in hashes (8) numLeaves (8) rows (1), as of the clear, then
+// for each spot written since: position (8) the hash that was there (32)
+type undoLog struct {
+	f *os.File
+	// size is how many hashes the forest file had when cleared; anything
+	// past that gets cut off on rollback, so doesn't need saving
+	size uint64
+	// saved is every position that's in the log already
+	saved map[uint64]bool
+	// end is where the next entry goes
+	end int64
+}
+
+const (
+	undoLogHeaderSize = 17
+	undoLogEntrySize  = 8 + leafSize
+)
+
+// clear starts the log over from the forest file as it is now, which is
+// size hashes and has numLeaves and rows
+func (u *undoLog) clear(size, numLeaves uint64, rows uint8) error {
+	err := u.f.Truncate(0)
+	if err != nil {
+		return err
+	}
+	b := append(U64tB(size), U64tB(numLeaves)...)
+	_, err = u.f.WriteAt(append(b, rows), 0)
+	if err != nil {
+		return err
+	}
+	u.size = size
+	u.saved = make(map[uint64]bool)
+	u.end = undoLogHeaderSize
+	return u.f.Sync()
+}
+
+// save logs what's in the forest file at the w positions from pos, before
+// they get written over.  Only the ones that weren't saved already and
+// were there at the clear go in.
+func (u *undoLog) save(forestFile *os.File, pos, w uint64) error {
+	var b []byte
+	for p := pos; p < pos+w && p < u.size; p++ {
+		if u.saved[p] {
+			continue
+		}
+		var h Hash
+		_, err := forestFile.ReadAt(h[:], int64(p*leafSize))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		b = append(b, U64tB(p)...)
+		b = append(b, h[:]...)
+		u.saved[p] = true
+	}
+	if len(b) == 0 {
+		return nil
+	}
+	_, err := u.f.WriteAt(b, u.end)
+	if err != nil {
+		return err
+	}
+	u.end += int64(len(b))
+	return nil
+}
+
+// SetUndoLog starts keeping how to put the forest file back to how it is
+// now in undoFile, so a crash before the next ClearUndoLog can be rolled
+// back with RollBackForest.  Anything in undoFile is dropped.  The forest
+// has to be in a file, and gets flushed first.  Closing the forest closes
+// undoFile.
+func (f *Forest) SetUndoLog(undoFile *os.File) error {
+	d := f.diskData()
+	if d == nil {
+		return fmt.Errorf("forest isn't in a file, no undo log")
+	}
+	d.undo = &undoLog{f: undoFile}
+	return f.ClearUndoLog()
+}
+
+// ClearUndoLog makes the forest as it is now the one RollBackForest goes
+// back to.  Call once the forest is saved.  Does nothing without an undo
+// log.
+func (f *Forest) ClearUndoLog() error {
+	d := f.diskData()
+	if d == nil || d.undo == nil {
+		return nil
+	}
+	// a hybrid forest's top rows need to be in the file
+	err := f.data.flush()
+	if err != nil {
+		return err
+	}
+	return d.undo.clear(d.size(), f.numLeaves, f.rows)
+}
+
+// diskData gives the part of the forest that's in a file, or nil for a
+// forest in ram
+func (f *Forest) diskData() *diskForestData {
+	switch d := f.data.(type) {
+	case *diskForestData:
+		return d
+	case *hybridForestData:
+		return &d.disk
+	}
+	return nil
+}
+
+// RollBackForest puts forestFile back how it was the last time the undo
+// log in undoFile was cleared, and the numLeaves and rows in
+// miscForestFile with it.  Then RestoreForest gives the forest from then.
+// Rolling back twice is the same as once, so a crash partway through can
+// just do it again.
+func RollBackForest(
+	miscForestFile, forestFile, undoFile *os.File) error {
+
+	b, err := readAllAt(undoFile)
+	if err != nil {
+		return err
+	}
+	if len(b) < undoLogHeaderSize {
+		return fmt.Errorf("undo log only %d bytes", len(b))
+	}
+	size := BtU64(b[:8])
+	head := b[8:undoLogHeaderSize]
+	b = b[undoLogHeaderSize:]
+	// a partial entry at the end is from a crash before its write, so it
+	// wasn't written over
+	for len(b) >= undoLogEntrySize {
+		pos := BtU64(b[:8])
+		if pos >= size {
+			return fmt.Errorf("undo log has position %d but "+
+				"forest was only %d", pos, size)
+		}
+		_, err = forestFile.WriteAt(
+			b[8:undoLogEntrySize], int64(pos*leafSize))
+		if err != nil {
+			return err
+		}
+		b = b[undoLogEntrySize:]
+	}
+	err = forestFile.Truncate(int64(size * leafSize))
+	if err != nil {
+		return err
+	}
+	err = forestFile.Sync()
+	if err != nil {
+		return err
+	}
+	// numLeaves and rows are the start of the misc file, and the delete
+	// mode after doesn't change
+	_, err = miscForestFile.WriteAt(head, 0)
+	if err != nil {
+		return err
+	}
+	return miscForestFile.Sync()
+}
+
+// readAllAt reads all of f from the start, wherever it's at
+func readAllAt(f *os.File) ([]byte, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, info.Size())
+	_, err = f.ReadAt(b, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	return b, err
+}
@@ -0,0 +1,113 @@
+package accumulator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRollBackForest saves a disk and a hybrid forest partway, keeps going
+// through remaps up and down, then drops them without saving like a crash
+// would, and checks rolling back gets the saved forest.
+func TestRollBackForest(t *testing.T) {
+	for _, budget := range []uint64{0, 8 * leafSize} {
+		err := testRollBackForest(t, budget)
+		if err != nil {
+			t.Fatalf("ram budget %d: %s", budget, err.Error())
+		}
+	}
+}
+
+func testRollBackForest(t *testing.T, budget uint64) error {
+	dir, err := ioutil.TempDir("", "undolog")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	var files [3]*os.File
+	for i, name := range []string{"misc", "forest", "undo"} {
+		files[i], err = os.OpenFile(filepath.Join(dir, name),
+			os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		defer files[i].Close()
+	}
+	miscFile, forestFile, undoFile := files[0], files[1], files[2]
+
+	var f *Forest
+	if budget == 0 {
+		f = NewForest(forestFile)
+	} else {
+		f = NewHybridForest(forestFile, budget)
+	}
+	err = f.SetUndoLog(undoFile)
+	if err != nil {
+		return err
+	}
+	var roots []Hash
+	var numLeaves uint64
+	var rows uint8
+	simBlocks(t, f, nil, 11, 80, func(b int, _ []Leaf, _ []Hash,
+		_ BatchProof) {
+
+		switch b {
+		case 30:
+			err = f.WriteForest(miscFile)
+			if err == nil {
+				err = f.ClearUndoLog()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			roots = f.GetRoots()
+			numLeaves, rows = f.ReconstructStats()
+		case 50, 70:
+			err = f.Compact()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	// the misc file can be past the checkpoint too
+	err = f.WriteForest(miscFile)
+	if err != nil {
+		return err
+	}
+	// half an entry, from a crash while writing it
+	_, err = undoFile.WriteAt(make([]byte, 20), f.diskData().undo.end)
+	if err != nil {
+		return err
+	}
+
+	// twice is the same as once
+	for i := 0; i < 2; i++ {
+		err = RollBackForest(miscFile, forestFile, undoFile)
+		if err != nil {
+			return err
+		}
+	}
+	miscFile.Seek(0, 0)
+	f2, err := RestoreForest(miscFile, forestFile)
+	if err != nil {
+		return err
+	}
+	nl, r := f2.ReconstructStats()
+	if nl != numLeaves || r != rows {
+		return fmt.Errorf("rolled back to %d leaves %d rows, "+
+			"expect %d %d", nl, r, numLeaves, rows)
+	}
+	if fmt.Sprintf("%x", f2.GetRoots()) != fmt.Sprintf("%x", roots) {
+		return fmt.Errorf("rolled back roots %x, expect %x",
+			f2.GetRoots(), roots)
+	}
+	report := f2.Fsck()
+	if len(report.BadNodes) != 0 || len(report.EmptyLeaves) != 0 {
+		return fmt.Errorf("rolled back forest has %d bad nodes "+
+			"%d empty leaves", len(report.BadNodes),
+			len(report.EmptyLeaves))
+	}
+	return nil
+}
@@ -272,6 +272,10 @@ func sortNodeSlice(s []node) {
 	sort.Slice(s, func(a, b int) bool { return s[a].Pos < s[b].Pos })
 }
 
+func sortLeafMoves(s []LeafMove) {
+	sort.Slice(s, func(a, b int) bool { return s[a].To < s[b].To })
+}
+
 // checkSortedNoDupes returns true for strictly increasing slices
 func checkSortedNoDupes(s []uint64) bool {
 	for i, _ := range s {
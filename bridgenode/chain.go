@@ -1,21 +1,20 @@
 package bridgenode
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
-	"sync"
 
-	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/util"
 )
 
-// initBridgeNodeState attempts to load and initialize the chain state from the disk.
-// If a chain state is not present, chain is initialized to the genesis
-// returns forest, height, lastIndexOffsetHeight, pOffset and error
-func initBridgeNodeState(
-	net wire.BitcoinNet, offsetFinished chan bool) (forest *accumulator.Forest,
-	height int32, lastIndexOffsetHeight int32, err error) {
+// initOffsetData makes sure there's an index of where the blocks are in the
+// blk*.dat and rev*.dat files, building it if needed.  Gives back the tip
+// height of the index.
+func initOffsetData(ctx context.Context, params *util.NetParams,
+	p *util.Paths) (lastIndexOffsetHeight int32, err error) {
 
 	// Default behavior is that the user should delete all offsetdata
 	// if they have new blk*.dat files to sync
@@ -25,84 +24,197 @@ func initBridgeNodeState(
 	// If either is incomplete or not complete, they're both removed and made
 	// anew
 	// Check if the offsetfiles for both rev*.dat and blk*.dat are present
-	if util.HasAccess(util.OffsetFilePath) && util.HasAccess(
-		util.RevOffsetFilePath) {
-		lastIndexOffsetHeight, err = restoreLastIndexOffsetHeight(
-			offsetFinished)
+	if util.HasAccess(p.OffsetFilePath) && util.HasAccess(
+		p.RevOffsetFilePath) {
+		return restoreLastIndexOffsetHeight(p)
+	}
+	fmt.Println("Offsetfile not present or half present." +
+		"Indexing offset for blocks blk*.dat files...")
+	lastIndexOffsetHeight, err = createOffsetData(ctx, params, p)
+	if err != nil {
+		return
+	}
+	fmt.Printf("tip height %d\n", lastIndexOffsetHeight)
+	return
+}
+
+// initBridgeNodeState attempts to load and initialize the chain state from the disk.
+// If a chain state is not present, chain is initialized to the genesis
+// returns forest, height and error
+func initBridgeNodeState(p *util.Paths, backend ForestBackend,
+	ramBudget uint64) (forest *accumulator.Forest, height int32, err error) {
+
+	// Check if the forestdata is present.  A forest in ram resumes from its
+	// snapshot, which has the checkpoint in it.
+	if backend == ForestRam && util.HasAccess(p.ForestSnapshotFilePath) {
+		fmt.Println("Has forest snapshot, resuming")
+		var cp checkpoint
+		forest, cp, err = restoreSnapshot(p)
 		if err != nil {
 			return
 		}
-	} else {
-		fmt.Println("Offsetfile not present or half present." +
-			"Indexing offset for blocks blk*.dat files...")
-		lastIndexOffsetHeight, err = createOffsetData(net, offsetFinished)
+		err = cp.checkForest(forest)
 		if err != nil {
 			return
 		}
-		fmt.Printf("tip height %d\n", lastIndexOffsetHeight)
-	}
-
-	// Check if the forestdata is present
-	if util.HasAccess(util.ForestFilePath) {
+		height = cp.height
+		err = cp.rollBackProofs(p.PFilePath, p.POffsetFilePath)
+		return
+	} else if backend != ForestRam && util.HasAccess(p.ForestFilePath) {
 		fmt.Println("Has access to forestdata, resuming")
-		forest, err = restoreForest()
+		forest, err = restoreForest(p, backend, ramBudget)
 		if err != nil {
 			return
 		}
-		height, err = restoreHeight()
+		height, err = restoreHeight(p)
 		if err != nil {
 			return
 		}
 	} else {
 		fmt.Println("Creating new forestdata")
-		forest, err = createForest()
+		forest, err = createForest(p, backend, ramBudget)
 		height = 1 // note that blocks start at 1, block 0 doesn't go into set
 		if err != nil {
 			return
 		}
+		// any proofs left over are for some other forest
+		cp := checkpoint{height: height}
+		err = cp.rollBackProofs(p.PFilePath, p.POffsetFilePath)
+		if err != nil {
+			return
+		}
+		if backend != ForestRam {
+			err = startUndoLog(p, forest)
+		}
+		return
 	}
 
+	// make sure the forest and proofs are from the same point
+	if !util.HasAccess(p.CheckpointFilePath) {
+		fmt.Println("No checkpoint, can't check forest and proofs match")
+		err = startUndoLog(p, forest)
+		return
+	}
+	cp, err := readCheckpoint(p.CheckpointFilePath)
+	if err != nil {
+		return
+	}
+	err = cp.checkForest(forest)
+	// blocks after the checkpoint changed the forest file, probably
+	// before a crash, so put it back how it was
+	if err != nil && util.HasAccess(p.ForestUndoFilePath) {
+		fmt.Printf("%s\nrolling forest back to the checkpoint at %d\n",
+			err.Error(), cp.height)
+		forest.Close()
+		forest, err = rollBackForest(p, backend, ramBudget)
+		if err != nil {
+			return
+		}
+		err = cp.checkForest(forest)
+	}
+	if err != nil {
+		forest.Close()
+		err = fmt.Errorf("%s\nforestdata was modified after the "+
+			"last checkpoint and can't be rolled back.  Remove %s "+
+			"and %s to start over",
+			err.Error(), p.ForestDirPath, p.ProofDirPath)
+		return
+	}
+	if cp.height != height {
+		fmt.Printf("height file says %d, checkpoint %d; "+
+			"using checkpoint\n", height, cp.height)
+		height = cp.height
+	}
+	err = cp.rollBackProofs(p.PFilePath, p.POffsetFilePath)
+	if err != nil {
+		return
+	}
+	err = startUndoLog(p, forest)
 	return
 }
 
 // saveBridgeNodeData saves the state of the bridgenode so that when the
 // user restarts, they'll be able to resume.
-// Saves height, forest fields, and pOffset
+// Saves height, forest fields, and a checkpoint.  All the proofs up to
+// height need to be written before calling this.
+// Everything is fsynced before the checkpoint is written, so if the
+// checkpoint is there, so is everything it points to.
 func saveBridgeNodeData(
-	forest *accumulator.Forest, height int32) error {
+	p *util.Paths, forest *accumulator.Forest, height int32) error {
 
-	var fileWait sync.WaitGroup
-	fileWait.Add(1)
-	go func() error {
-		heightFile, err := os.OpenFile(
-			util.ForestLastSyncedBlockHeightFilePath,
-			os.O_CREATE|os.O_RDWR, 0600)
-		if err != nil {
-			return err
+	err := forest.Flush()
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{p.PFilePath, p.POffsetFilePath} {
+		if !util.HasAccess(path) {
+			continue
 		}
-		_, err = heightFile.WriteAt(util.I32tB(height), 0)
+		err = util.SyncPath(path)
 		if err != nil {
 			return err
 		}
-		fileWait.Done()
-		return nil
-	}()
-	fileWait.Add(1)
+	}
+
+	heightFile, err := os.OpenFile(
+		p.ForestLastSyncedBlockHeightFilePath,
+		os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer heightFile.Close()
+	_, err = heightFile.WriteAt(util.I32tB(height), 0)
+	if err != nil {
+		return err
+	}
+	err = heightFile.Sync()
+	if err != nil {
+		return err
+	}
+
 	// write other misc forest data
-	go func() error {
-		miscForestFile, err := os.OpenFile(
-			util.MiscForestFilePath, os.O_CREATE|os.O_RDWR, 0600)
-		if err != nil {
-			return err
-		}
-		err = forest.WriteForest(miscForestFile)
+	miscForestFile, err := os.OpenFile(
+		p.MiscForestFilePath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer miscForestFile.Close()
+	err = forest.WriteForest(miscForestFile)
+	if err != nil {
+		return err
+	}
+	err = miscForestFile.Sync()
+	if err != nil {
+		return err
+	}
+
+	cp, err := makeCheckpoint(
+		forest, height, p.PFilePath, p.POffsetFilePath)
+	if err != nil {
+		return err
+	}
+	err = writeCheckpoint(p.CheckpointFilePath, cp)
+	if err != nil {
+		return err
+	}
+	// the forest won't need to go back to the checkpoint before now
+	return forest.ClearUndoLog()
+}
+
+// saveSnapshot writes the snapshot of a forest in ram, with the checkpoint
+// for it at the start, so a crash leaves either the old pair or the new
+// one.  The proofs up to the checkpoint need to be synced already.  It only
+// uses what it's given, so it can run in the background while the forest
+// keeps going.
+func saveSnapshot(p *util.Paths,
+	snap *accumulator.ForestSnapshot, cp checkpoint) error {
+
+	return util.WriteAtomic(p.ForestSnapshotFilePath, func(w io.Writer) error {
+		err := writeSnapshotCheckpoint(w, cp)
 		if err != nil {
 			return err
 		}
-		fileWait.Done()
-		return nil
-	}()
-
-	fileWait.Wait()
-	return nil
+		_, err = snap.WriteTo(w)
+		return err
+	})
 }
@@ -1,75 +1,81 @@
 package bridgenode
 
 import (
+	"context"
 	"os"
 
-	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/util"
 )
 
 // createOffsetData restores the offsetfile needed to index the
 // blocks in the raw blk*.dat and raw rev*.dat files.
-func createOffsetData(
-	net wire.BitcoinNet, offsetFinished chan bool) (
+func createOffsetData(ctx context.Context, params *util.NetParams,
+	p *util.Paths) (
 	lastIndexOffsetHeight int32, err error) {
 
-	// Set the Block Header hash
-	// buildOffsetFile matches the header hash to organize
-	// for blk*.dat files
-	hash, err := util.GenHashForNet(net)
+	err = util.BuildRevOffsetFile(p, params.Net)
 	if err != nil {
 		return 0, err
 	}
-
-	err = util.BuildRevOffsetFile()
+	// buildOffsetFile matches the header hashes starting from the genesis
+	// hash to organize for blk*.dat files
+	lastIndexOffsetHeight, err = buildOffsetFile(ctx, p, params)
 	if err != nil {
 		return 0, err
 	}
-	lastIndexOffsetHeight, err = buildOffsetFile(*hash)
-	if err != nil {
-		return 0, err
-	}
-
-	offsetFinished <- true
 
 	return
 }
 
-// createForest initializes forest
-func createForest() (forest *accumulator.Forest, err error) {
+// createForest initializes forest.  ramBudget is only for ForestHybrid.
+func createForest(p *util.Paths, backend ForestBackend, ramBudget uint64) (
+	forest *accumulator.Forest, err error) {
+
+	if backend == ForestRam {
+		return accumulator.NewForest(nil), nil
+	}
 
 	// Where the forestfile exists
 	forestFile, err := os.OpenFile(
-		util.ForestFilePath, os.O_CREATE|os.O_RDWR, 0600)
+		p.ForestFilePath, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return nil, err
 	}
 
 	// Restores all the forest data
+	if backend == ForestHybrid {
+		return accumulator.NewHybridForest(forestFile, ramBudget), nil
+	}
 	forest = accumulator.NewForest(forestFile)
 
 	return
 }
 
 // restoreForest restores forest fields based off the existing forestdata
-// on disk.
-func restoreForest() (forest *accumulator.Forest, err error) {
+// on disk.  ramBudget is only for ForestHybrid.
+func restoreForest(p *util.Paths, backend ForestBackend, ramBudget uint64) (
+	forest *accumulator.Forest, err error) {
 
 	// Where the forestfile exists
 	forestFile, err := os.OpenFile(
-		util.ForestFilePath, os.O_RDWR, 0400)
+		p.ForestFilePath, os.O_RDWR, 0400)
 	if err != nil {
 		return nil, err
 	}
 	// Where the misc forest data exists
 	miscForestFile, err := os.OpenFile(
-		util.MiscForestFilePath, os.O_RDONLY, 0400)
+		p.MiscForestFilePath, os.O_RDONLY, 0400)
 	if err != nil {
 		return nil, err
 	}
 
-	forest, err = accumulator.RestoreForest(miscForestFile, forestFile)
+	if backend == ForestHybrid {
+		forest, err = accumulator.RestoreHybridForest(
+			miscForestFile, forestFile, ramBudget)
+	} else {
+		forest, err = accumulator.RestoreForest(miscForestFile, forestFile)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -77,14 +83,69 @@ func restoreForest() (forest *accumulator.Forest, err error) {
 	return
 }
 
-// restoreHeight restores height from util.ForestLastSyncedBlockHeightFilePath
-func restoreHeight() (height int32, err error) {
+// startUndoLog has the forest keep how to go back to how it is now, which
+// should be the last checkpoint, in the forest undo file
+func startUndoLog(p *util.Paths, forest *accumulator.Forest) error {
+	undoFile, err := os.OpenFile(
+		p.ForestUndoFilePath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	err = forest.SetUndoLog(undoFile)
+	if err != nil {
+		undoFile.Close()
+	}
+	return err
+}
+
+// rollBackForest puts the forest files back to the last checkpoint with
+// the forest undo file, and restores the forest from them
+func rollBackForest(p *util.Paths, backend ForestBackend, ramBudget uint64) (
+	*accumulator.Forest, error) {
+
+	var files [3]*os.File
+	for i, path := range []string{p.MiscForestFilePath, p.ForestFilePath,
+		p.ForestUndoFilePath} {
+		f, err := os.OpenFile(path, os.O_RDWR, 0600)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		files[i] = f
+	}
+	err := accumulator.RollBackForest(files[0], files[1], files[2])
+	if err != nil {
+		return nil, err
+	}
+	return restoreForest(p, backend, ramBudget)
+}
+
+// restoreSnapshot restores a forest in ram from its snapshot, and gives
+// the checkpoint saved with it.  Doesn't check that they match.
+func restoreSnapshot(p *util.Paths) (
+	forest *accumulator.Forest, cp checkpoint, err error) {
+
+	snapFile, err := os.Open(p.ForestSnapshotFilePath)
+	if err != nil {
+		return
+	}
+	defer snapFile.Close()
+	cp, err = readSnapshotCheckpoint(snapFile)
+	if err != nil {
+		return
+	}
+	forest, err = accumulator.RestoreSnapshot(snapFile)
+	return
+}
+
+// restoreHeight restores height from p.ForestLastSyncedBlockHeightFilePath
+func restoreHeight(p *util.Paths) (height int32, err error) {
 
 	// if there is a heightfile, get the height from that
 	// heightFile saves the last block that was written to ttldb
-	if util.HasAccess(util.ForestLastSyncedBlockHeightFilePath) {
+	if util.HasAccess(p.ForestLastSyncedBlockHeightFilePath) {
 		heightFile, err := os.OpenFile(
-			util.ForestLastSyncedBlockHeightFilePath,
+			p.ForestLastSyncedBlockHeightFilePath,
 			os.O_RDONLY, 0400)
 		if err != nil {
 			return 0, err
@@ -100,7 +161,7 @@ func restoreHeight() (height int32, err error) {
 }
 
 // restoreLastIndexOffsetHeight restores the lastIndexOffsetHeight
-func restoreLastIndexOffsetHeight(offsetFinished chan bool) (
+func restoreLastIndexOffsetHeight(p *util.Paths) (
 	lastIndexOffsetHeight int32, err error) {
 
 	// grab the last block height from currentoffsetheight
@@ -108,7 +169,7 @@ func restoreLastIndexOffsetHeight(offsetFinished chan bool) (
 	var lastIndexOffsetHeightByte [4]byte
 
 	f, err := os.OpenFile(
-		util.LastIndexOffsetHeightFilePath, os.O_CREATE|os.O_RDWR, 0600)
+		p.LastIndexOffsetHeightFilePath, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return 0, err
 	}
@@ -120,9 +181,5 @@ func restoreLastIndexOffsetHeight(offsetFinished chan bool) (
 	f.Read(lastIndexOffsetHeightByte[:])
 	lastIndexOffsetHeight = util.BtI32(lastIndexOffsetHeightByte[:])
 
-	// if there is a offset file, we should pass true to offsetFinished
-	// to let stopParse() know that it shouldn't delete offsetfile
-	offsetFinished <- true
-
 	return
 }
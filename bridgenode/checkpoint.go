@@ -0,0 +1,209 @@
+package bridgenode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// A checkpoint records a point where all the bridgenode files agree with
+// each other: the forest, the height, and how much of the proof and proof
+// offset files was written.  The forest file and proof files are written as
+// genproofs goes, so after a crash they may be ahead of the last checkpoint;
+// the proof files get cut back to the checkpoint, and the forest file put
+// back with its undo log.
+//
+// On disk it's all big endian:
+// height (4) numLeaves (8) rows (1) proofLen (8) offsetLen (8)
+// numRoots (1) roots (32 each) sha256 of everything before (32)
+type checkpoint struct {
+	// height is the next block to process
+	height    int32
+	numLeaves uint64
+	rows      uint8
+	roots     []accumulator.Hash
+
+	// lengths of proof.dat and proofoffset.dat
+	proofLen  int64
+	offsetLen int64
+}
+
+// makeCheckpoint gets the checkpoint for the current state.  Call once
+// everything up to height has been written to the proof files.
+func makeCheckpoint(forest *accumulator.Forest, height int32,
+	proofPath, offsetPath string) (cp checkpoint, err error) {
+
+	cp.height = height
+	cp.numLeaves, cp.rows = forest.ReconstructStats()
+	cp.roots = forest.GetRoots()
+	cp.proofLen, err = fileLen(proofPath)
+	if err != nil {
+		return
+	}
+	cp.offsetLen, err = fileLen(offsetPath)
+	return
+}
+
+// fileLen gives the size of a file, or 0 if it doesn't exist yet
+func fileLen(path string) (int64, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (cp *checkpoint) serialize() []byte {
+	var buf bytes.Buffer
+	// errors writing to a bytes.Buffer are always nil
+	binary.Write(&buf, binary.BigEndian, cp.height)
+	binary.Write(&buf, binary.BigEndian, cp.numLeaves)
+	buf.WriteByte(cp.rows)
+	binary.Write(&buf, binary.BigEndian, cp.proofLen)
+	binary.Write(&buf, binary.BigEndian, cp.offsetLen)
+	buf.WriteByte(uint8(len(cp.roots)))
+	for _, r := range cp.roots {
+		buf.Write(r[:])
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+func deserializeCheckpoint(b []byte) (cp checkpoint, err error) {
+	// fixed part + checksum
+	if len(b) < 30+32 {
+		err = fmt.Errorf("checkpoint only %d bytes", len(b))
+		return
+	}
+	body, sum := b[:len(b)-32], b[len(b)-32:]
+	want := sha256.Sum256(body)
+	if !bytes.Equal(want[:], sum) {
+		err = fmt.Errorf("checkpoint checksum mismatch")
+		return
+	}
+
+	buf := bytes.NewBuffer(body)
+	binary.Read(buf, binary.BigEndian, &cp.height)
+	binary.Read(buf, binary.BigEndian, &cp.numLeaves)
+	cp.rows, _ = buf.ReadByte()
+	binary.Read(buf, binary.BigEndian, &cp.proofLen)
+	binary.Read(buf, binary.BigEndian, &cp.offsetLen)
+	numRoots, _ := buf.ReadByte()
+	if buf.Len() != int(numRoots)*32 {
+		err = fmt.Errorf("checkpoint has %d roots but %d bytes left",
+			numRoots, buf.Len())
+		return
+	}
+	cp.roots = make([]accumulator.Hash, numRoots)
+	for i := range cp.roots {
+		copy(cp.roots[i][:], buf.Next(32))
+	}
+	return
+}
+
+// writeCheckpoint atomically replaces the checkpoint file.  It writes to a
+// temp file, fsyncs, and renames over the old one, so there's always either
+// the old or the new checkpoint there, never half of one.
+func writeCheckpoint(path string, cp checkpoint) error {
+	return util.WriteFileAtomic(path, cp.serialize())
+}
+
+// readCheckpoint reads the checkpoint at path
+func readCheckpoint(path string) (cp checkpoint, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	return deserializeCheckpoint(b)
+}
+
+// A forest in ram keeps its checkpoint at the start of the snapshot file
+// instead of in the checkpoint file, so the two get replaced together: the
+// checkpoint's length (2) then the checkpoint, then the forest snapshot.
+
+// writeSnapshotCheckpoint writes cp to the start of a snapshot file
+func writeSnapshotCheckpoint(w io.Writer, cp checkpoint) error {
+	b := cp.serialize()
+	var l [2]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(b)))
+	_, err := w.Write(append(l[:], b...))
+	return err
+}
+
+// readSnapshotCheckpoint reads the checkpoint at the start of a snapshot
+// file, leaving r at the forest snapshot
+func readSnapshotCheckpoint(r io.Reader) (cp checkpoint, err error) {
+	var l [2]byte
+	_, err = io.ReadFull(r, l[:])
+	if err != nil {
+		return
+	}
+	b := make([]byte, binary.BigEndian.Uint16(l[:]))
+	_, err = io.ReadFull(r, b)
+	if err != nil {
+		return
+	}
+	return deserializeCheckpoint(b)
+}
+
+// checkForest makes sure the forest is the one the checkpoint was made with
+func (cp *checkpoint) checkForest(forest *accumulator.Forest) error {
+	numLeaves, rows := forest.ReconstructStats()
+	if numLeaves != cp.numLeaves || rows != cp.rows {
+		return fmt.Errorf("forest has %d leaves %d rows, "+
+			"checkpoint at height %d has %d leaves %d rows",
+			numLeaves, rows, cp.height, cp.numLeaves, cp.rows)
+	}
+	roots := forest.GetRoots()
+	if len(roots) != len(cp.roots) {
+		return fmt.Errorf("forest has %d roots, checkpoint has %d",
+			len(roots), len(cp.roots))
+	}
+	for i, r := range roots {
+		if r != cp.roots[i] {
+			return fmt.Errorf("forest root %d is %x, checkpoint has %x",
+				i, r[:4], cp.roots[i][:4])
+		}
+	}
+	return nil
+}
+
+// rollBackProofs cuts the proof and proof offset files back to where they
+// were at the checkpoint.  Anything past that is from blocks after the
+// checkpoint, which will be done again.
+func (cp *checkpoint) rollBackProofs(proofPath, offsetPath string) error {
+	for _, f := range []struct {
+		path string
+		size int64
+	}{{proofPath, cp.proofLen}, {offsetPath, cp.offsetLen}} {
+		size, err := fileLen(f.path)
+		if err != nil {
+			return err
+		}
+		if size < f.size {
+			return fmt.Errorf("%s is %d bytes but checkpoint at height %d "+
+				"has %d bytes", f.path, size, cp.height, f.size)
+		}
+		if size == f.size {
+			continue
+		}
+		fmt.Printf("rolling %s back from %d to %d bytes\n",
+			f.path, size, f.size)
+		err = os.Truncate(f.path, f.size)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
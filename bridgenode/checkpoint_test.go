@@ -0,0 +1,155 @@
+package bridgenode
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+func testForest(t *testing.T, n int) *accumulator.Forest {
+	f := accumulator.NewForest(nil)
+	adds := make([]accumulator.Leaf, n)
+	for i := range adds {
+		adds[i].Hash[0] = uint8(i)
+		adds[i].Hash[1] = 0xaa
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	proofPath := filepath.Join(dir, "proof.dat")
+	offsetPath := filepath.Join(dir, "proofoffset.dat")
+	cpPath := filepath.Join(dir, "checkpoint.dat")
+
+	err = ioutil.WriteFile(proofPath, make([]byte, 100), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(offsetPath, make([]byte, 16), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := testForest(t, 11)
+	cp, err := makeCheckpoint(f, 3, proofPath, offsetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeCheckpoint(cpPath, cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readCheckpoint(cpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cp, got) {
+		t.Fatalf("wrote %+v read %+v", cp, got)
+	}
+	err = got.checkForest(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a forest that kept going after the checkpoint doesn't match
+	_, err = f.Modify([]accumulator.Leaf{{Hash: accumulator.Hash{0xff}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.checkForest(f) == nil {
+		t.Fatalf("checkpoint matched modified forest")
+	}
+
+	// proofs written after the checkpoint get cut off
+	err = ioutil.WriteFile(proofPath, make([]byte, 150), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = got.rollBackProofs(proofPath, offsetPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size, err := fileLen(proofPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != 100 {
+		t.Fatalf("proof file %d bytes after roll back, expect 100", size)
+	}
+
+	// but missing proofs can't be made up
+	err = os.Truncate(offsetPath, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.rollBackProofs(proofPath, offsetPath) == nil {
+		t.Fatalf("no error with short offset file")
+	}
+}
+
+// TestSnapshotCheckpoint saves a snapshot and checks the checkpoint and
+// forest both come back from it
+func TestSnapshotCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := util.NewPaths(dir, "")
+	err = os.MkdirAll(p.ForestDirPath, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := testForest(t, 11)
+	cp := checkpoint{height: 3, proofLen: 100, offsetLen: 16}
+	cp.numLeaves, cp.rows = f.ReconstructStats()
+	cp.roots = f.GetRoots()
+	err = saveSnapshot(p, f.Snapshot(), cp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, gotCP, err := restoreSnapshot(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(cp, gotCP) {
+		t.Fatalf("wrote %+v read %+v", cp, gotCP)
+	}
+	err = gotCP.checkForest(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckpointCorrupt(t *testing.T) {
+	cp := checkpoint{height: 7, numLeaves: 3, rows: 2,
+		roots: []accumulator.Hash{{1}, {2}}, proofLen: 5, offsetLen: 48}
+	b := cp.serialize()
+	for i := range b {
+		b[i] ^= 0x10
+		_, err := deserializeCheckpoint(b)
+		if err == nil {
+			t.Fatalf("no error with byte %d changed", i)
+		}
+		b[i] ^= 0x10
+	}
+	_, err := deserializeCheckpoint(b[:len(b)-1])
+	if err == nil {
+		t.Fatalf("no error on truncated checkpoint")
+	}
+}
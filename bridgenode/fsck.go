@@ -0,0 +1,252 @@
+package bridgenode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// fsckMaxPrint is how many problems Fsck prints
+const fsckMaxPrint = 100
+
+// Fsck checks that the files a bridge node left in dataDir agree with each
+// other.  Every hash in the forest is worked out again from the leaves and
+// compared to what's there, the roots and sizes are checked against the
+// checkpoint, and the proof files against the checkpoint's height.  A
+// forest in ram has its checkpoint in its snapshot.  The position map isn't
+// saved, it's made from the leaves when loading, so that's only checked for
+// duplicate leaves.  It prints everything wrong it finds, with positions,
+// and returns an error if there was anything.
+//
+// With repair, forest hashes above the leaves that are wrong get rewritten,
+// as long as the roots from the leaves match the checkpoint.  Leaves can't
+// be repaired.  Don't run it on a data dir a node is using.
+func Fsck(dataDir string, repair bool) error {
+	p := util.NewPaths(dataDir, "")
+	var forest *accumulator.Forest
+	var err error
+	var cp checkpoint
+	fromSnapshot, haveCP := false, false
+	switch {
+	case util.HasAccess(p.ForestFilePath):
+		forest, err = restoreForest(p, ForestDisk, 0)
+	case util.HasAccess(p.ForestSnapshotFilePath):
+		// the snapshot has its checkpoint in it
+		forest, cp, err = restoreSnapshot(p)
+		fromSnapshot, haveCP = true, true
+	default:
+		return fmt.Errorf("no forest in %s", p.ForestDirPath)
+	}
+	if err != nil {
+		return err
+	}
+	defer forest.Close()
+
+	var problems int
+	problem := func(format string, a ...interface{}) {
+		problems++
+		if problems <= fsckMaxPrint {
+			fmt.Printf("BAD "+format+"\n", a...)
+		}
+	}
+
+	numLeaves, rows := forest.ReconstructStats()
+	fmt.Printf("forest has %d leaves %d rows, %s\n",
+		numLeaves, rows, forest.DeleteMode())
+	if !fromSnapshot {
+		info, err := os.Stat(p.ForestFilePath)
+		if err != nil {
+			return err
+		}
+		// positions go up to 2<<rows - 2
+		need := int64(2<<rows-1) * 32
+		if info.Size() < need {
+			problem("forest file is %d bytes, %d rows needs %d",
+				info.Size(), rows, need)
+		}
+	}
+
+	report := forest.Fsck()
+	for _, b := range report.BadNodes {
+		problem("forest row %d position %d is %x, should be %x",
+			b.Row, b.Pos, b.Stored.Prefix(), b.Computed.Prefix())
+	}
+	for _, pos := range report.EmptyLeaves {
+		problem("forest leaf at %d is empty", pos)
+	}
+	// the position map was just made from the leaves, so all this can
+	// find is a leaf that's the same as another
+	for _, pos := range report.PosMapWrong {
+		problem("forest leaf at %d is a duplicate of another leaf", pos)
+	}
+	if report.PosMapExtra != 0 {
+		problem("position map has %d more leaves than the forest",
+			report.PosMapExtra)
+	}
+
+	if !fromSnapshot {
+		if !util.HasAccess(p.CheckpointFilePath) {
+			fmt.Println("no checkpoint, can't check roots or proofs")
+		} else {
+			cp, err = readCheckpoint(p.CheckpointFilePath)
+			if err != nil {
+				problem("checkpoint: %s", err.Error())
+			} else {
+				haveCP = true
+			}
+		}
+	}
+	rootsMatch := false
+	if haveCP {
+		rootsMatch = fsckCheckpoint(cp, report, forest, problem)
+		err = fsckProofs(p, cp, problem)
+		if err != nil {
+			return err
+		}
+		if !fromSnapshot {
+			height, err := restoreHeight(p)
+			if err != nil {
+				return err
+			}
+			if height != cp.height {
+				fmt.Printf("height file says %d, checkpoint %d; "+
+					"resuming uses the checkpoint\n", height, cp.height)
+			}
+		}
+	}
+	if problems > fsckMaxPrint {
+		fmt.Printf("... and %d more\n", problems-fsckMaxPrint)
+	}
+
+	if repair && len(report.BadNodes) != 0 {
+		if !rootsMatch {
+			fmt.Println("not repairing: the roots from the leaves don't " +
+				"match a checkpoint, so the leaves may be wrong too")
+		} else {
+			err = forest.RepairFsck(report)
+			if err != nil {
+				return err
+			}
+			if fromSnapshot {
+				err = saveSnapshot(p, forest.Snapshot(), cp)
+				if err != nil {
+					return err
+				}
+			}
+			fmt.Printf("repaired %d forest hashes\n", len(report.BadNodes))
+			problems -= len(report.BadNodes)
+		}
+	}
+
+	if problems != 0 {
+		return fmt.Errorf("fsck found %d problems in %s", problems, dataDir)
+	}
+	fmt.Println("fsck found no problems")
+	return nil
+}
+
+// fsckCheckpoint checks the forest against the checkpoint, and says if the
+// roots worked out from the leaves match it
+func fsckCheckpoint(cp checkpoint, report accumulator.FsckReport,
+	forest *accumulator.Forest,
+	problem func(format string, a ...interface{})) bool {
+
+	numLeaves, rows := forest.ReconstructStats()
+	if numLeaves != cp.numLeaves || rows != cp.rows {
+		problem("forest has %d leaves %d rows, checkpoint at height %d "+
+			"has %d leaves %d rows", numLeaves, rows, cp.height,
+			cp.numLeaves, cp.rows)
+		return false
+	}
+	if len(report.Roots) != len(cp.roots) {
+		problem("forest has %d roots, checkpoint has %d",
+			len(report.Roots), len(cp.roots))
+		return false
+	}
+	match := true
+	for i, r := range report.Roots {
+		if r != cp.roots[i] {
+			problem("root %d from the leaves is %x, checkpoint has %x",
+				i, r.Prefix(), cp.roots[i].Prefix())
+			match = false
+		}
+	}
+	return match
+}
+
+// fsckProofs checks the proof offset file has an offset for every block
+// before the checkpoint height, and each one points right after the proof
+// before, up to where the checkpoint says the proof file ends.  Anything
+// past the checkpoint is fine; it gets cut off on resume.
+func fsckProofs(p *util.Paths, cp checkpoint,
+	problem func(format string, a ...interface{})) error {
+
+	if cp.offsetLen != int64(cp.height-1)*8 {
+		problem("checkpoint at height %d has %d bytes of proof offsets, "+
+			"expect %d", cp.height, cp.offsetLen, int64(cp.height-1)*8)
+	}
+	offsetLen, err := fileLen(p.POffsetFilePath)
+	if err != nil {
+		return err
+	}
+	proofLen, err := fileLen(p.PFilePath)
+	if err != nil {
+		return err
+	}
+	if offsetLen < cp.offsetLen || proofLen < cp.proofLen {
+		problem("proof offset file is %d bytes and proof file %d, "+
+			"checkpoint has %d and %d", offsetLen, proofLen,
+			cp.offsetLen, cp.proofLen)
+		return nil
+	}
+	if offsetLen > cp.offsetLen {
+		fmt.Printf("proof files have %d blocks past the checkpoint\n",
+			(offsetLen-cp.offsetLen)/8)
+	}
+	if cp.offsetLen == 0 {
+		return nil
+	}
+
+	offsetFile, err := os.Open(p.POffsetFilePath)
+	if err != nil {
+		return err
+	}
+	defer offsetFile.Close()
+	offsets := make([]int64, cp.offsetLen/8)
+	err = binary.Read(io.LimitReader(offsetFile, cp.offsetLen),
+		binary.BigEndian, offsets)
+	if err != nil {
+		return err
+	}
+	proofFile, err := os.Open(p.PFilePath)
+	if err != nil {
+		return err
+	}
+	defer proofFile.Close()
+
+	// each proof is its size (8) and then the proof
+	var loc int64
+	for i, offset := range offsets {
+		if offset != loc {
+			problem("block %d proof offset is %d, expect %d",
+				i+1, offset, loc)
+			return nil
+		}
+		var size int64
+		err = binary.Read(io.NewSectionReader(proofFile, offset, 8),
+			binary.BigEndian, &size)
+		if err != nil || size < 0 {
+			problem("block %d proof size at %d can't be read", i+1, offset)
+			return nil
+		}
+		loc = offset + 8 + size
+	}
+	if loc != cp.proofLen {
+		problem("proofs end at %d, checkpoint says %d", loc, cp.proofLen)
+	}
+	return nil
+}
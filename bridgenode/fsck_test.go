@@ -0,0 +1,98 @@
+package bridgenode
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mit-dci/utreexo/util"
+)
+
+// TestFsck runs a node, then messes up its files and checks fsck notices,
+// and repairs what it can.
+func TestFsck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgenode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocksDir := filepath.Join(dir, "blocks")
+	err = os.Mkdir(blocksDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestChain(t, blocksDir, &util.SigNetParams, 30)
+
+	ctx := context.Background()
+	for _, backend := range []ForestBackend{ForestDisk, ForestRam} {
+		dataDir := filepath.Join(dir, fmt.Sprintf("data%d", backend))
+		n, err := NewNode(ctx, Config{
+			DataDir:   dataDir,
+			BlocksDir: blocksDir,
+			Net:       &util.SigNetParams,
+			Forest:    backend,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.Run(ctx, CheckpointConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = Fsck(dataDir, false)
+		if err != nil {
+			t.Fatalf("backend %d: %s", backend, err.Error())
+		}
+	}
+
+	// mess up a hash above the leaves in the forest file
+	p := util.NewPaths(filepath.Join(dir, "data0"), "")
+	forest, err := restoreForest(p, ForestDisk, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rows := forest.ReconstructStats()
+	forest.Close()
+	ff, err := os.OpenFile(p.ForestFilePath, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ff.WriteAt([]byte{0xba, 0xd0}, int64(1<<rows+1)*32)
+	ff.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Fsck(p.DataDir, false)
+	if err == nil {
+		t.Fatalf("no error with a bad forest hash")
+	}
+	err = Fsck(p.DataDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Fsck(p.DataDir, false)
+	if err != nil {
+		t.Fatalf("after repair: %s", err.Error())
+	}
+
+	// cut a block's offset off the proof offset file
+	offsetLen, err := fileLen(p.POffsetFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Truncate(p.POffsetFilePath, offsetLen-8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Fsck(p.DataDir, true)
+	if err == nil {
+		t.Fatalf("no error with a short proof offset file")
+	}
+}
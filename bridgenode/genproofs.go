@@ -1,156 +1,272 @@
 package bridgenode
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"sync"
 	"time"
 
-	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/util"
 	"github.com/mit-dci/utreexo/util/ttl"
 
 	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
-// build the bridge node / proofs
-func BuildProofs(
-	net wire.BitcoinNet, ttlpath, offsetfile string, sig chan bool) error {
+// CheckpointConfig says how often BuildProofs saves its state.  A checkpoint
+// happens after Blocks blocks or Interval time since the last one, whichever
+// comes first.  0 turns that one off.  There's always a checkpoint at exit.
+type CheckpointConfig struct {
+	Blocks   int32
+	Interval time.Duration
+}
 
-	// Channel to alert the tell the main loop it's ok to exit
-	done := make(chan bool, 1)
+// build the bridge node / proofs
+// BuildProofs runs a Node until it gets to the last block it knows about,
+// or until ctx is cancelled.
+func BuildProofs(ctx context.Context, cfg Config,
+	ckpt CheckpointConfig) error {
 
-	// Waitgroup to alert stopBuildProofs() that revoffet and offset has
-	// been finished
-	offsetFinished := make(chan bool, 1)
+	n, err := NewNode(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	err = n.Run(ctx, ckpt)
+	cerr := n.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
 
-	// Channel for stopBuildProofs() to wait
-	finish := make(chan bool, 1)
+// ExportSnapshot writes a RootsSnapshot to path of where the node in
+// dataDir is: its last checkpoint, since that's where it resumes from.  It
+// only reads the data dir, so it's ok with genproofs running.
+func ExportSnapshot(dataDir string, path string) error {
+	p := util.NewPaths(dataDir, "")
+	var cp checkpoint
+	var mode accumulator.DeleteMode
+	var err error
+	// same order as fsck: a forest file, then a forest in ram
+	switch {
+	case util.HasAccess(p.ForestFilePath):
+		cp, err = readCheckpoint(p.CheckpointFilePath)
+		if err != nil {
+			return err
+		}
+		mode, err = readMiscDeleteMode(p.MiscForestFilePath)
+	case util.HasAccess(p.ForestSnapshotFilePath):
+		cp, mode, err = readSnapshotHead(p.ForestSnapshotFilePath)
+	default:
+		return fmt.Errorf("no forest in %s", p.ForestDirPath)
+	}
+	if err != nil {
+		return err
+	}
+	if cp.height < 2 {
+		return fmt.Errorf("no blocks yet, nothing to snapshot")
+	}
 
-	// Handle user interruptions
-	go stopBuildProofs(sig, offsetFinished, done, finish)
+	// the root history has the hash of the last block in the checkpoint
+	r, err := RootsAt(dataDir, cp.height-1)
+	if err != nil {
+		return err
+	}
+	if r.Commitment() != accumulator.RootsCommitment(cp.numLeaves, cp.roots) {
+		return fmt.Errorf("root history at %d doesn't match the checkpoint",
+			cp.height-1)
+	}
+	s := &util.RootsSnapshot{Height: cp.height, BlockHash: r.BlockHash,
+		NumLeaves: cp.numLeaves, DeleteMode: mode, Roots: cp.roots}
+	err = util.WriteFileAtomic(path, s.Bytes())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote snapshot at height %d block %s to %s\nid %s\n",
+		s.Height, s.BlockHash, path, s.ID())
+	return nil
+}
 
-	// If given the option testnet=true, check if the blk00000.dat file
-	// in the directory is a testnet file. Vise-versa for mainnet
-	util.CheckNet(net)
+// readMiscDeleteMode reads the delete mode from a misc forest file
+func readMiscDeleteMode(path string) (accumulator.DeleteMode, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return accumulator.ReadDeleteMode(f)
+}
 
-	// Creates all the directories needed for bridgenode
-	util.MakePaths()
+// readSnapshotHead reads the checkpoint and delete mode from the start of a
+// forest snapshot, without reading the forest
+func readSnapshotHead(path string) (
+	cp checkpoint, mode accumulator.DeleteMode, err error) {
 
-	// Init forest and variables. Resumes if the data directory exists
-	forest, height, knownTipHeight, err :=
-		initBridgeNodeState(net, offsetFinished)
+	f, err := os.Open(path)
 	if err != nil {
-		panic(err)
+		return
 	}
+	defer f.Close()
+	cp, err = readSnapshotCheckpoint(f)
+	if err != nil {
+		return
+	}
+	mode, err = accumulator.ReadDeleteMode(f)
+	return
+}
 
-	// Open leveldb
-	o := new(opt.Options)
-	o.CompactionTableSizeMultiplier = 8
-	lvdb, err := leveldb.OpenFile(ttlpath, o)
+// Run processes blocks until it gets to TipHeight, or until ctx is
+// cancelled.  Either way it finishes the block it's on, lets all the writers
+// finish, and saves before returning.  On errors it returns right away
+// without saving; the last checkpoint is still there.  Proofs still being
+// written get dropped then, so an error after any blocks stops the node.
+func (n *Node) Run(ctx context.Context, ckpt CheckpointConfig) (err error) {
+	if n.failed != nil {
+		return n.failed
+	}
+	// the source might have more blocks since last time
+	tip, err := n.source.TipHeight()
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer lvdb.Close()
+	n.tipHeight = tip
+	start := n.height
+	defer func() {
+		if err != nil && n.height != start {
+			n.fail(n.height, err)
+		}
+	}()
+
+	// Errors from any of the goroutines below.  Room for one from each of
+	// them so none of them block sending it.
+	errChan := make(chan error, 18)
+
+	// The writers don't stop when ctx is cancelled, since everything they
+	// get should be written before saving.  They only get cancelled if
+	// Run returns early with an error.
+	workCtx, cancelWork := context.WithCancel(context.Background())
+	defer cancelWork()
 
 	// For ttl value writing
-	var batchwg sync.WaitGroup
+	var batchwg, dbWorkerwg sync.WaitGroup
 	batchan := make(chan *leveldb.Batch, 10)
 
 	// Start 16 workers. Just an arbitrary number
 	for j := 0; j < 16; j++ {
-		go ttl.DbWorker(batchan, lvdb, &batchwg)
+		dbWorkerwg.Add(1)
+		go func() {
+			ttl.DbWorker(workCtx, batchan, n.lvdb, &batchwg, errChan)
+			dbWorkerwg.Done()
+		}()
 	}
 
-	// To send/receive blocks from blockreader()
+	// To send/receive blocks from sourceReader()
 	blockAndRevReadQueue := make(chan util.BlockAndRev, 10)
 
-	// Reads block asynchronously from .dat files
-	// Reads util the lastIndexOffsetHeight
-	go util.BlockAndRevReader(blockAndRevReadQueue,
-		knownTipHeight, height)
+	// Reads blocks asynchronously from the source, up to the tip
+	readCtx, cancelRead := context.WithCancel(ctx)
+	defer cancelRead()
+	go sourceReader(readCtx, n.ReadBlock, blockAndRevReadQueue,
+		errChan, n.tipHeight, n.height)
 	proofChan := make(chan []byte, 10)
 	var fileWait sync.WaitGroup
-	go proofWriterWorker(proofChan, &fileWait)
+	proofWriterDone := make(chan struct{})
+	go func() {
+		proofWriterWorker(workCtx, n.proofs, proofChan, &fileWait, errChan)
+		close(proofWriterDone)
+	}()
 
 	fmt.Println("Building Proofs and ttldb...")
 
-	var stop bool // bool for stopping the main loop
+	prog := newProgress(n.height, n.tipHeight)
+	lastCkptHeight, lastCkptTime := n.height, time.Now()
 
-	for ; height != knownTipHeight && stop != true; height++ {
+blockLoop:
+	for n.height < n.tipHeight {
 
 		// Receive txs from the asynchronous blk*.dat reader
-		bnr := <-blockAndRevReadQueue
+		var bnr util.BlockAndRev
+		select {
+		case bnr = <-blockAndRevReadQueue:
+		case err := <-errChan:
+			return err
+		case <-ctx.Done():
+			break blockLoop
+		}
 
 		// Writes the ttl values for each tx to leveldb
 		ttl.WriteBlock(bnr, batchan, &batchwg)
 
-		// Get the add and remove data needed from the block & undo block
-		blockAdds, delLeaves, err := blockToAddDel(bnr)
+		// Prove and modify the forest
+		_, b, err := n.addBlock(bnr)
 		if err != nil {
 			return err
 		}
 
-		// use the accumulator to get inclusion proofs, and produce a block
-		// proof with all data needed to verify the block
-		ud, err := genUData(delLeaves, forest, bnr.Height)
-		if err != nil {
-			return err
-		}
-
-		// convert UData struct to bytes
-		b := ud.ToBytes()
-
 		// Add to WaitGroup and send data to channel to be written
 		// to disk
 		fileWait.Add(1)
 		proofChan <- b
 
-		ud.AccProof.SortTargets()
-
-		// fmt.Printf("h %d adds %d targets %d\n",
-		// 	height, len(blockAdds), len(ud.AccProof.Targets))
-
-		// TODO: Don't ignore undoblock
-		// Modifies the forest with the given TXINs and TXOUTs
-		_, err = forest.Modify(blockAdds, ud.AccProof.Targets)
-		if err != nil {
-			return err
-		}
-
 		if bnr.Height%10000 == 0 {
-			fmt.Println("On block :", bnr.Height+1)
+			fmt.Println(prog.String(n.height))
 		}
 
-		// Check if stopSig is no longer false
-		// stop = true makes the loop exit
-		select {
-		case stop = <-done: // receives true from stopBuildProofs()
-		default:
+		if ckpt.Blocks > 0 && n.height-lastCkptHeight >= ckpt.Blocks ||
+			ckpt.Interval > 0 && time.Since(lastCkptTime) >= ckpt.Interval {
+			// everything before the checkpoint needs to be written
+			fileWait.Wait()
+			batchwg.Wait()
+			err = checkErr(errChan)
+			if err != nil {
+				return err
+			}
+			err = n.Save()
+			if err != nil {
+				return err
+			}
+			lastCkptHeight, lastCkptTime = n.height, time.Now()
+			fmt.Printf("checkpoint at %s\n", prog.String(n.height))
 		}
 	}
 
+	// Shut down in order: stop reading blocks, let the proof writer and
+	// ttl db workers finish what they've got, then save.
+	cancelRead()
+
+	close(proofChan)
+	<-proofWriterDone
+
 	// wait until dbWorker() has written to the ttldb file
 	// allows leveldb to close gracefully
-	batchwg.Wait()
+	close(batchan)
+	dbWorkerwg.Wait()
 
-	// Wait for the file workers to finish
-	fileWait.Wait()
+	// don't save if anything went wrong writing
+	err = checkErr(errChan)
+	if err != nil {
+		return err
+	}
 
 	// Save the current state so genproofs can be resumed
-	err = saveBridgeNodeData(forest, height)
+	err = n.Save()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	fmt.Println("Done writing")
-
-	// Tell stopBuildProofs that it's ok to exit
-	finish <- true
+	fmt.Printf("Done writing, stopped at %s\n", prog.String(n.height))
 	return nil
+}
 
+// checkErr gets an error out of errChan if there is one
+func checkErr(errChan chan error) error {
+	select {
+	case err := <-errChan:
+		return err
+	default:
+		return nil
+	}
 }
 
 // genBlockProof calls forest.ProveBatch with the hash data to get a batched
@@ -277,53 +393,3 @@ func blockNRevToDelLeaves(bnr util.BlockAndRev, skiplist []uint32) (
 	}
 	return
 }
-
-// stopBuildProofs listens for the signal from the OS and initiates an exit squence
-func stopBuildProofs(
-	sig, offsetfinished, done, finish chan bool) {
-
-	// Listen for SIGINT, SIGQUIT, SIGTERM
-	<-sig
-
-	// Sometimes there are bugs that make the program run forver.
-	// Utreexo binary should never take more than 10 seconds to exit
-	go func() {
-		time.Sleep(10 * time.Second)
-		fmt.Println("Program timed out. Force quitting. Data likely corrupted")
-		os.Exit(1)
-	}()
-
-	// Tell the user that the sig is received
-	fmt.Println("User exit signal received. Exiting...")
-
-	select {
-	// If offsetfile is there or was built, don't remove it
-	case <-offsetfinished:
-		select {
-		default:
-			done <- true
-		}
-	// If nothing is received, delete offsetfile and other directories
-	// Don't wait for done channel from the main BuildProofs() for loop
-	default:
-		select {
-		default:
-			fmt.Println("offsetfile incomplete, removing...")
-			// May not work sometimes.
-			err := os.RemoveAll(util.OffsetDirPath)
-			if err != nil {
-				fmt.Println("ERR. offsetdata/ directory not removed. Please manually remove it.")
-			}
-			err = os.RemoveAll(util.RevOffsetDirPath)
-			if err != nil {
-				fmt.Println("ERR. revdata/ directory not removed. Please manually remove it.")
-			}
-			fmt.Println("Exiting...")
-			os.Exit(0)
-		}
-	}
-
-	// Wait until BuildProofs() or buildOffsetFile() says it's ok to exit
-	<-finish
-	os.Exit(0)
-}
@@ -0,0 +1,273 @@
+package bridgenode
+
+import (
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/util"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	dbutil "github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// leafStore has the leaf data for every utxo, so the bridge node can make
+// proofs from the blocks alone, without the undo data from bitcoind's rev
+// files.  Outputs go in as blocks make them and come out as they're spent.
+//
+// It's written as blocks are added, so after a crash it can be ahead of the
+// forest's last checkpoint.  So for each block it also keeps what the block
+// spent, to be able to undo blocks back to the checkpoint; those go away
+// once there's a newer checkpoint.
+//
+// In the leveldb:
+// "h" -> height (4), the next block to add
+// 'u' outpoint hash (32) index (4) -> height<<1|coinbase (4) amt (8) pkscript
+// 's' height (4) -> what that block spent, as PrefixLen16'd LeafData bytes
+type leafStore struct {
+	db *leveldb.DB
+	// height is the next block to add
+	height int32
+}
+
+var leafStoreHeightKey = []byte("h")
+
+const (
+	utxoPrefix  = 'u'
+	spentPrefix = 's'
+)
+
+// openLeafStore opens or makes the leaf store at path
+func openLeafStore(path string) (*leafStore, error) {
+	o := new(opt.Options)
+	o.CompactionTableSizeMultiplier = 8
+	db, err := leveldb.OpenFile(path, o)
+	if err != nil {
+		return nil, err
+	}
+	ls := &leafStore{db: db, height: 1}
+	b, err := db.Get(leafStoreHeightKey, nil)
+	if err == leveldb.ErrNotFound {
+		return ls, nil
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	ls.height = util.BtI32(b)
+	return ls, nil
+}
+
+func utxoKey(op wire.OutPoint) []byte {
+	k := make([]byte, 37)
+	k[0] = utxoPrefix
+	copy(k[1:33], op.Hash[:])
+	copy(k[33:], util.U32tB(op.Index))
+	return k
+}
+
+func spentKey(height int32) []byte {
+	return append([]byte{spentPrefix}, util.I32tB(height)...)
+}
+
+// utxoValue is the leaf data without the outpoint, which is in the key, or
+// the block hash, which isn't used
+func utxoValue(l util.LeafData) []byte {
+	b := l.ToBytes()
+	return b[68:]
+}
+
+// newLeafData makes the leaf data for output i of tx, made at height
+func newLeafData(tx *wire.MsgTx, txid chainhash.Hash, i int,
+	height int32, coinbase bool) util.LeafData {
+
+	return util.LeafData{
+		Outpoint: wire.OutPoint{Hash: txid, Index: uint32(i)},
+		Height:   height,
+		Coinbase: coinbase,
+		Amt:      tx.TxOut[i].Value,
+		PkScript: tx.TxOut[i].PkScript,
+	}
+}
+
+// blockOutputs gives the leaf data for all the spendable outputs made in
+// the block
+func blockOutputs(blk *wire.MsgBlock, height int32) (
+	outs map[wire.OutPoint]util.LeafData) {
+
+	outs = make(map[wire.OutPoint]util.LeafData)
+	for txnum, tx := range blk.Transactions {
+		txid := tx.TxHash()
+		for i, out := range tx.TxOut {
+			if util.IsUnspendable(out) {
+				continue
+			}
+			l := newLeafData(tx, txid, i, height, txnum == 0)
+			outs[l.Outpoint] = l
+		}
+	}
+	return outs
+}
+
+// revBlock makes the undo data for the block at the store's height, the
+// same as what's in the rev files.  Inputs spending outputs from earlier in
+// the same block get those from the block.
+func (ls *leafStore) revBlock(blk *wire.MsgBlock) (
+	rev util.RevBlock, err error) {
+
+	inBlock := blockOutputs(blk, ls.height)
+	for txnum, tx := range blk.Transactions {
+		// the coinbase has no undo data
+		if txnum == 0 {
+			continue
+		}
+		txUndo := new(util.TxUndo)
+		for _, in := range tx.TxIn {
+			l, ok := inBlock[in.PreviousOutPoint]
+			if !ok {
+				l, err = ls.get(in.PreviousOutPoint)
+				if err != nil {
+					return
+				}
+			}
+			txUndo.TxIn = append(txUndo.TxIn, &util.TxInUndo{
+				Height:   l.Height,
+				Coinbase: l.Coinbase,
+				Amount:   l.Amt,
+				PKScript: l.PkScript,
+			})
+		}
+		rev.Txs = append(rev.Txs, txUndo)
+	}
+	return
+}
+
+// get gets the leaf data for a utxo
+func (ls *leafStore) get(op wire.OutPoint) (l util.LeafData, err error) {
+	v, err := ls.db.Get(utxoKey(op), nil)
+	if err == leveldb.ErrNotFound {
+		return l, fmt.Errorf("block %d spends %s which isn't in the leaf store",
+			ls.height, op.String())
+	}
+	if err != nil {
+		return
+	}
+	if len(v) < 12 {
+		return l, fmt.Errorf("leaf store entry for %s only %d bytes",
+			op.String(), len(v))
+	}
+	l.Outpoint = op
+	l.Height = util.BtI32(v[:4])
+	l.Coinbase = l.Height&1 == 1
+	l.Height >>= 1
+	l.Amt = util.BtI64(v[4:12])
+	l.PkScript = v[12:]
+	return
+}
+
+// addBlock takes out what the block spends and puts in what it makes.  The
+// block has to be at the store's height, with the rev block from revBlock.
+func (ls *leafStore) addBlock(bnr util.BlockAndRev) error {
+	if bnr.Height != ls.height {
+		return fmt.Errorf("leaf store got block %d but at height %d",
+			bnr.Height, ls.height)
+	}
+	outs := blockOutputs(&bnr.Blk, bnr.Height)
+	batch := new(leveldb.Batch)
+	var spent []byte
+	for txnum, tx := range bnr.Blk.Transactions {
+		if txnum == 0 {
+			continue
+		}
+		for i, in := range tx.TxIn {
+			// made and spent in this block, so never in the store
+			if _, ok := outs[in.PreviousOutPoint]; ok {
+				delete(outs, in.PreviousOutPoint)
+				continue
+			}
+			ti := bnr.Rev.Txs[txnum-1].TxIn[i]
+			l := util.LeafData{Outpoint: in.PreviousOutPoint,
+				Height: ti.Height, Coinbase: ti.Coinbase,
+				Amt: ti.Amount, PkScript: ti.PKScript}
+			spent = append(spent, util.PrefixLen16(l.ToBytes())...)
+			batch.Delete(utxoKey(in.PreviousOutPoint))
+		}
+	}
+	for op, l := range outs {
+		batch.Put(utxoKey(op), utxoValue(l))
+	}
+	batch.Put(spentKey(bnr.Height), spent)
+	batch.Put(leafStoreHeightKey, util.I32tB(bnr.Height+1))
+	err := ls.db.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+	ls.height++
+	return nil
+}
+
+// undoBlock takes the last block added back out
+func (ls *leafStore) undoBlock(blk *wire.MsgBlock) error {
+	height := ls.height - 1
+	spent, err := ls.db.Get(spentKey(height), nil)
+	if err == leveldb.ErrNotFound {
+		return fmt.Errorf("can't undo block %d, leaf store doesn't have "+
+			"what it spent", height)
+	}
+	if err != nil {
+		return err
+	}
+	batch := new(leveldb.Batch)
+	for op := range blockOutputs(blk, height) {
+		batch.Delete(utxoKey(op))
+	}
+	for len(spent) > 0 {
+		var b []byte
+		b, spent, err = util.PopPrefixLen16(spent)
+		if err != nil {
+			return err
+		}
+		l, err := util.LeafDataFromBytes(b)
+		if err != nil {
+			return err
+		}
+		batch.Put(utxoKey(l.Outpoint), utxoValue(l))
+	}
+	batch.Delete(spentKey(height))
+	batch.Put(leafStoreHeightKey, util.I32tB(height))
+	err = ls.db.Write(batch, nil)
+	if err != nil {
+		return err
+	}
+	ls.height--
+	return nil
+}
+
+// flush makes sure everything written so far is on disk
+func (ls *leafStore) flush() error {
+	batch := new(leveldb.Batch)
+	batch.Put(leafStoreHeightKey, util.I32tB(ls.height))
+	return ls.db.Write(batch, &opt.WriteOptions{Sync: true})
+}
+
+// prune removes what blocks before height spent, since they won't need
+// undoing.  Call once there's a checkpoint at height.
+func (ls *leafStore) prune(height int32) error {
+	batch := new(leveldb.Batch)
+	iter := ls.db.NewIterator(&dbutil.Range{
+		Start: spentKey(0), Limit: spentKey(height)}, nil)
+	for iter.Next() {
+		batch.Delete(iter.Key())
+	}
+	iter.Release()
+	err := iter.Error()
+	if err != nil {
+		return err
+	}
+	return ls.db.Write(batch, nil)
+}
+
+func (ls *leafStore) close() error {
+	return ls.db.Close()
+}
@@ -0,0 +1,104 @@
+package bridgenode
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// leafStoreUtxos gives everything in the leaf store, to compare
+func leafStoreUtxos(t *testing.T, ls *leafStore) map[string]string {
+	m := make(map[string]string)
+	iter := ls.db.NewIterator(nil, nil)
+	for iter.Next() {
+		if iter.Key()[0] == utxoPrefix {
+			m[string(iter.Key())] = string(iter.Value())
+		}
+	}
+	iter.Release()
+	if iter.Error() != nil {
+		t.Fatal(iter.Error())
+	}
+	return m
+}
+
+func TestLeafStoreUndo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leafstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocks := writeTestChain(t, dir, &util.SigNetParams, 12)
+
+	// block 8 also spends an output made earlier in the same block
+	blk := blocks[7]
+	inBlock := wire.NewMsgTx(1)
+	inBlock.AddTxIn(&wire.TxIn{PreviousOutPoint: wire.OutPoint{
+		Hash: blk.Transactions[1].TxHash(), Index: 0}})
+	inBlock.AddTxOut(wire.NewTxOut(0, p2pkh(8, 0xdd)))
+	blk.AddTransaction(inBlock)
+
+	ls, err := openLeafStore(filepath.Join(dir, "leafstore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ls.close()
+	add := func(blk *wire.MsgBlock) {
+		bnr := util.BlockAndRev{Height: ls.height, Blk: *blk}
+		bnr.Rev, err = ls.revBlock(blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ls.addBlock(bnr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, blk := range blocks[:5] {
+		add(blk)
+	}
+	err = ls.prune(ls.height)
+	if err != nil {
+		t.Fatal(err)
+	}
+	at6 := leafStoreUtxos(t, ls)
+
+	for _, blk := range blocks[5:] {
+		add(blk)
+	}
+	// 2 coinbase outputs per block and an output from the spends in
+	// blocks 3 to 12, minus coinbase output 0 of blocks 1 to 10.  In block
+	// 8 the spend's output is spent, but the new tx's output is there.
+	if len(leafStoreUtxos(t, ls)) != 12*2+10-10 {
+		t.Fatalf("%d utxos at 13", len(leafStoreUtxos(t, ls)))
+	}
+
+	for h := 12; h >= 6; h-- {
+		err = ls.undoBlock(blocks[h-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ls.height != 6 || !reflect.DeepEqual(leafStoreUtxos(t, ls), at6) {
+		t.Fatalf("undo back to %d didn't give the same utxos", ls.height)
+	}
+	// blocks before the prune can't be undone
+	if ls.undoBlock(blocks[4]) == nil {
+		t.Fatalf("undid pruned block")
+	}
+
+	// reopens at the same height
+	ls.close()
+	ls, err = openLeafStore(filepath.Join(dir, "leafstore"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ls.height != 6 {
+		t.Fatalf("reopened at %d, expect 6", ls.height)
+	}
+}
@@ -0,0 +1,563 @@
+package bridgenode
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+	"github.com/mit-dci/utreexo/util/ttl"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+// ForestBackend is where a Node keeps its forest
+type ForestBackend uint8
+
+const (
+	// ForestDisk keeps the forest in a file in the data dir.  Doesn't need
+	// much ram, and the node can be stopped and resumed.
+	ForestDisk ForestBackend = iota
+	// ForestRam keeps the whole forest in memory.  Faster, but needs ram
+	// for all of it.  Save writes a snapshot of it in the background to
+	// resume from.  The snapshot is a copy of the forest's hashes, so while
+	// it's being written the node can use up to twice the forest's ram.
+	ForestRam
+	// ForestHybrid keeps the forest in a file like ForestDisk, but the top
+	// rows, which get written every block, in ram, as many as fit in
+	// Config.ForestRamBudget.  Can resume from a ForestDisk data dir and the
+	// other way around.
+	ForestHybrid
+)
+
+// UndoData is where the node gets the leaf data for what blocks spend
+type UndoData uint8
+
+const (
+	// UndoFromSource uses the undo data the BlockSource gives: bitcoind's
+	// rev files, or the prevouts from RPC
+	UndoFromSource UndoData = iota
+	// UndoLeafStore keeps a store of the leaf data for every utxo in the
+	// data dir, and doesn't need undo data from the source.  The Rev from
+	// the source's BlockAndRev is ignored, so it can be empty.
+	UndoLeafStore
+)
+
+// Config is everything needed to make a Node
+type Config struct {
+	// DataDir is where the forest, proofs, and block indexes go
+	DataDir string
+	// BlocksDir has the blk*.dat and rev*.dat files from bitcoind
+	BlocksDir string
+	// Net is which network the blocks are from
+	Net *util.NetParams
+	// Source is where to get blocks if not from the files in BlocksDir,
+	// like an RPCSource.  Then BlocksDir isn't used, and there's no
+	// offset files to make.
+	Source BlockSource
+	// TTLDBPath is the leveldb for ttls.  DataDir/ttldb if empty.
+	TTLDBPath string
+	Forest    ForestBackend
+	Undo      UndoData
+	// DeleteMode is how the forest deletes.  A forest resumed from DataDir
+	// with some other mode is an error.
+	DeleteMode accumulator.DeleteMode
+	// ForestRamBudget is how many bytes of ram ForestHybrid can use for
+	// the top rows of the forest
+	ForestRamBudget uint64
+}
+
+// Node is a bridge node: it has the whole forest, goes through the blocks
+// in order, and makes proofs for each of them.  It can be run by itself
+// with Run, or fed blocks one at a time with ProcessBlock.  Not safe to use
+// from more than one goroutine.
+type Node struct {
+	cfg    Config
+	paths  *util.Paths
+	forest *accumulator.Forest
+	lvdb   *leveldb.DB
+	proofs *proofWriter
+	// history has the roots after every block
+	history *rootHistory
+	source  BlockSource
+	// leaves is nil unless cfg.Undo is UndoLeafStore
+	leaves *leafStore
+
+	// snapshotDone gets the error from the forest snapshot being written
+	// in the background, if there is one, and snapshotHeight is the
+	// height it's at
+	snapshotDone   chan error
+	snapshotHeight int32
+
+	// height is the next block to process
+	height int32
+	// lastHash is the block before height, which the next one has to
+	// build on.  Zero if it's not known, in a data dir from before the
+	// root history.
+	lastHash chainhash.Hash
+	// failed is set when something went wrong after the forest changed
+	// for a block.  Nothing after that is right, so the node won't take
+	// any more blocks or save; a new Node resumes from the last checkpoint.
+	failed error
+	// tipHeight is how far the source went last time we asked; Run stops
+	// there
+	tipHeight int32
+}
+
+// NewNode makes a Node, resuming from what's in cfg.DataDir if there's
+// anything there.  Reading from cfg.BlocksDir, the first time it indexes
+// all the blocks there, which can be stopped with ctx.
+func NewNode(ctx context.Context, cfg Config) (*Node, error) {
+	if cfg.Forest > ForestHybrid {
+		return nil, fmt.Errorf("unknown forest backend %d", cfg.Forest)
+	}
+	if cfg.Undo != UndoFromSource && cfg.Undo != UndoLeafStore {
+		return nil, fmt.Errorf("unknown undo data %d", cfg.Undo)
+	}
+	if cfg.TTLDBPath == "" {
+		cfg.TTLDBPath = filepath.Join(cfg.DataDir, "ttldb")
+	}
+	if cfg.Net == nil {
+		return nil, fmt.Errorf("no network given")
+	}
+	n := &Node{cfg: cfg, paths: util.NewPaths(cfg.DataDir, cfg.BlocksDir)}
+
+	if cfg.Source == nil {
+		// Check that the blk00000.dat file in the blocks dir is from the
+		// network we were told
+		err := util.CheckNet(cfg.Net, n.paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Creates all the directories needed for bridgenode
+	err := n.paths.MakePaths()
+	if err != nil {
+		return nil, err
+	}
+
+	n.source = cfg.Source
+	if n.source == nil {
+		tip, err := initOffsetData(ctx, cfg.Net, n.paths)
+		if err != nil {
+			return nil, err
+		}
+		n.source = &fileSource{paths: n.paths, tip: tip}
+	}
+	n.tipHeight, err = n.source.TipHeight()
+	if err != nil {
+		return nil, err
+	}
+
+	// Init forest and variables. Resumes if the data directory exists
+	n.forest, n.height, err = initBridgeNodeState(
+		n.paths, cfg.Forest, cfg.ForestRamBudget)
+	if err != nil {
+		return nil, err
+	}
+	if n.forest.DeleteMode() != cfg.DeleteMode {
+		err = n.forest.SetDeleteMode(cfg.DeleteMode)
+		if err != nil {
+			n.forest.Close()
+			return nil, fmt.Errorf("forest in %s is %s, not %s: %s",
+				cfg.DataDir, n.forest.DeleteMode(), cfg.DeleteMode,
+				err.Error())
+		}
+	}
+
+	// Open leveldb
+	o := new(opt.Options)
+	o.CompactionTableSizeMultiplier = 8
+	n.lvdb, err = leveldb.OpenFile(cfg.TTLDBPath, o)
+	if err != nil {
+		n.forest.Close()
+		return nil, err
+	}
+
+	n.proofs, err = openProofWriter(n.paths)
+	if err != nil {
+		n.lvdb.Close()
+		n.forest.Close()
+		return nil, err
+	}
+
+	n.history, err = openRootHistory(n.paths, n.height)
+	if err != nil {
+		n.proofs.close()
+		n.lvdb.Close()
+		n.forest.Close()
+		return nil, err
+	}
+
+	if n.height == 1 {
+		n.lastHash = chainhash.Hash(cfg.Net.GenesisHash)
+	} else if n.height > n.history.first {
+		var r RootsRecord
+		r, err = n.history.read(n.height - 1)
+		if err != nil {
+			n.history.close()
+			n.proofs.close()
+			n.lvdb.Close()
+			n.forest.Close()
+			return nil, err
+		}
+		n.lastHash = r.BlockHash
+	}
+
+	if cfg.Undo == UndoLeafStore {
+		err = n.initLeafStore()
+		if err != nil {
+			n.history.close()
+			n.proofs.close()
+			n.lvdb.Close()
+			n.forest.Close()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// initLeafStore opens the leaf store, and undoes any blocks in it past the
+// forest's height, which were added after the last checkpoint.  A forest
+// in ram with no snapshot starts over, so the leaf store does too.
+func (n *Node) initLeafStore() error {
+	if n.cfg.Forest == ForestRam && n.height == 1 {
+		err := os.RemoveAll(n.paths.LeafStoreDirPath)
+		if err != nil {
+			return err
+		}
+	}
+	ls, err := openLeafStore(n.paths.LeafStoreDirPath)
+	if err != nil {
+		return err
+	}
+	if ls.height < n.height {
+		ls.close()
+		return fmt.Errorf("leaf store is at block %d but the forest is at "+
+			"%d.  Remove %s and %s to start over", ls.height, n.height,
+			n.paths.LeafStoreDirPath, n.paths.ForestDirPath)
+	}
+	n.leaves = ls
+	if ls.height > n.height {
+		fmt.Printf("leaf store at %d, undoing back to %d\n",
+			ls.height, n.height)
+	}
+	for ls.height > n.height {
+		var bnr util.BlockAndRev
+		bnr, err = n.ReadBlock(ls.height - 1)
+		if err != nil {
+			break
+		}
+		err = ls.undoBlock(&bnr.Blk)
+		if err != nil {
+			break
+		}
+	}
+	if err != nil {
+		ls.close()
+		n.leaves = nil
+		return err
+	}
+	return nil
+}
+
+// Paths gives where the node keeps its files
+func (n *Node) Paths() *util.Paths {
+	return n.paths
+}
+
+// Height is the next block the node needs
+func (n *Node) Height() int32 {
+	return n.height
+}
+
+// TipHeight is how far the blocks go, as of the last time the node asked
+// the source.  Run stops there.
+func (n *Node) TipHeight() int32 {
+	return n.tipHeight
+}
+
+// Roots gives the roots of the forest, as of Height()
+func (n *Node) Roots() []accumulator.Hash {
+	return n.forest.GetRoots()
+}
+
+// NumLeaves is how many utxos are in the forest
+func (n *Node) NumLeaves() uint64 {
+	numLeaves, _ := n.forest.ReconstructStats()
+	return numLeaves
+}
+
+// RootsSnapshot gives the accumulator as of Height(), for a compact state
+// node to start from.  It reads the block before to get its hash.
+func (n *Node) RootsSnapshot() (*util.RootsSnapshot, error) {
+	if n.height < 2 {
+		return nil, fmt.Errorf("no blocks yet, nothing to snapshot")
+	}
+	bnr, err := n.ReadBlock(n.height - 1)
+	if err != nil {
+		return nil, err
+	}
+	numLeaves, _ := n.forest.ReconstructStats()
+	return &util.RootsSnapshot{Height: n.height,
+		BlockHash: bnr.Blk.BlockHash(), NumLeaves: numLeaves,
+		DeleteMode: n.forest.DeleteMode(), Roots: n.forest.GetRoots()}, nil
+}
+
+// RootsAt gives the roots after block height, from the root history
+func (n *Node) RootsAt(height int32) (RootsRecord, error) {
+	return n.history.read(height)
+}
+
+// Stats is forest stats, for printing
+func (n *Node) Stats() string {
+	return n.forest.Stats()
+}
+
+// blockReader is a BlockSource that can give just the block, without the
+// undo data.  With a leaf store that's all the node needs.
+type blockReader interface {
+	Block(height int32) (wire.MsgBlock, error)
+}
+
+// ReadBlock gets a block and its rev block from the node's source.  With a
+// leaf store, the rev block is left empty when the source can skip it;
+// ProcessBlock fills it in.
+func (n *Node) ReadBlock(height int32) (util.BlockAndRev, error) {
+	if n.leaves != nil {
+		if br, ok := n.source.(blockReader); ok {
+			blk, err := br.Block(height)
+			return util.BlockAndRev{Height: height, Blk: blk}, err
+		}
+	}
+	return n.source.BlockAndRev(height)
+}
+
+// ProcessBlock does everything for one block: it gets a proof for the
+// block's inputs, writes the proof and ttls, and updates the forest.  bnr
+// has to be the block at Height().  Gives back the proof.  An error after
+// the forest changed stops the node; see Save.
+func (n *Node) ProcessBlock(bnr util.BlockAndRev) (util.UData, error) {
+	ud, b, err := n.addBlock(bnr)
+	if err != nil {
+		return ud, err
+	}
+	err = n.proofs.write(b)
+	if err != nil {
+		return ud, n.fail(bnr.Height, err)
+	}
+	err = n.lvdb.Write(ttl.BlockBatch(bnr), nil)
+	if err != nil {
+		return ud, n.fail(bnr.Height, err)
+	}
+	return ud, nil
+}
+
+// fail stops the node for good after an error partway through block
+// height.  Gives back err.
+func (n *Node) fail(height int32, err error) error {
+	if n.failed == nil {
+		n.failed = fmt.Errorf("node stopped at block %d: %s.  Make a new "+
+			"Node to resume from the last checkpoint", height, err.Error())
+	}
+	return err
+}
+
+// addBlock proves and modifies for a block, and gives back the proof along
+// with how it's serialized for the proof file.
+func (n *Node) addBlock(bnr util.BlockAndRev) (
+	ud util.UData, b []byte, err error) {
+
+	if n.failed != nil {
+		err = n.failed
+		return
+	}
+	if bnr.Height != n.height {
+		err = fmt.Errorf("got block %d but at height %d", bnr.Height, n.height)
+		return
+	}
+	// there's no undoing blocks, so a reorg has to stop here
+	if n.lastHash != (chainhash.Hash{}) &&
+		bnr.Blk.Header.PrevBlock != n.lastHash {
+		err = fmt.Errorf("block %d builds on %s, not %s, the last block "+
+			"done.  Reorg?", bnr.Height, bnr.Blk.Header.PrevBlock, n.lastHash)
+		return
+	}
+
+	// with a leaf store, the undo data comes from there
+	if n.leaves != nil {
+		bnr.Rev, err = n.leaves.revBlock(&bnr.Blk)
+		if err != nil {
+			return
+		}
+	}
+
+	// Get the add and remove data needed from the block & undo block
+	blockAdds, delLeaves, err := blockToAddDel(bnr)
+	if err != nil {
+		return
+	}
+
+	// use the accumulator to get inclusion proofs, and produce a block
+	// proof with all data needed to verify the block
+	ud, err = genUData(delLeaves, n.forest, bnr.Height)
+	if err != nil {
+		return
+	}
+
+	// convert UData struct to bytes
+	b = ud.ToBytes()
+
+	// the forest needs the targets sorted, but the leaf data in ud goes
+	// with them unsorted, so sort a copy
+	del := accumulator.BatchProof{
+		Targets: make([]uint64, len(ud.AccProof.Targets))}
+	copy(del.Targets, ud.AccProof.Targets)
+	del.SortTargets()
+
+	// TODO: Don't ignore undoblock
+	// Modifies the forest with the given TXINs and TXOUTs.  From here on
+	// the block can't be tried again, so errors stop the node.
+	_, err = n.forest.Modify(blockAdds, del.Targets)
+	if err != nil {
+		err = n.fail(bnr.Height, err)
+		return
+	}
+	if n.leaves != nil {
+		err = n.leaves.addBlock(bnr)
+		if err != nil {
+			err = n.fail(bnr.Height, err)
+			return
+		}
+	}
+	numLeaves, _ := n.forest.ReconstructStats()
+	hash := bnr.Blk.BlockHash()
+	err = n.history.write(RootsRecord{Height: bnr.Height,
+		BlockHash: hash, NumLeaves: numLeaves,
+		Roots: n.forest.GetRoots()})
+	if err != nil {
+		err = n.fail(bnr.Height, err)
+		return
+	}
+	n.height++
+	n.lastHash = hash
+	return
+}
+
+// GetUData reads the proof for a block that's already been processed
+func (n *Node) GetUData(height int32) (util.UData, error) {
+	if height >= n.height {
+		return util.UData{}, fmt.Errorf(
+			"no proof for block %d yet, at height %d", height, n.height)
+	}
+	return util.GetUDataFromFile(height, n.paths)
+}
+
+// Save writes everything out, so that a new Node with the same data dir
+// picks up from here.  It won't after an error that stopped the node.
+// With ForestRam the forest snapshot is written in the background, and it's
+// only done by the next Save or Close; until then a new Node would pick up
+// from the Save before.
+func (n *Node) Save() error {
+	if n.failed != nil {
+		return n.failed
+	}
+	// only 1 snapshot at a time
+	err := n.waitSnapshot()
+	if err != nil {
+		return err
+	}
+	// the leaf store has to be on disk before the checkpoint says it's
+	// there, and can forget how to undo blocks once it is
+	if n.leaves != nil {
+		err = n.leaves.flush()
+		if err != nil {
+			return err
+		}
+	}
+	err = n.history.sync()
+	if err != nil {
+		return err
+	}
+	if n.cfg.Forest == ForestRam {
+		return n.startSnapshot()
+	}
+	err = saveBridgeNodeData(n.paths, n.forest, n.height)
+	if err != nil || n.leaves == nil {
+		return err
+	}
+	return n.leaves.prune(n.height)
+}
+
+// startSnapshot copies the forest in ram and starts writing it out, with
+// the checkpoint at the start.  The proofs get synced first, since the
+// checkpoint says they're there.  The copy is kept until it's written.
+func (n *Node) startSnapshot() error {
+	err := n.proofs.sync()
+	if err != nil {
+		return err
+	}
+	cp, err := makeCheckpoint(
+		n.forest, n.height, n.paths.PFilePath, n.paths.POffsetFilePath)
+	if err != nil {
+		return err
+	}
+	snap := n.forest.Snapshot()
+	done := make(chan error, 1)
+	go func() {
+		done <- saveSnapshot(n.paths, snap, cp)
+	}()
+	n.snapshotDone, n.snapshotHeight = done, n.height
+	return nil
+}
+
+// waitSnapshot waits for the snapshot being written in the background, if
+// there is one.  Once it's there, the leaf store can forget how to undo
+// blocks before it.
+func (n *Node) waitSnapshot() error {
+	if n.snapshotDone == nil {
+		return nil
+	}
+	err := <-n.snapshotDone
+	n.snapshotDone = nil
+	if err != nil || n.leaves == nil {
+		return err
+	}
+	return n.leaves.prune(n.snapshotHeight)
+}
+
+// Close closes all the node's files.  It doesn't save; call Save first to
+// keep what's been done since the last Save.  It waits for a snapshot
+// being written to finish.
+func (n *Node) Close() error {
+	err := n.waitSnapshot()
+	perr := n.proofs.close()
+	if err == nil {
+		err = perr
+	}
+	herr := n.history.close()
+	if err == nil {
+		err = herr
+	}
+	lerr := n.lvdb.Close()
+	if err == nil {
+		err = lerr
+	}
+	ferr := n.forest.Close()
+	if err == nil {
+		err = ferr
+	}
+	if n.leaves != nil {
+		serr := n.leaves.close()
+		if err == nil {
+			err = serr
+		}
+	}
+	return err
+}
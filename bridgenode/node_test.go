@@ -0,0 +1,1056 @@
+package bridgenode
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// p2pkh makes a pay to pubkey hash script with a hash starting with a, b
+func p2pkh(a, b byte) []byte {
+	s := make([]byte, 25)
+	s[0], s[1], s[2] = txscript.OP_DUP, txscript.OP_HASH160, txscript.OP_DATA_20
+	s[3], s[4] = a, b
+	s[23], s[24] = txscript.OP_EQUALVERIFY, txscript.OP_CHECKSIG
+	return s
+}
+
+// writeTestChain writes blk00000.dat and rev00000.dat with numBlocks
+// blocks for the network net.  Each block has a coinbase with 2 outputs, and
+// from block 3 on, a tx spending the first output of the coinbase 2 blocks
+// back.  Gives back the blocks.
+func writeTestChain(t *testing.T, dir string, net *util.NetParams,
+	numBlocks int) []*wire.MsgBlock {
+
+	var blk, rev bytes.Buffer
+	magic := net.MagicBytes()
+	var err error
+	prev := chainhash.Hash(net.GenesisHash)
+	var coinbases []chainhash.Hash
+	var blocks []*wire.MsgBlock
+
+	for h := 1; h <= numBlocks; h++ {
+		msg := new(wire.MsgBlock)
+		msg.Header = wire.BlockHeader{
+			Version:   1,
+			PrevBlock: prev,
+			Timestamp: time.Unix(int64(1500000000+h), 0),
+		}
+		cb := wire.NewMsgTx(1)
+		cb.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Index: 0xffffffff},
+			SignatureScript:  []byte{byte(h), 0x51},
+		})
+		cb.AddTxOut(wire.NewTxOut(0, p2pkh(byte(h), 0)))
+		cb.AddTxOut(wire.NewTxOut(0, p2pkh(byte(h), 1)))
+		msg.AddTransaction(cb)
+		coinbases = append(coinbases, cb.TxHash())
+
+		// rev data is for every tx but the coinbase
+		var undo bytes.Buffer
+		if h >= 3 {
+			spend := wire.NewMsgTx(1)
+			spend.AddTxIn(&wire.TxIn{PreviousOutPoint: wire.OutPoint{
+				Hash: coinbases[h-3], Index: 0}})
+			spend.AddTxOut(wire.NewTxOut(0, p2pkh(byte(h), 0xee)))
+			msg.AddTransaction(spend)
+
+			wire.WriteVarInt(&undo, 0, 1)
+			wire.WriteVarInt(&undo, 0, 1)
+			// height*2 + coinbase, then a 0 varint, a 0 amount, and
+			// the p2pkh hash.  All of the VLQs here fit in a byte.
+			undo.Write([]byte{byte((h-2)*2 + 1), 0, 0, 0})
+			undo.Write(p2pkh(byte(h-2), 0)[3:23])
+		} else {
+			wire.WriteVarInt(&undo, 0, 0)
+		}
+
+		var b bytes.Buffer
+		err = msg.Serialize(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blk.Write(magic[:])
+		binary.Write(&blk, binary.LittleEndian, uint32(b.Len()))
+		blk.Write(b.Bytes())
+
+		rev.Write(magic[:])
+		binary.Write(&rev, binary.LittleEndian, uint32(undo.Len()))
+		rev.Write(undo.Bytes())
+		// checksum, which isn't checked
+		rev.Write(make([]byte, 32))
+
+		prev = msg.BlockHash()
+		blocks = append(blocks, msg)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "blk00000.dat"), blk.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "rev00000.dat"), rev.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return blocks
+}
+
+// TestNode runs one node on its own and feeds another blocks one at a time,
+// in different data dirs, and makes sure they end up the same.
+func TestNode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgenode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocksDir := filepath.Join(dir, "blocks")
+	err = os.Mkdir(blocksDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := writeTestChain(t, blocksDir, &util.SigNetParams, 30)
+
+	ctx := context.Background()
+	runCfg := Config{
+		DataDir:   filepath.Join(dir, "run"),
+		BlocksDir: blocksDir,
+		Net:       &util.SigNetParams,
+	}
+	a, err := NewNode(ctx, runCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.Run(ctx, CheckpointConfig{Blocks: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Height() != a.TipHeight() {
+		t.Fatalf("run stopped at %d, tip %d", a.Height(), a.TipHeight())
+	}
+
+	b, err := NewNode(ctx, Config{
+		DataDir:   filepath.Join(dir, "step"),
+		BlocksDir: blocksDir,
+		Net:       &util.SigNetParams,
+		Forest:    ForestRam,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	var dels int
+	for b.Height() != b.TipHeight() {
+		bnr, err := b.ReadBlock(b.Height())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ud, err := b.ProcessBlock(bnr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dels += len(ud.AccProof.Targets)
+
+		got, err := b.GetUData(bnr.Height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got.ToBytes(), ud.ToBytes()) {
+			t.Fatalf("block %d proof read back different", bnr.Height)
+		}
+	}
+	if dels == 0 {
+		t.Fatalf("no deletions")
+	}
+
+	if !reflect.DeepEqual(a.Roots(), b.Roots()) {
+		t.Fatalf("run roots %x, step roots %x", a.Roots(), b.Roots())
+	}
+	for h := int32(1); h < a.Height(); h++ {
+		ua, err := a.GetUData(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ub, err := b.GetUData(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ua.ToBytes(), ub.ToBytes()) {
+			t.Fatalf("block %d proofs differ", h)
+		}
+	}
+
+	// start the first one up again and it should be in the same place
+	roots := a.Roots()
+	err = a.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err = NewNode(ctx, runCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Height() != b.Height() || !reflect.DeepEqual(a.Roots(), roots) {
+		t.Fatalf("resumed at %d roots %x, expect %d %x",
+			a.Height(), a.Roots(), b.Height(), roots)
+	}
+
+	// and again with the top rows in ram, which uses the same files
+	err = a.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runCfg.Forest = ForestHybrid
+	runCfg.ForestRamBudget = 1024
+	a, err = NewNode(ctx, runCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	if a.Height() != b.Height() || !reflect.DeepEqual(a.Roots(), roots) {
+		t.Fatalf("hybrid resumed at %d roots %x, expect %d %x",
+			a.Height(), a.Roots(), b.Height(), roots)
+	}
+
+	s, err := a.RootsSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Height != a.Height() ||
+		s.BlockHash != blocks[a.Height()-2].BlockHash() ||
+		s.NumLeaves != a.NumLeaves() || !reflect.DeepEqual(s.Roots, roots) {
+		t.Fatalf("snapshot %+v", s)
+	}
+
+	// exporting it just reads the files, and gets the same thing
+	snapPath := filepath.Join(dir, "snapshot")
+	err = ExportSnapshot(runCfg.DataDir, snapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := ioutil.ReadFile(snapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(exported, s.Bytes()) {
+		t.Fatalf("exported snapshot differs")
+	}
+}
+
+// cancelSource gets blocks from src, and calls cancel when asked for
+// block at
+type cancelSource struct {
+	src    BlockSource
+	at     int32
+	cancel func()
+}
+
+func (cs *cancelSource) BlockAndRev(height int32) (util.BlockAndRev, error) {
+	if height == cs.at {
+		cs.cancel()
+	}
+	return cs.src.BlockAndRev(height)
+}
+
+func (cs *cancelSource) TipHeight() (int32, error) {
+	return cs.src.TipHeight()
+}
+
+// TestNodeCancel stops Run partway with ctx, and checks the node saved
+// where it stopped and picks up from there the same as a node that didn't
+// stop.
+func TestNodeCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgenode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocksDir := filepath.Join(dir, "blocks")
+	err = os.Mkdir(blocksDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestChain(t, blocksDir, &util.SigNetParams, 40)
+
+	ref, err := NewNode(context.Background(), Config{
+		DataDir:   filepath.Join(dir, "ref"),
+		BlocksDir: blocksDir,
+		Net:       &util.SigNetParams,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Close()
+	err = ref.Run(context.Background(), CheckpointConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg := Config{
+		DataDir: filepath.Join(dir, "cancel"),
+		Net:     &util.SigNetParams,
+		Source:  &cancelSource{src: ref.source, at: 20, cancel: cancel},
+	}
+	n, err := NewNode(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Run(ctx, CheckpointConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped, roots := n.Height(), n.Roots()
+	if stopped == 1 || stopped > 20 {
+		t.Fatalf("cancelled at block 20 but stopped at %d", stopped)
+	}
+	err = n.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err = NewNode(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if n.Height() != stopped || !reflect.DeepEqual(n.Roots(), roots) {
+		t.Fatalf("resumed at %d roots %x, expect %d %x",
+			n.Height(), n.Roots(), stopped, roots)
+	}
+	err = n.Run(context.Background(), CheckpointConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Height() != ref.Height() || !reflect.DeepEqual(n.Roots(), ref.Roots()) {
+		t.Fatalf("finished at %d roots %x, expect %d %x",
+			n.Height(), n.Roots(), ref.Height(), ref.Roots())
+	}
+	for h := int32(1); h < n.Height(); h++ {
+		ua, err := ref.GetUData(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ub, err := n.GetUData(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ua.ToBytes(), ub.ToBytes()) {
+			t.Fatalf("block %d proofs differ", h)
+		}
+	}
+}
+
+// TestNodeWriteError makes the root history fail to write partway through
+// a block, after the forest changed, and checks the node won't go on or
+// save, and a new one resumes from the last checkpoint.
+func TestNodeWriteError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgenode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocksDir := filepath.Join(dir, "blocks")
+	err = os.Mkdir(blocksDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestChain(t, blocksDir, &util.SigNetParams, 20)
+
+	ctx := context.Background()
+	cfg := Config{
+		DataDir:   filepath.Join(dir, "data"),
+		BlocksDir: blocksDir,
+		Net:       &util.SigNetParams,
+		Forest:    ForestRam,
+	}
+	n, err := NewNode(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n.Height() <= 10 {
+		bnr, err := n.ReadBlock(n.Height())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = n.ProcessBlock(bnr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = n.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := n.Roots()
+
+	bnr, err := n.ReadBlock(11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.history.file.Close()
+	_, err = n.ProcessBlock(bnr)
+	if err == nil {
+		t.Fatal("no error writing to a closed root history")
+	}
+	// the forest has the block, so it can't go in again
+	_, err = n.ProcessBlock(bnr)
+	if err == nil || n.Height() != 11 {
+		t.Fatalf("took block 11 again after an error, at %d", n.Height())
+	}
+	if n.Save() == nil || n.Run(ctx, CheckpointConfig{}) == nil {
+		t.Fatal("saved after an error")
+	}
+	n.Close()
+
+	n, err = NewNode(ctx, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if n.Height() != 11 || !reflect.DeepEqual(n.Roots(), roots) {
+		t.Fatalf("resumed at %d roots %x, expect 11 %x",
+			n.Height(), n.Roots(), roots)
+	}
+	err = n.Run(ctx, CheckpointConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := int32(11); h < n.Height(); h++ {
+		r, err := n.RootsAt(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Height != h {
+			t.Fatalf("root history has block %d for %d", r.Height, h)
+		}
+	}
+}
+
+// TestNodeCrash stops a node with its forest in a file without saving,
+// after it's changed the forest past the last checkpoint, and checks it
+// resumes from the checkpoint and ends up the same as a node that didn't
+// stop.
+func TestNodeCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgenode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocksDir := filepath.Join(dir, "blocks")
+	err = os.Mkdir(blocksDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestChain(t, blocksDir, &util.SigNetParams, 30)
+
+	ctx := context.Background()
+	ref, err := NewNode(ctx, Config{
+		DataDir:   filepath.Join(dir, "ref"),
+		BlocksDir: blocksDir,
+		Net:       &util.SigNetParams,
+		Forest:    ForestRam,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Close()
+	err = ref.Run(ctx, CheckpointConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, backend := range []ForestBackend{ForestDisk, ForestHybrid} {
+		dataDir := filepath.Join(dir, fmt.Sprint(backend))
+		cfg := Config{
+			DataDir:         dataDir,
+			BlocksDir:       blocksDir,
+			Net:             &util.SigNetParams,
+			Forest:          backend,
+			ForestRamBudget: 256,
+		}
+		n, err := NewNode(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n.Height() <= 20 {
+			if n.Height() == 12 {
+				err = n.Save()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			bnr, err := n.ReadBlock(n.Height())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = n.ProcessBlock(bnr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		crashNode(n)
+
+		n, err = NewNode(ctx, cfg)
+		if err != nil {
+			t.Fatalf("backend %d: %s", backend, err.Error())
+		}
+		r, err := ref.RootsAt(11)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Height() != 12 || !reflect.DeepEqual(n.Roots(), r.Roots) {
+			t.Fatalf("backend %d resumed at %d roots %x, "+
+				"expect 12 %x", backend, n.Height(), n.Roots(),
+				r.Roots)
+		}
+		err = n.Run(ctx, CheckpointConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Height() != ref.Height() ||
+			!reflect.DeepEqual(n.Roots(), ref.Roots()) {
+			t.Fatalf("backend %d finished at %d roots %x, "+
+				"expect %d %x", backend, n.Height(), n.Roots(),
+				ref.Height(), ref.Roots())
+		}
+		n.Close()
+	}
+}
+
+// crashNode stops a node like it crashed: nothing gets saved, and the
+// forest is left how it is, without writing out anything it has in ram.
+// Everything else is closed so a new Node can open the data dir.
+func crashNode(n *Node) {
+	n.proofs.close()
+	n.history.close()
+	n.lvdb.Close()
+	if n.leaves != nil {
+		n.leaves.close()
+	}
+}
+
+// failSource gets blocks from src, but fails from block at on
+type failSource struct {
+	src BlockSource
+	at  int32
+}
+
+func (fs *failSource) BlockAndRev(height int32) (util.BlockAndRev, error) {
+	if height >= fs.at {
+		return util.BlockAndRev{}, fmt.Errorf("no block %d", height)
+	}
+	return fs.src.BlockAndRev(height)
+}
+
+func (fs *failSource) TipHeight() (int32, error) {
+	return fs.src.TipHeight()
+}
+
+// TestNodeCheckpoints runs nodes with their forest on disk that checkpoint
+// every few blocks or every bit of time, crashes them partway, and checks
+// they resume from the last checkpoint they made and finish the same as a
+// node that didn't stop.
+func TestNodeCheckpoints(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgenode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocksDir := filepath.Join(dir, "blocks")
+	err = os.Mkdir(blocksDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestChain(t, blocksDir, &util.SigNetParams, 30)
+
+	ctx := context.Background()
+	ref, err := NewNode(ctx, Config{
+		DataDir:   filepath.Join(dir, "ref"),
+		BlocksDir: blocksDir,
+		Net:       &util.SigNetParams,
+		Forest:    ForestRam,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ref.Close()
+	err = ref.Run(ctx, CheckpointConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, ckpt := range []CheckpointConfig{
+		{Blocks: 5},
+		// every block
+		{Interval: time.Nanosecond},
+		// the blocks come first
+		{Blocks: 4, Interval: time.Hour},
+	} {
+		cfg := Config{
+			DataDir: filepath.Join(dir, fmt.Sprint(i)),
+			Net:     &util.SigNetParams,
+			Source:  &failSource{src: ref.source, at: 18},
+		}
+		n, err := NewNode(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.Run(ctx, ckpt)
+		if err == nil {
+			t.Fatalf("%+v: no error from the source", ckpt)
+		}
+		// the error can come before the blocks already read, but the
+		// block reader only gets 10 ahead
+		stopped := n.Height()
+		if stopped < 8 || stopped > 18 {
+			t.Fatalf("%+v: stopped at %d", ckpt, stopped)
+		}
+		crashNode(n)
+
+		cfg.Source = ref.source
+		n, err = NewNode(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// it resumes from the last checkpoint before where it stopped,
+		// or the one before that, since the error can come first
+		resumed, every := n.Height(), int32(1)
+		if ckpt.Blocks != 0 {
+			every = ckpt.Blocks
+		}
+		if resumed > stopped || resumed < stopped-every ||
+			(resumed-1)%every != 0 {
+			t.Fatalf("%+v: stopped at %d, resumed at %d",
+				ckpt, stopped, resumed)
+		}
+		r, err := ref.RootsAt(resumed - 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(n.Roots(), r.Roots) {
+			t.Fatalf("%+v: resumed at %d roots %x, expect %x",
+				ckpt, resumed, n.Roots(), r.Roots)
+		}
+		err = n.Run(ctx, ckpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Height() != ref.Height() ||
+			!reflect.DeepEqual(n.Roots(), ref.Roots()) {
+			t.Fatalf("%+v: finished at %d roots %x, expect %d %x",
+				ckpt, n.Height(), n.Roots(), ref.Height(),
+				ref.Roots())
+		}
+		for h := int32(1); h < n.Height(); h++ {
+			ua, err := ref.GetUData(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ub, err := n.GetUData(h)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(ua.ToBytes(), ub.ToBytes()) {
+				t.Fatalf("%+v: block %d proofs differ", ckpt, h)
+			}
+		}
+		n.Close()
+	}
+}
+
+// TestNodeReorg gives a node blocks that don't build on the last one it
+// did, before and after resuming
+func TestNodeReorg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgenode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocksDir := filepath.Join(dir, "blocks")
+	err = os.Mkdir(blocksDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestChain(t, blocksDir, &util.SigNetParams, 12)
+
+	ctx := context.Background()
+	cfg := Config{
+		DataDir:   filepath.Join(dir, "data"),
+		BlocksDir: blocksDir,
+		Net:       &util.SigNetParams,
+	}
+	for _, stop := range []int32{1, 2, 9} {
+		n, err := NewNode(ctx, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for n.Height() < stop {
+			bnr, err := n.ReadBlock(n.Height())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = n.ProcessBlock(bnr)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		bnr, err := n.ReadBlock(stop)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bad := bnr
+		bad.Blk.Header.PrevBlock[0] ^= 1
+		_, err = n.ProcessBlock(bad)
+		if err == nil || n.Height() != stop {
+			t.Fatalf("took block %d on the wrong block", stop)
+		}
+		// the right one still goes in
+		_, err = n.ProcessBlock(bnr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.Save()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestNodeXor runs a node on blk and rev files obfuscated like newer
+// bitcoind does, and makes sure it gets the same roots as with plain files.
+func TestNodeXor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgenode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	var roots [2][]accumulator.Hash
+	for i, key := range [][]byte{nil, {1, 2, 3, 4, 0xf0, 0xe0, 0xd0, 0xc0}} {
+		blocksDir := filepath.Join(dir, fmt.Sprintf("blocks%d", i))
+		err = os.Mkdir(blocksDir, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestChain(t, blocksDir, &util.SigNetParams, 20)
+		if key != nil {
+			xorTestFiles(t, blocksDir, key)
+		}
+
+		n, err := NewNode(ctx, Config{
+			DataDir:   filepath.Join(dir, fmt.Sprintf("data%d", i)),
+			BlocksDir: blocksDir,
+			Net:       &util.SigNetParams,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.Run(ctx, CheckpointConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Height() != n.TipHeight() {
+			t.Fatalf("stopped at %d, tip %d", n.Height(), n.TipHeight())
+		}
+		roots[i] = n.Roots()
+		err = n.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(roots[0], roots[1]) {
+		t.Fatalf("obfuscated roots %x, plain roots %x", roots[1], roots[0])
+	}
+}
+
+// xorTestFiles obfuscates the blk and rev files in dir with key, and writes
+// the key to xor.dat
+func xorTestFiles(t *testing.T, dir string, key []byte) {
+	for _, name := range []string{"blk00000.dat", "rev00000.dat"} {
+		path := filepath.Join(dir, name)
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range b {
+			b[i] ^= key[i%len(key)]
+		}
+		err = ioutil.WriteFile(path, b, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := ioutil.WriteFile(filepath.Join(dir, "xor.dat"), key, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNodeLeafStore runs a node with a leaf store on blocks without rev
+// files, and checks it makes the same proofs as one using the rev files.
+func TestNodeLeafStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgenode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	net := &util.SigNetParams
+	revDir := filepath.Join(dir, "rev")
+	noRevDir := filepath.Join(dir, "norev")
+	for _, d := range []string{revDir, noRevDir} {
+		err = os.Mkdir(d, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeTestChain(t, d, net, 30)
+	}
+	err = os.Remove(filepath.Join(noRevDir, "rev00000.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	a, err := NewNode(ctx, Config{
+		DataDir:   filepath.Join(dir, "a"),
+		BlocksDir: revDir,
+		Net:       net,
+		Forest:    ForestRam,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	bCfg := Config{
+		DataDir:   filepath.Join(dir, "b"),
+		BlocksDir: noRevDir,
+		Net:       net,
+		Undo:      UndoLeafStore,
+	}
+	b, err := NewNode(ctx, bCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for a.Height() < a.TipHeight() {
+		// stop b halfway and start it up again
+		if a.Height() == 15 {
+			err = b.Save()
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = b.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err = NewNode(ctx, bCfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.Height() != 15 {
+				t.Fatalf("resumed at %d, expect 15", b.Height())
+			}
+		}
+		bnr, err := a.ReadBlock(a.Height())
+		if err != nil {
+			t.Fatal(err)
+		}
+		aud, err := a.ProcessBlock(bnr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bnr, err = b.ReadBlock(b.Height())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(bnr.Rev.Txs) != 0 {
+			t.Fatalf("leaf store node read rev block")
+		}
+		bud, err := b.ProcessBlock(bnr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(aud.ToBytes(), bud.ToBytes()) {
+			t.Fatalf("block %d proofs differ", bnr.Height)
+		}
+	}
+	if !reflect.DeepEqual(a.Roots(), b.Roots()) {
+		t.Fatalf("roots %x and %x", a.Roots(), b.Roots())
+	}
+	err = b.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestNodeRamSnapshot stops a node with its forest in ram after it's gone
+// past its last save, and checks it picks up from the snapshot, with the
+// leaf store rolled back to match.
+func TestNodeRamSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgenode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	net := &util.SigNetParams
+	blocksDir := filepath.Join(dir, "blocks")
+	err = os.Mkdir(blocksDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := writeTestChain(t, blocksDir, net, 30)
+
+	ctx := context.Background()
+	disk, err := NewNode(ctx, Config{
+		DataDir:   filepath.Join(dir, "disk"),
+		BlocksDir: blocksDir,
+		Net:       net,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+	err = disk.Run(ctx, CheckpointConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ramCfg := Config{
+		DataDir:   filepath.Join(dir, "ram"),
+		BlocksDir: blocksDir,
+		Net:       net,
+		Forest:    ForestRam,
+		Undo:      UndoLeafStore,
+	}
+	ram, err := NewNode(ctx, ramCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the roots after each block, for the root history
+	var roots [][]accumulator.Hash
+	for ram.Height() < 14 {
+		// save at 6 and 10; the one at 10 is done by Close
+		if ram.Height() == 6 || ram.Height() == 10 {
+			err = ram.Save()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		bnr, err := ram.ReadBlock(ram.Height())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = ram.ProcessBlock(bnr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots = append(roots, ram.Roots())
+	}
+	err = ram.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the checkpoint is in the snapshot, not its own file
+	if util.HasAccess(util.NewPaths(ramCfg.DataDir, "").CheckpointFilePath) {
+		t.Fatalf("ram node wrote a checkpoint file")
+	}
+	snapPath := filepath.Join(dir, "snapshot")
+	err = ExportSnapshot(ramCfg.DataDir, snapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, err := ioutil.ReadFile(snapPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := util.RootsSnapshotFromBytes(exported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Height != 10 || s.BlockHash != blocks[8].BlockHash() ||
+		!reflect.DeepEqual(s.Roots, roots[8]) {
+		t.Fatalf("exported snapshot %+v", s)
+	}
+
+	ram, err = NewNode(ctx, ramCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ram.Close()
+	if ram.Height() != 10 || ram.leaves.height != 10 {
+		t.Fatalf("resumed at %d with leaf store at %d, expect 10",
+			ram.Height(), ram.leaves.height)
+	}
+	err = ram.Run(ctx, CheckpointConfig{Blocks: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ram.Height() != disk.Height() ||
+		!reflect.DeepEqual(ram.Roots(), disk.Roots()) {
+		t.Fatalf("ram at %d roots %x, disk at %d %x",
+			ram.Height(), ram.Roots(), disk.Height(), disk.Roots())
+	}
+	for h := int32(1); h < disk.Height(); h++ {
+		ur, err := ram.GetUData(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ud, err := disk.GetUData(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(ur.ToBytes(), ud.ToBytes()) {
+			t.Fatalf("block %d proofs differ", h)
+		}
+	}
+
+	// the ram node's root history was rolled back to 10 and redone
+	for h := int32(1); h < disk.Height(); h++ {
+		rr, err := ram.RootsAt(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rd, err := disk.RootsAt(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(rr, rd) ||
+			rr.BlockHash != blocks[h-1].BlockHash() ||
+			int(h) <= len(roots) && !reflect.DeepEqual(rr.Roots, roots[h-1]) {
+			t.Fatalf("block %d ram roots %+v disk %+v", h, rr, rd)
+		}
+	}
+	last, err := RootsAt(ramCfg.DataDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Height != ram.Height()-1 ||
+		!reflect.DeepEqual(last.Roots, ram.Roots()) ||
+		last.Commitment() != accumulator.RootsCommitment(
+			ram.NumLeaves(), ram.Roots()) {
+		t.Fatalf("last roots %+v, node at %d roots %x",
+			last, ram.Height(), ram.Roots())
+	}
+	_, err = ram.RootsAt(ram.Height())
+	if err == nil {
+		t.Fatal("roots for a block not done yet")
+	}
+}
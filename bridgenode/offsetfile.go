@@ -1,12 +1,14 @@
 package bridgenode
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"os"
 	"sync"
 
+	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/util"
 )
 
@@ -18,24 +20,39 @@ import (
 // delete the current offsetfile directory and run genproofs again.
 // Fairly quick process with one blk*.dat file taking a few seconds.
 //
-// Returns the last block height that it processed.
-func buildOffsetFile(tip util.Hash) (int32, error) {
+// Returns the last block height that it processed.  If ctx is cancelled
+// before it's done, the partial offset files are removed, since the next
+// run would think they're complete.
+func buildOffsetFile(ctx context.Context, p *util.Paths,
+	params *util.NetParams) (
+	int32, error) {
 
 	// Map to store Block Header Hashes for sorting purposes
 	// blk*.dat files aren't in block order so this is needed
 	nextMap := make(map[[32]byte]util.RawHeaderData)
 
-	offsetFile, err := os.OpenFile(util.OffsetFilePath,
+	offsetFile, err := os.OpenFile(p.OffsetFilePath,
 		os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
 	var lastOffsetHeight int32
+	// blocks are chained from the genesis block
+	tip := params.GenesisHash
 
 	defer offsetFile.Close()
 	for fileNum := 0; ; fileNum++ {
-		fileName := fmt.Sprintf("blk%05d.dat", fileNum)
+		if ctx.Err() != nil {
+			fmt.Println("Stopped building offsetfile, removing it")
+			offsetFile.Close()
+			err = removeOffsetData(p)
+			if err != nil {
+				return 0, err
+			}
+			return 0, ctx.Err()
+		}
+		fileName := p.BlkFilePath(uint32(fileNum))
 		fmt.Printf("Building offsetfile... %s\n", fileName)
 
 		_, err := os.Stat(fileName)
@@ -44,30 +61,44 @@ func buildOffsetFile(tip util.Hash) (int32, error) {
 			break
 		}
 		// grab headers from the .dat file as RawHeaderData type
-		rawheaders, err := readRawHeadersFromFile(uint32(fileNum))
+		rawheaders, err := readRawHeadersFromFile(p, uint32(fileNum), params.Net)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 		tip, lastOffsetHeight, err = writeBlockOffset(
 			rawheaders, nextMap, offsetFile, lastOffsetHeight, tip)
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 	}
 
 	// write the last height of the offsetfile
 	// needed info for the main genproofs processes
 	LastIndexOffsetHeightFile, err := os.OpenFile(
-		util.LastIndexOffsetHeightFilePath, os.O_CREATE|os.O_WRONLY, 0600)
+		p.LastIndexOffsetHeightFilePath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer LastIndexOffsetHeightFile.Close()
+	_, err = LastIndexOffsetHeightFile.Write(
+		util.U32tB(uint32(lastOffsetHeight))[:])
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	LastIndexOffsetHeightFile.Write(util.U32tB(uint32(lastOffsetHeight))[:])
-	LastIndexOffsetHeightFile.Close()
 
 	return lastOffsetHeight, nil
 }
 
+// removeOffsetData removes the blk and rev offset files, so they get built
+// again from scratch next time
+func removeOffsetData(p *util.Paths) error {
+	err := os.RemoveAll(p.OffsetDirPath)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p.RevOffsetDirPath)
+}
+
 /*
 Proof file format is somewhat like the blk.dat and rev.dat files.  But it's
 always in order!  The offset file is in 8 byte chunks, so to find the proof
@@ -81,86 +112,145 @@ change to 4 byte which file and 4 byte offset within file like the blk/rev but
 we're not running on fat32 so works OK for now.
 */
 
-// pFileWorker takes in blockproof and height information from the channel
-// and writes to disk. MUST NOT have more than one worker as the proofs need to be
-// in order
-func proofWriterWorker(
-	proofChan chan []byte, fileWait *sync.WaitGroup) {
+// proofWriter appends proofs to the proof file and their offsets to the
+// proof offset file
+type proofWriter struct {
+	proofFile  *os.File
+	offsetFile *os.File
+	// where the next proof goes in proofFile
+	loc int64
+}
 
+func openProofWriter(p *util.Paths) (*proofWriter, error) {
+	pw := new(proofWriter)
+	var err error
 	// for the pFile
-	proofFile, err := os.OpenFile(
-		util.PFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	pw.proofFile, err = os.OpenFile(
+		p.PFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	offsetFile, err := os.OpenFile(
-		util.POffsetFilePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	pw.offsetFile, err = os.OpenFile(
+		p.POffsetFilePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
-		panic(err)
+		pw.proofFile.Close()
+		return nil, err
 	}
 
-	_, err = offsetFile.Seek(0, 2)
+	pw.loc, err = pw.proofFile.Seek(0, 2)
 	if err != nil {
-		panic(err)
+		pw.close()
+		return nil, err
 	}
+	return pw, nil
+}
 
-	proofFileLocation, err := proofFile.Seek(0, 2)
+// write writes one block's proof
+// TODO: optimization - don't write anything to proof file for blocks with
+// no deletions (inputs).  Lots of em in testnet.  Not so many on mainnet
+// I guess.  But in testnet would save millions *8 bytes.
+func (pw *proofWriter) write(pbytes []byte) error {
+	// write to offset file first
+	err := binary.Write(pw.offsetFile, binary.BigEndian, pw.loc)
 	if err != nil {
-		panic(err)
+		return err
+	}
 
+	// write to proof file
+	// first write big endian proof size int64
+	err = binary.Write(pw.proofFile, binary.BigEndian, int64(len(pbytes)))
+	if err != nil {
+		return err
 	}
-	// TODO: optimization - don't write anything to proof file for blocks with
-	// no deletions (inputs).  Lots of em in testnet.  Not so many on mainnet
-	// I guess.  But in testnet would save millions *8 bytes.
+	pw.loc += 8
+
+	// then write the proof
+	written, err := pw.proofFile.Write(pbytes)
+	if err != nil {
+		return err
+	}
+	pw.loc += int64(written)
+	return nil
+}
+
+func (pw *proofWriter) sync() error {
+	err := pw.proofFile.Sync()
+	if err != nil {
+		return err
+	}
+	return pw.offsetFile.Sync()
+}
+
+func (pw *proofWriter) close() error {
+	err := pw.proofFile.Close()
+	oerr := pw.offsetFile.Close()
+	if err != nil {
+		return err
+	}
+	return oerr
+}
+
+// proofWriterWorker takes in blockproofs from the channel and writes them to
+// disk. MUST NOT have more than one worker as the proofs need to be in order.
+// It returns once proofChan is closed and everything in it is written, or
+// when ctx is done.  If a write fails, the error goes to errChan and the rest
+// of the proofs are dropped, since they'd be at the wrong offsets.
+func proofWriterWorker(ctx context.Context, pw *proofWriter,
+	proofChan chan []byte, fileWait *sync.WaitGroup, errChan chan error) {
+
 	for {
-		pbytes := <-proofChan
-		// write to offset file first
-		err = binary.Write(offsetFile, binary.BigEndian, proofFileLocation)
-		if err != nil {
-			fmt.Printf(err.Error())
+		var pbytes []byte
+		var ok bool
+		select {
+		case pbytes, ok = <-proofChan:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
 			return
 		}
-
-		// write to proof file
-		// first write big endian proof size int64
-		err = binary.Write(proofFile, binary.BigEndian, int64(len(pbytes)))
+		err := pw.write(pbytes)
+		fileWait.Done()
 		if err != nil {
-			fmt.Printf(err.Error())
-			return
+			util.SendErr(errChan, err)
+			break
 		}
-		proofFileLocation += 8
+	}
 
-		// then write the proof
-		written, err := proofFile.Write(pbytes)
-		if err != nil {
-			fmt.Printf(err.Error())
+	// keep taking proofs so nobody waiting on fileWait gets stuck
+	for {
+		select {
+		case _, ok := <-proofChan:
+			if !ok {
+				return
+			}
+			fileWait.Done()
+		case <-ctx.Done():
 			return
 		}
-		proofFileLocation += int64(written)
-
-		fileWait.Done()
 	}
 }
 
 // readRawHeadersFromFile reads only the headers from the given .dat file
-func readRawHeadersFromFile(fileNum uint32) ([]util.RawHeaderData, error) {
+func readRawHeadersFromFile(p *util.Paths, fileNum uint32,
+	net wire.BitcoinNet) (
+	[]util.RawHeaderData, error) {
 	var blockHeaders []util.RawHeaderData
 
-	fileName := fmt.Sprintf("blk%05d.dat", fileNum)
-	f, err := os.Open(fileName)
+	f, err := p.OpenBlkFile(fileNum)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer f.Close()
 
 	fStat, err := f.Stat()
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	fSize := fStat.Size()
 
-	defer f.Close()
 	loc := int64(0)
 	offset := uint32(0) // where the block is located from the beginning of the file
 
@@ -173,7 +263,7 @@ func readRawHeadersFromFile(fileNum uint32) ([]util.RawHeaderData, error) {
 		// check if Bitcoin magic bytes were read
 		var magicbytes [4]byte
 		f.Read(magicbytes[:])
-		if util.CheckMagicByte(magicbytes) == false {
+		if util.CheckMagicByte(magicbytes, net) == false {
 			break
 		}
 
@@ -187,7 +277,7 @@ func readRawHeadersFromFile(fileNum uint32) ([]util.RawHeaderData, error) {
 		var blockheader [80]byte
 		f.Read(blockheader[:])
 
-		copy(b.Prevhash[:], blockheader[4:32])
+		copy(b.Prevhash[:], blockheader[4:36])
 
 		// create block hash
 		// double sha256 needed with Bitcoin
@@ -0,0 +1,36 @@
+package bridgenode
+
+import (
+	"fmt"
+	"time"
+)
+
+// progress keeps track of how fast genproofs is going
+type progress struct {
+	startTime   time.Time
+	startHeight int32
+	tipHeight   int32
+}
+
+func newProgress(startHeight, tipHeight int32) *progress {
+	return &progress{
+		startTime:   time.Now(),
+		startHeight: startHeight,
+		tipHeight:   tipHeight,
+	}
+}
+
+// String gives height, blocks/sec since starting, and an ETA for getting to
+// the tip at that rate.
+func (p *progress) String(height int32) string {
+	elapsed := time.Since(p.startTime)
+	done := height - p.startHeight
+	if done <= 0 || elapsed <= 0 {
+		return fmt.Sprintf("block %d of %d", height, p.tipHeight)
+	}
+	rate := float64(done) / elapsed.Seconds()
+	left := float64(p.tipHeight - height)
+	eta := time.Duration(left / rate * float64(time.Second))
+	return fmt.Sprintf("block %d of %d, %.1f blocks/sec, ETA %s",
+		height, p.tipHeight, rate, eta.Round(time.Second))
+}
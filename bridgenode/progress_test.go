@@ -0,0 +1,29 @@
+package bridgenode
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	p := newProgress(100, 1100)
+	got := p.String(100)
+	if got != "block 100 of 1100" {
+		t.Fatalf("nothing done yet gives %q", got)
+	}
+
+	// 100 blocks in 10 seconds, 900 to go
+	p.startTime = time.Now().Add(-10 * time.Second)
+	got = p.String(200)
+	want := "block 200 of 1100, 10.0 blocks/sec, ETA 1m30s"
+	if got != want {
+		t.Fatalf("got %q, expect %q", got, want)
+	}
+
+	// at the tip there's nothing left
+	got = p.String(1100)
+	want = "block 1100 of 1100, 100.0 blocks/sec, ETA 0s"
+	if got != want {
+		t.Fatalf("got %q, expect %q", got, want)
+	}
+}
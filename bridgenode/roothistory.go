@@ -0,0 +1,266 @@
+package bridgenode
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// RootsRecord is what the root history has for a block
+type RootsRecord struct {
+	// Height is the block; the roots are from after it
+	Height    int32
+	BlockHash chainhash.Hash
+	NumLeaves uint64
+	// Roots are in the same order as GetRoots
+	Roots []accumulator.Hash
+}
+
+// Commitment is 1 hash for the roots, to compare with others
+func (r *RootsRecord) Commitment() accumulator.Hash {
+	return accumulator.RootsCommitment(r.NumLeaves, r.Roots)
+}
+
+// rootHistory keeps the roots after every block, so they can be looked up
+// by height later.  Like the proof files, there's a file with a record for
+// each block and an offset file saying where each one starts.
+//
+// The offset file is the first block there's a record for (4), then the
+// offset of each record (8).  A record is numLeaves (8) block hash (32) and
+// the roots (32 each), as many as there are 1 bits in numLeaves.  All big
+// endian.  Data dirs from before there was a root history start it
+// wherever they are.
+type rootHistory struct {
+	file, offsetFile *os.File
+	first            int32
+	// next is the block the next record is for
+	next int32
+	// loc is where the next record goes in file
+	loc int64
+}
+
+// openRootHistory opens the root history for a forest at height, the next
+// block, making it if it's not there.  Records for blocks at height and
+// after are from after the last checkpoint, and get cut off.
+func openRootHistory(p *util.Paths, height int32) (*rootHistory, error) {
+	rh := new(rootHistory)
+	var err error
+	rh.file, err = os.OpenFile(
+		p.RootHistoryFilePath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	rh.offsetFile, err = os.OpenFile(
+		p.RootHistoryOffsetFilePath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		rh.file.Close()
+		return nil, err
+	}
+	err = rh.rollBack(height)
+	if err != nil {
+		rh.close()
+		return nil, err
+	}
+	return rh, nil
+}
+
+// rollBack cuts the history back to where it has everything before height
+func (rh *rootHistory) rollBack(height int32) error {
+	have, err := rh.readFirst()
+	if err != nil {
+		return err
+	}
+	if have == -1 || rh.first > height {
+		if have != -1 {
+			fmt.Printf("root history starts at %d, after the forest at %d; "+
+				"starting it over\n", rh.first, height)
+		}
+		rh.first = height
+		err = rh.file.Truncate(0)
+		if err != nil {
+			return err
+		}
+		err = rh.offsetFile.Truncate(0)
+		if err != nil {
+			return err
+		}
+		_, err = rh.offsetFile.WriteAt(util.I32tB(height), 0)
+		if err != nil {
+			return err
+		}
+		rh.next = height
+		return nil
+	}
+
+	rh.next = height
+	need := int64(height - rh.first)
+	if have < need {
+		return fmt.Errorf("root history has blocks %d to %d, but the "+
+			"forest is at %d.  Remove %s and %s to start the history over",
+			rh.first, rh.first+int32(have)-1, height,
+			rh.file.Name(), rh.offsetFile.Name())
+	}
+	err = rh.offsetFile.Truncate(4 + need*8)
+	if err != nil {
+		return err
+	}
+	// the next record goes right after the last one
+	rh.loc = 0
+	if need != 0 {
+		r, err := rh.read(height - 1)
+		if err != nil {
+			return err
+		}
+		off, err := rh.offset(height - 1)
+		if err != nil {
+			return err
+		}
+		rh.loc = off + recordLen(r.NumLeaves)
+	}
+	return rh.file.Truncate(rh.loc)
+}
+
+// readFirst reads the first block from the offset file, and gives back how
+// many records it has, or -1 if it's new
+func (rh *rootHistory) readFirst() (int64, error) {
+	info, err := rh.offsetFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if info.Size() < 4 {
+		return -1, nil
+	}
+	var b [4]byte
+	_, err = rh.offsetFile.ReadAt(b[:], 0)
+	if err != nil {
+		return 0, err
+	}
+	rh.first = util.BtI32(b[:])
+	return (info.Size() - 4) / 8, nil
+}
+
+// recordLen is how long a record with numLeaves is
+func recordLen(numLeaves uint64) int64 {
+	return 40 + 32*int64(bits.OnesCount64(numLeaves))
+}
+
+// write adds the record for a block.  They have to go in order.
+func (rh *rootHistory) write(r RootsRecord) error {
+	if r.Height != rh.next {
+		return fmt.Errorf("root history at %d, got block %d",
+			rh.next, r.Height)
+	}
+	_, err := rh.offsetFile.WriteAt(util.U64tB(uint64(rh.loc)),
+		4+int64(r.Height-rh.first)*8)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, 40, recordLen(r.NumLeaves))
+	copy(b, util.U64tB(r.NumLeaves))
+	copy(b[8:], r.BlockHash[:])
+	for _, root := range r.Roots {
+		b = append(b, root[:]...)
+	}
+	n, err := rh.file.WriteAt(b, rh.loc)
+	rh.loc += int64(n)
+	if err != nil {
+		return err
+	}
+	rh.next++
+	return nil
+}
+
+// offset is where the record for a block starts
+func (rh *rootHistory) offset(height int32) (int64, error) {
+	var b [8]byte
+	_, err := rh.offsetFile.ReadAt(b[:], 4+int64(height-rh.first)*8)
+	if err != nil {
+		return 0, err
+	}
+	return int64(util.BtU64(b[:])), nil
+}
+
+// read gives the record for a block
+func (rh *rootHistory) read(height int32) (r RootsRecord, err error) {
+	if height < rh.first || height >= rh.next {
+		err = fmt.Errorf("no roots for block %d, history has %d to %d",
+			height, rh.first, rh.next-1)
+		return
+	}
+	off, err := rh.offset(height)
+	if err != nil {
+		return
+	}
+	sr := io.NewSectionReader(rh.file, off, 1<<62)
+	var head [40]byte
+	_, err = io.ReadFull(sr, head[:])
+	if err != nil {
+		return
+	}
+	r.Height = height
+	r.NumLeaves = util.BtU64(head[:8])
+	copy(r.BlockHash[:], head[8:])
+	r.Roots = make([]accumulator.Hash, bits.OnesCount64(r.NumLeaves))
+	for i := range r.Roots {
+		_, err = io.ReadFull(sr, r.Roots[i][:])
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (rh *rootHistory) sync() error {
+	err := rh.file.Sync()
+	if err != nil {
+		return err
+	}
+	return rh.offsetFile.Sync()
+}
+
+func (rh *rootHistory) close() error {
+	err := rh.file.Close()
+	oerr := rh.offsetFile.Close()
+	if err != nil {
+		return err
+	}
+	return oerr
+}
+
+// RootsAt reads the roots after block height from the root history in
+// dataDir, without opening the rest of the node.  Height 0 is the last block
+// there.  It only reads, so it's ok with genproofs running, but blocks past
+// the last checkpoint can still change if genproofs stops before the next.
+func RootsAt(dataDir string, height int32) (RootsRecord, error) {
+	p := util.NewPaths(dataDir, "")
+	rh := new(rootHistory)
+	var err error
+	rh.file, err = os.Open(p.RootHistoryFilePath)
+	if err != nil {
+		return RootsRecord{}, err
+	}
+	defer rh.file.Close()
+	rh.offsetFile, err = os.Open(p.RootHistoryOffsetFilePath)
+	if err != nil {
+		return RootsRecord{}, err
+	}
+	defer rh.offsetFile.Close()
+	have, err := rh.readFirst()
+	if err != nil {
+		return RootsRecord{}, err
+	}
+	if have < 1 {
+		return RootsRecord{}, fmt.Errorf("root history in %s is empty",
+			p.ProofDirPath)
+	}
+	rh.next = rh.first + int32(have)
+	if height == 0 {
+		height = rh.next - 1
+	}
+	return rh.read(height)
+}
@@ -0,0 +1,99 @@
+package bridgenode
+
+import (
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// TestRootHistory writes records, and opens the history again at heights
+// before, after, and inside them.
+func TestRootHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "roothistory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := util.NewPaths(dir, "")
+	err = p.MakePaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a data dir from before there was a history, at block 5
+	rh, err := openRootHistory(p, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var records []RootsRecord
+	for h := int32(5); h < 12; h++ {
+		r := RootsRecord{Height: h, NumLeaves: uint64(h) * 3}
+		r.BlockHash[0] = byte(h)
+		for i := 0; i < bits.OnesCount64(r.NumLeaves); i++ {
+			r.Roots = append(r.Roots, accumulator.Hash{byte(h), byte(i)})
+		}
+		err = rh.write(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	if rh.write(records[0]) == nil {
+		t.Fatal("wrote block 5 again")
+	}
+	rh.close()
+
+	// roll back to 9; 9 and on are gone
+	rh, err = openRootHistory(p, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := int32(5); h < 9; h++ {
+		r, err := rh.read(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(r, records[h-5]) {
+			t.Fatalf("block %d read %+v, expect %+v", h, r, records[h-5])
+		}
+	}
+	for _, h := range []int32{4, 9} {
+		_, err = rh.read(h)
+		if err == nil {
+			t.Fatalf("read block %d", h)
+		}
+	}
+	err = rh.write(records[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rh.close()
+	r, err := RootsAt(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r, records[4]) {
+		t.Fatalf("last %+v, expect %+v", r, records[4])
+	}
+
+	// a forest past the end of the history can't be filled in
+	_, err = openRootHistory(p, 12)
+	if err == nil {
+		t.Fatal("opened history ending at 9 for forest at 12")
+	}
+	// a forest before the start of it starts it over
+	rh, err = openRootHistory(p, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rh.close()
+	_, err = RootsAt(dir, 0)
+	if err == nil {
+		t.Fatal("history not started over")
+	}
+}
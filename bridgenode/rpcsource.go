@@ -0,0 +1,327 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// RPCSource gets blocks from bitcoind over JSON-RPC, so the bridge node
+// doesn't need bitcoind's files or for it to be stopped.  The undo data
+// comes from getblock with verbosity 3, which gives the output each input
+// spends; that's bitcoind 23 and up.  With UndoLeafStore it isn't needed
+// and older versions work too.
+//
+// The bridge node can't undo blocks, so a reorg of blocks it's already
+// done breaks it.  TipHeight stays depth blocks behind bitcoind's tip for
+// that, and the node won't take a block that doesn't build on the last one.
+type RPCSource struct {
+	url        string
+	user, pass string
+	depth      int32
+	client     *http.Client
+	// id for the next request
+	id uint64
+}
+
+// DefaultRPCDepth is how many blocks behind bitcoind's tip to stay, unless
+// told otherwise
+const DefaultRPCDepth = 6
+
+// NewRPCSource connects to bitcoind's RPC at url, like
+// http://127.0.0.1:8332, and checks it's on the network net.  It only gives
+// blocks depth or more behind bitcoind's best block.
+func NewRPCSource(url, user, pass string, net *util.NetParams,
+	depth int32) (*RPCSource, error) {
+
+	if depth < 0 {
+		return nil, fmt.Errorf("depth %d below 0", depth)
+	}
+	s := &RPCSource{url: url, user: user, pass: pass, depth: depth,
+		client: &http.Client{Timeout: 5 * time.Minute}}
+	hash, err := s.blockHash(0)
+	if err != nil {
+		return nil, err
+	}
+	if hash != chainhash.Hash(net.GenesisHash) {
+		return nil, fmt.Errorf("%s has genesis block %s, not %s's %s",
+			url, hash, net.Name, chainhash.Hash(net.GenesisHash))
+	}
+	return s, nil
+}
+
+// TipHeight is one past bitcoind's best block, less the depth.  At least 1.
+func (s *RPCSource) TipHeight() (int32, error) {
+	var count int32
+	err := s.call("getblockcount", &count)
+	if err != nil {
+		return 0, err
+	}
+	if count < s.depth {
+		return 1, nil
+	}
+	return count + 1 - s.depth, nil
+}
+
+// BlockAndRev gets the block at height, and makes its undo data from the
+// prevouts in it
+func (s *RPCSource) BlockAndRev(height int32) (util.BlockAndRev, error) {
+	bnr := util.BlockAndRev{Height: height}
+	hash, err := s.blockHash(height)
+	if err != nil {
+		return bnr, err
+	}
+	var rb rpcBlock
+	err = s.call("getblock", &rb, hash.String(), 3)
+	if err != nil {
+		return bnr, err
+	}
+	if rb.Height != height {
+		return bnr, fmt.Errorf("asked for block %d %s but got %d",
+			height, hash, rb.Height)
+	}
+	bnr.Blk, err = rb.msgBlock()
+	if err != nil {
+		return bnr, fmt.Errorf("block %d: %s", height, err.Error())
+	}
+	if bnr.Blk.BlockHash() != hash {
+		return bnr, fmt.Errorf("block %d hashes to %s, expect %s",
+			height, bnr.Blk.BlockHash(), hash)
+	}
+	bnr.Rev, err = rb.revBlock()
+	if err != nil {
+		return bnr, fmt.Errorf("block %d: %s", height, err.Error())
+	}
+	return bnr, nil
+}
+
+// Block gets just the block, for when the undo data isn't needed.  That
+// works with any version of bitcoind.
+func (s *RPCSource) Block(height int32) (msg wire.MsgBlock, err error) {
+	hash, err := s.blockHash(height)
+	if err != nil {
+		return
+	}
+	var blockHex string
+	err = s.call("getblock", &blockHex, hash.String(), 0)
+	if err != nil {
+		return
+	}
+	b, err := hex.DecodeString(blockHex)
+	if err != nil {
+		return
+	}
+	err = msg.Deserialize(bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	if msg.BlockHash() != hash {
+		err = fmt.Errorf("block %d hashes to %s, expect %s",
+			height, msg.BlockHash(), hash)
+	}
+	return
+}
+
+func (s *RPCSource) blockHash(height int32) (chainhash.Hash, error) {
+	var hashStr string
+	err := s.call("getblockhash", &hashStr, height)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	hash, err := chainhash.NewHashFromStr(hashStr)
+	if err != nil {
+		return chainhash.Hash{}, err
+	}
+	return *hash, nil
+}
+
+// rpcRequest and rpcResponse are JSON-RPC 1.0, which bitcoind takes
+type rpcRequest struct {
+	JSONRPC string        `json:"jsonrpc"`
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	Result json.RawMessage `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// call calls method with params and puts what comes back in result
+func (s *RPCSource) call(
+	method string, result interface{}, params ...interface{}) error {
+
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(rpcRequest{JSONRPC: "1.0",
+		ID: atomic.AddUint64(&s.id, 1), Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(s.user, s.pass)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// bitcoind sends errors with a 500 or 404 and the error in the json,
+	// but a bad password is a 401 and nothing else
+	var rr rpcResponse
+	err = json.NewDecoder(resp.Body).Decode(&rr)
+	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", method, resp.Status)
+		}
+		return fmt.Errorf("%s: %s", method, err.Error())
+	}
+	if rr.Error != nil {
+		return fmt.Errorf("%s: %s (code %d)",
+			method, rr.Error.Message, rr.Error.Code)
+	}
+	return json.Unmarshal(rr.Result, result)
+}
+
+// rpcBlock is the parts of getblock with verbosity 3 that we need
+type rpcBlock struct {
+	Height            int32   `json:"height"`
+	Version           int32   `json:"version"`
+	PreviousBlockHash string  `json:"previousblockhash"`
+	MerkleRoot        string  `json:"merkleroot"`
+	Time              int64   `json:"time"`
+	Bits              string  `json:"bits"`
+	Nonce             uint32  `json:"nonce"`
+	Tx                []rpcTx `json:"tx"`
+}
+
+type rpcTx struct {
+	Hex string `json:"hex"`
+	Vin []struct {
+		// Prevout is only there with verbosity 3, and never for the
+		// coinbase
+		Prevout *rpcPrevout `json:"prevout"`
+	} `json:"vin"`
+}
+
+type rpcPrevout struct {
+	Generated    bool        `json:"generated"`
+	Height       int32       `json:"height"`
+	Value        json.Number `json:"value"`
+	ScriptPubKey struct {
+		Hex string `json:"hex"`
+	} `json:"scriptPubKey"`
+}
+
+// msgBlock puts the block back together from the header fields and the
+// raw txs
+func (rb *rpcBlock) msgBlock() (msg wire.MsgBlock, err error) {
+	prev, err := chainhash.NewHashFromStr(rb.PreviousBlockHash)
+	if err != nil {
+		return
+	}
+	merkle, err := chainhash.NewHashFromStr(rb.MerkleRoot)
+	if err != nil {
+		return
+	}
+	bits, err := strconv.ParseUint(rb.Bits, 16, 32)
+	if err != nil {
+		return
+	}
+	msg.Header = wire.BlockHeader{
+		Version:    rb.Version,
+		PrevBlock:  *prev,
+		MerkleRoot: *merkle,
+		Timestamp:  time.Unix(rb.Time, 0),
+		Bits:       uint32(bits),
+		Nonce:      rb.Nonce,
+	}
+	for i, rtx := range rb.Tx {
+		b, err := hex.DecodeString(rtx.Hex)
+		if err != nil {
+			return msg, fmt.Errorf("tx %d: %s", i, err.Error())
+		}
+		tx := wire.NewMsgTx(1)
+		err = tx.Deserialize(bytes.NewReader(b))
+		if err != nil {
+			return msg, fmt.Errorf("tx %d: %s", i, err.Error())
+		}
+		msg.AddTransaction(tx)
+	}
+	return
+}
+
+// revBlock makes the undo data from the prevouts, the same as what's in
+// the rev files
+func (rb *rpcBlock) revBlock() (rev util.RevBlock, err error) {
+	for i, rtx := range rb.Tx {
+		// the coinbase has no undo data
+		if i == 0 {
+			continue
+		}
+		txUndo := new(util.TxUndo)
+		for j, in := range rtx.Vin {
+			if in.Prevout == nil {
+				return rev, fmt.Errorf("tx %d input %d has no "+
+					"prevout; getblock verbosity 3 needs "+
+					"bitcoind 23 or newer", i, j)
+			}
+			var ti util.TxInUndo
+			ti.Height = in.Prevout.Height
+			ti.Coinbase = in.Prevout.Generated
+			ti.Amount, err = btcToSat(in.Prevout.Value)
+			if err != nil {
+				return rev, fmt.Errorf("tx %d input %d: %s",
+					i, j, err.Error())
+			}
+			ti.PKScript, err = hex.DecodeString(
+				in.Prevout.ScriptPubKey.Hex)
+			if err != nil {
+				return rev, fmt.Errorf("tx %d input %d: %s",
+					i, j, err.Error())
+			}
+			txUndo.TxIn = append(txUndo.TxIn, &ti)
+		}
+		rev.Txs = append(rev.Txs, txUndo)
+	}
+	return
+}
+
+// btcToSat turns an amount in btc like bitcoind gives, 0.00012345, into
+// satoshis.  Goes through the digits instead of a float so nothing's off
+// by one.
+func btcToSat(n json.Number) (int64, error) {
+	s := n.String()
+	whole, frac := s, ""
+	if dot := strings.Index(s, "."); dot != -1 {
+		whole, frac = s[:dot], s[dot+1:]
+	}
+	if len(frac) > 8 {
+		return 0, fmt.Errorf("amount %s has more than 8 decimals", s)
+	}
+	frac += strings.Repeat("0", 8-len(frac))
+	sat, err := strconv.ParseInt(whole+frac, 10, 64)
+	if err != nil || sat < 0 {
+		return 0, fmt.Errorf("bad amount %s", s)
+	}
+	return sat, nil
+}
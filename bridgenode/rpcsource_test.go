@@ -0,0 +1,281 @@
+package bridgenode
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// fakeRPC serves blocks like bitcoind's RPC does, with getblock verbosity
+// 3.  It keeps its own utxo set to make the prevouts.
+type fakeRPC struct {
+	genesis chainhash.Hash
+	blocks  []*wire.MsgBlock
+	// getblock results by hash
+	verbose map[chainhash.Hash]map[string]interface{}
+}
+
+func newFakeRPC(net *util.NetParams, blocks []*wire.MsgBlock) *fakeRPC {
+	f := &fakeRPC{genesis: chainhash.Hash(net.GenesisHash), blocks: blocks,
+		verbose: make(map[chainhash.Hash]map[string]interface{})}
+
+	type utxo struct {
+		height   int32
+		coinbase bool
+		out      *wire.TxOut
+	}
+	utxos := make(map[wire.OutPoint]utxo)
+	for i, msg := range blocks {
+		height := int32(i + 1)
+		var txs []interface{}
+		for j, tx := range msg.Transactions {
+			var vins []interface{}
+			for _, in := range tx.TxIn {
+				if j == 0 {
+					vins = append(vins, map[string]interface{}{
+						"coinbase": hex.EncodeToString(in.SignatureScript)})
+					continue
+				}
+				u := utxos[in.PreviousOutPoint]
+				delete(utxos, in.PreviousOutPoint)
+				vins = append(vins, map[string]interface{}{
+					"txid": in.PreviousOutPoint.Hash.String(),
+					"vout": in.PreviousOutPoint.Index,
+					"prevout": map[string]interface{}{
+						"generated": u.coinbase,
+						"height":    u.height,
+						"value": json.Number(fmt.Sprintf("%d.%08d",
+							u.out.Value/1e8, u.out.Value%1e8)),
+						"scriptPubKey": map[string]interface{}{
+							"hex": hex.EncodeToString(u.out.PkScript)},
+					},
+				})
+			}
+			for k, out := range tx.TxOut {
+				utxos[wire.OutPoint{Hash: tx.TxHash(), Index: uint32(k)}] =
+					utxo{height: height, coinbase: j == 0, out: out}
+			}
+			var b bytes.Buffer
+			tx.Serialize(&b)
+			txs = append(txs, map[string]interface{}{
+				"txid": tx.TxHash().String(),
+				"hex":  hex.EncodeToString(b.Bytes()),
+				"vin":  vins,
+			})
+		}
+		f.verbose[msg.BlockHash()] = map[string]interface{}{
+			"hash":              msg.BlockHash().String(),
+			"height":            height,
+			"version":           msg.Header.Version,
+			"previousblockhash": msg.Header.PrevBlock.String(),
+			"merkleroot":        msg.Header.MerkleRoot.String(),
+			"time":              msg.Header.Timestamp.Unix(),
+			"bits":              fmt.Sprintf("%08x", msg.Header.Bits),
+			"nonce":             msg.Header.Nonce,
+			"tx":                txs,
+		}
+	}
+	return f
+}
+
+func (f *fakeRPC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != "user" || pass != "pass" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var req struct {
+		ID     uint64            `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var result interface{}
+	var rpcErr interface{}
+	switch req.Method {
+	case "getblockcount":
+		result = len(f.blocks)
+	case "getblockhash":
+		var height int
+		json.Unmarshal(req.Params[0], &height)
+		switch {
+		case height == 0:
+			result = f.genesis.String()
+		case height > 0 && height <= len(f.blocks):
+			result = f.blocks[height-1].BlockHash().String()
+		default:
+			rpcErr = map[string]interface{}{
+				"code": -8, "message": "Block height out of range"}
+		}
+	case "getblock":
+		var hashStr string
+		var verbosity int
+		json.Unmarshal(req.Params[0], &hashStr)
+		json.Unmarshal(req.Params[1], &verbosity)
+		hash, _ := chainhash.NewHashFromStr(hashStr)
+		if verbosity != 3 || f.verbose[*hash] == nil {
+			rpcErr = map[string]interface{}{
+				"code": -5, "message": "Block not found"}
+			break
+		}
+		result = f.verbose[*hash]
+	default:
+		rpcErr = map[string]interface{}{
+			"code": -32601, "message": "Method not found"}
+	}
+	if rpcErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result": result, "error": rpcErr, "id": req.ID})
+}
+
+// TestRPCSource runs a node getting blocks over rpc from a fake bitcoind,
+// and checks it makes the same proofs as a node reading the same blocks
+// from files.
+func TestRPCSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bridgenode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocksDir := filepath.Join(dir, "blocks")
+	err = os.Mkdir(blocksDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	net := &util.SigNetParams
+	blocks := writeTestChain(t, blocksDir, net, 25)
+	server := httptest.NewServer(newFakeRPC(net, blocks))
+	defer server.Close()
+
+	_, err = NewRPCSource(server.URL, "user", "nope", net, 0)
+	if err == nil {
+		t.Fatalf("no error with wrong password")
+	}
+	_, err = NewRPCSource(server.URL, "user", "pass", &util.TestNet3Params, 0)
+	if err == nil {
+		t.Fatalf("no error for wrong network")
+	}
+	for depth, expect := range map[int32]int32{5: 21, 25: 1, 40: 1} {
+		src, err := NewRPCSource(server.URL, "user", "pass", net, depth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tip, err := src.TipHeight()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tip != expect {
+			t.Fatalf("depth %d tip %d, expect %d", depth, tip, expect)
+		}
+	}
+	src, err := NewRPCSource(server.URL, "user", "pass", net, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip, err := src.TipHeight()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tip != 26 {
+		t.Fatalf("tip %d, expect 26", tip)
+	}
+	_, err = src.BlockAndRev(26)
+	if err == nil {
+		t.Fatalf("got block past the tip")
+	}
+
+	ctx := context.Background()
+	files, err := NewNode(ctx, Config{
+		DataDir:   filepath.Join(dir, "files"),
+		BlocksDir: blocksDir,
+		Net:       net,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer files.Close()
+	rpc, err := NewNode(ctx, Config{
+		DataDir: filepath.Join(dir, "rpc"),
+		Net:     net,
+		Source:  src,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rpc.Close()
+	// no offset files with rpc
+	if util.HasAccess(rpc.Paths().OffsetFilePath) {
+		t.Fatalf("rpc node made an offset file")
+	}
+
+	err = rpc.Run(ctx, CheckpointConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rpc.Height() != 26 {
+		t.Fatalf("rpc node stopped at %d, expect 26", rpc.Height())
+	}
+	for files.Height() < files.TipHeight() {
+		bnr, err := files.ReadBlock(files.Height())
+		if err != nil {
+			t.Fatal(err)
+		}
+		rbnr, err := rpc.ReadBlock(bnr.Height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(bnr, rbnr) {
+			t.Fatalf("block %d from files %+v, from rpc %+v",
+				bnr.Height, bnr, rbnr)
+		}
+		fud, err := files.ProcessBlock(bnr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rud, err := rpc.GetUData(bnr.Height)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(fud.ToBytes(), rud.ToBytes()) {
+			t.Fatalf("block %d proofs differ", bnr.Height)
+		}
+	}
+}
+
+func TestBTCToSat(t *testing.T) {
+	for s, sat := range map[string]int64{
+		"0": 0, "0.00000001": 1, "1": 1e8, "0.1": 1e7,
+		"20999999.97690000": 2099999997690000,
+	} {
+		got, err := btcToSat(json.Number(s))
+		if err != nil || got != sat {
+			t.Fatalf("%s gave %d %v, expect %d", s, got, err, sat)
+		}
+	}
+	for _, s := range []string{"-1", "0.000000001", "1e8", "x"} {
+		_, err := btcToSat(json.Number(s))
+		if err == nil {
+			t.Fatalf("no error for %s", s)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package bridgenode
+
+import (
+	"context"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// BlockSource is where a Node gets blocks, along with the undo data that
+// says what each block's inputs spend
+type BlockSource interface {
+	// BlockAndRev gives the block at height and its undo data
+	BlockAndRev(height int32) (util.BlockAndRev, error)
+	// TipHeight is where Run stops; blocks below it are there to get
+	TipHeight() (int32, error)
+}
+
+// fileSource reads blocks from bitcoind's blk*.dat and rev*.dat files,
+// using the offset files in the data dir to find them
+type fileSource struct {
+	paths *util.Paths
+	// tip is how far the offset files go
+	tip int32
+}
+
+// BlockAndRev reads a block and its rev block from the blocks dir
+func (fs *fileSource) BlockAndRev(height int32) (
+	bnr util.BlockAndRev, err error) {
+
+	bnr.Height = height
+	bnr.Blk, err = util.GetRawBlockFromFile(height, fs.paths)
+	if err != nil {
+		return
+	}
+	bnr.Rev, err = util.GetRevBlock(height, fs.paths)
+	return
+}
+
+// Block reads just the block, for when the rev block isn't needed
+func (fs *fileSource) Block(height int32) (wire.MsgBlock, error) {
+	return util.GetRawBlockFromFile(height, fs.paths)
+}
+
+// TipHeight is how far the offset files go.  New blk files aren't picked up
+// until the offset files are made again.
+func (fs *fileSource) TipHeight() (int32, error) {
+	return fs.tip, nil
+}
+
+// sourceReader gets blocks from curHeight up to maxHeight with read and
+// sends them to blockChan, in order.  It stops when ctx is done, or on an
+// error, which goes to errChan.
+func sourceReader(ctx context.Context,
+	read func(height int32) (util.BlockAndRev, error),
+	blockChan chan util.BlockAndRev, errChan chan error,
+	maxHeight, curHeight int32) {
+
+	for curHeight < maxHeight {
+		bnr, err := read(curHeight)
+		if err != nil {
+			util.SendErr(errChan, err)
+			return
+		}
+		select {
+		case blockChan <- bnr:
+		case <-ctx.Done():
+			return
+		}
+		curHeight++
+	}
+}
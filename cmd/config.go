@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// confFileName is the config file, which goes in the base data dir
+const confFileName = "utreexo.conf"
+
+// readConf reads a config file of option=value lines, the same options as
+// the command line flags.  Blank lines and lines starting with # are skipped.
+// A missing file is fine and gives no options.
+func readConf(path string) (map[string]string, error) {
+	opts := make(map[string]string)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return opts, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		eq := strings.Index(line, "=")
+		if eq == -1 {
+			return nil, fmt.Errorf("%s line %d: expect option=value, got %s",
+				path, lineNum, line)
+		}
+		key := strings.TrimLeft(strings.TrimSpace(line[:eq]), "-")
+		opts[key] = strings.TrimSpace(line[eq+1:])
+	}
+	return opts, scanner.Err()
+}
+
+// applyConf sets the flags from the config file that weren't given on the
+// command line.  The command line wins.
+func applyConf(fs *flag.FlagSet, opts map[string]string, path string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	for key, val := range opts {
+		// the data dir is where the config file is, so it can't be in it
+		if key == "datadir" || key == "conf" {
+			return fmt.Errorf("%s: %s can't be set in the config file",
+				path, key)
+		}
+		if fs.Lookup(key) == nil {
+			return fmt.Errorf("%s: unknown option %s", path, key)
+		}
+		if given[key] {
+			continue
+		}
+		err := fs.Set(key, val)
+		if err != nil {
+			return fmt.Errorf("%s: %s: %s", path, key, err.Error())
+		}
+	}
+	return nil
+}
+
+// expandHome replaces a leading ~ with the home directory
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, path[1:]), nil
+}
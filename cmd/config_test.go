@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConf(t *testing.T) {
+	dir, err := ioutil.TempDir("", "utreexoconf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, confFileName)
+	err = ioutil.WriteFile(path, []byte(`
+# comment
+net = testnet
+-blocksdir=/blocks/here
+checkpointblocks=5
+`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	net := fs.String("net", "mainnet", "")
+	blocksDir := fs.String("blocksdir", "", "")
+	ckptBlocks := fs.Int("checkpointblocks", 10000, "")
+	fs.String("datadir", "", "")
+	err = fs.Parse([]string{"-checkpointblocks=7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := readConf(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = applyConf(fs, opts, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the command line wins over the file
+	if *net != "testnet" || *blocksDir != "/blocks/here" || *ckptBlocks != 7 {
+		t.Fatalf("got net %s blocksdir %s checkpointblocks %d",
+			*net, *blocksDir, *ckptBlocks)
+	}
+
+	for _, bad := range []string{"what=1", "datadir=/x"} {
+		err = ioutil.WriteFile(path, []byte(bad+"\n"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts, err = readConf(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if applyConf(fs, opts, path) == nil {
+			t.Fatalf("no error for %s", bad)
+		}
+	}
+	err = ioutil.WriteFile(path, []byte("net\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readConf(path)
+	if err == nil {
+		t.Fatalf("no error for line without =")
+	}
+
+	// no file is no options
+	opts, err = readConf(filepath.Join(dir, "nothere.conf"))
+	if err != nil || len(opts) != 0 {
+		t.Fatalf("missing file gave %v %v", opts, err)
+	}
+}
@@ -1,15 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
-	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
 	bridge "github.com/mit-dci/utreexo/bridgenode"
 	"github.com/mit-dci/utreexo/csn"
+	"github.com/mit-dci/utreexo/util"
 )
 
 var msg = `
@@ -17,17 +24,105 @@ Usage: utreexo COMMAND [OPTION]
 A dynamic hash based accumulator designed for the Bitcoin UTXO set
 
 Commands:
-  ibdsim         simulates an initial block download with ttl.testnet.txos as an input
-  genproofs      generates proofs from the ttl.testnet.txos file
+  ibdsim         simulates an initial block download with the blocks in
+                 -blocksdir and the proofs genproofs wrote to -datadir
+  genproofs      generates proofs for the blocks in -blocksdir, and keeps
+                 them and its state in -datadir
+  fsck           checks the forest and proofs genproofs left in the datadir
+                 agree with each other
+  exportsnapshot writes the roots at genproofs' last checkpoint to the
+                 -snapshot file, for ibdsim to start from
+  roots          prints the roots after block -height from genproofs' root
+                 history, and a hash of them to compare
+  utxostats      prints ibdsim's totals for the utxo set, like bitcoind's
+                 gettxoutsetinfo
 OPTIONS:
-  -net=testnet   configure whether to use testnet. Optional.
-  -net=regtest   configure whether to use regtest. Optional.
+  -net=NET       mainnet, testnet, regtest, signet or custom.  Default mainnet
+  -signetchallenge=HEX   with -net=signet, the challenge script of a signet
+                 other than the default one.
+  -netparams=FILE        with -net=custom, a json file with the network's
+                 name, magic and genesishash (see readme).
+  -datadir=DIR   where utreexo keeps its data, in a directory for each
+                 network.  Default ~/.utreexo
+  -blocksdir=DIR where bitcoind's blk*.dat and rev*.dat files are.  Default
+                 ~/.bitcoin/blocks, or ~/.bitcoin/testnet3/blocks etc.
+  -conf=FILE     config file with option=value lines.  Options given on the
+                 command line win.  Default DATADIR/utreexo.conf
+  -rpcurl=URL    genproofs gets blocks from bitcoind's RPC, like
+                 http://127.0.0.1:8332, instead of from the blocks dir.
+                 Needs bitcoind 23 or newer.
+  -rpcuser=USER -rpcpass=PASS   login for -rpcurl
+  -rpccookie=FILE        bitcoind's .cookie file, instead of -rpcuser and
+                 -rpcpass
+  -rpcdepth=N    genproofs stays N blocks behind bitcoind's tip, since it
+                 can't undo a reorg.  Default 6.
+  -leafstore     genproofs keeps its own utxo data in the datadir, and
+                 doesn't need rev*.dat files or getblock verbosity 3.
+  -forestram=MB  genproofs keeps the top rows of the forest in this much
+                 ram, and the rest on disk.  Faster than all on disk.
+  -ramforest     genproofs keeps the whole forest in ram, which needs lots of
+                 it.  A snapshot is saved at each checkpoint to resume from;
+                 it's a copy, so up to twice the forest's ram while saving.
+  -swapless      delete from the accumulator without moving leaves around.
+                 genproofs and ibdsim have to both use it or both not.
+  -repair        fsck rewrites hashes in the forest that are wrong, if the
+                 leaves match the last checkpoint.
+  -snapshot=FILE exportsnapshot writes the snapshot here, and ibdsim starts
+                 from it instead of block 1 if it has nothing saved.
+  -snapshotid=HEX        ibdsim only uses a -snapshot with this id, which
+                 exportsnapshot prints.
+  -validatesnapshot      ibdsim also goes through the blocks before the
+                 -snapshot, to check it's right.
+  -height=N      the block roots prints.  Default the last one.
+  -checkpointblocks=N    genproofs saves its state every N blocks. Optional.
+  -checkpointminutes=M   genproofs saves its state every M minutes. Optional.
 `
 
 // bit of a hack. Standard flag lib doesn't allow flag.Parse(os.Args[2]). You need a subcommand to do so.
 var optionCmd = flag.NewFlagSet("", flag.ExitOnError)
 var netCmd = optionCmd.String("net", "mainnet",
-	"Target testnet or regtest instead of mainnet. Usage: '-net=regtest' or '-net=testnet'")
+	"Which network: mainnet, testnet, regtest, signet or custom")
+var sigNetChallengeCmd = optionCmd.String("signetchallenge", "",
+	"Challenge script in hex, for a signet that isn't the default one")
+var netParamsCmd = optionCmd.String("netparams", "",
+	"Params file for -net=custom")
+var dataDirCmd = optionCmd.String("datadir", "~/.utreexo",
+	"Where utreexo keeps its data.  Each network gets its own directory in here")
+var blocksDirCmd = optionCmd.String("blocksdir", "",
+	"Where the blk*.dat and rev*.dat files are.  Defaults to bitcoind's for the network")
+var confCmd = optionCmd.String("conf", "",
+	"Config file.  Defaults to utreexo.conf in the datadir")
+var rpcURLCmd = optionCmd.String("rpcurl", "",
+	"Get blocks for genproofs from bitcoind's RPC at this url")
+var rpcUserCmd = optionCmd.String("rpcuser", "", "Username for -rpcurl")
+var rpcPassCmd = optionCmd.String("rpcpass", "", "Password for -rpcurl")
+var rpcCookieCmd = optionCmd.String("rpccookie", "",
+	"bitcoind's .cookie file to log in to -rpcurl with")
+var rpcDepthCmd = optionCmd.Int("rpcdepth", bridge.DefaultRPCDepth,
+	"genproofs stays this many blocks behind -rpcurl's tip")
+var leafStoreCmd = optionCmd.Bool("leafstore", false,
+	"genproofs keeps its own utxo data instead of using rev files")
+var swaplessCmd = optionCmd.Bool("swapless", false,
+	"Delete without moving leaves.  genproofs and ibdsim need the same setting")
+var forestRamCmd = optionCmd.Uint64("forestram", 0,
+	"genproofs keeps the top rows of the forest in this many MB of ram")
+var ramForestCmd = optionCmd.Bool("ramforest", false,
+	"genproofs keeps the whole forest in ram, and saves a snapshot at "+
+		"checkpoints, which needs up to twice the ram")
+var repairCmd = optionCmd.Bool("repair", false,
+	"fsck rewrites forest hashes that are wrong")
+var snapshotCmd = optionCmd.String("snapshot", "",
+	"File exportsnapshot writes and ibdsim starts from")
+var snapshotIDCmd = optionCmd.String("snapshotid", "",
+	"ibdsim checks -snapshot has this id")
+var validateSnapshotCmd = optionCmd.Bool("validatesnapshot", false,
+	"ibdsim also checks the blocks before -snapshot")
+var heightCmd = optionCmd.Int("height", 0,
+	"Block to print the roots after.  0 for the last one")
+var ckptBlocksCmd = optionCmd.Int("checkpointblocks", 10000,
+	"genproofs saves its state every this many blocks. 0 to turn off")
+var ckptMinutesCmd = optionCmd.Int("checkpointminutes", 30,
+	"genproofs saves its state every this many minutes. 0 to turn off")
 
 func main() {
 	// check if enough arguments were given
@@ -35,40 +130,96 @@ func main() {
 		fmt.Println(msg)
 		os.Exit(1)
 	}
-	var ttldb, offsetfile string
 	optionCmd.Parse(os.Args[2:])
-	var net wire.BitcoinNet
-	if *netCmd == "testnet" {
-		ttldb = "testnet-ttldb"
-		offsetfile = "testnet-offsetfile"
-		net = wire.TestNet3
-	} else if *netCmd == "regtest" {
-		ttldb = "regtest-ttldb"
-		offsetfile = "regtest-offsetfile"
-		net = wire.TestNet // yes, this is the name of regtest in lit
-	} else if *netCmd == "mainnet" {
-		ttldb = "ttldb"
-		offsetfile = "offsetfile"
-		net = wire.MainNet
-	} else {
-		fmt.Println("Invalid net flag given.")
+	net, dataDir, blocksDir, err := options()
+	if err != nil {
+		fmt.Println(err)
 		fmt.Println(msg)
 		os.Exit(1)
 	}
-	//listen for SIGINT, SIGTERM, or SIGQUIT from the os
-	sig := make(chan bool, 1)
-	handleIntSig(sig)
+	fmt.Printf("data in %s, blocks from %s\n", dataDir, blocksDir)
+
+	// cancelled on SIGINT, SIGTERM, or SIGQUIT from the os
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handleIntSig(cancel)
 
 	switch os.Args[1] {
 	case "ibdsim":
-		err := csn.RunIBD(net, offsetfile, ttldb, sig)
+		cfg := csn.Config{DataDir: dataDir, DeleteMode: deleteMode(),
+			ValidateSnapshot: *validateSnapshotCmd}
+		cfg.Snapshot, err = readSnapshot()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		err = csn.RunIBD(ctx, net, blocksDir, cfg)
 		if err != nil {
-			panic(err)
+			fmt.Println(err)
+			os.Exit(1)
 		}
 	case "genproofs":
-		err := bridge.BuildProofs(net, ttldb, offsetfile, sig)
+		ckpt := bridge.CheckpointConfig{
+			Blocks:   int32(*ckptBlocksCmd),
+			Interval: time.Duration(*ckptMinutesCmd) * time.Minute,
+		}
+		cfg, err := bridgeConfig(net, dataDir, blocksDir)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		err = bridge.BuildProofs(ctx, cfg, ckpt)
 		if err != nil {
-			panic(err)
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "exportsnapshot":
+		if *snapshotCmd == "" {
+			fmt.Println("exportsnapshot needs -snapshot=FILE to write to")
+			os.Exit(1)
+		}
+		path, err := expandHome(*snapshotCmd)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		err = bridge.ExportSnapshot(dataDir, path)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "fsck":
+		err := bridge.Fsck(dataDir, *repairCmd)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "roots":
+		r, err := bridge.RootsAt(dataDir, int32(*heightCmd))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("block %d %s\n%d leaves\n", r.Height, r.BlockHash,
+			r.NumLeaves)
+		for i, root := range r.Roots {
+			fmt.Printf("root %d %x\n", i, root)
+		}
+		fmt.Printf("commitment %x\n", r.Commitment())
+	case "utxostats":
+		s, height, err := csn.ReadUTXOStats(dataDir)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if s.Since != 1 {
+			fmt.Printf("started from a snapshot; only what's changed since "+
+				"block %d\n", s.Since)
+		}
+		fmt.Printf("height %d\ntxouts %d\ntotal_amount %s\n",
+			height-1, s.Count, formatBTC(s.Amount))
+		for i, n := range s.ByType {
+			fmt.Printf("%s %d\n", util.ScriptType(i), n)
 		}
 	default:
 		fmt.Println(msg)
@@ -76,11 +227,194 @@ func main() {
 	}
 }
 
-func handleIntSig(sig chan bool) {
-	s := make(chan os.Signal, 1)
+// formatBTC writes satoshis as bitcoin with all 8 decimals, like bitcoind
+func formatBTC(sat int64) string {
+	sign := ""
+	if sat < 0 {
+		sign = "-"
+		sat = -sat
+	}
+	return fmt.Sprintf("%s%d.%08d", sign, sat/1e8, sat%1e8)
+}
+
+// options reads the config file, then works out the network and the
+// directories from the flags.  The data dir is the one for the network.
+func options() (net *util.NetParams, dataDir, blocksDir string, err error) {
+	baseDir, err := expandHome(*dataDirCmd)
+	if err != nil {
+		return
+	}
+	confPath := *confCmd
+	if confPath == "" {
+		confPath = filepath.Join(baseDir, confFileName)
+	}
+	confPath, err = expandHome(confPath)
+	if err != nil {
+		return
+	}
+	conf, err := readConf(confPath)
+	if err != nil {
+		return
+	}
+	err = applyConf(optionCmd, conf, confPath)
+	if err != nil {
+		return
+	}
+
+	net, err = netParams()
+	if err != nil {
+		return
+	}
+	// mainnet gets a directory too, so nothing's mixed up between networks
+	dataDir = filepath.Join(baseDir, net.Name)
+
+	blocksDir = *blocksDirCmd
+	if blocksDir == "" {
+		// bitcoind's directory for the network's blocks, under ~/.bitcoin
+		blocksDir = filepath.Join("~/.bitcoin", net.BitcoindDir, "blocks")
+	}
+	blocksDir, err = expandHome(blocksDir)
+	return
+}
+
+// bridgeConfig gives the bridge node config from the options, for the
+// commands that use one
+func bridgeConfig(net *util.NetParams,
+	dataDir, blocksDir string) (bridge.Config, error) {
+
+	cfg := bridge.Config{DataDir: dataDir, BlocksDir: blocksDir, Net: net}
+	if *leafStoreCmd {
+		cfg.Undo = bridge.UndoLeafStore
+	}
+	cfg.DeleteMode = deleteMode()
+	if *ramForestCmd && *forestRamCmd != 0 {
+		return cfg, fmt.Errorf("-ramforest and -forestram don't go together")
+	}
+	if *ramForestCmd {
+		cfg.Forest = bridge.ForestRam
+	}
+	if *forestRamCmd != 0 {
+		cfg.Forest = bridge.ForestHybrid
+		cfg.ForestRamBudget = *forestRamCmd << 20
+	}
+	var err error
+	cfg.Source, err = rpcSource(net)
+	return cfg, err
+}
+
+// readSnapshot reads -snapshot for ibdsim, if it's given, and checks it has
+// -snapshotid
+func readSnapshot() (*util.RootsSnapshot, error) {
+	if *snapshotCmd == "" {
+		if *snapshotIDCmd != "" || *validateSnapshotCmd {
+			return nil, fmt.Errorf("no -snapshot given")
+		}
+		return nil, nil
+	}
+	path, err := expandHome(*snapshotCmd)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := util.RootsSnapshotFromBytes(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	if *snapshotIDCmd != "" && !strings.EqualFold(s.ID(), *snapshotIDCmd) {
+		return nil, fmt.Errorf("%s has id %s, not %s",
+			path, s.ID(), *snapshotIDCmd)
+	}
+	if *snapshotIDCmd == "" {
+		fmt.Printf("snapshot id %s; check it's one you trust, or give "+
+			"-snapshotid\n", s.ID())
+	}
+	return s, nil
+}
+
+// netParams gives the params for -net, and -signetchallenge or -netparams
+func netParams() (*util.NetParams, error) {
+	if *sigNetChallengeCmd != "" && *netCmd != "signet" {
+		return nil, fmt.Errorf("-signetchallenge is only for -net=signet")
+	}
+	if *netParamsCmd != "" && *netCmd != "custom" {
+		return nil, fmt.Errorf("-netparams is only for -net=custom")
+	}
+	switch *netCmd {
+	case "signet":
+		if *sigNetChallengeCmd == "" {
+			return &util.SigNetParams, nil
+		}
+		challenge, err := hex.DecodeString(*sigNetChallengeCmd)
+		if err != nil {
+			return nil, fmt.Errorf("-signetchallenge: %s", err.Error())
+		}
+		return util.SigNetParamsForChallenge(challenge), nil
+	case "custom":
+		if *netParamsCmd == "" {
+			return nil, fmt.Errorf("-net=custom needs -netparams")
+		}
+		path, err := expandHome(*netParamsCmd)
+		if err != nil {
+			return nil, err
+		}
+		return util.LoadNetParams(path)
+	}
+	return util.NetParamsByName(*netCmd)
+}
+
+// rpcSource connects to -rpcurl, if it's given
+func rpcSource(net *util.NetParams) (bridge.BlockSource, error) {
+	if *rpcURLCmd == "" {
+		return nil, nil
+	}
+	user, pass := *rpcUserCmd, *rpcPassCmd
+	if *rpcCookieCmd != "" {
+		if user != "" || pass != "" {
+			return nil, fmt.Errorf("give -rpccookie or -rpcuser and -rpcpass")
+		}
+		path, err := expandHome(*rpcCookieCmd)
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		// the cookie is user:pass
+		cookie := strings.TrimSpace(string(b))
+		colon := strings.Index(cookie, ":")
+		if colon == -1 {
+			return nil, fmt.Errorf("%s isn't user:pass", path)
+		}
+		user, pass = cookie[:colon], cookie[colon+1:]
+	}
+	fmt.Printf("getting blocks from %s\n", *rpcURLCmd)
+	return bridge.NewRPCSource(
+		*rpcURLCmd, user, pass, net, int32(*rpcDepthCmd))
+}
+
+// handleIntSig cancels on the first signal, which lets whatever's running
+// finish the block it's on and save.  A second signal quits right away.
+func handleIntSig(cancel context.CancelFunc) {
+	s := make(chan os.Signal, 2)
 	signal.Notify(s, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM)
 	go func() {
 		<-s
-		sig <- true
+		fmt.Println("User exit signal received. Exiting...")
+		cancel()
+		<-s
+		fmt.Println("Second signal received, quitting without saving")
+		os.Exit(1)
 	}()
 }
+
+// deleteMode gives the accumulator delete mode for -swapless
+func deleteMode() accumulator.DeleteMode {
+	if *swaplessCmd {
+		return accumulator.SwaplessDelete
+	}
+	return accumulator.SwapDelete
+}
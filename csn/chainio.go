@@ -1,23 +1,23 @@
 package csn
 
 import (
+	"io"
 	"os"
-	"sync"
 
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/util"
 )
 
 // restorePollard restores the pollard from disk to memory.
-// If starting anew, it just returns a empty pollard.
-func restorePollard() (p accumulator.Pollard, err error) {
+func restorePollard(paths *util.Paths) (p accumulator.Pollard, err error) {
 
 	// Restore Pollard
 	pollardFile, err := os.OpenFile(
-		util.PollardFilePath, os.O_RDWR, 0600)
+		paths.PollardFilePath, os.O_RDONLY, 0600)
 	if err != nil {
 		return p, err
 	}
+	defer pollardFile.Close()
 	err = p.RestorePollard(pollardFile)
 	if err != nil {
 		return p, err
@@ -28,17 +28,18 @@ func restorePollard() (p accumulator.Pollard, err error) {
 
 // restorePollardHeight restores the current height that pollard is synced to
 // Not to be confused with the height variable for genproofs
-func restorePollardHeight() (height int32, err error) {
+func restorePollardHeight(paths *util.Paths) (height int32, err error) {
 
 	var pHeightFile *os.File
 	// Restore height
 	pHeightFile, err = os.OpenFile(
-		util.PollardHeightFilePath, os.O_RDONLY, 0600)
+		paths.PollardHeightFilePath, os.O_RDONLY, 0600)
 	if err != nil {
 		return 0, err
 	}
+	defer pHeightFile.Close()
 	var t [4]byte
-	_, err = pHeightFile.Read(t[:])
+	_, err = io.ReadFull(pHeightFile, t[:])
 	if err != nil {
 		return 0, err
 	}
@@ -49,43 +50,39 @@ func restorePollardHeight() (height int32, err error) {
 
 // saveIBDsimData saves the state of ibdsim so that when the
 // user restarts, they'll be able to resume.
-// Saves height for ibdsim and pollard itself
-func saveIBDsimData(height int32, p accumulator.Pollard) error {
+// Saves the pollard and utxo stats, then the height they're at
+func saveIBDsimData(paths *util.Paths, height int32,
+	p *accumulator.Pollard, stats UTXOStats) error {
 
-	var fileWait sync.WaitGroup
-
-	fileWait.Add(1)
-	go func() error {
-		pHeightFile, err := os.OpenFile(
-			util.PollardHeightFilePath, os.O_WRONLY, 0600)
-		if err != nil {
-			return err
-		}
-		// write to the heightfile
-		_, err = pHeightFile.WriteAt(util.U32tB(uint32(height)), 0)
-		if err != nil {
-			return err
-		}
-		fileWait.Done()
-		return nil
-	}()
-
-	fileWait.Add(1)
-	go func() error {
-
-		pollardFile, err := os.OpenFile(
-			util.PollardFilePath, os.O_WRONLY, 0600)
-		if err != nil {
-			return err
-		}
-		err = p.WritePollard(pollardFile)
-		if err != nil {
-			return err
-		}
-		fileWait.Done()
-		return nil
-	}()
+	pollardFile, err := os.OpenFile(
+		paths.PollardFilePath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer pollardFile.Close()
+	err = p.WritePollard(pollardFile)
+	if err != nil {
+		return err
+	}
+	err = pollardFile.Sync()
+	if err != nil {
+		return err
+	}
+	err = saveUTXOStats(paths, stats)
+	if err != nil {
+		return err
+	}
 
-	fileWait.Wait()
-	return nil
+	// write to the heightfile
+	pHeightFile, err := os.OpenFile(
+		paths.PollardHeightFilePath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer pHeightFile.Close()
+	_, err = pHeightFile.WriteAt(util.U32tB(uint32(height)), 0)
+	if err != nil {
+		return err
+	}
+	return pHeightFile.Sync()
 }
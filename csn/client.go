@@ -1,141 +1,43 @@
 package csn
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"time"
 
-	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/util"
-
-	"github.com/syndtr/goleveldb/leveldb"
-	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
 // run IBD from block proof data
 // we get the new utxo info from the same txos text file
-func IBDClient(net wire.BitcoinNet,
-	offsetfile string, ttldb string, sig chan bool) error {
-
-	// Channel to alert the main loop to break when receiving a quit signal from
-	// the OS
-	stopGoing := make(chan bool, 1)
-
-	// Channel to alert stopRunIBD it's ok to exit
-	// Makes it wait for flushing to disk
-	done := make(chan bool, 1)
-
-	go stopRunIBD(sig, stopGoing, done)
-
-	// Check if the blk*.dat file given is a testnet/mainnet/regtest
-	// file corresponding to net
-	util.CheckNet(net)
-
-	// open database
-	o := new(opt.Options)
-	o.CompactionTableSizeMultiplier = 8
-	o.ReadOnly = true
-	lvdb, err := leveldb.OpenFile(ttldb, o)
-	if err != nil {
-		panic(err)
-	}
-	defer lvdb.Close()
-
-	// Make neccesary directories
-	util.MakePaths()
-
-	p, height, knownTipHeight, err := initCSNState()
-	if err != nil {
-		panic(err)
-	}
-
-	// caching parameter. Keeps txos that are spent before than this many blocks
-	lookahead := int32(1000)
-
-	// for benchmarking
-	var totalTXOAdded, totalDels int
-
-	// blocks come in and sit in the blockQueue
-	// They should come in from the network -- right now they're coming from the
-	// disk but it should be the exact same thing
-	ublockQueue := make(chan util.UBlock, 10)
+// When ctx is cancelled it finishes the block it's on, saves, and returns.
+func IBDClient(ctx context.Context, net *util.NetParams,
+	paths *util.Paths, cfg Config) error {
 
-	pFile, err := os.OpenFile(
-		util.PFilePath, os.O_RDONLY, 0400)
+	// Check that the blk*.dat files given are from net
+	err := util.CheckNet(net, paths)
 	if err != nil {
 		return err
 	}
 
-	pOffsetFile, err := os.OpenFile(
-		util.POffsetFilePath, os.O_RDONLY, 0400)
+	cfg.DataDir = paths.DataDir
+	n, err := NewNode(cfg, NewFileSource(paths))
 	if err != nil {
 		return err
 	}
-
-	// Reads blocks asynchronously from blk*.dat files, and the proof.dat, and DB
-	// this will be a network reader, with the server sending the same stuff over
-	go util.UBlockReader(ublockQueue, knownTipHeight, height, lookahead)
-
-	var plustime time.Duration
-	starttime := time.Now()
-
-	// bool for stopping the below for loop
-	var stop bool
-	for ; height != knownTipHeight && stop != true; height++ {
-
-		blocknproof := <-ublockQueue
-
-		err = putBlockInPollard(blocknproof,
-			&totalTXOAdded, &totalDels, plustime, &p)
-		if err != nil {
-			panic(err)
-		}
-
-		//if height%10000 == 0 {
-		//	fmt.Printf("Block %d %s plus %.2f total %.2f proofnodes %d \n",
-		//		height, newForest.Stats(),
-		//		plustime.Seconds(), time.Now().Sub(starttime).Seconds(),
-		//		totalProofNodes)
-		//}
-
-		if height%10000 == 0 {
-			fmt.Printf("Block %d add %d del %d %s plus %.2f total %.2f \n",
-				height, totalTXOAdded, totalDels, p.Stats(),
-				plustime.Seconds(), time.Now().Sub(starttime).Seconds())
-		}
-
-		// Check if stopSig is no longer false
-		// stop = true makes the loop exit
-		select {
-		case stop = <-stopGoing:
-		default:
-		}
-	}
-	pFile.Close()
-	pOffsetFile.Close()
-
-	fmt.Printf("Block %d add %d del %d %s plus %.2f total %.2f \n",
-		height, totalTXOAdded, totalDels, p.Stats(),
-		plustime.Seconds(), time.Now().Sub(starttime).Seconds())
-
-	saveIBDsimData(height, p)
-
-	fmt.Println("Done Writing")
-
-	done <- true
-
-	return nil
+	return n.Run(ctx)
 }
 
 // Here we write proofs for all the txs.
 // All the inputs are saved as 32byte sha256 hashes.
 // All the outputs are saved as LeafTXO type.
+// The block gets counted in stats too, once it's in.
 func putBlockInPollard(
 	ub util.UBlock,
 	totalTXOAdded, totalDels *int,
-	plustime time.Duration,
-	p *accumulator.Pollard) error {
+	plustime *time.Duration,
+	p *accumulator.Pollard, stats *UTXOStats) error {
 
 	plusstart := time.Now()
 
@@ -173,9 +75,10 @@ func putBlockInPollard(
 	if err != nil {
 		return err
 	}
+	stats.addBlock(&ub.Block, outskip, ub.ExtraData.UtxoData)
 
 	donetime := time.Now()
-	plustime += donetime.Sub(plusstart)
+	*plustime += donetime.Sub(plusstart)
 
 	return nil
 }
@@ -1,41 +1,19 @@
 package csn
 
 import (
-	"fmt"
-	"os"
-	"time"
+	"context"
 
-	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/util"
 )
 
-func RunIBD(net wire.BitcoinNet, offsetfile string, ttldb string, sig chan bool) error {
+// RunIBD runs ibdsim until it's caught up or ctx is cancelled.  It uses the
+// proofs genproofs wrote to cfg.DataDir, and the blocks in blocksDir.
+// cfg.DeleteMode has to be the one genproofs used.
+func RunIBD(ctx context.Context, net *util.NetParams, blocksDir string,
+	cfg Config) error {
 	// start server & listen
 	// go IBDServer()
 
 	// start client & connect
-	return IBDClient(net, offsetfile, ttldb, sig)
-}
-
-func stopRunIBD(sig chan bool, stopGoing chan bool, done chan bool) {
-	// Listen for SIGINT, SIGTERM, and SIGQUIT from the user
-	<-sig
-
-	// Sometimes there are bugs that make the program run forver.
-	// Utreexo binary should never take more than 10 seconds to exit
-	go func() {
-		time.Sleep(10 * time.Second)
-		fmt.Println("Program timed out. Force quitting." +
-			"Data likely corrupted")
-		os.Exit(1)
-	}()
-
-	// Tell the user that the sig is received
-	fmt.Println("User exit signal received. Exiting...")
-
-	// Tell Runibd() to finish the block it's working on
-	stopGoing <- true
-
-	// Wait until RunIBD() says it's ok to quit
-	<-done
-	os.Exit(0)
+	return IBDClient(ctx, net, util.NewPaths(cfg.DataDir, blocksDir), cfg)
 }
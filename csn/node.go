@@ -0,0 +1,332 @@
+package csn
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// Config is everything needed to make a Node
+type Config struct {
+	// DataDir is where the pollard is saved.  Empty to only keep it in ram.
+	DataDir string
+	// DeleteMode has to be what the bridge node making the proofs uses.
+	// A saved pollard with some other mode is an error.
+	DeleteMode accumulator.DeleteMode
+	// Snapshot is where to start when there's no saved pollard, instead of
+	// block 1.  Its DeleteMode has to be DeleteMode.
+	Snapshot *util.RootsSnapshot
+	// ValidateSnapshot has Run also go through the blocks before Snapshot
+	// in the background, and make sure they end up where it says.  That
+	// starts over every Run, so it has to get through in one.  The source
+	// has to be ok with 2 goroutines reading it.
+	ValidateSnapshot bool
+}
+
+// Node is a compact state node.  It keeps a pollard with just the roots,
+// and takes in blocks with proofs, checking the proofs and updating the
+// roots.  Blocks come from a BlockSource with Run, or one at a time with
+// ProcessUBlock.  Not safe to use from more than one goroutine.
+type Node struct {
+	// paths is nil if not saving
+	paths   *util.Paths
+	source  BlockSource
+	pollard accumulator.Pollard
+
+	// height is the next block to process
+	height int32
+	stats  UTXOStats
+
+	// snapshot is nil if not using one
+	snapshot *util.RootsSnapshot
+	validate bool
+
+	onConnect []func(ub *util.UBlock)
+
+	// for benchmarking
+	totalTXOAdded, totalDels int
+	plustime                 time.Duration
+}
+
+// NewNode makes a Node getting blocks from source.  If there's a saved
+// pollard in cfg.DataDir it resumes from there.
+func NewNode(cfg Config, source BlockSource) (*Node, error) {
+	if cfg.ValidateSnapshot && cfg.Snapshot == nil {
+		return nil, fmt.Errorf("no snapshot to validate")
+	}
+	n := &Node{source: source, height: 1, stats: UTXOStats{Since: 1},
+		snapshot: cfg.Snapshot, validate: cfg.ValidateSnapshot}
+	if cfg.DataDir != "" {
+		n.paths = util.NewPaths(cfg.DataDir, "")
+		var err error
+		n.pollard, n.height, n.stats, err = initCSNState(n.paths)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s := cfg.Snapshot; s != nil {
+		if s.DeleteMode != cfg.DeleteMode {
+			return nil, fmt.Errorf("snapshot is %s, not %s",
+				s.DeleteMode, cfg.DeleteMode)
+		}
+		if n.height == 1 {
+			fmt.Printf("starting from snapshot %s at height %d\n",
+				s.ID(), s.Height)
+			err := n.pollard.RestoreRoots(s.NumLeaves, s.Roots, s.DeleteMode)
+			if err != nil {
+				return nil, err
+			}
+			n.height = s.Height
+			n.stats = UTXOStats{Since: s.Height}
+		}
+	}
+	if n.pollard.DeleteMode() != cfg.DeleteMode {
+		err := n.pollard.SetDeleteMode(cfg.DeleteMode)
+		if err != nil {
+			return nil, fmt.Errorf("saved pollard is %s, not %s: %s",
+				n.pollard.DeleteMode(), cfg.DeleteMode, err.Error())
+		}
+	}
+	return n, nil
+}
+
+// OnConnect adds a function to call after each block is connected.  It's
+// called from whatever's calling ProcessUBlock or Run, so it should be
+// quick, and not call back into the Node.
+func (n *Node) OnConnect(f func(ub *util.UBlock)) {
+	n.onConnect = append(n.onConnect, f)
+}
+
+// Height is the next block the node needs
+func (n *Node) Height() int32 {
+	return n.height
+}
+
+// Roots gives the roots of the accumulator, as of Height()
+func (n *Node) Roots() []accumulator.Hash {
+	return n.pollard.GetRoots()
+}
+
+// UTXOStats gives the totals for the utxo set, as of Height()
+func (n *Node) UTXOStats() UTXOStats {
+	return n.stats
+}
+
+// Stats gives how much has been added and deleted, for printing
+func (n *Node) Stats() string {
+	return fmt.Sprintf("Block %d add %d del %d %s plus %.2f",
+		n.height, n.totalTXOAdded, n.totalDels, n.pollard.Stats(),
+		n.plustime.Seconds())
+}
+
+// ProcessUBlock checks a block's proof and puts it in the accumulator.  ub
+// has to be the block at Height().  If the proof is bad, nothing changes.
+func (n *Node) ProcessUBlock(ub util.UBlock) error {
+	if ub.Height != n.height {
+		return fmt.Errorf("got block %d but at height %d", ub.Height, n.height)
+	}
+	if n.snapshot != nil && ub.Height == n.snapshot.Height &&
+		ub.Block.Header.PrevBlock != n.snapshot.BlockHash {
+		return fmt.Errorf("block %d builds on %s, not the snapshot's %s",
+			ub.Height, ub.Block.Header.PrevBlock, n.snapshot.BlockHash)
+	}
+	adds, dels, took, err := processInto(ub, &n.pollard, &n.stats)
+	if err != nil {
+		return err
+	}
+	n.totalTXOAdded += adds
+	n.totalDels += dels
+	n.plustime += took
+	n.height++
+	for _, f := range n.onConnect {
+		f(&ub)
+	}
+	return nil
+}
+
+// processInto checks ub's proof and puts it in p, and counts it in stats.
+// Verifying sorts the targets, so it sorts a copy and ub stays the same for
+// the callbacks and the caller.  Gives back how many leaves were added and
+// deleted, and how long it took, for benchmarking.
+func processInto(ub util.UBlock, p *accumulator.Pollard, stats *UTXOStats) (
+	adds, dels int, took time.Duration, err error) {
+
+	ud := ub.ExtraData
+	ud.AccProof.Targets = make([]uint64, len(ub.ExtraData.AccProof.Targets))
+	copy(ud.AccProof.Targets, ub.ExtraData.AccProof.Targets)
+	ub.ExtraData = ud
+	err = putBlockInPollard(ub, &adds, &dels, &took, p, stats)
+	return
+}
+
+// Save writes the pollard and height to the data dir, if there is one
+func (n *Node) Save() error {
+	if n.paths == nil {
+		return nil
+	}
+	return saveIBDsimData(n.paths, n.height, &n.pollard, n.stats)
+}
+
+// Run gets blocks from the source and processes them until it gets to the
+// source's tip, or ctx is cancelled.  Either way it saves before returning,
+// unless there's an error.  With ValidateSnapshot it then waits for that to
+// finish, and gives an error if the snapshot was wrong.  If that's found
+// before the blocks are done, Run stops then, without saving.
+func (n *Node) Run(ctx context.Context) error {
+	tip, err := n.source.TipHeight()
+	if err != nil {
+		return err
+	}
+
+	// blocks come in and sit in the blockQueue
+	ublockQueue := make(chan util.UBlock, 10)
+	errChan := make(chan error, 1)
+
+	// stop the reader when returning, for whatever reason
+	readCtx, cancelRead := context.WithCancel(ctx)
+	defer cancelRead()
+	go sourceReader(readCtx, n.source, ublockQueue, errChan, tip, n.height)
+
+	// the blocks before the snapshot get validated alongside, and give
+	// the utxo stats up to it.  If that fails, Run stops right away.
+	var validated chan error
+	var before *UTXOStats
+	validateDone := false
+	if n.validate {
+		validated = make(chan error, 1)
+		validateCtx, cancelValidate := context.WithCancel(ctx)
+		defer cancelValidate()
+		go func() {
+			var err error
+			before, err = n.validateSnapshot(validateCtx)
+			validated <- err
+		}()
+	}
+
+	starttime := time.Now()
+
+blockLoop:
+	for n.height < tip {
+		var ub util.UBlock
+		select {
+		case ub = <-ublockQueue:
+		case err = <-errChan:
+			return err
+		case err = <-validated:
+			if err != nil {
+				return err
+			}
+			// nil channels never get picked, so this only happens once
+			validated, validateDone = nil, true
+			continue
+		case <-ctx.Done():
+			break blockLoop
+		}
+
+		err = n.ProcessUBlock(ub)
+		if err != nil {
+			return err
+		}
+
+		if ub.Height%10000 == 0 {
+			fmt.Printf("%s total %.2f \n",
+				n.Stats(), time.Since(starttime).Seconds())
+		}
+	}
+	cancelRead()
+
+	fmt.Printf("%s total %.2f \n", n.Stats(), time.Since(starttime).Seconds())
+
+	err = n.Save()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Done Writing")
+
+	if n.validate {
+		if !validateDone {
+			select {
+			case err = <-validated:
+			default:
+				fmt.Println("still validating the blocks before the snapshot")
+				err = <-validated
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// with what came before, the stats are for the whole utxo set
+		if before != nil && n.stats.Since == n.snapshot.Height {
+			n.stats.add(*before)
+			n.stats.Since = 1
+			err = n.Save()
+		}
+	}
+	return err
+}
+
+// validateSnapshot goes through the blocks before the snapshot with a
+// pollard of its own, and checks they end up where the snapshot says.
+// Gives back the utxo stats for those blocks.  Stopping with ctx isn't an
+// error, but there's no stats since the snapshot isn't validated.
+func (n *Node) validateSnapshot(ctx context.Context) (*UTXOStats, error) {
+	s := n.snapshot
+	var p accumulator.Pollard
+	err := p.SetDeleteMode(s.DeleteMode)
+	if err != nil {
+		return nil, err
+	}
+	blocks := make(chan util.UBlock, 10)
+	errChan := make(chan error, 1)
+	go sourceReader(ctx, n.source, blocks, errChan, s.Height, 1)
+
+	stats := UTXOStats{Since: 1}
+	var last chainhash.Hash
+	for height := int32(1); height < s.Height; height++ {
+		var ub util.UBlock
+		select {
+		case ub = <-blocks:
+		case err = <-errChan:
+			return nil, err
+		case <-ctx.Done():
+			fmt.Printf("stopped validating snapshot at block %d of %d\n",
+				height, s.Height)
+			return nil, nil
+		}
+		_, _, _, err = processInto(ub, &p, &stats)
+		if err != nil {
+			return nil, fmt.Errorf("validating snapshot: %s", err.Error())
+		}
+		last = ub.Block.BlockHash()
+		if height%10000 == 0 {
+			fmt.Printf("validating snapshot, at block %d of %d\n",
+				height, s.Height)
+		}
+	}
+
+	numLeaves, _ := p.ReconstructStats()
+	if last != s.BlockHash || numLeaves != s.NumLeaves ||
+		!reflect.DeepEqual(p.GetRoots(), s.Roots) {
+		return nil, fmt.Errorf("snapshot %s is wrong.  Block %d is %s with %d "+
+			"leaves and roots %x, the snapshot has %s %d %x.  Remove %s "+
+			"to start over", s.ID(), s.Height-1, last, numLeaves,
+			p.GetRoots(), s.BlockHash, s.NumLeaves, s.Roots,
+			n.pollardDir())
+	}
+	fmt.Printf("snapshot %s at height %d is valid\n", s.ID(), s.Height)
+	return &stats, nil
+}
+
+// pollardDir is where the pollard is saved, for messages
+func (n *Node) pollardDir() string {
+	if n.paths == nil {
+		return "nothing"
+	}
+	return n.paths.PollardDirPath
+}
@@ -0,0 +1,374 @@
+package csn
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// makeUBlocks makes numBlocks blocks with proofs, using a forest like a
+// bridge node would.  Each block has a coinbase with 2 outputs, and an
+// OP_RETURN every 5th block.  From block 3 on, a tx spends the first output
+// of the coinbase 2 blocks back to a p2wpkh.  Gives back the forest too, to
+// check roots against.  The headers only link up with PrevBlock.
+func makeUBlocks(t *testing.T, numBlocks int) (
+	[]util.UBlock, *accumulator.Forest) {
+
+	f := accumulator.NewForest(nil)
+	var ubs []util.UBlock
+	var coinbases []chainhash.Hash
+	for h := int32(1); h <= int32(numBlocks); h++ {
+		var ub util.UBlock
+		ub.Height = h
+		if h > 1 {
+			ub.Block.Header.PrevBlock = ubs[h-2].Block.BlockHash()
+		}
+		cb := wire.NewMsgTx(1)
+		cb.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Index: 0xffffffff},
+			SignatureScript:  []byte{byte(h), 0x51},
+		})
+		cb.AddTxOut(wire.NewTxOut(int64(h)*100, []byte{0x51, byte(h), 0}))
+		cb.AddTxOut(wire.NewTxOut(int64(h)*100, []byte{0x51, byte(h), 1}))
+		if h%5 == 0 {
+			cb.AddTxOut(wire.NewTxOut(0, []byte{0x6a, byte(h)}))
+		}
+		ub.Block.AddTransaction(cb)
+		coinbases = append(coinbases, cb.TxHash())
+
+		if h >= 3 {
+			spend := wire.NewMsgTx(1)
+			spend.AddTxIn(&wire.TxIn{PreviousOutPoint: wire.OutPoint{
+				Hash: coinbases[h-3], Index: 0}})
+			spend.AddTxOut(wire.NewTxOut(1,
+				append([]byte{0x00, 0x14, byte(h)}, make([]byte, 19)...)))
+			ub.Block.AddTransaction(spend)
+
+			// what the leaf added 2 blocks ago was
+			ub.ExtraData.UtxoData = []util.LeafData{{
+				Outpoint: wire.OutPoint{Hash: coinbases[h-3], Index: 0},
+				Height:   h - 2,
+				Coinbase: true,
+				Amt:      int64(h-2) * 100,
+				PkScript: []byte{0x51, byte(h - 2), 0},
+			}}
+		}
+
+		delHashes := make([]accumulator.Hash, len(ub.ExtraData.UtxoData))
+		for i, ld := range ub.ExtraData.UtxoData {
+			delHashes[i] = ld.LeafHash()
+		}
+		var err error
+		ub.ExtraData.AccProof, err = f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// ProveBatch can make a proof but not for a leaf that's not there
+		if len(ub.ExtraData.AccProof.Targets) != len(delHashes) {
+			t.Fatalf("block %d proof has %d targets, expect %d",
+				h, len(ub.ExtraData.AccProof.Targets), len(delHashes))
+		}
+		del := accumulator.BatchProof{
+			Targets: make([]uint64, len(ub.ExtraData.AccProof.Targets))}
+		copy(del.Targets, ub.ExtraData.AccProof.Targets)
+		del.SortTargets()
+		_, err = f.Modify(util.BlockToAddLeaves(ub.Block, nil, nil, h), del.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ubs = append(ubs, ub)
+	}
+	return ubs, f
+}
+
+func TestNodeRun(t *testing.T) {
+	ubs, f := makeUBlocks(t, 40)
+	n, err := NewNode(Config{}, &MemSource{Blocks: ubs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var connected []int32
+	n.OnConnect(func(ub *util.UBlock) {
+		connected = append(connected, ub.Height)
+	})
+	err = n.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Height() != 41 {
+		t.Fatalf("stopped at %d, expect 41", n.Height())
+	}
+	if !reflect.DeepEqual(n.Roots(), f.GetRoots()) {
+		t.Fatalf("roots %x, forest roots %x", n.Roots(), f.GetRoots())
+	}
+	for i, h := range connected {
+		if h != int32(i)+1 {
+			t.Fatalf("connected %v", connected)
+		}
+	}
+	if len(connected) != 40 {
+		t.Fatalf("%d blocks connected, expect 40", len(connected))
+	}
+}
+
+func TestNodeBadBlocks(t *testing.T) {
+	ubs, _ := makeUBlocks(t, 5)
+	n, err := NewNode(Config{}, &MemSource{Blocks: ubs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.ProcessUBlock(ubs[1]) == nil {
+		t.Fatalf("took block 2 at height 1")
+	}
+	for _, ub := range ubs[:3] {
+		err = n.ProcessUBlock(ub)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	roots := n.Roots()
+
+	// change the amount of the utxo spent; the proof doesn't match now
+	bad := ubs[3]
+	bad.ExtraData.UtxoData = []util.LeafData{bad.ExtraData.UtxoData[0]}
+	bad.ExtraData.UtxoData[0].Amt++
+	if n.ProcessUBlock(bad) == nil {
+		t.Fatalf("took block with bad leaf data")
+	}
+	// leaf data for a different input than the block spends
+	bad = ubs[3]
+	bad.ExtraData.UtxoData = []util.LeafData{bad.ExtraData.UtxoData[0]}
+	bad.ExtraData.UtxoData[0].Outpoint.Index = 1
+	if n.ProcessUBlock(bad) == nil {
+		t.Fatalf("took block with wrong outpoint")
+	}
+	if n.Height() != 4 || !reflect.DeepEqual(n.Roots(), roots) {
+		t.Fatalf("bad blocks changed node")
+	}
+
+	// the real one still goes in
+	err = n.ProcessUBlock(ubs[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNodeSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ubs, f := makeUBlocks(t, 30)
+	n, err := NewNode(Config{DataDir: dir}, &MemSource{Blocks: ubs[:17]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := n.Roots()
+
+	n, err = NewNode(Config{DataDir: dir}, &MemSource{Blocks: ubs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Height() != 18 || !reflect.DeepEqual(n.Roots(), roots) {
+		t.Fatalf("resumed at %d roots %x, expect 18 %x",
+			n.Height(), n.Roots(), roots)
+	}
+	err = n.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(n.Roots(), f.GetRoots()) {
+		t.Fatalf("roots %x, forest roots %x", n.Roots(), f.GetRoots())
+	}
+}
+
+// cancelSource is a MemSource that calls cancel when asked for block at
+type cancelSource struct {
+	MemSource
+	at     int32
+	cancel func()
+}
+
+func (cs *cancelSource) UBlock(height int32) (util.UBlock, error) {
+	if height == cs.at {
+		cs.cancel()
+	}
+	return cs.MemSource.UBlock(height)
+}
+
+// holdSource is a MemSource that doesn't give blocks from at on until
+// release is closed
+type holdSource struct {
+	MemSource
+	at      int32
+	release chan struct{}
+}
+
+func (hs *holdSource) UBlock(height int32) (util.UBlock, error) {
+	if height >= hs.at {
+		<-hs.release
+	}
+	return hs.MemSource.UBlock(height)
+}
+
+// TestNodeCancel stops Run partway with ctx, and checks the node saved
+// where it stopped and can pick up from there.
+func TestNodeCancel(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ubs, f := makeUBlocks(t, 40)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n, err := NewNode(Config{DataDir: dir}, &cancelSource{
+		MemSource: MemSource{Blocks: ubs}, at: 20, cancel: cancel})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Run(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stopped, roots, stats := n.Height(), n.Roots(), n.UTXOStats()
+	if stopped == 1 || stopped > 20 {
+		t.Fatalf("cancelled at block 20 but stopped at %d", stopped)
+	}
+
+	n, err = NewNode(Config{DataDir: dir}, &MemSource{Blocks: ubs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Height() != stopped || !reflect.DeepEqual(n.Roots(), roots) ||
+		n.UTXOStats() != stats {
+		t.Fatalf("resumed at %d roots %x, expect %d %x",
+			n.Height(), n.Roots(), stopped, roots)
+	}
+	err = n.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(n.Roots(), f.GetRoots()) ||
+		n.UTXOStats() != wholeStats(ubs) {
+		t.Fatalf("roots %x, forest roots %x", n.Roots(), f.GetRoots())
+	}
+}
+
+// TestNodeSnapshot starts a node from a snapshot partway through, with and
+// without validating it, and with snapshots that are wrong.
+func TestNodeSnapshot(t *testing.T) {
+	ubs, f := makeUBlocks(t, 40)
+	// a node that went through the first 20 blocks makes the snapshot
+	n, err := NewNode(Config{}, &MemSource{Blocks: ubs[:20]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	numLeaves, _ := n.pollard.ReconstructStats()
+	snap := util.RootsSnapshot{Height: 21,
+		BlockHash: ubs[19].Block.BlockHash(), NumLeaves: numLeaves,
+		Roots: n.Roots()}
+
+	for _, validate := range []bool{false, true} {
+		s := snap
+		n, err = NewNode(Config{Snapshot: &s, ValidateSnapshot: validate},
+			&MemSource{Blocks: ubs})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Height() != 21 {
+			t.Fatalf("started at %d, expect 21", n.Height())
+		}
+		err = n.Run(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(n.Roots(), f.GetRoots()) {
+			t.Fatalf("roots %x, forest roots %x", n.Roots(), f.GetRoots())
+		}
+		// validating gives the stats from before the snapshot too
+		want := UTXOStats{Since: 21}
+		for _, ub := range ubs[20:] {
+			want.add(blockStats(ub))
+		}
+		if validate {
+			want = wholeStats(ubs)
+		}
+		if n.UTXOStats() != want {
+			t.Fatalf("validate %v stats %+v, expect %+v",
+				validate, n.UTXOStats(), want)
+		}
+	}
+
+	// wrong roots; with no blocks after, only validating sees it
+	s := snap
+	s.Roots = append([]accumulator.Hash{}, snap.Roots...)
+	s.Roots[0][0] ^= 1
+	n, err = NewNode(Config{Snapshot: &s, ValidateSnapshot: true},
+		&MemSource{Blocks: ubs[:20]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Run(context.Background()) == nil {
+		t.Fatal("validated snapshot with wrong roots")
+	}
+
+	// validating fails while Run is still waiting on blocks, so it
+	// shouldn't wait for them
+	hold := &holdSource{MemSource: MemSource{Blocks: ubs}, at: 21,
+		release: make(chan struct{})}
+	defer close(hold.release)
+	n, err = NewNode(Config{Snapshot: &s, ValidateSnapshot: true}, hold)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- n.Run(context.Background())
+	}()
+	select {
+	case err = <-runErr:
+		if err == nil {
+			t.Fatal("validated snapshot with wrong roots")
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Run kept going after validating the snapshot failed")
+	}
+
+	// block 21 doesn't build on the snapshot's block
+	s = snap
+	s.BlockHash = ubs[18].Block.BlockHash()
+	n, err = NewNode(Config{Snapshot: &s}, &MemSource{Blocks: ubs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Run(context.Background()) == nil {
+		t.Fatal("took block 21 on the wrong block")
+	}
+
+	s = snap
+	s.DeleteMode = accumulator.SwaplessDelete
+	_, err = NewNode(Config{Snapshot: &s}, &MemSource{Blocks: ubs})
+	if err == nil {
+		t.Fatal("took swapless snapshot for swap node")
+	}
+}
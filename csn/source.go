@@ -0,0 +1,108 @@
+package csn
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/mit-dci/utreexo/util"
+)
+
+// BlockSource is where a Node gets blocks and their proofs from.  It could
+// be files, a bridge node over the network, or blocks already in memory.
+type BlockSource interface {
+	// UBlock gives the block at height, along with its proof
+	UBlock(height int32) (util.UBlock, error)
+	// TipHeight is the height after the last block the source has; Run
+	// goes up to there
+	TipHeight() (int32, error)
+}
+
+// FileSource reads blocks from blk*.dat files and proofs from the proof
+// files a bridgenode wrote, for when they're on the same computer.
+type FileSource struct {
+	paths *util.Paths
+}
+
+// NewFileSource makes a FileSource reading from paths
+func NewFileSource(paths *util.Paths) *FileSource {
+	return &FileSource{paths: paths}
+}
+
+// UBlock reads a block and its proof from the files
+func (fs *FileSource) UBlock(height int32) (ub util.UBlock, err error) {
+	ub.Height = height
+	ub.ExtraData, err = util.GetUDataFromFile(height, fs.paths)
+	if err != nil {
+		err = fmt.Errorf("GetUDataFromFile %s", err.Error())
+		return
+	}
+	ub.Block, err = util.GetRawBlockFromFile(height, fs.paths)
+	if err != nil {
+		err = fmt.Errorf("GetRawBlockFromFile %s", err.Error())
+	}
+	return
+}
+
+// TipHeight is one past the last block there's a proof for
+func (fs *FileSource) TipHeight() (int32, error) {
+	// We expect the offsetdata to be present
+	// TODO this will be depreciated in the future
+	if !util.HasAccess(fs.paths.OffsetFilePath) {
+		return 0, fmt.Errorf("No offsetdata present. " +
+			"Please run `genproofs` first and try again")
+	}
+	info, err := os.Stat(fs.paths.POffsetFilePath)
+	if err != nil {
+		return 0, err
+	}
+	if info.Size()%8 != 0 {
+		return 0, fmt.Errorf("offsetfile %d bytes, not multiple of 8",
+			info.Size())
+	}
+	return int32(info.Size()/8) + 1, nil
+}
+
+// MemSource is a BlockSource with all the blocks in memory.  Blocks[0] is
+// block 1.
+type MemSource struct {
+	Blocks []util.UBlock
+}
+
+// UBlock gives the block at height
+func (ms *MemSource) UBlock(height int32) (util.UBlock, error) {
+	if height < 1 || int(height) > len(ms.Blocks) {
+		return util.UBlock{}, fmt.Errorf("no block %d, have 1 to %d",
+			height, len(ms.Blocks))
+	}
+	ub := ms.Blocks[height-1]
+	if ub.Height != height {
+		return ub, fmt.Errorf("block %d says it's at height %d",
+			height, ub.Height)
+	}
+	return ub, nil
+}
+
+// TipHeight is one past the last block
+func (ms *MemSource) TipHeight() (int32, error) {
+	return int32(len(ms.Blocks)) + 1, nil
+}
+
+// sourceReader gets blocks from src and puts them in blockChan, from
+// curHeight up to maxHeight.  It stops when ctx is done, or on an error,
+// which goes to errChan.
+func sourceReader(ctx context.Context, src BlockSource,
+	blockChan chan util.UBlock, errChan chan error, maxHeight, curHeight int32) {
+	for ; curHeight != maxHeight; curHeight++ {
+		ub, err := src.UBlock(curHeight)
+		if err != nil {
+			util.SendErr(errChan, err)
+			return
+		}
+		select {
+		case blockChan <- ub:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package csn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// UTXOStats are totals for the utxo set, kept up as blocks come in, like
+// bitcoind's gettxoutsetinfo.  Like the accumulator, they leave out
+// OP_RETURNs and outputs spent in the same block they're made.
+//
+// The coinbases BIP30 is about, in blocks 91842 and 91880, are the same
+// txs as ones before them.  Here they're separate leaves so they're counted
+// twice, but bitcoind only has one of each, so on mainnet the totals are 2
+// utxos and 100 BTC more than gettxoutsetinfo says.
+//
+// Everything is added up block by block, so a node that started from a
+// snapshot only has what's changed since, which can be negative.  Since
+// says which.
+type UTXOStats struct {
+	// Since is the first block counted.  1 for the whole utxo set.
+	Since int32
+	// Count is how many utxos there are
+	Count int64
+	// Amount is what they add up to, in satoshis
+	Amount int64
+	// ByType is how many utxos have each type of script
+	ByType [util.NumScriptTypes]int64
+}
+
+// addBlock counts the outputs a block adds and the ones it spends.  outskip
+// is from DedupeBlock, and spent is the leaf data from the block's proof.
+func (s *UTXOStats) addBlock(blk *wire.MsgBlock, outskip []uint32,
+	spent []util.LeafData) {
+
+	// go through the outputs the way BlockToAddLeaves does
+	var txonum uint32
+	for _, tx := range blk.Transactions {
+		for _, out := range tx.TxOut {
+			skip := util.IsUnspendable(out)
+			if !skip && len(outskip) > 0 && outskip[0] == txonum {
+				outskip = outskip[1:]
+				skip = true
+			}
+			txonum++
+			if skip {
+				continue
+			}
+			s.Count++
+			s.Amount += out.Value
+			s.ByType[util.ScriptTypeOf(out.PkScript)]++
+		}
+	}
+	for _, ld := range spent {
+		s.Count--
+		s.Amount -= ld.Amt
+		s.ByType[util.ScriptTypeOf(ld.PkScript)]--
+	}
+}
+
+// add adds in the totals from other
+func (s *UTXOStats) add(other UTXOStats) {
+	s.Count += other.Count
+	s.Amount += other.Amount
+	for i, n := range other.ByType {
+		s.ByType[i] += n
+	}
+}
+
+// bytes serializes the stats: since (4) count (8) amount (8) number of
+// script types (1) and the count for each (8), all big endian
+func (s *UTXOStats) bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, s.Since)
+	binary.Write(&buf, binary.BigEndian, s.Count)
+	binary.Write(&buf, binary.BigEndian, s.Amount)
+	buf.WriteByte(uint8(len(s.ByType)))
+	binary.Write(&buf, binary.BigEndian, s.ByType[:])
+	return buf.Bytes()
+}
+
+// utxoStatsFromBytes reads what bytes wrote.  Script types it doesn't
+// know about are an error, so nothing's lost from a newer version.
+func utxoStatsFromBytes(b []byte) (s UTXOStats, err error) {
+	if len(b) < 21 || len(b) != 21+8*int(b[20]) {
+		err = fmt.Errorf("utxo stats %d bytes", len(b))
+		return
+	}
+	if int(b[20]) > len(s.ByType) {
+		err = fmt.Errorf("utxo stats have %d script types, only know %d",
+			b[20], len(s.ByType))
+		return
+	}
+	buf := bytes.NewReader(b)
+	binary.Read(buf, binary.BigEndian, &s.Since)
+	binary.Read(buf, binary.BigEndian, &s.Count)
+	binary.Read(buf, binary.BigEndian, &s.Amount)
+	buf.ReadByte()
+	err = binary.Read(buf, binary.BigEndian, s.ByType[:b[20]])
+	return
+}
+
+// restoreUTXOStats reads the stats saved with the pollard
+func restoreUTXOStats(paths *util.Paths) (UTXOStats, error) {
+	b, err := ioutil.ReadFile(paths.UTXOStatsFilePath)
+	if err != nil {
+		return UTXOStats{}, err
+	}
+	return utxoStatsFromBytes(b)
+}
+
+// saveUTXOStats writes the stats next to the pollard.  It replaces the old
+// file atomically, so a crash leaves either the old stats or the new ones.
+func saveUTXOStats(paths *util.Paths, s UTXOStats) error {
+	return util.WriteFileAtomic(paths.UTXOStatsFilePath, s.bytes())
+}
+
+// ReadUTXOStats reads the utxo stats ibdsim saved in dataDir, and the
+// height they're at, without starting a node
+func ReadUTXOStats(dataDir string) (UTXOStats, int32, error) {
+	paths := util.NewPaths(dataDir, "")
+	s, err := restoreUTXOStats(paths)
+	if err != nil {
+		return s, 0, err
+	}
+	height, err := restorePollardHeight(paths)
+	return s, height, err
+}
@@ -0,0 +1,94 @@
+package csn
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// wholeStats works out the stats for the blocks by keeping every utxo
+func wholeStats(ubs []util.UBlock) UTXOStats {
+	utxos := make(map[wire.OutPoint]*wire.TxOut)
+	for _, ub := range ubs {
+		for i, tx := range ub.Block.Transactions {
+			if i != 0 {
+				for _, in := range tx.TxIn {
+					delete(utxos, in.PreviousOutPoint)
+				}
+			}
+			for j, out := range tx.TxOut {
+				if !util.IsUnspendable(out) {
+					utxos[wire.OutPoint{Hash: tx.TxHash(),
+						Index: uint32(j)}] = out
+				}
+			}
+		}
+	}
+	s := UTXOStats{Since: 1}
+	for _, out := range utxos {
+		s.Count++
+		s.Amount += out.Value
+		s.ByType[util.ScriptTypeOf(out.PkScript)]++
+	}
+	return s
+}
+
+// blockStats is what one block changes
+func blockStats(ub util.UBlock) UTXOStats {
+	var s UTXOStats
+	_, outskip := util.DedupeBlock(&ub.Block)
+	s.addBlock(&ub.Block, outskip, ub.ExtraData.UtxoData)
+	return s
+}
+
+func TestUTXOStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ubs, _ := makeUBlocks(t, 40)
+	n, err := NewNode(Config{DataDir: dir}, &MemSource{Blocks: ubs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.Run(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := wholeStats(ubs)
+	if n.UTXOStats() != want {
+		t.Fatalf("stats %+v, expect %+v", n.UTXOStats(), want)
+	}
+	if want.ByType[util.ScriptP2WPKH] != 38 || want.ByType[util.ScriptOther] != 42 {
+		t.Fatalf("test blocks don't have the utxos they should: %+v", want)
+	}
+
+	saved, height, err := ReadUTXOStats(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != want || height != 41 {
+		t.Fatalf("saved stats %+v at %d, expect %+v at 41",
+			saved, height, want)
+	}
+
+	b := want.bytes()
+	for _, bad := range [][]byte{b[:len(b)-1], append(b, 0)} {
+		_, err = utxoStatsFromBytes(bad)
+		if err == nil {
+			t.Fatalf("read %d bytes of stats", len(bad))
+		}
+	}
+	// a newer version with another script type
+	b[20]++
+	_, err = utxoStatsFromBytes(append(b, make([]byte, 8)...))
+	if err == nil {
+		t.Fatal("read stats with an unknown script type")
+	}
+}
@@ -0,0 +1,106 @@
+package util
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// xorKeyFileName is where newer bitcoind keeps the key it xors the blk and
+// rev files with, in the blocks dir
+const xorKeyFileName = "xor.dat"
+
+// BlockFile is a blk*.dat or rev*.dat file from bitcoind, open for reading.
+// Newer bitcoind obfuscates those files by xoring every byte with the 8 byte
+// key in xor.dat; BlockFile undoes that as it reads, so it can be read like
+// a plain file either way.
+type BlockFile struct {
+	f   *os.File
+	key [8]byte
+	// pos is where in the file the next Read starts, which says which
+	// byte of the key goes with which byte of the file
+	pos int64
+}
+
+// OpenBlkFile opens blk file number n
+func (p *Paths) OpenBlkFile(n uint32) (*BlockFile, error) {
+	return p.openBlockFile(p.BlkFilePath(n))
+}
+
+// OpenRevFile opens rev file number n
+func (p *Paths) OpenRevFile(n uint32) (*BlockFile, error) {
+	return p.openBlockFile(p.RevFilePath(n))
+}
+
+func (p *Paths) openBlockFile(name string) (*BlockFile, error) {
+	p.xorOnce.Do(func() {
+		p.xorKey, p.xorErr = readXorKey(p.BlocksDir)
+	})
+	if p.xorErr != nil {
+		return nil, p.xorErr
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &BlockFile{f: f, key: p.xorKey}, nil
+}
+
+// readXorKey reads xor.dat from the blocks dir.  No xor.dat means the files
+// aren't obfuscated, same as a key of all 0s.
+func readXorKey(blocksDir string) (key [8]byte, err error) {
+	path := filepath.Join(blocksDir, xorKeyFileName)
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return key, nil
+	}
+	if err != nil {
+		return key, err
+	}
+	if len(b) != len(key) {
+		return key, fmt.Errorf("%s is %d bytes, expect %d",
+			path, len(b), len(key))
+	}
+	copy(key[:], b)
+	return key, nil
+}
+
+// Read reads from the file and un-xors what it read
+func (bf *BlockFile) Read(b []byte) (int, error) {
+	n, err := bf.f.Read(b)
+	xorBytes(b[:n], bf.key, bf.pos)
+	bf.pos += int64(n)
+	return n, err
+}
+
+// Seek is like os.File's Seek
+func (bf *BlockFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := bf.f.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	bf.pos = pos
+	return pos, nil
+}
+
+// Stat is like os.File's Stat
+func (bf *BlockFile) Stat() (os.FileInfo, error) {
+	return bf.f.Stat()
+}
+
+// Close closes the file
+func (bf *BlockFile) Close() error {
+	return bf.f.Close()
+}
+
+// xorBytes xors b, which is from position pos in a file, with the key.
+// Also obfuscates, since xoring twice gives back what you started with.
+func xorBytes(b []byte, key [8]byte, pos int64) {
+	if key == [8]byte{} {
+		return
+	}
+	for i := range b {
+		b[i] ^= key[(pos+int64(i))%int64(len(key))]
+	}
+}
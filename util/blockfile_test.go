@@ -0,0 +1,92 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlockFileXor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := NewPaths(dir, dir)
+
+	plain := make([]byte, 100)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+	key := [8]byte{0, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0xff}
+	obf := make([]byte, len(plain))
+	copy(obf, plain)
+	xorBytes(obf, key, 0)
+	if bytes.Equal(obf, plain) {
+		t.Fatalf("xor didn't change anything")
+	}
+	err = ioutil.WriteFile(p.BlkFilePath(0), obf, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, xorKeyFileName), key[:], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := p.OpenBlkFile(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// reads that don't start on a multiple of 8, after seeks both ways
+	got := make([]byte, 13)
+	for _, seek := range []struct {
+		offset int64
+		whence int
+		pos    int
+	}{{5, 0, 5}, {3, 1, 21}, {-30, 1, 4}, {-13, 2, 87}} {
+		_, err = f.Seek(seek.offset, seek.whence)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.Read(got)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, plain[seek.pos:seek.pos+len(got)]) {
+			t.Fatalf("at %d read %x, expect %x",
+				seek.pos, got, plain[seek.pos:seek.pos+len(got)])
+		}
+	}
+
+	// a key that's the wrong size is an error
+	err = ioutil.WriteFile(filepath.Join(dir, xorKeyFileName), key[:7], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewPaths(dir, dir).OpenBlkFile(0)
+	if err == nil {
+		t.Fatalf("no error for 7 byte xor.dat")
+	}
+
+	// no xor.dat is no xor
+	err = os.Remove(filepath.Join(dir, xorKeyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := NewPaths(dir, dir).OpenBlkFile(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	_, err = f2.Read(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, obf[:len(got)]) {
+		t.Fatalf("read %x without xor.dat, expect %x", got, obf[:len(got)])
+	}
+}
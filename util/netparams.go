@@ -0,0 +1,192 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// NetParams is what utreexo needs to know about a network
+type NetParams struct {
+	// Name is used for -net and for the network's data dir
+	Name string
+	// Net is the magic bytes at the start of each block in the blk and
+	// rev files, same as on the p2p network
+	Net wire.BitcoinNet
+	// GenesisHash is the hash of block 0, in the byte order of the block
+	// header (reversed from how it's usually shown)
+	GenesisHash Hash
+	// BitcoindDir is where bitcoind keeps this network's blocks, in
+	// ~/.bitcoin.  Empty for mainnet.
+	BitcoindDir string
+}
+
+// MainNetParams is bitcoin mainnet
+var MainNetParams = NetParams{
+	Name: "mainnet",
+	Net:  wire.MainNet,
+	GenesisHash: Hash{
+		0x6f, 0xe2, 0x8c, 0x0a, 0xb6, 0xf1, 0xb3, 0x72,
+		0xc1, 0xa6, 0xa2, 0x46, 0xae, 0x63, 0xf7, 0x4f,
+		0x93, 0x1e, 0x83, 0x65, 0xe1, 0x5a, 0x08, 0x9c,
+		0x68, 0xd6, 0x19, 0x00, 0x00, 0x00, 0x00, 0x00,
+	},
+}
+
+// TestNet3Params is testnet version 3
+var TestNet3Params = NetParams{
+	Name: "testnet",
+	Net:  wire.TestNet3,
+	GenesisHash: Hash{
+		0x43, 0x49, 0x7f, 0xd7, 0xf8, 0x26, 0x95, 0x71,
+		0x08, 0xf4, 0xa3, 0x0f, 0xd9, 0xce, 0xc3, 0xae,
+		0xba, 0x79, 0x97, 0x20, 0x84, 0xe9, 0x0e, 0xad,
+		0x01, 0xea, 0x33, 0x09, 0x00, 0x00, 0x00, 0x00,
+	},
+	BitcoindDir: "testnet3",
+}
+
+// RegTestParams is regtest
+var RegTestParams = NetParams{
+	Name: "regtest",
+	Net:  wire.TestNet, // yes, this is the name of regtest in btcd
+	GenesisHash: Hash{
+		0x06, 0x22, 0x6e, 0x46, 0x11, 0x1a, 0x0b, 0x59,
+		0xca, 0xaf, 0x12, 0x60, 0x43, 0xeb, 0x5b, 0xbf,
+		0x28, 0xc3, 0x4f, 0x3a, 0x5e, 0x33, 0x2a, 0x1f,
+		0xc7, 0xb2, 0xb7, 0x3c, 0xf1, 0x88, 0x91, 0x0f,
+	},
+	BitcoindDir: "regtest",
+}
+
+// SigNetParams is the default signet.  Other signets have the same genesis
+// block but a different challenge, which gives them different magic bytes;
+// see SigNetParamsForChallenge.
+var SigNetParams = NetParams{
+	Name: "signet",
+	Net:  wire.BitcoinNet(0x40cf030a),
+	GenesisHash: Hash{
+		0xf6, 0x1e, 0xee, 0x3b, 0x63, 0xa3, 0x80, 0xa4,
+		0x77, 0xa0, 0x63, 0xaf, 0x32, 0xb2, 0xbb, 0xc9,
+		0x7c, 0x9f, 0xf9, 0xf0, 0x1f, 0x2c, 0x42, 0x25,
+		0xe9, 0x73, 0x98, 0x81, 0x08, 0x00, 0x00, 0x00,
+	},
+	BitcoindDir: "signet",
+}
+
+// defaultSigNetChallenge is the block signing script for the default signet
+var defaultSigNetChallenge, _ = hex.DecodeString("512103ad5e0edad18cb1f0" +
+	"fc0d28a3d4f1f3e445640337489abb10404f2d1e086be430210359ef5021964fe2" +
+	"2d6f8e05b2463c9540ce96883fe3b278760f048f5189f2e6c452ae")
+
+// NetParamsByName gives the params for one of the built in networks
+func NetParamsByName(name string) (*NetParams, error) {
+	for _, p := range []*NetParams{
+		&MainNetParams, &TestNet3Params, &RegTestParams, &SigNetParams} {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network %s", name)
+}
+
+// SigNetParamsForChallenge gives the params for the signet with the given
+// challenge script.  The magic bytes are the first 4 bytes of the double
+// sha256 of the challenge with its length in front (BIP325).  Signets other
+// than the default one are named signet_ and their magic in hex, so they
+// don't share a data dir.
+func SigNetParamsForChallenge(challenge []byte) *NetParams {
+	p := SigNetParams
+	var buf bytes.Buffer
+	// errors writing to a bytes.Buffer are always nil
+	wire.WriteVarBytes(&buf, 0, challenge)
+	first := sha256.Sum256(buf.Bytes())
+	h := sha256.Sum256(first[:])
+	p.Net = wire.BitcoinNet(LBtU32(h[:4]))
+	if !bytes.Equal(challenge, defaultSigNetChallenge) {
+		p.Name = fmt.Sprintf("signet_%x", h[:4])
+	}
+	return &p
+}
+
+// netParamsFile is the json in a params file for a custom network.
+// Magic is the 4 bytes at the start of each block in the blk files, in
+// hex.  A signet can give its challenge script instead of the magic.
+// GenesisHash is shown the usual way, like bitcoin-cli getblockhash 0.
+type netParamsFile struct {
+	Name            string `json:"name"`
+	Magic           string `json:"magic"`
+	SigNetChallenge string `json:"signetchallenge"`
+	GenesisHash     string `json:"genesishash"`
+	BitcoindDir     string `json:"bitcoinddir"`
+}
+
+// LoadNetParams reads a custom network's params from a json file
+func LoadNetParams(path string) (*NetParams, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var pf netParamsFile
+	err = json.Unmarshal(b, &pf)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	p := new(NetParams)
+
+	switch {
+	case pf.Magic != "" && pf.SigNetChallenge != "":
+		return nil, fmt.Errorf("%s: give magic or signetchallenge, not both",
+			path)
+	case pf.SigNetChallenge != "":
+		challenge, err := hex.DecodeString(pf.SigNetChallenge)
+		if err != nil {
+			return nil, fmt.Errorf("%s: signetchallenge %s", path, err.Error())
+		}
+		p = SigNetParamsForChallenge(challenge)
+	case pf.Magic != "":
+		magic, err := hex.DecodeString(pf.Magic)
+		if err != nil || len(magic) != 4 {
+			return nil, fmt.Errorf("%s: magic %s isn't 4 bytes of hex",
+				path, pf.Magic)
+		}
+		p.Net = wire.BitcoinNet(LBtU32(magic))
+	default:
+		return nil, fmt.Errorf("%s: no magic or signetchallenge", path)
+	}
+
+	if pf.GenesisHash != "" {
+		h, err := chainhash.NewHashFromStr(pf.GenesisHash)
+		if err != nil {
+			return nil, fmt.Errorf("%s: genesishash %s", path, err.Error())
+		}
+		p.GenesisHash = Hash(*h)
+	} else if pf.SigNetChallenge == "" {
+		return nil, fmt.Errorf("%s: no genesishash", path)
+	}
+	if pf.Name != "" {
+		p.Name = pf.Name
+	}
+	// the name is a directory in the data dir
+	if p.Name == "" || p.Name == "." || p.Name == ".." ||
+		strings.ContainsAny(p.Name, `/\`) {
+		return nil, fmt.Errorf("%s: bad name %q", path, p.Name)
+	}
+	if pf.BitcoindDir != "" {
+		p.BitcoindDir = pf.BitcoindDir
+	}
+	return p, nil
+}
+
+// MagicBytes is how Net looks at the start of a block in the blk files
+func (p *NetParams) MagicBytes() (b [4]byte) {
+	copy(b[:], U32tLB(uint32(p.Net)))
+	return
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSigNetMagic(t *testing.T) {
+	// the default signet's magic comes from its challenge like any other
+	p := SigNetParamsForChallenge(defaultSigNetChallenge)
+	if *p != SigNetParams {
+		t.Fatalf("default challenge gave %+v", p)
+	}
+	if p.MagicBytes() != [4]byte{0x0a, 0x03, 0xcf, 0x40} {
+		t.Fatalf("signet magic %x", p.MagicBytes())
+	}
+
+	p = SigNetParamsForChallenge([]byte{0x51})
+	if p.Net == SigNetParams.Net || p.Name == SigNetParams.Name ||
+		p.GenesisHash != SigNetParams.GenesisHash {
+		t.Fatalf("challenge OP_TRUE gave %+v", p)
+	}
+}
+
+func TestLoadNetParams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "netparams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "params.json")
+
+	// testnet written out as a custom network
+	err = ioutil.WriteFile(path, []byte(`{
+	"name": "testnet",
+	"magic": "0b110907",
+	"genesishash": "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943",
+	"bitcoinddir": "testnet3"
+}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadNetParams(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *p != TestNet3Params {
+		t.Fatalf("got %+v, expect %+v", p, TestNet3Params)
+	}
+
+	// a signet can just give its challenge
+	err = ioutil.WriteFile(path, []byte(`{"signetchallenge": "51"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err = LoadNetParams(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *p != *SigNetParamsForChallenge([]byte{0x51}) {
+		t.Fatalf("got %+v", p)
+	}
+
+	for _, bad := range []string{
+		`{"name": "x", "magic": "0b1109"}`,
+		`{"name": "x", "magic": "0b110907"}`,
+		`{"name": "x", "genesishash": "00"}`,
+		`{"magic": "0b110907", "genesishash": "00"}`,
+		`{"name": "../x", "magic": "0b110907", "genesishash": "00"}`,
+		`{"signetchallenge": "51", "magic": "0b110907"}`,
+	} {
+		err = ioutil.WriteFile(path, []byte(bad), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = LoadNetParams(path)
+		if err == nil {
+			t.Fatalf("no error for %s", bad)
+		}
+	}
+}
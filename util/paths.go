@@ -1,51 +1,139 @@
 package util
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
-// Directory paths
-var OffsetDirPath string = filepath.Join(".", "offsetdata")
-var RevOffsetDirPath string = filepath.Join(".", "revdata")
-var ProofDirPath string = filepath.Join(".", "proofdata")
-var ForestDirPath string = filepath.Join(".", "forestdata")
-var PollardDirPath string = filepath.Join(".", "pollarddata")
+// Paths has where all the files go.  Everything the bridgenode and csn make
+// goes in directories under DataDir; the blk*.dat and rev*.dat files from
+// bitcoind are read from BlocksDir.
+type Paths struct {
+	DataDir   string
+	BlocksDir string
 
-// File paths
+	// Directory paths
+	OffsetDirPath    string
+	RevOffsetDirPath string
+	ProofDirPath     string
+	ForestDirPath    string
+	PollardDirPath   string
 
-// offsetdata file paths
-var OffsetFilePath string = filepath.Join(OffsetDirPath, "offsetfile")
-var LastIndexOffsetHeightFilePath string = filepath.Join(OffsetDirPath, "lastindexoffsetheightfile")
+	// offsetdata file paths
+	OffsetFilePath                string
+	LastIndexOffsetHeightFilePath string
 
-// proofdata file paths
-//
-// Where the proofs for txs are stored
-var PFilePath string = filepath.Join(ProofDirPath, "proof.dat")
+	// RevOffsetFilePath is the path for rev data file paths
+	RevOffsetFilePath string
 
-// Where the index for a proof for a block is stored
-var POffsetFilePath string = filepath.Join(ProofDirPath, "proofoffset.dat")
+	// proofdata file paths
+	//
+	// Where the proofs for txs are stored
+	PFilePath string
+	// Where the index for a proof for a block is stored
+	POffsetFilePath string
+	// For resuming purposes. Stores the last index that genproofs left at
+	LastPOffsetFilePath string
+	// RootHistoryFilePath has the roots after every block, and
+	// RootHistoryOffsetFilePath where each block's are in it
+	RootHistoryFilePath       string
+	RootHistoryOffsetFilePath string
 
-// For resuming purposes. Stores the last index that genproofs left at
-var LastPOffsetFilePath string = filepath.Join(ProofDirPath, "lastproofoffset.dat")
+	// forestdata file paths
+	ForestFilePath                      string
+	MiscForestFilePath                  string
+	ForestLastSyncedBlockHeightFilePath string
+	// Where the last consistent state of the forest and proof files is
+	// recorded
+	CheckpointFilePath string
+	// ForestSnapshotFilePath is where a forest in ram gets saved, along
+	// with its checkpoint
+	ForestSnapshotFilePath string
+	// ForestUndoFilePath has what a forest in a file needs to go back to
+	// the last checkpoint
+	ForestUndoFilePath string
 
-// forestdata file paths
-var ForestFilePath string = filepath.Join(ForestDirPath, "forestfile.dat")
-var MiscForestFilePath string = filepath.Join(ForestDirPath, "miscforestfile.dat")
-var ForestLastSyncedBlockHeightFilePath string = filepath.Join(ForestDirPath, "forestlastsyncedheight.dat")
+	// pollard data file paths
+	PollardFilePath       string
+	PollardHeightFilePath string
+	// UTXOStatsFilePath has the csn's totals for the utxo set
+	UTXOStatsFilePath string
 
-// pollard data file paths
-var PollardFilePath string = filepath.Join(PollardDirPath, "pollardfile.dat")
-var PollardHeightFilePath string = filepath.Join(PollardDirPath, "pollardheight.dat")
+	// LeafStoreDirPath is the leveldb of utxo leaf data, for a bridge node
+	// that doesn't use rev files
+	LeafStoreDirPath string
 
-// RevOffsetFilePath is the path for rev data file paths
-var RevOffsetFilePath string = filepath.Join(RevOffsetDirPath, "revoffsetfile")
+	// the key the blk and rev files are xored with, read the first time
+	// one is opened
+	xorOnce sync.Once
+	xorKey  [8]byte
+	xorErr  error
+}
+
+// NewPaths gives the paths for data in dataDir and blocks in blocksDir.
+// NewPaths(".", ".") is everything in the current directory.
+func NewPaths(dataDir, blocksDir string) *Paths {
+	p := &Paths{DataDir: dataDir, BlocksDir: blocksDir}
+
+	p.OffsetDirPath = filepath.Join(dataDir, "offsetdata")
+	p.RevOffsetDirPath = filepath.Join(dataDir, "revdata")
+	p.ProofDirPath = filepath.Join(dataDir, "proofdata")
+	p.ForestDirPath = filepath.Join(dataDir, "forestdata")
+	p.PollardDirPath = filepath.Join(dataDir, "pollarddata")
+
+	p.OffsetFilePath = filepath.Join(p.OffsetDirPath, "offsetfile")
+	p.LastIndexOffsetHeightFilePath = filepath.Join(
+		p.OffsetDirPath, "lastindexoffsetheightfile")
+	p.RevOffsetFilePath = filepath.Join(p.RevOffsetDirPath, "revoffsetfile")
+
+	p.PFilePath = filepath.Join(p.ProofDirPath, "proof.dat")
+	p.POffsetFilePath = filepath.Join(p.ProofDirPath, "proofoffset.dat")
+	p.LastPOffsetFilePath = filepath.Join(
+		p.ProofDirPath, "lastproofoffset.dat")
+	p.RootHistoryFilePath = filepath.Join(p.ProofDirPath, "roothistory.dat")
+	p.RootHistoryOffsetFilePath = filepath.Join(
+		p.ProofDirPath, "roothistoryoffset.dat")
+
+	p.ForestFilePath = filepath.Join(p.ForestDirPath, "forestfile.dat")
+	p.MiscForestFilePath = filepath.Join(
+		p.ForestDirPath, "miscforestfile.dat")
+	p.ForestLastSyncedBlockHeightFilePath = filepath.Join(
+		p.ForestDirPath, "forestlastsyncedheight.dat")
+	p.CheckpointFilePath = filepath.Join(p.ForestDirPath, "checkpoint.dat")
+	p.ForestSnapshotFilePath = filepath.Join(
+		p.ForestDirPath, "forestsnapshot.dat")
+	p.ForestUndoFilePath = filepath.Join(p.ForestDirPath, "forestundo.dat")
+
+	p.PollardFilePath = filepath.Join(p.PollardDirPath, "pollardfile.dat")
+	p.PollardHeightFilePath = filepath.Join(
+		p.PollardDirPath, "pollardheight.dat")
+	p.UTXOStatsFilePath = filepath.Join(p.PollardDirPath, "utxostats.dat")
+
+	p.LeafStoreDirPath = filepath.Join(dataDir, "leafstore")
+
+	return p
+}
+
+// BlkFilePath is the path of blk file number n
+func (p *Paths) BlkFilePath(n uint32) string {
+	return filepath.Join(p.BlocksDir, fmt.Sprintf("blk%05d.dat", n))
+}
+
+// RevFilePath is the path of rev file number n
+func (p *Paths) RevFilePath(n uint32) string {
+	return filepath.Join(p.BlocksDir, fmt.Sprintf("rev%05d.dat", n))
+}
 
 // MakePaths makes the neccessary paths for all files
-func MakePaths() {
-	os.MkdirAll(OffsetDirPath, os.ModePerm)
-	os.MkdirAll(ProofDirPath, os.ModePerm)
-	os.MkdirAll(ForestDirPath, os.ModePerm)
-	os.MkdirAll(PollardDirPath, os.ModePerm)
-	os.MkdirAll(RevOffsetDirPath, os.ModePerm)
+func (p *Paths) MakePaths() error {
+	for _, dir := range []string{p.OffsetDirPath, p.ProofDirPath,
+		p.ForestDirPath, p.PollardDirPath, p.RevOffsetDirPath} {
+		err := os.MkdirAll(dir, os.ModePerm)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
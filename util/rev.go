@@ -63,7 +63,7 @@ type TxInUndo struct {
 }
 
 // GetRevBlock gets a single block from the rev*.dat file given the height
-func GetRevBlock(height int32, revOffsetFileName string) (
+func GetRevBlock(height int32, p *Paths) (
 	rBlock RevBlock, err error) {
 	if height == 0 {
 		err = fmt.Errorf("Block 0 is not in blk files or utxo set")
@@ -74,7 +74,7 @@ func GetRevBlock(height int32, revOffsetFileName string) (
 	var datFile [4]byte
 	var offset [4]byte
 
-	offsetFile, err := os.Open(revOffsetFileName)
+	offsetFile, err := os.Open(p.RevOffsetFilePath)
 	if err != nil {
 		return rBlock, err
 	}
@@ -87,9 +87,7 @@ func GetRevBlock(height int32, revOffsetFileName string) (
 	offsetFile.Read(datFile[:])
 	offsetFile.Read(offset[:])
 
-	fileName := fmt.Sprintf("rev%05d.dat", int(BtU32(datFile[:])))
-
-	f, err := os.Open(fileName)
+	f, err := p.OpenRevFile(BtU32(datFile[:]))
 	if err != nil {
 		return rBlock, err
 	}
@@ -179,9 +177,9 @@ func readTxInUndo(r io.Reader, ti *TxInUndo) error {
 }
 
 // BuildRevOffsetFile builds an offset file for rev*.dat files
-// Just an index.
-func BuildRevOffsetFile() error {
-	offsetFile, err := os.OpenFile(RevOffsetFilePath,
+// Just an index.  net is the magic bytes each rev block starts with.
+func BuildRevOffsetFile(p *Paths, net wire.BitcoinNet) error {
+	offsetFile, err := os.OpenFile(p.RevOffsetFilePath,
 		os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
@@ -189,7 +187,7 @@ func BuildRevOffsetFile() error {
 	defer offsetFile.Close()
 
 	for fileNum := uint32(0); ; fileNum++ {
-		fileName := fmt.Sprintf("rev%05d.dat", fileNum)
+		fileName := p.RevFilePath(fileNum)
 		fmt.Printf("Building offsetfile... %s\n", fileName)
 		_, err := os.Stat(fileName)
 		if os.IsNotExist(err) {
@@ -198,7 +196,7 @@ func BuildRevOffsetFile() error {
 			break
 		}
 
-		err = writeOffset(fileNum, offsetFile)
+		err = writeOffset(p, fileNum, offsetFile, net)
 		if err != nil {
 			return err
 		}
@@ -208,10 +206,9 @@ func BuildRevOffsetFile() error {
 
 // writeOffset reads the magic bytes from the rev*.dat files to make an index of
 // each individual revblock
-func writeOffset(fileNum uint32, offsetFile *os.File) error {
-	fileName := fmt.Sprintf("rev%05d.dat", fileNum)
-	fmt.Println(fileName)
-	f, err := os.Open(fileName)
+func writeOffset(p *Paths, fileNum uint32, offsetFile *os.File,
+	net wire.BitcoinNet) error {
+	f, err := p.OpenRevFile(fileNum)
 	if err != nil {
 		return err
 	}
@@ -233,9 +230,9 @@ func writeOffset(fileNum uint32, offsetFile *os.File) error {
 		var magicbytes [4]byte
 		_, err := f.Read(magicbytes[:])
 		if err != nil {
-			panic(err)
+			return err
 		}
-		if CheckMagicByte(magicbytes) == false {
+		if CheckMagicByte(magicbytes, net) == false {
 			break
 		}
 
@@ -8,78 +8,79 @@ import (
 
 /*
  * TODO: These tests require rev*.dat files in the util directory.
- * Copy them over to test.
+ * Copy them over to test.  They're testnet files.
  */
 
+// revTestPaths makes the offset dirs for the rev files in the util
+// directory, or skips the test if there aren't any
+func revTestPaths(t *testing.T) *Paths {
+	p := NewPaths(".", ".")
+	if !HasAccess(p.RevFilePath(0)) {
+		t.Skip("no rev00000.dat in util directory")
+	}
+	err := p.MakePaths()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// removeRevTestPaths deletes all the directories revTestPaths made
+func removeRevTestPaths(p *Paths) {
+	os.RemoveAll(p.OffsetDirPath)
+	os.RemoveAll(p.ProofDirPath)
+	os.RemoveAll(p.ForestDirPath)
+	os.RemoveAll(p.PollardDirPath)
+	os.RemoveAll(p.RevOffsetDirPath)
+}
+
 func TestGetRevBlocks(t *testing.T) {
 	// Makes neccessary directories
-	MakePaths()
+	p := revTestPaths(t)
+	defer removeRevTestPaths(p)
 
 	// Builds an index
 	// takes less than 1/10th of a  second
-	err := BuildRevOffsetFile()
+	err := BuildRevOffsetFile(p, TestNet3Params.Net)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Gets blocks 1 ~ 300,001
-	for i := int32(0); i < 300000; i++ {
-		rb, err := GetRevBlock(i, RevOffsetFilePath)
+	// Gets blocks 1 ~ 300,000
+	for i := int32(1); i <= 300000; i++ {
+		rb, err := GetRevBlock(i, p)
 		if err != nil {
-			t.Log("Failed at height:", i+1)
-			// If it does fail, delete the created directories
-			os.RemoveAll(OffsetDirPath)
-			os.RemoveAll(ProofDirPath)
-			os.RemoveAll(ForestDirPath)
-			os.RemoveAll(PollardDirPath)
-			os.RemoveAll(RevOffsetDirPath)
+			t.Log("Failed at height:", i)
 			t.Fatal(err)
 		}
-		fmt.Println("height", i+1)
-		for _, tx := range rb.Block.Tx {
+		fmt.Println("height", i)
+		for _, tx := range rb.Txs {
 			for i, txin := range tx.TxIn {
 				fmt.Println("txcount:", i)
 				fmt.Println(txin)
 			}
 		}
-
 	}
-	// Delete all the directories
-	os.RemoveAll(OffsetDirPath)
-	os.RemoveAll(ProofDirPath)
-	os.RemoveAll(ForestDirPath)
-	os.RemoveAll(PollardDirPath)
-	os.RemoveAll(RevOffsetDirPath)
 }
 
 func TestGetOneRevBlock(t *testing.T) {
-	MakePaths()
+	p := revTestPaths(t)
+	defer removeRevTestPaths(p)
 
-	err := BuildRevOffsetFile()
+	err := BuildRevOffsetFile(p, TestNet3Params.Net)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	// Any arbitrary block will do here for testing
-	// 382 actually fetches block 383
-	rb, err := GetRevBlock(382, RevOffsetFilePath)
-	for _, tx := range rb.Block.Tx {
+	rb, err := GetRevBlock(383, p)
+	if err != nil {
+		t.Log("Failed at height:", 383)
+		t.Fatal(err)
+	}
+	for _, tx := range rb.Txs {
 		for _, txin := range tx.TxIn {
 			fmt.Println(txin)
 		}
 	}
-	if err != nil {
-		t.Log("Failed at height:", 382+1)
-		os.RemoveAll(OffsetDirPath)
-		os.RemoveAll(ProofDirPath)
-		os.RemoveAll(ForestDirPath)
-		os.RemoveAll(PollardDirPath)
-		os.RemoveAll(RevOffsetDirPath)
-		t.Fatal(err)
-	}
-	os.RemoveAll(OffsetDirPath)
-	os.RemoveAll(ProofDirPath)
-	os.RemoveAll(ForestDirPath)
-	os.RemoveAll(PollardDirPath)
-	os.RemoveAll(RevOffsetDirPath)
 }
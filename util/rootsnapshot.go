@@ -0,0 +1,113 @@
+package util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// RootsSnapshotVersion is the version of RootsSnapshot this writes, and the
+// only one it reads
+const RootsSnapshotVersion = 1
+
+// rootsSnapshotMagic starts every serialized RootsSnapshot
+var rootsSnapshotMagic = [4]byte{'u', 't', 'r', 's'}
+
+// A RootsSnapshot is the accumulator as of some block: all a compact state
+// node needs to start from there instead of from block 1.  Like assumeutxo,
+// it's only as good as whoever made it, so compare ID with one you trust
+// before using it.
+//
+// Serialized it's all big endian: magic "utrs" (4) version (1) height (4)
+// block hash (32) numLeaves (8) deleteMode (1) numRoots (1) roots (32 each),
+// then a sha256 of everything before (32).
+type RootsSnapshot struct {
+	// Height is the next block after the snapshot, like a Node's height
+	Height int32
+	// BlockHash is the hash of the last block in it, at Height-1
+	BlockHash  chainhash.Hash
+	NumLeaves  uint64
+	DeleteMode accumulator.DeleteMode
+	// Roots are in the same order as GetRoots
+	Roots []accumulator.Hash
+}
+
+// Bytes serializes the snapshot
+func (s *RootsSnapshot) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.Write(rootsSnapshotMagic[:])
+	buf.WriteByte(RootsSnapshotVersion)
+	binary.Write(&buf, binary.BigEndian, s.Height)
+	buf.Write(s.BlockHash[:])
+	binary.Write(&buf, binary.BigEndian, s.NumLeaves)
+	buf.WriteByte(byte(s.DeleteMode))
+	buf.WriteByte(uint8(len(s.Roots)))
+	for _, r := range s.Roots {
+		buf.Write(r[:])
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	buf.Write(sum[:])
+	return buf.Bytes()
+}
+
+// ID is the sha256 at the end of the serialized snapshot, in hex.  It's
+// what to check against a snapshot someone else vouches for.
+func (s *RootsSnapshot) ID() string {
+	b := s.Bytes()
+	return hex.EncodeToString(b[len(b)-32:])
+}
+
+// RootsSnapshotFromBytes reads what Bytes wrote.  The checksum has to
+// match, and the roots have to be right for numLeaves.
+func RootsSnapshotFromBytes(b []byte) (*RootsSnapshot, error) {
+	// fixed part + checksum
+	if len(b) < 51+32 {
+		return nil, fmt.Errorf("snapshot only %d bytes", len(b))
+	}
+	if !bytes.Equal(b[:4], rootsSnapshotMagic[:]) {
+		return nil, fmt.Errorf("not a utreexo snapshot")
+	}
+	if b[4] != RootsSnapshotVersion {
+		return nil, fmt.Errorf("snapshot version %d, only know %d",
+			b[4], RootsSnapshotVersion)
+	}
+	body, sum := b[:len(b)-32], b[len(b)-32:]
+	want := sha256.Sum256(body)
+	if !bytes.Equal(want[:], sum) {
+		return nil, fmt.Errorf("snapshot checksum mismatch")
+	}
+
+	s := new(RootsSnapshot)
+	buf := bytes.NewBuffer(body[5:])
+	binary.Read(buf, binary.BigEndian, &s.Height)
+	copy(s.BlockHash[:], buf.Next(32))
+	binary.Read(buf, binary.BigEndian, &s.NumLeaves)
+	mode, _ := buf.ReadByte()
+	s.DeleteMode = accumulator.DeleteMode(mode)
+	numRoots, _ := buf.ReadByte()
+	if s.Height < 2 {
+		return nil, fmt.Errorf("snapshot at height %d has no blocks",
+			s.Height)
+	}
+	err := s.DeleteMode.Check()
+	if err != nil {
+		return nil, err
+	}
+	// a root for every 1 bit in numLeaves
+	if int(numRoots) != bits.OnesCount64(s.NumLeaves) ||
+		buf.Len() != int(numRoots)*32 {
+		return nil, fmt.Errorf("snapshot has %d roots and %d bytes of them "+
+			"for %d leaves", numRoots, buf.Len(), s.NumLeaves)
+	}
+	s.Roots = make([]accumulator.Hash, numRoots)
+	for i := range s.Roots {
+		copy(s.Roots[i][:], buf.Next(32))
+	}
+	return s, nil
+}
@@ -0,0 +1,47 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+func TestRootsSnapshot(t *testing.T) {
+	s := &RootsSnapshot{Height: 1234, NumLeaves: 0x15,
+		DeleteMode: accumulator.SwaplessDelete,
+		Roots:      []accumulator.Hash{{1}, {2}, {3}}}
+	s.BlockHash[0] = 0xbb
+	b := s.Bytes()
+	if len(b) != 51+3*32+32 {
+		t.Fatalf("%d bytes", len(b))
+	}
+	s2, err := RootsSnapshotFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, s2) || s.ID() != s2.ID() {
+		t.Fatalf("read back %+v, expect %+v", s2, s)
+	}
+
+	flipped := append([]byte{}, b...)
+	flipped[60] ^= 1
+	newer := append([]byte{}, b...)
+	newer[4] = RootsSnapshotVersion + 1
+	// right checksum, but 0x15 leaves needs 3 roots
+	short := &RootsSnapshot{Height: 5, NumLeaves: 0x15,
+		Roots: []accumulator.Hash{{1}}}
+	tests := map[string][]byte{
+		"flipped bit":  flipped,
+		"truncated":    b[:len(b)-1],
+		"newer":        newer,
+		"wrong roots":  short.Bytes(),
+		"not snapshot": append([]byte("utrx"), b[4:]...),
+	}
+	for name, b := range tests {
+		_, err = RootsSnapshotFromBytes(b)
+		if err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
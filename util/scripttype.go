@@ -0,0 +1,69 @@
+package util
+
+import (
+	"github.com/btcsuite/btcd/txscript"
+)
+
+// ScriptType is what kind of script an output has, going by its form
+type ScriptType uint8
+
+const (
+	// ScriptOther is anything not below: bare multisig, nonstandard, etc
+	ScriptOther ScriptType = iota
+	ScriptP2PK
+	ScriptP2PKH
+	ScriptP2SH
+	ScriptP2WPKH
+	ScriptP2WSH
+	ScriptP2TR
+	// NumScriptTypes is how many there are
+	NumScriptTypes
+)
+
+func (t ScriptType) String() string {
+	switch t {
+	case ScriptOther:
+		return "other"
+	case ScriptP2PK:
+		return "p2pk"
+	case ScriptP2PKH:
+		return "p2pkh"
+	case ScriptP2SH:
+		return "p2sh"
+	case ScriptP2WPKH:
+		return "p2wpkh"
+	case ScriptP2WSH:
+		return "p2wsh"
+	case ScriptP2TR:
+		return "p2tr"
+	}
+	return "unknown"
+}
+
+// ScriptTypeOf says what kind of script pkScript is.  It only looks at the
+// form, so a p2pk with a pubkey that isn't on the curve is still p2pk.
+func ScriptTypeOf(pkScript []byte) ScriptType {
+	if ok, _ := isPubKeyHash(pkScript); ok {
+		return ScriptP2PKH
+	}
+	if ok, _ := isScriptHash(pkScript); ok {
+		return ScriptP2SH
+	}
+	switch {
+	case len(pkScript) == 22 && pkScript[0] == txscript.OP_0 &&
+		pkScript[1] == txscript.OP_DATA_20:
+		return ScriptP2WPKH
+	case len(pkScript) == 34 && pkScript[0] == txscript.OP_0 &&
+		pkScript[1] == txscript.OP_DATA_32:
+		return ScriptP2WSH
+	case len(pkScript) == 34 && pkScript[0] == txscript.OP_1 &&
+		pkScript[1] == txscript.OP_DATA_32:
+		return ScriptP2TR
+	case len(pkScript) == 35 && pkScript[0] == txscript.OP_DATA_33 &&
+		pkScript[34] == txscript.OP_CHECKSIG,
+		len(pkScript) == 67 && pkScript[0] == txscript.OP_DATA_65 &&
+			pkScript[66] == txscript.OP_CHECKSIG:
+		return ScriptP2PK
+	}
+	return ScriptOther
+}
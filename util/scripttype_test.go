@@ -0,0 +1,37 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestScriptTypeOf(t *testing.T) {
+	// a script of n bytes starting with start, and ending with end
+	script := func(n int, start []byte, end ...byte) []byte {
+		s := make([]byte, n)
+		copy(s, start)
+		copy(s[n-len(end):], end)
+		return s
+	}
+	tests := []struct {
+		script []byte
+		want   ScriptType
+	}{
+		{script(25, []byte{0x76, 0xa9, 0x14}, 0x88, 0xac), ScriptP2PKH},
+		{script(23, []byte{0xa9, 0x14}, 0x87), ScriptP2SH},
+		{script(22, []byte{0x00, 0x14}), ScriptP2WPKH},
+		{script(34, []byte{0x00, 0x20}), ScriptP2WSH},
+		{script(34, []byte{0x51, 0x20}), ScriptP2TR},
+		{script(35, []byte{0x21, 0x02}, 0xac), ScriptP2PK},
+		{script(67, []byte{0x41, 0x04}, 0xac), ScriptP2PK},
+		// witness v1 with a 20 byte program isn't taproot
+		{script(22, []byte{0x51, 0x14}), ScriptOther},
+		{script(24, []byte{0x76, 0xa9, 0x14}, 0x88, 0xac), ScriptOther},
+		{nil, ScriptOther},
+	}
+	for _, test := range tests {
+		got := ScriptTypeOf(test.script)
+		if got != test.want {
+			t.Errorf("%x is %s, expect %s", test.script, got, test.want)
+		}
+	}
+}
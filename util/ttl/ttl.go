@@ -1,6 +1,7 @@
 package ttl
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
@@ -21,6 +22,15 @@ type DeathInfo struct {
 func WriteBlock(bnr util.BlockAndRev,
 	batchan chan *leveldb.Batch, wg *sync.WaitGroup) {
 
+	blockBatch := BlockBatch(bnr)
+	wg.Add(1)
+
+	// send to dbworker to be written to ttldb asynchronously
+	batchan <- blockBatch
+}
+
+// BlockBatch makes the leveldb batch with the ttl info for a block
+func BlockBatch(bnr util.BlockAndRev) *leveldb.Batch {
 	blockBatch := new(leveldb.Batch)
 
 	// iterate through the transactions in a block
@@ -35,23 +45,31 @@ func WriteBlock(bnr util.BlockAndRev,
 			}
 		}
 	}
-	wg.Add(1)
-
-	// send to dbworker to be written to ttldb asynchronously
-	batchan <- blockBatch
+	return blockBatch
 }
 
 // DbWorker writes everything to the db. It's it's own goroutine so it
 // can work at the same time that the reads are happening
-func DbWorker(
-	bChan chan *leveldb.Batch, lvdb *leveldb.DB, wg *sync.WaitGroup) {
+// It returns once bChan is closed and everything sent has been written, or
+// right away when ctx is done.  Write errors go to errChan (if there's room)
+// and the worker keeps calling wg.Done so nobody waiting on it gets stuck.
+func DbWorker(ctx context.Context, bChan chan *leveldb.Batch,
+	lvdb *leveldb.DB, wg *sync.WaitGroup, errChan chan error) {
 
 	for {
-		b := <-bChan
-		err := lvdb.Write(b, nil)
-		if err != nil {
-			fmt.Println(err.Error())
+		select {
+		case b, ok := <-bChan:
+			if !ok {
+				return
+			}
+			err := lvdb.Write(b, nil)
+			if err != nil {
+				util.SendErr(errChan,
+					fmt.Errorf("ttl db write: %s", err.Error()))
+			}
+			wg.Done()
+		case <-ctx.Done():
+			return
 		}
-		wg.Done()
 	}
 }
@@ -4,152 +4,45 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"sort"
 
 	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/accumulator"
 )
 
-// Hash is just [32]byte
-var mainNetGenHash = Hash{
-	0x6f, 0xe2, 0x8c, 0x0a, 0xb6, 0xf1, 0xb3, 0x72,
-	0xc1, 0xa6, 0xa2, 0x46, 0xae, 0x63, 0xf7, 0x4f,
-	0x93, 0x1e, 0x83, 0x65, 0xe1, 0x5a, 0x08, 0x9c,
-	0x68, 0xd6, 0x19, 0x00, 0x00, 0x00, 0x00, 0x00,
-}
-
-var testNet3GenHash = Hash{
-	0x43, 0x49, 0x7f, 0xd7, 0xf8, 0x26, 0x95, 0x71,
-	0x08, 0xf4, 0xa3, 0x0f, 0xd9, 0xce, 0xc3, 0xae,
-	0xba, 0x79, 0x97, 0x20, 0x84, 0xe9, 0x0e, 0xad,
-	0x01, 0xea, 0x33, 0x09, 0x00, 0x00, 0x00, 0x00,
-}
-
-var regTestGenHash = Hash{
-	0x06, 0x22, 0x6e, 0x46, 0x11, 0x1a, 0x0b, 0x59,
-	0xca, 0xaf, 0x12, 0x60, 0x43, 0xeb, 0x5b, 0xbf,
-	0x28, 0xc3, 0x4f, 0x3a, 0x5e, 0x33, 0x2a, 0x1f,
-	0xc7, 0xb2, 0xb7, 0x3c, 0xf1, 0x88, 0x91, 0x0f,
-}
-
-// For a given BitcoinNet, yields the genesis hash
-// If the BitcoinNet is not supported, an error is
-// returned.
-func GenHashForNet(net wire.BitcoinNet) (*Hash, error) {
-	switch net {
-	case wire.TestNet3:
-		return &testNet3GenHash, nil
-	case wire.MainNet:
-		return &mainNetGenHash, nil
-	case wire.TestNet: // yes, this is regtest
-		return &regTestGenHash, nil
-	}
-	return nil, fmt.Errorf("net not supported\n")
-}
-
-// Checks if the blk00000.dat file in the current directory
-// is testnet3 or mainnet or regtest.
-func CheckNet(net wire.BitcoinNet) {
-	f, err := os.Open("blk00000.dat")
+// CheckNet checks that the blk00000.dat file in the blocks dir is from the
+// network given.
+func CheckNet(params *NetParams, p *Paths) error {
+	f, err := p.OpenBlkFile(0)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer f.Close()
 	var magicbytes [4]byte
-	f.Read(magicbytes[:])
-
-	bytesToMatch := U32tLB(uint32(net))
-
-	if bytes.Compare(magicbytes[:], bytesToMatch) != 0 {
-		switch net {
-		case wire.TestNet3:
-			fmt.Println("Option -net=testnet given but .dat file is NOT a testnet file.")
-		case wire.MainNet:
-			fmt.Println("Neither option -net=testnet or -net=regtest was given but .dat file is NOT a mainnet file.")
-		case wire.TestNet:
-			fmt.Println("Option -net=regtest given but .dat file is NOT a regtest file.")
-		}
-		fmt.Println("Exiting...")
-		os.Exit(2)
-	}
-}
-
-// TODO all these readers -- BlockAndRevReader, UBlockReader
-// keep opening and closing files which is inefficient
-
-// BlockReader is a wrapper around GetRawBlockFromFile so that the process
-// can be made into a goroutine. As long as it's running, it keeps sending
-// the entire blocktxs and height to bchan with TxToWrite type.
-// It also puts in the proofs.  This will run on the archive server, and the
-// data will be sent over the network to the CSN.
-func BlockAndRevReader(
-	blockChan chan BlockAndRev,
-	maxHeight, curHeight int32) {
-	for curHeight != maxHeight {
-		blk, err := GetRawBlockFromFile(curHeight, OffsetFilePath)
-		if err != nil {
-			panic(err)
-		}
-
-		rb, err := GetRevBlock(curHeight, RevOffsetFilePath)
-		if err != nil {
-			panic(err)
-		}
-
-		bnr := BlockAndRev{Height: curHeight, Blk: blk, Rev: rb}
-
-		blockChan <- bnr
-		curHeight++
+	_, err = f.Read(magicbytes[:])
+	if err != nil {
+		return err
 	}
-}
 
-// BlockReader is a wrapper around GetRawBlockFromFile so that the process
-// can be made into a goroutine. As long as it's running, it keeps sending
-// the entire blocktxs and height to bchan with TxToWrite type.
-// It also puts in the proofs.  This will run on the archive server, and the
-// data will be sent over the network to the CSN.
-func UBlockReader(
-	blockChan chan UBlock, maxHeight, curHeight, lookahead int32) {
-	for curHeight != maxHeight {
-
-		ud, err := GetUDataFromFile(curHeight)
-		if err != nil {
-			fmt.Printf("GetUDataFromFile ")
-			panic(err)
-		}
-
-		blk, err := GetRawBlockFromFile(curHeight, OffsetFilePath)
-		if err != nil {
-			fmt.Printf("GetRawBlockFromFile ")
-			panic(err)
-		}
-
-		send := UBlock{Block: blk, Height: curHeight, ExtraData: ud}
-
-		blockChan <- send
-		curHeight++
+	if magicbytes != params.MagicBytes() {
+		return fmt.Errorf("-net=%s given but blk00000.dat magic bytes %x "+
+			"aren't %s's %x", params.Name, magicbytes, params.Name,
+			params.MagicBytes())
 	}
+	return nil
 }
 
-// UblockNetworkReader gets Ublocks from the remote host and puts em in the
-// channel.  It'll try to fill the channel buffer.
-func UblockNetworkReader(
-	blockChan chan UBlock,
-	maxHeight, curHeight, lookahead int32) {
-	for curHeight != maxHeight {
-		blk, err := GetRawBlockFromFile(curHeight, OffsetFilePath)
-		if err != nil {
-			panic(err)
-		}
-
-		// rb, err := GetRevBlock(curHeight, RevOffsetFilePath)
-
-		send := UBlock{Block: blk, Height: curHeight} //Proof: nil}
-
-		// Txs: txs, Height: curHeight, Blockhash: bh, Rev: rb}
-		blockChan <- send
-		curHeight++
+// SendErr sends err on errChan without blocking, for goroutines that stop
+// on an error.  errChan should have room for an error from each goroutine
+// that can send one; if it's full, there's already an error waiting to be
+// dealt with anyway.
+func SendErr(errChan chan error, err error) {
+	select {
+	case errChan <- err:
+	default:
 	}
 }
 
@@ -157,7 +50,7 @@ func UblockNetworkReader(
 // returns those blocks.
 // Skips the genesis block. If you search for block 0, it will give you
 // block 1.
-func GetRawBlockFromFile(tipnum int32, offsetFileName string) (
+func GetRawBlockFromFile(tipnum int32, p *Paths) (
 	block wire.MsgBlock, err error) {
 	if tipnum == 0 {
 		err = fmt.Errorf("Block 0 is not in blk files or utxo set")
@@ -167,7 +60,7 @@ func GetRawBlockFromFile(tipnum int32, offsetFileName string) (
 
 	var datFile, offset uint32
 
-	offsetFile, err := os.Open(offsetFileName)
+	offsetFile, err := os.Open(p.OffsetFilePath)
 	if err != nil {
 		return
 	}
@@ -189,10 +82,8 @@ func GetRawBlockFromFile(tipnum int32, offsetFileName string) (
 		return
 	}
 
-	blockFileName := fmt.Sprintf("blk%05d.dat", datFile)
-	// Channel to alert stopParse() that offset
-	// fmt.Printf("opened %s ", blockFileName)
-	blockFile, err := os.Open(blockFileName)
+	// fmt.Printf("opened blk%05d.dat ", datFile)
+	blockFile, err := p.OpenBlkFile(datFile)
 	if err != nil {
 		return
 	}
@@ -224,7 +115,7 @@ func GetRawBlockFromFile(tipnum int32, offsetFileName string) (
 // GetUDataFromFile reads the proof data from proof.dat and proofoffset.dat
 // and gives the proof & utxo data back.
 // Don't ask for block 0, there is no proof of that.
-func GetUDataFromFile(tipnum int32) (ud UData, err error) {
+func GetUDataFromFile(tipnum int32, p *Paths) (ud UData, err error) {
 	if tipnum == 0 {
 		err = fmt.Errorf("Block 0 is not in blk files or utxo set")
 		return
@@ -232,12 +123,12 @@ func GetUDataFromFile(tipnum int32) (ud UData, err error) {
 	tipnum--
 	var offset int64
 	var size uint32
-	offsetFile, err := os.Open(POffsetFilePath)
+	offsetFile, err := os.Open(p.POffsetFilePath)
 	if err != nil {
 		return
 	}
 
-	proofFile, err := os.Open(PFilePath)
+	proofFile, err := os.Open(p.PFilePath)
 	if err != nil {
 		return
 	}
@@ -447,7 +338,8 @@ func PopPrefixLen16(b []byte) ([]byte, []byte, error) {
 	buf := bytes.NewBuffer(prefix)
 	binary.Read(buf, binary.BigEndian, &l)
 	if int(l) > len(payload) {
-		return nil, nil, fmt.Errorf("Prefixed %d but payload %d left", l)
+		return nil, nil, fmt.Errorf("Prefixed %d but payload %d left",
+			l, len(payload))
 	}
 	return payload[:l], payload[l:], nil
 }
@@ -550,17 +442,14 @@ func I64tB(i int64) []byte {
 	return buf.Bytes()
 }
 
-// CheckMagicByte checks for the Bitcoin magic bytes.
-// returns false if it didn't read the Bitcoin magic bytes.
-// Checks only for testnet3 and mainnet
-func CheckMagicByte(bytesgiven [4]byte) bool {
-	if bytesgiven != [4]byte{0x0b, 0x11, 0x09, 0x07} && //testnet
-		bytesgiven != [4]byte{0xf9, 0xbe, 0xb4, 0xd9} { // mainnet
+// CheckMagicByte checks for the magic bytes of the network net.
+// returns false if it didn't read the magic bytes.
+func CheckMagicByte(bytesgiven [4]byte, net wire.BitcoinNet) bool {
+	if !bytes.Equal(bytesgiven[:], U32tLB(uint32(net))) {
 		fmt.Printf("got non magic bytes %x, finishing\n", bytesgiven)
 		return false
-	} else {
-		return true
 	}
+	return true
 }
 
 // HasAccess reports whether we have access to the named file.
@@ -576,6 +465,54 @@ func HasAccess(fileName string) bool {
 	return true
 }
 
+// WriteFileAtomic writes data to a temp file next to path, fsyncs it, and
+// renames it to path.  Then fsyncs the directory so the rename sticks.
+func WriteFileAtomic(path string, data []byte) error {
+	return WriteAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// WriteAtomic is WriteFileAtomic for something that isn't all in one
+// []byte: write writes it out to the temp file.
+func WriteAtomic(path string, write func(w io.Writer) error) error {
+	tmpPath := path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = write(tmp)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	return SyncPath(filepath.Dir(path))
+}
+
+// SyncPath opens a file or directory and fsyncs it
+func SyncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
 //IsUnspendable determines whether a tx is spenable or not.
 //returns true if spendable, false if unspenable.
 func IsUnspendable(o *wire.TxOut) bool {